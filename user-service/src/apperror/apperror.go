@@ -0,0 +1,144 @@
+// Package apperror holds the errors the service reports to its callers. Each has a kind, which decides how it is
+// answered, and a message that is safe to show the caller. The error it was caused by, such as a database error,
+// is kept for logging but never shown
+package apperror
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kind is the class of an error, which decides the status it is answered with
+type Kind int
+
+const (
+	// KIND_INTERNAL is anything the caller can't fix. Its cause is logged and hidden from the caller
+	KIND_INTERNAL Kind = iota
+	// KIND_NOT_FOUND is a request for something that does not exist
+	KIND_NOT_FOUND
+	// KIND_CONFLICT is a request that would violate the uniqueness of a field
+	KIND_CONFLICT
+	// KIND_VALIDATION is a request with missing, malformed or invalid values
+	KIND_VALIDATION
+	// KIND_UNAUTHORIZED is a request whose credentials don't check out
+	KIND_UNAUTHORIZED
+	// KIND_FORBIDDEN is a request the caller is authenticated for, but not permitted to make
+	KIND_FORBIDDEN
+	// KIND_GONE is a request for something that existed, but can no longer be used, such as an expired token
+	KIND_GONE
+)
+
+var kindNames = map[Kind]string{KIND_INTERNAL: "internal", KIND_NOT_FOUND: "not-found", KIND_CONFLICT: "conflict",
+	KIND_VALIDATION: "validation", KIND_UNAUTHORIZED: "unauthorized", KIND_FORBIDDEN: "forbidden",
+	KIND_GONE: "gone"}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// FieldError is a problem with a single field of a request
+type FieldError struct {
+	// Field is the path of the field as the caller sends it, e.g. email
+	Field string `json:"field"`
+	// Code identifies the problem for machines, e.g. too_short, empty for fields not checked by a validation rule
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	// Params are the values the message was built from, e.g. the minimum length
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// Error is an error to report to the caller
+type Error struct {
+	Kind Kind
+	// Message describes the error to the caller
+	Message string
+	// Field is the field whose uniqueness a conflict violated, empty if it isn't known
+	Field string
+	// Fields are the problems with each field that failed validation
+	Fields []FieldError
+	// Err is the cause of the error, for logging
+	Err error
+}
+
+// Error returns the message. Validation errors list the problem with each field on its own line
+func (e *Error) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+
+	lines := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		lines[i] = field.Message
+	}
+	return e.Message + ":\n\t- " + strings.Join(lines, "\n\t- ")
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap records err as the cause of the error, so errors.Is and errors.As still find it
+// returns the error, for chaining onto a constructor
+func (e *Error) Wrap(err error) *Error {
+	e.Err = err
+	return e
+}
+
+// NotFound returns a KIND_NOT_FOUND error with the formatted message
+func NotFound(format string, args ...interface{}) *Error {
+	return &Error{Kind: KIND_NOT_FOUND, Message: fmt.Sprintf(format, args...)}
+}
+
+// Conflict returns a KIND_CONFLICT error for a violation of the uniqueness of field, with the formatted message
+func Conflict(field, format string, args ...interface{}) *Error {
+	return &Error{Kind: KIND_CONFLICT, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// Validation returns a KIND_VALIDATION error with the message and the problem with each field
+func Validation(message string, fields ...FieldError) *Error {
+	return &Error{Kind: KIND_VALIDATION, Message: message, Fields: fields}
+}
+
+// Invalid returns a KIND_VALIDATION error for a single field
+func Invalid(field, format string, args ...interface{}) *Error {
+	message := fmt.Sprintf(format, args...)
+	return &Error{Kind: KIND_VALIDATION, Message: message, Fields: []FieldError{{Field: field, Message: message}}}
+}
+
+// Unauthorized returns a KIND_UNAUTHORIZED error with the message
+func Unauthorized(message string) *Error {
+	return &Error{Kind: KIND_UNAUTHORIZED, Message: message}
+}
+
+// Forbidden returns a KIND_FORBIDDEN error with the message
+func Forbidden(message string) *Error {
+	return &Error{Kind: KIND_FORBIDDEN, Message: message}
+}
+
+// Gone returns a KIND_GONE error with the formatted message
+func Gone(format string, args ...interface{}) *Error {
+	return &Error{Kind: KIND_GONE, Message: fmt.Sprintf(format, args...)}
+}
+
+// INTERNAL_MESSAGE is all a caller is told of an internal error
+const INTERNAL_MESSAGE string = "Internal server error"
+
+// Internal returns a KIND_INTERNAL error caused by err
+func Internal(err error) *Error {
+	return &Error{Kind: KIND_INTERNAL, Message: INTERNAL_MESSAGE, Err: err}
+}
+
+// From returns err as an Error: the Error in its chain if there is one, otherwise an internal error caused by it
+func From(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return Internal(err)
+}
+
+// KindOf returns the kind of err, KIND_INTERNAL unless there is an Error in its chain
+func KindOf(err error) Kind {
+	return From(err).Kind
+}
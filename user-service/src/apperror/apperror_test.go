@@ -0,0 +1,55 @@
+package apperror
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestErrorMessage Checks validation errors list each field's problem after the message, and other errors are just
+// their message
+func TestErrorMessage(t *testing.T) {
+	err := Validation("UserModel failed validation", FieldError{Field: "email", Message: "Email is invalid"},
+		FieldError{Field: "username", Message: "Username is required"})
+	expected := "UserModel failed validation:\n\t- Email is invalid\n\t- Username is required"
+	if err.Error() != expected {
+		t.Errorf("Validation error expected to read |%s|, got |%s|", expected, err.Error())
+	}
+
+	if err := NotFound("No User with ID %d found", 7); err.Error() != "No User with ID 7 found" {
+		t.Errorf("Not found error expected to read its message, got |%s|", err.Error())
+	}
+
+	if err := Invalid("id", "ID must be null"); len(err.Fields) != 1 || err.Fields[0].Field != "id" {
+		t.Errorf("Invalid expected to report the field, got %+v", err.Fields)
+	}
+}
+
+// TestFrom Checks an Error is found through wrapping, anything else becomes an internal error that hides its cause
+func TestFrom(t *testing.T) {
+	notFound := NotFound("No User with ID %d found", 7).Wrap(sql.ErrNoRows)
+	wrapped := fmt.Errorf("while fetching: %w", notFound)
+	if From(wrapped) != notFound || KindOf(wrapped) != KIND_NOT_FOUND {
+		t.Errorf("Wrapped error expected to be found, got %+v", From(wrapped))
+	}
+	if !errors.Is(wrapped, sql.ErrNoRows) {
+		t.Errorf("Cause of the error expected to be found by errors.Is")
+	}
+
+	cause := errors.New("pq: connection refused")
+	internal := From(cause)
+	if internal.Kind != KIND_INTERNAL || internal.Error() != INTERNAL_MESSAGE || !errors.Is(internal, cause) {
+		t.Errorf("Plain error expected to become an internal error caused by it, got %+v", internal)
+	}
+}
+
+func TestKindString(t *testing.T) {
+	for kind, expected := range map[Kind]string{KIND_INTERNAL: "internal", KIND_NOT_FOUND: "not-found",
+		KIND_CONFLICT: "conflict", KIND_VALIDATION: "validation", KIND_UNAUTHORIZED: "unauthorized",
+		KIND_FORBIDDEN: "forbidden", KIND_GONE: "gone"} {
+		if kind.String() != expected {
+			t.Errorf("Kind %d expected to be named %s, got %s", kind, expected, kind.String())
+		}
+	}
+}
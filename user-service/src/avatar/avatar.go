@@ -0,0 +1,139 @@
+// Package avatar turns uploaded profile pictures into the square thumbnails users are shown with, and keeps them in
+// a blob.Store
+package avatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/blob"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // registers the decoder
+	"image/jpeg"
+	_ "image/png" // registers the decoder
+	"net/http"
+	"sort"
+)
+
+// CONTENT_TYPES are the types of image that can be uploaded, as sniffed from their content
+var CONTENT_TYPES = []string{"image/jpeg", "image/png", "image/gif"}
+
+// CONTENT_TYPE is the type thumbnails are stored and served as
+const CONTENT_TYPE string = "image/jpeg"
+
+// MAX_PIXELS is the most pixels an uploaded image can have, so a small file can't decode into a huge image
+const MAX_PIXELS int = 25000000
+
+// JPEG_QUALITY is the quality thumbnails are encoded at
+const JPEG_QUALITY int = 85
+
+// ErrUnsupportedType is returned for an upload that isn't one of CONTENT_TYPES
+var ErrUnsupportedType = errors.New("avatar must be a JPEG, PNG or GIF image")
+
+// ErrTooManyPixels is returned for an image with more than MAX_PIXELS
+var ErrTooManyPixels = fmt.Errorf("avatar must have at most %d pixels", MAX_PIXELS)
+
+// ErrInvalidImage is returned for an upload that claims to be an image but can't be decoded
+var ErrInvalidImage = errors.New("avatar is not a valid image")
+
+// Process turns an uploaded image into a thumbnail of each size, cropped to a square from its center, turned the
+// way its EXIF orientation says, flattened onto white, and re-encoded as JPEG. Re-encoding drops EXIF and every
+// other kind of metadata. Images smaller than a size aren't enlarged
+// returns the thumbnails keyed by size
+func Process(data []byte, sizes []int) (map[int][]byte, error) {
+	contentType := http.DetectContentType(data)
+	supported := false
+	for _, t := range CONTENT_TYPES {
+		supported = supported || contentType == t
+	}
+	if !supported {
+		return nil, ErrUnsupportedType
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	} else if config.Width*config.Height > MAX_PIXELS {
+		return nil, ErrTooManyPixels
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = exifOrientation(data)
+	}
+	square := cropSquare(img)
+
+	thumbnails := make(map[int][]byte)
+	for _, size := range sizes {
+		var encoded bytes.Buffer
+		err = jpeg.Encode(&encoded, orient(resize(square, size), orientation), &jpeg.Options{Quality: JPEG_QUALITY})
+		if err != nil {
+			return nil, err
+		}
+		thumbnails[size] = encoded.Bytes()
+	}
+
+	return thumbnails, nil
+}
+
+// cropSquare copies the largest square at the center of the image onto white, so transparent pixels turn white
+func cropSquare(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	origin := image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2)
+
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(square, square.Bounds(), img, origin, draw.Over)
+	return square
+}
+
+// Key is where the thumbnail of a size of the avatar of a user is stored
+func Key(orgID, userID, size int) string {
+	return fmt.Sprintf("avatars/%d/%d/%d.jpg", orgID, userID, size)
+}
+
+// Save stores the thumbnails of the avatar of a user, replacing any it had
+func Save(ctx context.Context, store blob.Store, orgID, userID int, thumbnails map[int][]byte) error {
+	for size, data := range thumbnails {
+		if err := store.Put(ctx, Key(orgID, userID, size), data, CONTENT_TYPE); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Open fetches the thumbnail of a size of the avatar of a user
+// returns blob.ErrNotFound if the user has no avatar
+func Open(ctx context.Context, store blob.Store, orgID, userID, size int) (*blob.Object, error) {
+	return store.Get(ctx, Key(orgID, userID, size))
+}
+
+// Delete removes the thumbnails of every size of the avatar of a user
+func Delete(ctx context.Context, store blob.Store, orgID, userID int, sizes []int) error {
+	for _, size := range sizes {
+		if err := store.Delete(ctx, Key(orgID, userID, size)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Largest returns the largest of the sizes, the one served when a request doesn't ask for one
+func Largest(sizes []int) int {
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+	return sorted[len(sorted)-1]
+}
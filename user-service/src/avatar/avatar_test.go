@@ -0,0 +1,130 @@
+package avatar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// halves draws a w x h image, red on its left half and blue on its right
+func halves(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+// withExif inserts an EXIF segment with the orientation, and a GPS like string, after the start of a JPEG
+func withExif(jpg []byte, orientation byte) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, // big endian, first directory at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, orientation, 0, 0, // orientation, a SHORT
+		0, 0, 0, 0} // no next directory
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	payload = append(payload, []byte("GPS 51.5072N 0.1276W")...)
+	segment := append([]byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+
+	return append(append(append([]byte{}, jpg[:2]...), segment...), jpg[2:]...)
+}
+
+// reddish reports whether a pixel is mostly red
+func reddish(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xC000 && b < 0x4000
+}
+
+// TestProcess Checks thumbnails are cropped square, scaled to each size, turned upright and stripped of EXIF
+func TestProcess(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, halves(80, 40), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	upload := withExif(encoded.Bytes(), 6)
+	if exifOrientation(upload) != 6 {
+		t.Fatalf("Orientation expected to be read as 6, got %d", exifOrientation(upload))
+	}
+
+	thumbnails, err := Process(upload, []int{20, 64})
+	if err != nil {
+		t.Fatalf("Image expected to pass, failed: %s", err)
+	}
+	for size, expected := range map[int]int{20: 20, 64: 40} {
+		if bytes.Contains(thumbnails[size], []byte("Exif")) || bytes.Contains(thumbnails[size], []byte("GPS")) {
+			t.Errorf("Thumbnail %d expected to have no EXIF", size)
+		}
+		img, format, err := image.Decode(bytes.NewReader(thumbnails[size]))
+		if err != nil || format != "jpeg" {
+			t.Errorf("Thumbnail %d expected to be a JPEG, got %s, %v", size, format, err)
+			continue
+		}
+		if img.Bounds().Dx() != expected || img.Bounds().Dy() != expected {
+			t.Errorf("Thumbnail %d expected to be %dx%d, got %v", size, expected, expected, img.Bounds())
+		}
+		// Turned 90° clockwise, the red left half is at the top
+		if !reddish(img.At(expected/2, 2)) || reddish(img.At(expected/2, expected-3)) {
+			t.Errorf("Thumbnail %d expected to be turned upright", size)
+		}
+	}
+}
+
+// TestProcessTransparent Checks transparent pixels turn white
+func TestProcessTransparent(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewNRGBA(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+
+	thumbnails, err := Process(encoded.Bytes(), []int{16})
+	if err != nil {
+		t.Fatalf("PNG expected to pass, failed: %s", err)
+	}
+	img, _, _ := image.Decode(bytes.NewReader(thumbnails[16]))
+	if r, g, b, _ := img.At(8, 8).RGBA(); r < 0xF000 || g < 0xF000 || b < 0xF000 {
+		t.Errorf("Transparent pixel expected to be white, got %v", img.At(8, 8))
+	}
+}
+
+// TestProcessRejects Checks files that aren't images, or are too big once decoded, are refused
+func TestProcessRejects(t *testing.T) {
+	if _, err := Process([]byte("%PDF-1.4 not an image"), []int{64}); err != ErrUnsupportedType {
+		t.Errorf("PDF expected to be unsupported, got %v", err)
+	}
+	if _, err := Process([]byte("\x89PNG\r\n\x1a\n truncated"), []int{64}); err != ErrInvalidImage {
+		t.Errorf("Truncated PNG expected to be invalid, got %v", err)
+	}
+
+	// Only the header is read to find the size, so the pixels needn't be there
+	var header bytes.Buffer
+	_ = png.Encode(&header, image.NewGray(image.Rect(0, 0, 1, 1)))
+	huge := header.Bytes()
+	copy(huge[16:24], []byte{0, 0, 0x27, 0x10, 0, 0, 0x27, 0x10}) // 10000 x 10000
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if _, err := Process(huge, []int{64}); err != ErrTooManyPixels {
+		t.Errorf("10000x10000 image expected to have too many pixels, got %v", err)
+	}
+}
+
+// TestOrient Checks every EXIF orientation puts the top left corner of the image where it belongs
+func TestOrient(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	src.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	for orientation, corner := range map[int]image.Point{1: {0, 0}, 2: {2, 0}, 3: {2, 2}, 4: {0, 2}, 5: {0, 0},
+		6: {2, 0}, 7: {2, 2}, 8: {0, 2}} {
+		if dst := orient(src, orientation); !reddish(dst.At(corner.X, corner.Y)) {
+			t.Errorf("Orientation %d expected to move the top left corner to %v", orientation, corner)
+		}
+	}
+}
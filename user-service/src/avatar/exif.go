@@ -0,0 +1,70 @@
+package avatar
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// EXIF_ORIENTATION_TAG is the tag of the orientation in the first image file directory of EXIF
+const EXIF_ORIENTATION_TAG uint16 = 0x0112
+
+// exifOrientation reads the orientation, 1 to 8, from the EXIF of a JPEG. Images without one, or with EXIF that
+// can't be read, are taken to be upright, 1
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	// Segments are 0xFF, a marker, then a big endian length that counts itself
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		// Start of scan: the image data follows, and no more metadata
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+
+	return 1
+}
+
+// tiffOrientation reads the orientation from the TIFF structure EXIF is kept in
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) || ifd < 8 {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		// A SHORT, type 3, is kept in the first two bytes of the value
+		if order.Uint16(tiff[entry:]) == EXIF_ORIENTATION_TAG && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,82 @@
+package avatar
+
+import (
+	"image"
+)
+
+// resize scales the square image down to size by averaging the pixels each pixel of the result covers, first across
+// then down. An image no larger than size is returned as it is
+func resize(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	if size >= side {
+		return src
+	}
+
+	// Across: side x side to size x side
+	across := image.NewRGBA(image.Rect(0, 0, size, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < size; x++ {
+			x0, x1 := x*side/size, (x+1)*side/size
+			var sum [4]uint32
+			for sx := x0; sx < x1; sx++ {
+				i := src.PixOffset(sx, y)
+				for c := 0; c < 4; c++ {
+					sum[c] += uint32(src.Pix[i+c])
+				}
+			}
+			i := across.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				across.Pix[i+c] = uint8(sum[c] / uint32(x1-x0))
+			}
+		}
+	}
+
+	// Down: size x side to size x size
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := y*side/size, (y+1)*side/size
+		for x := 0; x < size; x++ {
+			var sum [4]uint32
+			for sy := y0; sy < y1; sy++ {
+				i := across.PixOffset(x, sy)
+				for c := 0; c < 4; c++ {
+					sum[c] += uint32(across.Pix[i+c])
+				}
+			}
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8(sum[c] / uint32(y1-y0))
+			}
+		}
+	}
+
+	return dst
+}
+
+// orient turns the square image the way an EXIF orientation, 1 to 8, says it should be shown
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	n := src.Bounds().Dx() - 1
+	// from gives the pixel of src shown at x, y
+	from := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return n - x, y },     // mirrored
+		3: func(x, y int) (int, int) { return n - x, n - y }, // turned 180°
+		4: func(x, y int) (int, int) { return x, n - y },     // flipped
+		5: func(x, y int) (int, int) { return y, x },         // mirrored and turned 270°
+		6: func(x, y int) (int, int) { return y, n - x },     // turned 90° clockwise
+		7: func(x, y int) (int, int) { return n - y, n - x }, // mirrored and turned 90°
+		8: func(x, y int) (int, int) { return n - y, x },     // turned 90° anticlockwise
+	}[orientation]
+	if from == nil {
+		return src
+	}
+
+	dst := image.NewRGBA(src.Bounds())
+	for y := 0; y <= n; y++ {
+		for x := 0; x <= n; x++ {
+			sx, sy := from(x, y)
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):])
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,49 @@
+// Package blob stores the files users upload, such as avatars, outside the database
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned for a key that has nothing stored under it
+var ErrNotFound = errors.New("blob not found")
+
+// Object is a file stored under a key
+type Object struct {
+	Data        []byte
+	ContentType string
+	// ETag identifies the content, changing whenever it does. It is quoted, ready for the ETag header
+	ETag    string
+	ModTime time.Time
+}
+
+// Reader is a file stored under a key, read as it is needed rather than all at once. It must be closed
+type Reader struct {
+	io.ReadCloser
+	ContentType string
+	// ETag identifies the content, changing whenever it does. It is quoted, ready for the ETag header
+	ETag    string
+	ModTime time.Time
+	// Size is the length of the content, -1 if it isn't known
+	Size int64
+}
+
+// Store keeps files under keys, which are paths such as avatars/1/2/128.jpg
+type Store interface {
+	// Put stores the data under the key, replacing anything already there
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get fetches what is stored under the key
+	// returns ErrNotFound if there is nothing
+	Get(ctx context.Context, key string) (*Object, error)
+	// Upload stores what the body reads under the key, replacing anything already there, for files too large to put
+	// from memory. The body is read from its start, and may be read more than once
+	Upload(ctx context.Context, key string, body io.ReadSeeker, contentType string) error
+	// Open opens what is stored under the key to be read
+	// returns ErrNotFound if there is nothing
+	Open(ctx context.Context, key string) (*Reader, error)
+	// Delete removes what is stored under the key. Deleting a key with nothing under it succeeds
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,140 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStore keeps files in a directory of the local filesystem. The content type isn't kept, but derived from the
+// extension of the key when the file is read
+type LocalStore struct {
+	Dir string
+}
+
+// path returns the file a key is stored in
+// returns an error for a key that would leave the directory
+func (s LocalStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if key == "" || clean != "/"+key || strings.HasSuffix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+
+	return filepath.Join(s.Dir, filepath.FromSlash(clean)), nil
+}
+
+func (s LocalStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.Upload(ctx, key, bytes.NewReader(data), contentType)
+}
+
+// Upload copies the body to a temporary file then renames it over the key's file, so readers never see part of it
+func (s LocalStore) Upload(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	file, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, body); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func (s LocalStore) Get(ctx context.Context, key string) (*Object, error) {
+	file, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	sum := sha256.Sum256(data)
+
+	return &Object{Data: data, ContentType: contentType, ETag: `"` + hex.EncodeToString(sum[:16]) + `"`,
+		ModTime: info.ModTime()}, nil
+}
+
+// Open opens the key's file. Its ETag is derived from its size and modification time, as the content isn't read up
+// front to hash it
+func (s LocalStore) Open(ctx context.Context, key string) (*Reader, error) {
+	file, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &Reader{ReadCloser: f, ContentType: contentType,
+		ETag:    fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()),
+		ModTime: info.ModTime(), Size: info.Size()}, nil
+}
+
+func (s LocalStore) Delete(ctx context.Context, key string) error {
+	file, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
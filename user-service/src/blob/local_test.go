@@ -0,0 +1,92 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testStore Checks an object can be put, got, replaced, uploaded, opened and deleted, and that a missing one is not
+// found
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	key := "1/2/a b.jpg"
+
+	if _, err := store.Get(ctx, key); err != ErrNotFound {
+		t.Errorf("Get of a missing key expected to be not found, got %v", err)
+	}
+
+	if err := store.Put(ctx, key, []byte("first"), "image/jpeg"); err != nil {
+		t.Fatalf("Put expected to pass, failed: %s", err)
+	}
+	first, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get expected to pass, failed: %s", err)
+	} else if !bytes.Equal(first.Data, []byte("first")) || first.ContentType != "image/jpeg" || first.ETag == "" {
+		t.Errorf("Get expected to return what was put, got %+v", first)
+	}
+
+	if err = store.Put(ctx, key, []byte("second"), "image/jpeg"); err != nil {
+		t.Fatalf("Put expected to replace, failed: %s", err)
+	}
+	second, err := store.Get(ctx, key)
+	if err != nil || !bytes.Equal(second.Data, []byte("second")) {
+		t.Errorf("Get expected to return the replacement, got %+v, %v", second, err)
+	}
+
+	if err = store.Upload(ctx, key, strings.NewReader("uploaded"), "image/jpeg"); err != nil {
+		t.Fatalf("Upload expected to pass, failed: %s", err)
+	}
+	reader, err := store.Open(ctx, key)
+	if err != nil {
+		t.Fatalf("Open expected to pass, failed: %s", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	_ = reader.Close()
+	if err != nil || string(data) != "uploaded" || reader.ContentType != "image/jpeg" || reader.Size != 8 ||
+		reader.ETag == "" {
+		t.Errorf("Open expected to read what was uploaded, got %q %+v, %v", data, reader, err)
+	}
+
+	if err = store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete expected to pass, failed: %s", err)
+	}
+	if _, err = store.Get(ctx, key); err != ErrNotFound {
+		t.Errorf("Get of a deleted key expected to be not found, got %v", err)
+	}
+	if _, err = store.Open(ctx, key); err != ErrNotFound {
+		t.Errorf("Open of a deleted key expected to be not found, got %v", err)
+	}
+	if err = store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing key expected to pass, failed: %s", err)
+	}
+}
+
+// TestLocalStore Checks objects can be put, got and deleted in a directory, and keys can't leave it
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := LocalStore{Dir: dir}
+	testStore(t, store)
+
+	_ = store.Put(context.Background(), "x.jpg", []byte("one"), "image/jpeg")
+	one, _ := store.Get(context.Background(), "x.jpg")
+	_ = store.Put(context.Background(), "x.jpg", []byte("two"), "image/jpeg")
+	two, _ := store.Get(context.Background(), "x.jpg")
+	if one == nil || two == nil || one.ETag == two.ETag {
+		t.Errorf("ETag expected to change with the content")
+	}
+
+	for _, key := range []string{"", "../escape.jpg", "a/../../escape.jpg", "/abs.jpg", "dir/"} {
+		if err = store.Put(context.Background(), key, []byte("x"), "image/jpeg"); err == nil {
+			t.Errorf("Key %q expected to fail, passed", key)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store keeps files in a bucket of Amazon S3, or of a service compatible with it such as MinIO. Objects are
+// addressed path style, <endpoint>/<bucket>/<key>, which every compatible service supports
+type S3Store struct {
+	// Endpoint is the URL of the service, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Client makes the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// S3_SERVICE is the name requests to S3 are signed for
+const S3_SERVICE string = "s3"
+
+// S3_TIME_FORMAT is the format of the time requests are signed at
+const S3_TIME_FORMAT string = "20060102T150405Z"
+
+// hmacSHA256 computes the HMAC-SHA256 of the data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// hashHex is the hex encoded SHA-256 of the data
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode encodes a path or query value as Signature Version 4 expects: everything but the unreserved characters
+// of RFC 3986, and / in paths, is percent encoded
+func uriEncode(value string, path bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || strings.IndexByte("-_.~", b) >= 0 ||
+			path && b == '/' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return encoded.String()
+}
+
+// signV4 signs the request with AWS Signature Version 4. The request must already have its x-amz-content-sha256
+// header, the hash of its body. Host, Content-Type, Range and every x-amz- header are signed
+func signV4(request *http.Request, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format(S3_TIME_FORMAT)
+	request.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": request.Host}
+	if request.Host == "" {
+		headers["host"] = request.URL.Host
+	}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := request.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, uriEncode(key, false)+"="+uriEncode(value, false))
+		}
+	}
+
+	canonicalPath := uriEncode(request.URL.Path, true)
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+	canonicalRequest := strings.Join([]string{request.Method, canonicalPath, strings.Join(params, "&"),
+		canonicalHeaders.String(), signedHeaders, request.Header.Get("X-Amz-Content-Sha256")}, "\n")
+
+	scope := strings.Join([]string{amzDate[:8], region, S3_SERVICE, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, S3_SERVICE)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// do makes a signed request for the object under the key. The body, if there is one, is read once to hash it then
+// again to send it
+func (s S3Store) do(ctx context.Context, method, key string, body io.ReadSeeker, contentType string) (*http.Response,
+	error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Path += "/" + s.Bucket + "/" + key
+	endpoint.RawPath = uriEncode(endpoint.Path, true)
+
+	hash := sha256.New()
+	var size int64
+	if body != nil {
+		if _, err = body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if size, err = io.Copy(hash, body); err != nil {
+			return nil, err
+		}
+		if _, err = body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		// The client closes the body it sends, which belongs to the caller
+		request.Body, request.ContentLength = ioutil.NopCloser(body), size
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash.Sum(nil)))
+	signV4(request, s.Region, s.AccessKey, s.SecretKey, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(request)
+}
+
+// responseError describes a response that failed, including the start of the error document S3 sent
+func responseError(method, key string, response *http.Response) error {
+	detail, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	return fmt.Errorf("s3 %s %s failed: %s %s", method, key, response.Status, strings.TrimSpace(string(detail)))
+}
+
+func (s S3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.Upload(ctx, key, bytes.NewReader(data), contentType)
+}
+
+func (s S3Store) Upload(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	response, err := s.do(ctx, http.MethodPut, key, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return responseError(http.MethodPut, key, response)
+	}
+	return nil
+}
+
+func (s S3Store) Get(ctx context.Context, key string) (*Object, error) {
+	reader, err := s.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{Data: data, ContentType: reader.ContentType, ETag: reader.ETag, ModTime: reader.ModTime}, nil
+}
+
+// Open returns the body of the response as it is received
+func (s S3Store) Open(ctx context.Context, key string) (*Reader, error) {
+	response, err := s.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, responseError(http.MethodGet, key, response)
+	}
+
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return &Reader{ReadCloser: response.Body, ContentType: response.Header.Get("Content-Type"),
+		ETag: response.Header.Get("ETag"), ModTime: modTime, Size: response.ContentLength}, nil
+}
+
+func (s S3Store) Delete(ctx context.Context, key string) error {
+	response, err := s.do(ctx, http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// S3 answers 204 whether or not there was an object, other services may answer 404
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK &&
+		response.StatusCode != http.StatusNotFound {
+		return responseError(http.MethodDelete, key, response)
+	}
+	return nil
+}
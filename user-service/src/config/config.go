@@ -0,0 +1,855 @@
+// Package config loads the settings of the service. Each setting has a default and can be overridden by a YAML or
+// TOML file, then by an environment variable, then by a command line flag
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/nyaruka/phonenumbers"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/idna"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Each setting is named by its section and its config tag, e.g. database.host, which is its key in the config file
+// and its command line flag. env names its environment variable. secret settings are masked when printed, can be
+// read from a file named by <env>_FILE, <key>_file in the config file or the -<key>_file flag, and can't be passed
+// as a flag themselves since the command line is visible to other processes
+
+type ServerConfig struct {
+	Port string `config:"port" env:"PORT"`
+	// ReadTimeout limits reading a request, including its body
+	ReadTimeout time.Duration `config:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	// WriteTimeout limits handling a request and writing its response
+	WriteTimeout time.Duration `config:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	// IdleTimeout limits how long a keep-alive connection waits for its next request
+	IdleTimeout time.Duration `config:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	// ShutdownDelay is how long to keep serving while reporting not ready before shutting down, so load balancers
+	// notice first
+	ShutdownDelay time.Duration `config:"shutdown_delay" env:"SERVER_SHUTDOWN_DELAY"`
+	// ShutdownTimeout limits how long shutting down waits for in-flight requests and background workers
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+}
+
+// DatabaseConfig locates the database and tunes the connections to it. Settings that libpq reads from the
+// environment can also be given by the libpq variable, e.g. PGHOST, when their own variable isn't set
+type DatabaseConfig struct {
+	// URL is a complete connection string, either a postgres:// URL or libpq key=value pairs. When set, the host,
+	// port, user, password, name and ssl settings are ignored
+	URL      string `config:"url" env:"DATABASE_URL" secret:"true"`
+	Host     string `config:"host" env:"PG_HOST" libpq:"PGHOST"`
+	Port     string `config:"port" env:"PG_PORT" libpq:"PGPORT"`
+	User     string `config:"user" env:"PG_USER" libpq:"PGUSER"`
+	Password string `config:"password" env:"PG_PASSWORD" libpq:"PGPASSWORD" secret:"true"`
+	Name     string `config:"name" env:"PG_DB" libpq:"PGDATABASE"`
+	// SSLMode is disable, require, verify-ca or verify-full
+	SSLMode string `config:"sslmode" env:"PG_SSLMODE" libpq:"PGSSLMODE"`
+	// SSLRootCert is the CA certificate file the server's certificate is verified against
+	SSLRootCert string `config:"sslrootcert" env:"PG_SSLROOTCERT" libpq:"PGSSLROOTCERT"`
+	// SSLCert and SSLKey are the client certificate and key files, for servers that authenticate clients by
+	// certificate
+	SSLCert string `config:"sslcert" env:"PG_SSLCERT" libpq:"PGSSLCERT"`
+	SSLKey  string `config:"sslkey" env:"PG_SSLKEY" libpq:"PGSSLKEY"`
+	// MaxOpenConns limits the connections in the pool, 0 for no limit
+	MaxOpenConns int `config:"max_open_conns" env:"PG_MAX_OPEN_CONNS"`
+	// MaxIdleConns is how many idle connections the pool keeps open
+	MaxIdleConns int `config:"max_idle_conns" env:"PG_MAX_IDLE_CONNS"`
+	// ConnMaxLifetime is how long a connection is reused before it is replaced, 0 for ever
+	ConnMaxLifetime time.Duration `config:"conn_max_lifetime" env:"PG_CONN_MAX_LIFETIME"`
+	// ConnectRetry is how long connecting at boot keeps retrying while the database can't be reached
+	ConnectRetry time.Duration `config:"connect_retry" env:"PG_CONNECT_RETRY"`
+	// ReadTimeout limits looking up a single row, such as when authenticating
+	ReadTimeout time.Duration `config:"read_timeout" env:"PG_READ_TIMEOUT"`
+	// ListTimeout limits listing and counting rows
+	ListTimeout time.Duration `config:"list_timeout" env:"PG_LIST_TIMEOUT"`
+	// WriteTimeout limits creating, updating and deleting rows
+	WriteTimeout time.Duration `config:"write_timeout" env:"PG_WRITE_TIMEOUT"`
+	// BulkTimeout limits writing many rows at once, such as importing users
+	BulkTimeout time.Duration `config:"bulk_timeout" env:"PG_BULK_TIMEOUT"`
+	// Replicas are the read replicas of the database, a comma separated list of host or host:port. They are
+	// connected to with the same settings as the database otherwise
+	Replicas string `config:"replicas" env:"PG_REPLICAS"`
+	// ReplicaMaxLag is how far a replica can fall behind the database before reads stop being sent to it
+	ReplicaMaxLag time.Duration `config:"replica_max_lag" env:"PG_REPLICA_MAX_LAG"`
+	// ReplicaCheckInterval is how often the health and lag of the replicas is checked
+	ReplicaCheckInterval time.Duration `config:"replica_check_interval" env:"PG_REPLICA_CHECK_INTERVAL"`
+	// ReadYourWrites sends the reads a request makes after writing to the database rather than a replica, so they
+	// see the write
+	ReadYourWrites bool `config:"read_your_writes" env:"PG_READ_YOUR_WRITES"`
+}
+
+// ReplicaList returns the replicas, host or host:port, each defaulting to the port of the database
+func (c DatabaseConfig) ReplicaList() (replicas []string) {
+	for _, replica := range strings.Split(c.Replicas, ",") {
+		if replica = strings.TrimSpace(replica); replica == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(replica); err != nil {
+			replica = net.JoinHostPort(strings.Trim(replica, "[]"), c.Port)
+		}
+		replicas = append(replicas, replica)
+	}
+
+	return replicas
+}
+
+type TenantConfig struct {
+	// Domain is the parent domain organizations are served under as subdomains, e.g. users.example.com
+	Domain string `config:"domain" env:"TENANT_DOMAIN"`
+	// Required rejects requests that don't name an organization instead of using the default one
+	Required bool `config:"required" env:"TENANT_REQUIRED"`
+}
+
+// SMTPConfig is the relay invitations are sent through. Without a host they are printed instead
+type SMTPConfig struct {
+	Host     string `config:"host" env:"SMTP_HOST"`
+	Port     string `config:"port" env:"SMTP_PORT"`
+	Username string `config:"username" env:"SMTP_USERNAME"`
+	Password string `config:"password" env:"SMTP_PASSWORD" secret:"true"`
+	From     string `config:"from" env:"SMTP_FROM"`
+}
+
+type InviteConfig struct {
+	// URL is the link invitation tokens are appended to, e.g. https://app.example.com/accept?token=
+	URL string `config:"url" env:"INVITE_URL"`
+	// TTL is how long an invitation can be accepted for
+	TTL time.Duration `config:"ttl" env:"INVITE_TTL"`
+}
+
+type AuthConfig struct {
+	// TokenSigningKey signs the tokens the service issues. A random one is generated when it is unset
+	TokenSigningKey string `config:"token_signing_key" env:"TOKEN_SIGNING_KEY" secret:"true"`
+	// AdminGroup names the group whose members are privileged
+	AdminGroup string `config:"admin_group" env:"ADMIN_GROUP"`
+	// PlatformOrganization is the slug of the organization whose privileged users manage every organization. When
+	// unset, privileged users only see their own organization and no one can create one
+	PlatformOrganization string `config:"platform_organization" env:"PLATFORM_ORGANIZATION"`
+	// ImpersonationTTL is how long an impersonation token lasts
+	ImpersonationTTL time.Duration `config:"impersonation_ttl" env:"IMPERSONATION_TTL"`
+	// BcryptCost is the work factor passwords are hashed with
+	BcryptCost int `config:"bcrypt_cost" env:"BCRYPT_COST"`
+}
+
+type PagingConfig struct {
+	// DefaultLimit is the number of results listed when the request doesn't give a limit
+	DefaultLimit int `config:"default_limit" env:"PAGING_DEFAULT_LIMIT"`
+	// MaxLimit caps the limit a request can give
+	MaxLimit int `config:"max_limit" env:"PAGING_MAX_LIMIT"`
+}
+
+type MetricsConfig struct {
+	// UserCountInterval is how often the users gauge is refreshed
+	UserCountInterval time.Duration `config:"user_count_interval" env:"METRICS_USER_COUNT_INTERVAL"`
+}
+
+type TracingConfig struct {
+	// Exporter is where spans are sent: none, stdout or otlp
+	Exporter string `config:"exporter" env:"TRACING_EXPORTER"`
+	// OTLPEndpoint is the host:port of the OTLP/HTTP collector
+	OTLPEndpoint string `config:"otlp_endpoint" env:"TRACING_OTLP_ENDPOINT"`
+	// OTLPInsecure sends spans to the collector over plain HTTP
+	OTLPInsecure bool `config:"otlp_insecure" env:"TRACING_OTLP_INSECURE"`
+	// SampleRatio is the fraction of traces started here that are sampled. Traces continued from a caller follow
+	// the caller's decision
+	SampleRatio float64 `config:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+	// ServiceName identifies the service in traces
+	ServiceName string `config:"service_name" env:"TRACING_SERVICE_NAME"`
+}
+
+type LoggingConfig struct {
+	// Level is the least severe level logged: debug, info, warn or error
+	Level string `config:"level" env:"LOG_LEVEL"`
+	// AccessLog logs every request served
+	AccessLog bool `config:"access_log" env:"LOG_ACCESS"`
+}
+
+type ValidationConfig struct {
+	// RulesFile is a YAML or JSON file overriding the built-in validation rules and adding messages, see the README
+	RulesFile string `config:"rules_file" env:"VALIDATION_RULES_FILE"`
+	// DefaultLocale is the language of validation messages when the caller accepts none there are messages for
+	DefaultLocale string `config:"default_locale" env:"VALIDATION_DEFAULT_LOCALE"`
+}
+
+type EmailConfig struct {
+	// AllowedDomains is a comma separated list of the only domains, with their subdomains, addresses can be at. Any
+	// domain is allowed if it is empty
+	AllowedDomains string `config:"allowed_domains" env:"EMAIL_ALLOWED_DOMAINS"`
+	// DeniedDomains is a comma separated list of domains, with their subdomains, addresses can't be at
+	DeniedDomains string `config:"denied_domains" env:"EMAIL_DENIED_DOMAINS"`
+	// Canonicalize finds duplicate addresses by the rules of well known providers, e.g. that Gmail ignores dots
+	Canonicalize bool `config:"canonicalize" env:"EMAIL_CANONICALIZE"`
+}
+
+// AllowedDomainList returns the allowed domains, converted to ASCII
+func (c EmailConfig) AllowedDomainList() ([]string, error) {
+	return domainList(c.AllowedDomains)
+}
+
+// DeniedDomainList returns the denied domains, converted to ASCII
+func (c EmailConfig) DeniedDomainList() ([]string, error) {
+	return domainList(c.DeniedDomains)
+}
+
+// domainList splits a comma separated list of domains, converting each to ASCII
+// returns an error naming the first that isn't a valid domain
+func domainList(list string) (domains []string, err error) {
+	for _, domain := range strings.Split(list, ",") {
+		if domain = strings.TrimSpace(domain); domain == "" {
+			continue
+		}
+		ascii, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain %s: %s", domain, err)
+		}
+		domains = append(domains, ascii)
+	}
+
+	return domains, nil
+}
+
+type UsernameConfig struct {
+	// AllowedPunctuation are the ASCII punctuation characters, such as ._-, usernames can have between their letters
+	// and digits
+	AllowedPunctuation string `config:"allowed_punctuation" env:"USERNAME_ALLOWED_PUNCTUATION"`
+	// Reserved is a comma separated list of usernames no one can take, nor any that looks like one
+	Reserved string `config:"reserved" env:"USERNAME_RESERVED"`
+}
+
+// ReservedList returns the reserved usernames
+func (c UsernameConfig) ReservedList() (reserved []string) {
+	for _, username := range strings.Split(c.Reserved, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			reserved = append(reserved, username)
+		}
+	}
+
+	return reserved
+}
+
+type PhoneConfig struct {
+	// DefaultRegion is the region, as an ISO 3166 code such as US, of telephone numbers given without a country code
+	DefaultRegion string `config:"default_region" env:"PHONE_DEFAULT_REGION"`
+	// Format is the format telephone numbers are given out in when a request doesn't ask for one: e164, national or
+	// international
+	Format string `config:"format" env:"PHONE_FORMAT"`
+}
+
+// BlobConfig is where uploaded files, such as avatars, are kept
+type BlobConfig struct {
+	// Store is local, a directory of the local filesystem, or s3, a bucket of Amazon S3 or a service compatible with it
+	Store string `config:"store" env:"BLOB_STORE"`
+	// Dir is the directory the local store keeps files in
+	Dir string `config:"dir" env:"BLOB_DIR"`
+	// S3Endpoint is the URL of the S3 service, e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	S3Endpoint  string `config:"s3_endpoint" env:"BLOB_S3_ENDPOINT"`
+	S3Region    string `config:"s3_region" env:"BLOB_S3_REGION"`
+	S3Bucket    string `config:"s3_bucket" env:"BLOB_S3_BUCKET"`
+	S3AccessKey string `config:"s3_access_key" env:"BLOB_S3_ACCESS_KEY"`
+	S3SecretKey string `config:"s3_secret_key" env:"BLOB_S3_SECRET_KEY" secret:"true"`
+}
+
+type AvatarConfig struct {
+	// MaxBytes is the largest image that can be uploaded
+	MaxBytes int `config:"max_bytes" env:"AVATAR_MAX_BYTES"`
+	// Sizes is a comma separated list of the sizes, in pixels, of the square thumbnails kept of each avatar
+	Sizes string `config:"sizes" env:"AVATAR_SIZES"`
+	// MaxAge is how long clients may use an avatar they have fetched before checking it hasn't changed
+	MaxAge time.Duration `config:"max_age" env:"AVATAR_MAX_AGE"`
+}
+
+// SizeList returns the sizes of thumbnails
+// returns an error naming the first that isn't a positive integer
+func (c AvatarConfig) SizeList() (sizes []int, err error) {
+	for _, size := range strings.Split(c.Sizes, ",") {
+		if size = strings.TrimSpace(size); size == "" {
+			continue
+		}
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 1 || n > 4096 {
+			return nil, fmt.Errorf("%s is not a size from 1 to 4096", size)
+		}
+		sizes = append(sizes, n)
+	}
+
+	return sizes, nil
+}
+
+type ImportConfig struct {
+	// MaxRows is the most users a single import can have
+	MaxRows int `config:"max_rows" env:"IMPORT_MAX_ROWS"`
+	// MaxBytes is the largest file that can be imported through the API
+	MaxBytes int `config:"max_bytes" env:"IMPORT_MAX_BYTES"`
+}
+
+type ExportConfig struct {
+	// TTL is how long the file of an export job is kept once it finishes
+	TTL time.Duration `config:"ttl" env:"EXPORT_TTL"`
+	// CleanupInterval is how often expired export jobs, and their files, are deleted
+	CleanupInterval time.Duration `config:"cleanup_interval" env:"EXPORT_CLEANUP_INTERVAL"`
+}
+
+type BatchConfig struct {
+	// MaxOperations is the most operations a single batch can have
+	MaxOperations int `config:"max_operations" env:"BATCH_MAX_OPERATIONS"`
+	// MaxBytes is the largest body a batch can have
+	MaxBytes int `config:"max_bytes" env:"BATCH_MAX_BYTES"`
+}
+
+type IdempotencyConfig struct {
+	// TTL is how long the response to a request with an Idempotency-Key is kept, to answer retries with
+	TTL time.Duration `config:"ttl" env:"IDEMPOTENCY_TTL"`
+	// CleanupInterval is how often expired idempotency keys are deleted
+	CleanupInterval time.Duration `config:"cleanup_interval" env:"IDEMPOTENCY_CLEANUP_INTERVAL"`
+	// MaxBytes is the largest body of a request with an Idempotency-Key, and of a response that is kept
+	MaxBytes int `config:"max_bytes" env:"IDEMPOTENCY_MAX_BYTES"`
+}
+
+// Config is the effective configuration of the service
+type Config struct {
+	Server      ServerConfig      `config:"server"`
+	Database    DatabaseConfig    `config:"database"`
+	Tenant      TenantConfig      `config:"tenant"`
+	SMTP        SMTPConfig        `config:"smtp"`
+	Invite      InviteConfig      `config:"invite"`
+	Auth        AuthConfig        `config:"auth"`
+	Paging      PagingConfig      `config:"paging"`
+	Metrics     MetricsConfig     `config:"metrics"`
+	Tracing     TracingConfig     `config:"tracing"`
+	Logging     LoggingConfig     `config:"logging"`
+	Validation  ValidationConfig  `config:"validation"`
+	Phone       PhoneConfig       `config:"phone"`
+	Email       EmailConfig       `config:"email"`
+	Username    UsernameConfig    `config:"username"`
+	Blob        BlobConfig        `config:"blob"`
+	Avatar      AvatarConfig      `config:"avatar"`
+	Import      ImportConfig      `config:"import"`
+	Export      ExportConfig      `config:"export"`
+	Batch       BatchConfig       `config:"batch"`
+	Idempotency IdempotencyConfig `config:"idempotency"`
+}
+
+// CONFIG_FILE_ENV names the environment variable giving the config file when the -config flag isn't used
+const CONFIG_FILE_ENV string = "CONFIG_FILE"
+
+// SECRET_MASK replaces the value of secrets that are set when the configuration is printed
+const SECRET_MASK string = "********"
+
+// Default returns the configuration used when nothing is overridden
+func Default() Config {
+	return Config{
+		Server: ServerConfig{Port: "8080", ReadTimeout: 15 * time.Second, WriteTimeout: 30 * time.Second,
+			IdleTimeout: 2 * time.Minute, ShutdownTimeout: 30 * time.Second},
+		Database: DatabaseConfig{Port: "5432", SSLMode: "disable", MaxOpenConns: 25, MaxIdleConns: 5,
+			ConnMaxLifetime: 30 * time.Minute, ConnectRetry: time.Minute, ReadTimeout: 5 * time.Second,
+			ListTimeout: 20 * time.Second, WriteTimeout: 10 * time.Second, BulkTimeout: 10 * time.Minute,
+			ReplicaMaxLag: 10 * time.Second, ReplicaCheckInterval: 5 * time.Second, ReadYourWrites: true},
+		SMTP:   SMTPConfig{Port: "25"},
+		Invite: InviteConfig{TTL: 72 * time.Hour},
+		Auth: AuthConfig{AdminGroup: "admins", ImpersonationTTL: 15 * time.Minute,
+			BcryptCost: bcrypt.DefaultCost},
+		Paging:  PagingConfig{DefaultLimit: 100, MaxLimit: 1000},
+		Metrics: MetricsConfig{UserCountInterval: time.Minute},
+		Tracing: TracingConfig{Exporter: "none", OTLPEndpoint: "localhost:4318", SampleRatio: 1,
+			ServiceName: "user-service"},
+		Logging:    LoggingConfig{Level: "info", AccessLog: true},
+		Validation: ValidationConfig{DefaultLocale: "en"},
+		Phone:      PhoneConfig{DefaultRegion: "US", Format: "national"},
+		Username: UsernameConfig{Reserved: "admin,administrator,root,system,support,help,security,abuse,postmaster," +
+			"webmaster,hostmaster,noreply,api,www"},
+		Blob:        BlobConfig{Store: "local", Dir: "data/blobs", S3Region: "us-east-1"},
+		Avatar:      AvatarConfig{MaxBytes: 5 << 20, Sizes: "512,128,64", MaxAge: time.Hour},
+		Import:      ImportConfig{MaxRows: 50000, MaxBytes: 64 << 20},
+		Export:      ExportConfig{TTL: 24 * time.Hour, CleanupInterval: time.Hour},
+		Batch:       BatchConfig{MaxOperations: 100, MaxBytes: 1 << 20},
+		Idempotency: IdempotencyConfig{TTL: 24 * time.Hour, CleanupInterval: time.Hour, MaxBytes: 1 << 20},
+	}
+}
+
+// setting is one field of the configuration
+type setting struct {
+	key string
+	env string
+	// libpqEnv is the libpq environment variable read when env isn't set
+	libpqEnv string
+	secret   bool
+	value    reflect.Value
+}
+
+// settings lists the fields of the configuration in the order they are declared
+func (c *Config) settings() (list []setting) {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		prefix := sections.Type().Field(i).Tag.Get("config")
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			list = append(list, setting{key: prefix + "." + field.Tag.Get("config"), env: field.Tag.Get("env"),
+				libpqEnv: field.Tag.Get("libpq"), secret: field.Tag.Get("secret") == "true", value: section.Field(j)})
+		}
+	}
+
+	return
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses the text into the setting. source names where the text came from for the error
+func (s setting) set(text, source string) error {
+	var err error
+	switch {
+	case s.value.Type() == durationType:
+		var d time.Duration
+		if d, err = time.ParseDuration(text); err == nil {
+			s.value.SetInt(int64(d))
+		} else {
+			err = fmt.Errorf("%s from %s must be a duration such as 15m: received %s", s.key, source, text)
+		}
+	case s.value.Kind() == reflect.Int:
+		var i int
+		if i, err = strconv.Atoi(text); err == nil {
+			s.value.SetInt(int64(i))
+		} else {
+			err = fmt.Errorf("%s from %s must be an integer: received %s", s.key, source, text)
+		}
+	case s.value.Kind() == reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(text, 64); err == nil {
+			s.value.SetFloat(f)
+		} else {
+			err = fmt.Errorf("%s from %s must be a number: received %s", s.key, source, text)
+		}
+	case s.value.Kind() == reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(text); err == nil {
+			s.value.SetBool(b)
+		} else {
+			err = fmt.Errorf("%s from %s must be true or false: received %s", s.key, source, text)
+		}
+	default:
+		s.value.SetString(text)
+	}
+
+	return err
+}
+
+// setFromFile reads a secret from a file, such as a Docker or Kubernetes secret. A trailing newline is dropped
+func (s setting) setFromFile(path, source string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s from %s: %s", s.key, source, err)
+	}
+
+	return s.set(strings.TrimRight(string(contents), "\r\n"), source)
+}
+
+// flagValue collects the flags that are set, so they can be applied after the file and environment
+type flagValue struct {
+	name    string
+	values  map[string]string
+	boolean bool
+}
+
+func (f *flagValue) String() string {
+	return ""
+}
+
+// IsBoolFlag lets boolean settings be given as a bare flag, e.g. -tenant.required
+func (f *flagValue) IsBoolFlag() bool {
+	return f.boolean
+}
+
+func (f *flagValue) Set(text string) error {
+	f.values[f.name] = text
+	return nil
+}
+
+// Load builds the configuration from the defaults, the config file, the environment and the command line flags
+// in args, each overriding the one before. The config file is given by the -config flag or CONFIG_FILE
+// returns flag.ErrHelp if the flags asked for usage
+func Load(args []string) (Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	flags := flag.NewFlagSet("user-service", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv(CONFIG_FILE_ENV), "YAML or TOML config file")
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		if s.secret {
+			flags.Var(&flagValue{name: s.key + "_file", values: flagValues}, s.key+"_file",
+				"file to read "+s.key+" from (env "+s.env+"_FILE)")
+		} else {
+			flags.Var(&flagValue{name: s.key, values: flagValues, boolean: s.value.Kind() == reflect.Bool}, s.key,
+				s.key+" (env "+s.env+")")
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+	if flags.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument %s", flags.Arg(0))
+	}
+
+	if *configFile != "" {
+		fileValues, err := readFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+		if err = apply(settings, fileValues, "config file "+*configFile); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			if err := s.set(value, s.env); err != nil {
+				return cfg, err
+			}
+		} else if value = os.Getenv(s.libpqEnv); s.libpqEnv != "" && value != "" {
+			if err := s.set(value, s.libpqEnv); err != nil {
+				return cfg, err
+			}
+		}
+		if path := os.Getenv(s.env + "_FILE"); s.secret && path != "" {
+			if err := s.setFromFile(path, s.env+"_FILE"); err != nil {
+				return cfg, err
+			}
+		}
+	}
+
+	return cfg, apply(settings, flagValues, "flag")
+}
+
+// apply sets the settings from values keyed by setting key, or <key>_file for secrets
+// returns an error for keys that are not settings
+func apply(settings []setting, values map[string]string, source string) error {
+	known := make(map[string]bool)
+	for _, s := range settings {
+		if value, ok := values[s.key]; ok {
+			if err := s.set(value, source); err != nil {
+				return err
+			}
+		}
+		if path, ok := values[s.key+"_file"]; ok && s.secret {
+			if err := s.setFromFile(path, source); err != nil {
+				return err
+			}
+			known[s.key+"_file"] = true
+		}
+		known[s.key] = true
+	}
+
+	var unknown []string
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings in %s: %s", source, strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// readFile reads a YAML (.yaml, .yml) or TOML (.toml) config file into values keyed by setting key
+func readFile(path string) (map[string]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &sections)
+	case ".toml":
+		_, err = toml.Decode(string(contents), &sections)
+	default:
+		return nil, fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %s", path, err)
+	}
+
+	values := make(map[string]string)
+	for name, section := range sections {
+		var fields map[string]interface{}
+		switch section := section.(type) {
+		case map[string]interface{}: // TOML
+			fields = section
+		case map[interface{}]interface{}: // YAML
+			fields = make(map[string]interface{})
+			for key, value := range section {
+				fields[fmt.Sprint(key)] = value
+			}
+		default:
+			return nil, fmt.Errorf("config file %s: %s must be a section of settings", path, name)
+		}
+
+		for key, value := range fields {
+			values[name+"."+key] = fmt.Sprint(value)
+		}
+	}
+
+	return values, nil
+}
+
+// validPort checks the port is a number a service can listen on
+func validPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p < 65536
+}
+
+// Validate Validates that all settings contain proper values
+// returns the list of validation errors
+func (c Config) Validate() (errs []string) {
+	if !validPort(c.Server.Port) {
+		errs = append(errs, "Invalid server.port: must be a number from 1 to 65535")
+	}
+	if c.Server.ReadTimeout <= 0 || c.Server.WriteTimeout <= 0 || c.Server.IdleTimeout <= 0 ||
+		c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, "Invalid server timeouts: must be positive durations such as 30s")
+	}
+	if c.Server.ShutdownDelay < 0 {
+		errs = append(errs, "Invalid server.shutdown_delay: must not be negative")
+	}
+
+	if c.Database.ReadTimeout <= 0 || c.Database.ListTimeout <= 0 || c.Database.WriteTimeout <= 0 ||
+		c.Database.BulkTimeout <= 0 {
+		errs = append(errs, "Invalid database timeouts: must be positive durations such as 5s")
+	}
+	if c.Database.URL == "" {
+		if c.Database.Host == "" {
+			errs = append(errs, "database.host is not specified!")
+		}
+		if !validPort(c.Database.Port) {
+			errs = append(errs, "Invalid database.port: must be a number from 1 to 65535")
+		}
+		if c.Database.User == "" {
+			errs = append(errs, "database.user is not specified!")
+		}
+		if c.Database.Name == "" {
+			errs = append(errs, "database.name is not specified!")
+		}
+		switch c.Database.SSLMode {
+		case "disable", "require", "verify-ca", "verify-full":
+		default:
+			errs = append(errs, "Invalid database.sslmode: must be disable, require, verify-ca or verify-full")
+		}
+		if (c.Database.SSLCert == "") != (c.Database.SSLKey == "") {
+			errs = append(errs, "database.sslcert and database.sslkey must be given together")
+		}
+	}
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 ||
+		(c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns) {
+		errs = append(errs, "Invalid database pool: max_open_conns and max_idle_conns must not be negative, and "+
+			"max_idle_conns must not exceed max_open_conns")
+	}
+	if c.Database.ConnMaxLifetime < 0 || c.Database.ConnectRetry < 0 {
+		errs = append(errs, "Invalid database.conn_max_lifetime or connect_retry: must not be negative")
+	}
+	for _, replica := range c.Database.ReplicaList() {
+		if host, port, err := net.SplitHostPort(replica); err != nil || host == "" || !validPort(port) {
+			errs = append(errs, "Invalid database.replicas: "+replica+" must be a host or host:port")
+		}
+	}
+	if c.Database.ReplicaMaxLag <= 0 || c.Database.ReplicaCheckInterval <= 0 {
+		errs = append(errs, "Invalid database.replica_max_lag or replica_check_interval: must be positive durations "+
+			"such as 10s")
+	}
+
+	if c.SMTP.Host != "" {
+		if !validPort(c.SMTP.Port) {
+			errs = append(errs, "Invalid smtp.port: must be a number from 1 to 65535")
+		}
+		if c.SMTP.From == "" {
+			errs = append(errs, "smtp.from is not specified!")
+		}
+	}
+
+	if c.Invite.TTL <= 0 {
+		errs = append(errs, "Invalid invite.ttl: must be a positive duration such as 72h")
+	}
+
+	if c.Auth.TokenSigningKey != "" && len(c.Auth.TokenSigningKey) < 32 {
+		errs = append(errs, "Invalid auth.token_signing_key: must be at least 32 characters")
+	}
+	if c.Auth.AdminGroup == "" {
+		errs = append(errs, "auth.admin_group is not specified!")
+	}
+	if c.Auth.ImpersonationTTL <= 0 {
+		errs = append(errs, "Invalid auth.impersonation_ttl: must be a positive duration such as 15m")
+	}
+	if c.Auth.BcryptCost < bcrypt.MinCost || c.Auth.BcryptCost > bcrypt.MaxCost {
+		errs = append(errs, fmt.Sprintf("Invalid auth.bcrypt_cost: must be from %d to %d", bcrypt.MinCost,
+			bcrypt.MaxCost))
+	}
+
+	if c.Paging.DefaultLimit < 1 {
+		errs = append(errs, "Invalid paging.default_limit: must be at least 1")
+	}
+	if c.Paging.MaxLimit < c.Paging.DefaultLimit {
+		errs = append(errs, "Invalid paging.max_limit: must be at least paging.default_limit")
+	}
+
+	if c.Metrics.UserCountInterval <= 0 {
+		errs = append(errs, "Invalid metrics.user_count_interval: must be a positive duration such as 1m")
+	}
+
+	if c.Tracing.Exporter != "none" && c.Tracing.Exporter != "stdout" && c.Tracing.Exporter != "otlp" {
+		errs = append(errs, "Invalid tracing.exporter: must be none, stdout or otlp")
+	}
+	if c.Tracing.Exporter == "otlp" && c.Tracing.OTLPEndpoint == "" {
+		errs = append(errs, "tracing.otlp_endpoint is not specified!")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, "Invalid tracing.sample_ratio: must be from 0 to 1")
+	}
+	if c.Tracing.ServiceName == "" {
+		errs = append(errs, "tracing.service_name is not specified!")
+	}
+
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, "Invalid logging.level: must be debug, info, warn or error")
+	}
+
+	if c.Validation.DefaultLocale == "" {
+		errs = append(errs, "validation.default_locale is not specified!")
+	}
+
+	if _, err := c.Email.AllowedDomainList(); err != nil {
+		errs = append(errs, fmt.Sprintf("Invalid email.allowed_domains: %s", err))
+	}
+	if _, err := c.Email.DeniedDomainList(); err != nil {
+		errs = append(errs, fmt.Sprintf("Invalid email.denied_domains: %s", err))
+	}
+
+	for _, r := range c.Username.AllowedPunctuation {
+		if r > unicode.MaxASCII || !unicode.IsPunct(r) && !unicode.IsSymbol(r) {
+			errs = append(errs, fmt.Sprintf("Invalid username.allowed_punctuation: %q is not ASCII punctuation", r))
+		}
+	}
+
+	if phonenumbers.GetCountryCodeForRegion(strings.ToUpper(c.Phone.DefaultRegion)) == 0 {
+		errs = append(errs, "Invalid phone.default_region: must be an ISO 3166 region code, such as US")
+	}
+	switch c.Phone.Format {
+	case "e164", "national", "international":
+	default:
+		errs = append(errs, "Invalid phone.format: must be e164, national or international")
+	}
+
+	switch c.Blob.Store {
+	case "local":
+		if c.Blob.Dir == "" {
+			errs = append(errs, "blob.dir is not specified!")
+		}
+	case "s3":
+		if c.Blob.S3Endpoint == "" || c.Blob.S3Region == "" || c.Blob.S3Bucket == "" {
+			errs = append(errs, "blob.s3_endpoint, s3_region and s3_bucket are required by the s3 store")
+		}
+	default:
+		errs = append(errs, "Invalid blob.store: must be local or s3")
+	}
+
+	if c.Avatar.MaxBytes < 1 {
+		errs = append(errs, "Invalid avatar.max_bytes: must be at least 1")
+	}
+	if sizes, err := c.Avatar.SizeList(); err != nil {
+		errs = append(errs, fmt.Sprintf("Invalid avatar.sizes: %s", err))
+	} else if len(sizes) == 0 {
+		errs = append(errs, "avatar.sizes is not specified!")
+	}
+	if c.Avatar.MaxAge < 0 {
+		errs = append(errs, "Invalid avatar.max_age: must not be negative")
+	}
+
+	if c.Import.MaxRows < 1 {
+		errs = append(errs, "Invalid import.max_rows: must be at least 1")
+	}
+	if c.Import.MaxBytes < 1 {
+		errs = append(errs, "Invalid import.max_bytes: must be at least 1")
+	}
+
+	if c.Export.TTL <= 0 {
+		errs = append(errs, "Invalid export.ttl: must be positive")
+	}
+	if c.Export.CleanupInterval <= 0 {
+		errs = append(errs, "Invalid export.cleanup_interval: must be positive")
+	}
+
+	if c.Batch.MaxOperations < 1 {
+		errs = append(errs, "Invalid batch.max_operations: must be at least 1")
+	}
+	if c.Batch.MaxBytes < 1 {
+		errs = append(errs, "Invalid batch.max_bytes: must be at least 1")
+	}
+
+	if c.Idempotency.TTL <= 0 {
+		errs = append(errs, "Invalid idempotency.ttl: must be positive")
+	}
+	if c.Idempotency.CleanupInterval <= 0 {
+		errs = append(errs, "Invalid idempotency.cleanup_interval: must be positive")
+	}
+	if c.Idempotency.MaxBytes < 1 {
+		errs = append(errs, "Invalid idempotency.max_bytes: must be at least 1")
+	}
+
+	return
+}
+
+// Check validates the configuration
+// returns an error listing every problem
+func (c Config) Check() error {
+	valErrors := c.Validate()
+	if len(valErrors) > 0 {
+		return errors.New(fmt.Sprintf("Config failed validation:\n\t- %s", strings.Join(valErrors, "\n\t- ")))
+	}
+
+	return nil
+}
+
+// Print writes the configuration as a YAML config file, with secrets that are set masked
+func (c Config) Print(w io.Writer) error {
+	var sections yaml.MapSlice
+	for _, s := range c.settings() {
+		key := strings.SplitN(s.key, ".", 2)
+		if len(sections) == 0 || sections[len(sections)-1].Key != key[0] {
+			sections = append(sections, yaml.MapItem{Key: key[0], Value: yaml.MapSlice{}})
+		}
+
+		var value interface{} = s.value.Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		} else if s.secret && s.value.String() != "" {
+			value = SECRET_MASK
+		}
+
+		section := &sections[len(sections)-1]
+		section.Value = append(section.Value.(yaml.MapSlice), yaml.MapItem{Key: key[1], Value: value})
+	}
+
+	out, err := yaml.Marshal(sections)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+
+	return err
+}
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a file into the test's temporary directory and returns its path
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Caught error while writing %s: %s", name, err)
+	}
+	return path
+}
+
+// setenv sets an environment variable for the rest of the test
+func setenv(t *testing.T, key, value string) {
+	os.Setenv(key, value)
+	t.Cleanup(func() { os.Unsetenv(key) })
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Defaults expected to load, got %s", err)
+	}
+	if cfg != Default() {
+		t.Errorf("Config expected to be the defaults, got %+v", cfg)
+	}
+}
+
+// TestLoadPrecedence Checks the file overrides the defaults, the environment the file and flags the environment
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+database:
+  host: file-host
+  user: file-user
+  name: file-db
+invite:
+  ttl: 24h
+tenant:
+  required: true
+`)
+	setenv(t, "PG_USER", "env-user")
+	setenv(t, "PG_DB", "env-db")
+
+	cfg, err := Load([]string{"-config", path, "-database.name", "flag-db"})
+	if err != nil {
+		t.Fatalf("Config expected to load, got %s", err)
+	}
+
+	if cfg.Server.Port != "8080" {
+		t.Errorf("server.port expected to keep its default, got %s", cfg.Server.Port)
+	}
+	if cfg.Database.Host != "file-host" || cfg.Invite.TTL != 24*time.Hour || !cfg.Tenant.Required {
+		t.Errorf("Config file expected to override the defaults, got %+v", cfg)
+	}
+	if cfg.Database.User != "env-user" {
+		t.Errorf("PG_USER expected to override the config file, got %s", cfg.Database.User)
+	}
+	if cfg.Database.Name != "flag-db" {
+		t.Errorf("-database.name expected to override PG_DB, got %s", cfg.Database.Name)
+	}
+}
+
+// TestLoadLibpqEnvironment Checks libpq variables are read when the service's own variable isn't set
+func TestLoadLibpqEnvironment(t *testing.T) {
+	setenv(t, "PGHOST", "libpq-host")
+	setenv(t, "PGSSLMODE", "verify-full")
+	setenv(t, "PG_SSLMODE", "require")
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Config expected to load, got %s", err)
+	}
+	if cfg.Database.Host != "libpq-host" {
+		t.Errorf("PGHOST expected to set database.host, got %s", cfg.Database.Host)
+	}
+	if cfg.Database.SSLMode != "require" {
+		t.Errorf("PG_SSLMODE expected to override PGSSLMODE, got %s", cfg.Database.SSLMode)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "config.toml", `
+[server]
+port = 9090
+
+[paging]
+default_limit = 20
+`)
+	setenv(t, CONFIG_FILE_ENV, path)
+
+	cfg, err := Load([]string{"-tenant.required"})
+	if err != nil {
+		t.Fatalf("Config expected to load, got %s", err)
+	}
+	if cfg.Server.Port != "9090" || cfg.Paging.DefaultLimit != 20 || !cfg.Tenant.Required {
+		t.Errorf("TOML config file and bare boolean flag expected to apply, got %+v", cfg)
+	}
+}
+
+// TestLoadSecretFiles Checks secrets can be read from files named by the environment, config file or flags
+func TestLoadSecretFiles(t *testing.T) {
+	dbSecret := writeFile(t, "pg_password", "db-secret\n")
+	smtpSecret := writeFile(t, "smtp_password", "smtp-secret")
+	keySecret := writeFile(t, "token_key", strings.Repeat("k", 32))
+	path := writeFile(t, "config.yaml", "smtp:\n  password_file: "+smtpSecret+"\n")
+	setenv(t, "PG_PASSWORD_FILE", dbSecret)
+
+	cfg, err := Load([]string{"-config", path, "-auth.token_signing_key_file", keySecret})
+	if err != nil {
+		t.Fatalf("Config expected to load, got %s", err)
+	}
+	if cfg.Database.Password != "db-secret" {
+		t.Errorf("database.password expected from PG_PASSWORD_FILE without its newline, got |%s|",
+			cfg.Database.Password)
+	}
+	if cfg.SMTP.Password != "smtp-secret" {
+		t.Errorf("smtp.password expected from smtp.password_file, got |%s|", cfg.SMTP.Password)
+	}
+	if cfg.Auth.TokenSigningKey != strings.Repeat("k", 32) {
+		t.Errorf("auth.token_signing_key expected from its flag file, got |%s|", cfg.Auth.TokenSigningKey)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, contents := range map[string]string{
+		"unknown.yaml":    "database:\n  pasword: x\n",
+		"notsection.yaml": "port: 8080\n",
+		"badint.toml":     "[paging]\nmax_limit = \"lots\"\n",
+		"config.json":     "{}",
+	} {
+		if _, err := Load([]string{"-config", writeFile(t, name, contents)}); err == nil {
+			t.Errorf("Config file %s expected to be rejected", name)
+		}
+	}
+
+	//Secrets can't be passed as flags themselves
+	for _, args := range [][]string{{"-database.password", "x"}, {"-invite.ttl", "soon"}, {"stray"}} {
+		if _, err := Load(args); err == nil {
+			t.Errorf("Flags %v expected to be rejected", args)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Host, cfg.Database.User, cfg.Database.Name = "localhost", "user", "userservice"
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Errorf("Config expected to pass, failed: %v", errs)
+	}
+
+	// A URL stands in for the host, user and name
+	withURL := Default()
+	withURL.Database.URL = "postgres://user@localhost/userservice"
+	if errs := withURL.Validate(); len(errs) > 0 {
+		t.Errorf("Config with database.url expected to pass, failed: %v", errs)
+	}
+
+	invalid := []func(c *Config){
+		func(c *Config) { c.Server.Port = "http" },
+		func(c *Config) { c.Database.Host = "" },
+		func(c *Config) { c.Database.Port = "70000" },
+		func(c *Config) { c.Database.ListTimeout = 0 },
+		func(c *Config) { c.Database.BulkTimeout = 0 },
+		func(c *Config) { c.Database.SSLMode = "prefer" },
+		func(c *Config) { c.Database.SSLCert = "client.crt" },
+		func(c *Config) { c.Database.MaxIdleConns = 30 },
+		func(c *Config) { c.Database.ConnectRetry = -time.Second },
+		func(c *Config) { c.Database.Replicas = "replica1:5432,:5432" },
+		func(c *Config) { c.Database.Replicas = "replica1:postgres" },
+		func(c *Config) { c.Database.ReplicaMaxLag = 0 },
+		func(c *Config) { c.SMTP.Host = "smtp.example.com" },
+		func(c *Config) { c.Invite.TTL = 0 },
+		func(c *Config) { c.Auth.TokenSigningKey = "short" },
+		func(c *Config) { c.Auth.BcryptCost = 2 },
+		func(c *Config) { c.Paging.MaxLimit = 10 },
+		func(c *Config) { c.Phone.DefaultRegion = "XX" },
+		func(c *Config) { c.Phone.Format = "e123" },
+		func(c *Config) { c.Email.DeniedDomains = "example.com, bad_domain!.com" },
+		func(c *Config) { c.Username.AllowedPunctuation = "._a" },
+		func(c *Config) { c.Blob.Store = "gcs" },
+		func(c *Config) { c.Blob.Store, c.Blob.S3Bucket = "s3", "" },
+		func(c *Config) { c.Avatar.MaxBytes = 0 },
+		func(c *Config) { c.Avatar.Sizes = "128,big" },
+		func(c *Config) { c.Avatar.Sizes = "" },
+		func(c *Config) { c.Import.MaxRows = 0 },
+		func(c *Config) { c.Import.MaxBytes = 0 },
+		func(c *Config) { c.Export.TTL = 0 },
+		func(c *Config) { c.Export.CleanupInterval = -time.Minute },
+		func(c *Config) { c.Batch.MaxOperations = 0 },
+		func(c *Config) { c.Batch.MaxBytes = 0 },
+		func(c *Config) { c.Idempotency.TTL = 0 },
+		func(c *Config) { c.Idempotency.CleanupInterval = -time.Minute },
+		func(c *Config) { c.Idempotency.MaxBytes = 0 },
+	}
+	for i, change := range invalid {
+		bad := cfg
+		change(&bad)
+		if errs := bad.Validate(); len(errs) == 0 {
+			t.Errorf("Config %d expected to fail, passed", i)
+		}
+	}
+}
+
+// TestReplicaList Checks replicas are split, trimmed and default to the port of the database
+func TestReplicaList(t *testing.T) {
+	cfg := Default().Database
+	cfg.Replicas = " replica1, replica2:6432,,[::1] ,[::1]:6543"
+
+	expected := []string{"replica1:5432", "replica2:6432", "[::1]:5432", "[::1]:6543"}
+	if replicas := cfg.ReplicaList(); !reflect.DeepEqual(replicas, expected) {
+		t.Errorf("Replicas expected to be %v, got %v", expected, replicas)
+	}
+}
+
+// TestPrint Checks the printed configuration masks secrets and loads back as a config file
+func TestPrint(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Host = "db"
+	cfg.Database.Password = "hunter2"
+	cfg.Invite.TTL = 48 * time.Hour
+
+	var out bytes.Buffer
+	if err := cfg.Print(&out); err != nil {
+		t.Fatalf("Caught error while printing: %s", err)
+	}
+	if strings.Contains(out.String(), "hunter2") || !strings.Contains(out.String(), SECRET_MASK) {
+		t.Errorf("Printed config expected to mask the password:\n%s", out.String())
+	}
+
+	loaded, err := Load([]string{"-config", writeFile(t, "printed.yaml", out.String())})
+	if err != nil {
+		t.Fatalf("Printed config expected to load, got %s", err)
+	}
+	loaded.Database.Password = cfg.Database.Password
+	if loaded != cfg {
+		t.Errorf("Printed config expected to load as %+v, got %+v", cfg, loaded)
+	}
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+type APIKeyControllerV1 struct {
+	Auth *Authenticator
+}
+
+// keyOwner reads the user id from the route and checks the principal may manage that user's keys: the user
+// themselves, or a privileged user acting as themselves
+// writes the error response and returns false otherwise
+func (c *APIKeyControllerV1) keyOwner(writer http.ResponseWriter, request *http.Request) (userID int, ok bool) {
+	vars := mux.Vars(request)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	if !c.Auth.selfOrPrivileged(writer, request, userID, "manage the user's API keys") {
+		return
+	}
+
+	return userID, true
+}
+
+// CreateAPIKey mints a key for the user. The key is only ever returned here. Minting requires the user's own
+// password, so neither a key nor an impersonation token can mint another
+func (c *APIKeyControllerV1) CreateAPIKey(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	vars := mux.Vars(request)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	principal := requestPrincipal(request)
+	if principal == nil {
+		errorResponse(writer, request, http.StatusUnauthorized, "Authentication required")
+		return
+	} else if principal.UserID != userID || !principal.PasswordAuthenticated() {
+		errorResponse(writer, request, http.StatusForbidden,
+			"API keys can only be minted by their user, authenticated with their password")
+		return
+	}
+
+	var key models.APIKeyModel
+	if err = decodeJSON(request, &key); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	key.OrgID = organizationID(request)
+	key.UserID = userID
+	if err = key.Create(request.Context(), c.Auth.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusCreated, key)
+	}
+}
+
+// GetAPIKeys lists the user's keys that have not been revoked. The keys themselves are never included
+func (c *APIKeyControllerV1) GetAPIKeys(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := c.keyOwner(writer, request)
+	if !ok {
+		return
+	}
+
+	keys, err := models.GetAPIKeys(request.Context(), c.Auth.Service.Dbh, organizationID(request), userID)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(keys) == 0 {
+			keys = make([]models.APIKeyModel, 0)
+		}
+		jsonResponse(writer, http.StatusOK, keys)
+	}
+}
+
+// RevokeAPIKey stops one of the user's keys from working
+func (c *APIKeyControllerV1) RevokeAPIKey(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := c.keyOwner(writer, request)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(request)
+	keyID, err := strconv.Atoi(vars["keyid"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid Key ID "+vars["keyid"])
+		return
+	}
+
+	err = models.RevokeAPIKey(request.Context(), c.Auth.Service.Dbh, organizationID(request), userID, keyID)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, models.Message{Message: fmt.Sprintf("API Key ID %d revoked", keyID)})
+	}
+}
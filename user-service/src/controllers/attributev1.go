@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+type AttributeControllerV1 struct {
+	Service *service.UserService
+}
+
+// CreateAttribute defines a custom attribute of the organization's users
+func (c *AttributeControllerV1) CreateAttribute(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	var attr models.AttributeModel
+	if err := decodeJSON(request, &attr); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	attr.OrgID = organizationID(request)
+	if err := attr.Create(request.Context(), c.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusCreated, attr)
+	}
+}
+
+// GetAllAttributes lists the attributes the organization has defined
+func (c *AttributeControllerV1) GetAllAttributes(writer http.ResponseWriter, request *http.Request) {
+	attrs, err := models.GetAttributes(request.Context(), c.Service.Dbh, organizationID(request))
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(attrs) == 0 {
+			attrs = make([]models.AttributeModel, 0)
+		}
+		jsonResponse(writer, http.StatusOK, attrs)
+	}
+}
+
+// UpdateAttribute updates the attribute by the specified ID
+func (c *AttributeControllerV1) UpdateAttribute(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	var attr models.AttributeModel
+	if err = decodeJSON(request, &attr); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	if id != attr.ID {
+		errorResponse(writer, request, http.StatusBadRequest, "changing ID is not permitted")
+		return
+	}
+
+	attr.OrgID = organizationID(request)
+	if err = attr.Update(request.Context(), c.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, attr)
+	}
+}
+
+// DeleteAttribute removes the specified attribute, along with its values
+func (c *AttributeControllerV1) DeleteAttribute(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	attr := models.AttributeModel{ID: id, OrgID: organizationID(request)}
+	if err = attr.Delete(request.Context(), c.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, models.Message{Message: fmt.Sprintf("Attribute ID %d deleted", id)})
+	}
+}
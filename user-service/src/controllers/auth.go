@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/metrics"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/token"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const principalKey contextKey = "principal"
+
+// Principal is the identity a request is authenticated as
+type Principal struct {
+	UserID   int
+	Username string
+	// ActorID is the staff member impersonating UserID, 0 when not impersonating
+	ActorID   int
+	SessionID string
+	// APIKey is the key the request authenticated with, nil when it didn't use one
+	APIKey *models.APIKeyModel
+	// Privileged is set once RequirePrivileged has found the user to be a member of the admin group
+	Privileged bool
+}
+
+// Impersonating reports whether a staff member is acting as the user
+func (p *Principal) Impersonating() bool {
+	return p.ActorID != 0
+}
+
+// PasswordAuthenticated reports whether the user proved who they are with their own password, rather than with a
+// key or an impersonation token
+func (p *Principal) PasswordAuthenticated() bool {
+	return p.ActorID == 0 && p.APIKey == nil
+}
+
+// errInvalidCredentials is returned when a request carries credentials that don't check out
+var errInvalidCredentials = apperror.Unauthorized("Invalid credentials")
+
+// Authenticator authenticates requests with Basic credentials or a bearer token
+type Authenticator struct {
+	Service *service.UserService
+}
+
+// bearerToken returns the bearer token of the request, "" if there isn't one
+func bearerToken(request *http.Request) string {
+	header := request.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// apiKey returns the API key the request carries, either as a bearer token or as the password of Basic
+// credentials, "" if there isn't one
+func apiKey(request *http.Request) string {
+	if value := bearerToken(request); models.IsAPIKey(value) {
+		return value
+	}
+	if _, password, ok := request.BasicAuth(); ok && models.IsAPIKey(password) {
+		return password
+	}
+	return ""
+}
+
+// tokenTenant returns the organization an impersonation token or API key belongs to, "" if there is no valid one.
+// API keys are only checked when they are authenticated
+func tokenTenant(request *http.Request, key []byte) string {
+	if claims, err := token.VerifyImpersonation(key, bearerToken(request)); err == nil {
+		return strconv.Itoa(claims.OrgID)
+	}
+	if orgID, err := models.APIKeyOrganization(apiKey(request)); err == nil {
+		return strconv.Itoa(orgID)
+	}
+	return ""
+}
+
+// authResult counts the authentication attempt by method and result, and passes the principal and error through
+func authResult(method, result string, principal *Principal, err error) (*Principal, error) {
+	metrics.Authentications.WithLabelValues(method, result).Inc()
+	return principal, err
+}
+
+// authenticateAPIKey checks the key and, for Basic credentials, that the username is its owner's
+func (a *Authenticator) authenticateAPIKey(request *http.Request, value string) (*Principal, error) {
+	key, owner, err := models.AuthenticateAPIKey(request.Context(), a.Service.Dbh, value)
+	if err == models.ErrInvalidAPIKey {
+		return authResult("apikey", "invalid_key", nil, errInvalidCredentials)
+	} else if err != nil {
+		return authResult("apikey", "error", nil, err)
+	} else if key.OrgID != organizationID(request) {
+		return authResult("apikey", "wrong_organization", nil, errInvalidCredentials)
+	}
+
+	if username, _, ok := request.BasicAuth(); ok && !models.SameUsername(username, owner) {
+		return authResult("apikey", "wrong_owner", nil, errInvalidCredentials)
+	}
+
+	return authResult("apikey", "success", &Principal{UserID: key.UserID, Username: owner, APIKey: &key}, nil)
+}
+
+// authenticate determines the principal of the request. Returns nil without an error for anonymous requests
+func (a *Authenticator) authenticate(request *http.Request) (*Principal, error) {
+	if request.Header.Get("Authorization") == "" {
+		return nil, nil
+	}
+
+	if value := apiKey(request); value != "" {
+		return a.authenticateAPIKey(request, value)
+	}
+
+	if username, password, ok := request.BasicAuth(); ok {
+		if password == "" {
+			return authResult("basic", "empty_password", nil, errInvalidCredentials)
+		}
+		userID, hashedPassword, err := models.GetUserCredentials(request.Context(), a.Service.Dbh, organizationID(request), username)
+		if err == sql.ErrNoRows {
+			return authResult("basic", "unknown_user", nil, errInvalidCredentials)
+		} else if database.ContextEnded(err) {
+			return authResult("basic", "error", nil, err)
+		} else if err != nil {
+			return authResult("basic", "error", nil, errInvalidCredentials)
+		} else if !models.CheckPassword(request.Context(), hashedPassword, password) {
+			return authResult("basic", "wrong_password", nil, errInvalidCredentials)
+		}
+		return authResult("basic", "success", &Principal{UserID: userID, Username: username}, nil)
+	}
+
+	if value := bearerToken(request); token.IsImpersonation(value) {
+		claims, err := token.VerifyImpersonation(a.Service.TokenKey, value)
+		if err != nil {
+			return authResult("impersonation", "invalid_token", nil, errInvalidCredentials)
+		} else if claims.OrgID != organizationID(request) {
+			return authResult("impersonation", "wrong_organization", nil, errInvalidCredentials)
+		}
+		// The token may have been stopped before it expired
+		err = models.CheckImpersonationSession(request.Context(), a.Service.Dbh, claims.OrgID, claims.SessionID)
+		if err == models.ErrImpersonationEnded {
+			return authResult("impersonation", "session_ended", nil, errInvalidCredentials)
+		} else if err != nil {
+			return authResult("impersonation", "error", nil, err)
+		}
+		return authResult("impersonation", "success",
+			&Principal{UserID: claims.Subject, ActorID: claims.Actor, SessionID: claims.SessionID}, nil)
+	}
+
+	return authResult("unknown", "unsupported_scheme", nil, errInvalidCredentials)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// requiredScope is the API key scope needed for the request: <resource>:read to GET under /api/v1/<resource>,
+// <resource>:write for anything else
+func requiredScope(request *http.Request) string {
+	resource := strings.TrimPrefix(request.URL.Path, "/api/v1/")
+	if i := strings.Index(resource, "/"); i >= 0 {
+		resource = resource[:i]
+	}
+
+	if request.Method == http.MethodGet || request.Method == http.MethodHead {
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
+
+// Middleware attaches the authenticated principal to the request. Requests without credentials continue
+// anonymously, requests with bad credentials are rejected, as are API keys without the scope for the request.
+// Every request made while impersonating is recorded in the audit trail
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		principal, err := a.authenticate(request)
+		if err != nil {
+			errResponse(writer, request, err)
+			return
+		} else if principal == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		if principal.APIKey != nil {
+			if scope := requiredScope(request); !principal.APIKey.HasScope(scope) {
+				errorResponse(writer, request, http.StatusForbidden, "API key does not have the "+scope+" scope")
+				return
+			}
+		}
+
+		request = request.WithContext(context.WithValue(request.Context(), principalKey, principal))
+		if !principal.Impersonating() {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(recorder, request)
+
+		event := models.AuditEventModel{OrgID: organizationID(request), Action: models.AUDIT_IMPERSONATION_REQUEST,
+			ActorID: principal.ActorID, SubjectID: principal.UserID, Detail: map[string]string{
+				"session": principal.SessionID, "method": request.Method, "path": request.URL.Path,
+				"status": strconv.Itoa(recorder.status)}}
+		if err = event.Record(database.Detach(request.Context()), a.Service.Dbh); err != nil {
+			logging.FromContext(request.Context(), a.Service.Logger).Error("Unable to record impersonated request",
+				logging.Fields{"method": request.Method, "path": request.URL.Path, "error": err})
+		}
+	})
+}
+
+// requestPrincipal returns the principal the request is authenticated as, nil if it is anonymous
+func requestPrincipal(request *http.Request) *Principal {
+	principal, _ := request.Context().Value(principalKey).(*Principal)
+	return principal
+}
+
+// requestPrivileged reports whether the request passed RequirePrivileged
+func requestPrivileged(request *http.Request) bool {
+	principal := requestPrincipal(request)
+	return principal != nil && principal.Privileged
+}
+
+// RequireAuthenticated only lets through requests authenticated as a user. The credentials of a request are only
+// accepted in the organization they belong to, so this binds the organization a request acts on to its credentials,
+// rather than to whichever organization it names
+func (a *Authenticator) RequireAuthenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if requestPrincipal(request) == nil {
+			errorResponse(writer, request, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// isPrivileged reports whether the user is a member of the admin group
+func (a *Authenticator) isPrivileged(ctx context.Context, orgID, userID int) (bool, error) {
+	return models.UserInGroup(ctx, a.Service.Dbh, orgID, userID, a.Service.Config.Auth.AdminGroup)
+}
+
+// platformOperator reports whether the request passed RequirePrivileged in the platform organization, whose
+// privileged users manage every organization rather than only their own
+func (a *Authenticator) platformOperator(request *http.Request) bool {
+	platform := a.Service.Config.Auth.PlatformOrganization
+	return platform != "" && requestPrivileged(request) && organization(request).Slug == platform
+}
+
+// selfOrPrivileged checks the principal may act on the user userID: the user themselves, or a privileged user
+// authenticated with their own password. action describes what is refused, e.g. "manage the user's API keys"
+// writes the error response and returns false otherwise
+func (a *Authenticator) selfOrPrivileged(writer http.ResponseWriter, request *http.Request, userID int,
+	action string) bool {
+	principal := requestPrincipal(request)
+	if principal == nil {
+		errorResponse(writer, request, http.StatusUnauthorized, "Authentication required")
+		return false
+	} else if principal.UserID == userID || principal.Privileged {
+		return true
+	}
+
+	if principal.PasswordAuthenticated() {
+		privileged, err := a.isPrivileged(request.Context(), organizationID(request), principal.UserID)
+		if err != nil {
+			errResponse(writer, request, err)
+			return false
+		}
+		principal.Privileged = privileged
+	}
+	if !principal.Privileged {
+		errorResponse(writer, request, http.StatusForbidden, "Only the user or an admin can "+action)
+		return false
+	}
+
+	return true
+}
+
+// RequirePrivileged only lets through members of the admin group authenticated with their own password
+func (a *Authenticator) RequirePrivileged(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		principal := requestPrincipal(request)
+		if principal == nil {
+			errorResponse(writer, request, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if !principal.PasswordAuthenticated() {
+			errorResponse(writer, request, http.StatusForbidden, "Not permitted with an API key or while impersonating")
+			return
+		}
+
+		privileged, err := a.isPrivileged(request.Context(), organizationID(request), principal.UserID)
+		if err != nil {
+			errResponse(writer, request, err)
+		} else if !privileged {
+			errorResponse(writer, request, http.StatusForbidden,
+				"Requires membership of the "+a.Service.Config.Auth.AdminGroup+" group")
+		} else {
+			principal.Privileged = true
+			next(writer, request)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/avatar"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/blob"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+type AvatarControllerV1 struct {
+	Service *service.UserService
+	Auth    *Authenticator
+}
+
+// AVATAR_FIELD is the name of the part of the multipart form holding the image
+const AVATAR_FIELD string = "avatar"
+
+// MULTIPART_OVERHEAD is allowed on top of avatar.max_bytes for the boundaries and headers of the form
+const MULTIPART_OVERHEAD int64 = 64 << 10
+
+// avatarUser reads the user id from the route and checks the principal may change that user's avatar, the user
+// themselves or a privileged user acting as themselves, and that the user exists
+// writes the error response and returns false otherwise
+func (c *AvatarControllerV1) avatarUser(writer http.ResponseWriter, request *http.Request) (userID int, ok bool) {
+	vars := mux.Vars(request)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+	if !c.Auth.selfOrPrivileged(writer, request, userID, "change the user's avatar") {
+		return
+	}
+
+	users, err := models.GetUsers(request.Context(), c.Service.Dbh, organizationID(request), "id", vars["id"], 1, 0)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	} else if len(users) == 0 {
+		errResponse(writer, request, apperror.NotFound("No User with ID %d found", userID))
+		return
+	}
+
+	return userID, true
+}
+
+// readAvatar reads the image from the avatar part of the multipart form, no larger than avatar.max_bytes
+// writes the error response and returns false if it can't
+func (c *AvatarControllerV1) readAvatar(writer http.ResponseWriter, request *http.Request) (data []byte, ok bool) {
+	maxBytes := int64(c.Service.Config.Avatar.MaxBytes)
+	tooLarge := func() {
+		errorResponse(writer, request, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Avatar must be at most %d bytes", maxBytes))
+	}
+
+	request.Body = http.MaxBytesReader(writer, request.Body, maxBytes+MULTIPART_OVERHEAD)
+	reader, err := request.MultipartReader()
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Unable to read the multipart form: "+err.Error())
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			errResponse(writer, request, apperror.Invalid(AVATAR_FIELD, "Avatar is not specified!"))
+			return nil, false
+		} else if err != nil {
+			// The form is larger than its image could be
+			if err.Error() == "http: request body too large" {
+				tooLarge()
+			} else {
+				errorResponse(writer, request, http.StatusBadRequest, "Unable to read the multipart form: "+err.Error())
+			}
+			return nil, false
+		}
+		if part.FormName() != AVATAR_FIELD {
+			continue
+		}
+
+		data, err = ioutil.ReadAll(io.LimitReader(part, maxBytes+1))
+		if err != nil && err.Error() == "http: request body too large" || int64(len(data)) > maxBytes {
+			tooLarge()
+			return nil, false
+		} else if err != nil {
+			errorResponse(writer, request, http.StatusBadRequest, "Unable to read the multipart form: "+err.Error())
+			return nil, false
+		}
+
+		return data, true
+	}
+}
+
+// UploadAvatar replaces the avatar of the user with the image uploaded as the avatar part of a multipart form
+func (c *AvatarControllerV1) UploadAvatar(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "AvatarControllerV1.UploadAvatar")
+	defer span.End()
+
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		errorResponse(writer, request, http.StatusUnsupportedMediaType, fmt.Sprintf(
+			"Illegal Request Content-Type. Only accepts multipart/form-data. Received: %s",
+			request.Header.Get("Content-Type")))
+		return
+	}
+
+	userID, ok := c.avatarUser(writer, request)
+	if !ok {
+		return
+	}
+	data, ok := c.readAvatar(writer, request)
+	if !ok {
+		return
+	}
+
+	sizes, _ := c.Service.Config.Avatar.SizeList()
+	thumbnails, err := avatar.Process(data, sizes)
+	switch err {
+	case nil:
+	case avatar.ErrUnsupportedType:
+		errorResponse(writer, request, http.StatusUnsupportedMediaType, "Avatar must be a JPEG, PNG or GIF image")
+		return
+	case avatar.ErrTooManyPixels:
+		errorResponse(writer, request, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Avatar must have at most %d pixels", avatar.MAX_PIXELS))
+		return
+	case avatar.ErrInvalidImage:
+		errResponse(writer, request, apperror.Invalid(AVATAR_FIELD, "Avatar is not a valid image").Wrap(err))
+		return
+	default:
+		errResponse(writer, request, err)
+		return
+	}
+
+	err = avatar.Save(request.Context(), c.Service.Blobs, organizationID(request), userID, thumbnails)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, models.Message{Message: fmt.Sprintf("Avatar of User ID %d saved", userID)})
+	}
+}
+
+// GetAvatar serves the avatar of the user, at the size asked for by ?size= or the largest. Responses carry an ETag
+// and Last-Modified, so clients can revalidate for a 304 once avatar.max_age has passed
+func (c *AvatarControllerV1) GetAvatar(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "AvatarControllerV1.GetAvatar")
+	defer span.End()
+
+	vars := mux.Vars(request)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	sizes, _ := c.Service.Config.Avatar.SizeList()
+	size := avatar.Largest(sizes)
+	if sizeVal := request.URL.Query().Get("size"); sizeVal != "" {
+		size, err = strconv.Atoi(sizeVal)
+		found := false
+		for _, s := range sizes {
+			found = found || s == size
+		}
+		if err != nil || !found {
+			errorResponse(writer, request, http.StatusBadRequest,
+				fmt.Sprintf("query \"size\" must be one of %s: received %s", c.Service.Config.Avatar.Sizes, sizeVal))
+			return
+		}
+	}
+
+	object, err := avatar.Open(request.Context(), c.Service.Blobs, organizationID(request), userID, size)
+	if err == blob.ErrNotFound {
+		errResponse(writer, request, apperror.NotFound("User ID %d has no avatar", userID).Wrap(err))
+		return
+	} else if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", object.ContentType)
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d",
+		int(c.Service.Config.Avatar.MaxAge.Seconds())))
+	if object.ETag != "" {
+		writer.Header().Set("ETag", object.ETag)
+	}
+	// Answers If-None-Match and If-Modified-Since with 304, and Range requests
+	http.ServeContent(writer, request, "", object.ModTime, bytes.NewReader(object.Data))
+}
+
+// DeleteAvatar removes the avatar of the user
+func (c *AvatarControllerV1) DeleteAvatar(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "AvatarControllerV1.DeleteAvatar")
+	defer span.End()
+
+	userID, ok := c.avatarUser(writer, request)
+	if !ok {
+		return
+	}
+
+	sizes, _ := c.Service.Config.Avatar.SizeList()
+	if err := avatar.Delete(request.Context(), c.Service.Blobs, organizationID(request), userID, sizes); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, models.Message{Message: fmt.Sprintf("Avatar of User ID %d deleted", userID)})
+	}
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/avatar"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/blob"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestGetAvatar Checks avatars are served with validators clients can revalidate with, at the sizes configured
+func TestGetAvatar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := blob.LocalStore{Dir: dir}
+	c := AvatarControllerV1{Service: &service.UserService{Config: config.Default(), Blobs: store}}
+	org := models.OrganizationModel{ID: 3}
+	if err = store.Put(context.Background(), avatar.Key(3, 7, 512), []byte("large"), avatar.CONTENT_TYPE); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Put(context.Background(), avatar.Key(3, 7, 64), []byte("small"), avatar.CONTENT_TYPE)
+
+	get := func(url, id, etag string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+		request = mux.SetURLVars(request.WithContext(context.WithValue(request.Context(), organizationKey, org)),
+			map[string]string{"id": id})
+		if etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		recorder := httptest.NewRecorder()
+		c.GetAvatar(recorder, request)
+		return recorder
+	}
+
+	recorder := get("/api/v1/user/7/avatar", "7", "")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "large" {
+		t.Fatalf("Avatar expected to be served at the largest size, got %d: %s", recorder.Code, recorder.Body)
+	}
+	etag := recorder.Header().Get("ETag")
+	if etag == "" || recorder.Header().Get("Cache-Control") != "private, max-age=3600" ||
+		recorder.Header().Get("Content-Type") != "image/jpeg" || recorder.Header().Get("Last-Modified") == "" {
+		t.Errorf("Avatar expected to be served with caching headers, got %v", recorder.Header())
+	}
+
+	if recorder = get("/api/v1/user/7/avatar", "7", etag); recorder.Code != http.StatusNotModified {
+		t.Errorf("Avatar with a matching ETag expected to return 304, got %d", recorder.Code)
+	}
+	if recorder = get("/api/v1/user/7/avatar?size=64", "7", etag); recorder.Code != http.StatusOK ||
+		recorder.Body.String() != "small" {
+		t.Errorf("Avatar expected to be served at size 64, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if recorder = get("/api/v1/user/7/avatar?size=100", "7", ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Avatar at a size not configured expected to return 400, got %d", recorder.Code)
+	}
+	if recorder = get("/api/v1/user/8/avatar", "8", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Avatar of a user without one expected to return 404, got %d", recorder.Code)
+	}
+
+	org.ID = 4
+	if recorder = get("/api/v1/user/7/avatar", "7", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Avatar of a user of another organization expected to return 404, got %d", recorder.Code)
+	}
+}
+
+// TestAvatarOwner Checks only the user or an admin can change or delete the user's avatar, before the database or
+// the blob store is reached
+func TestAvatarOwner(t *testing.T) {
+	svc := &service.UserService{Config: config.Default()}
+	c := AvatarControllerV1{Service: svc, Auth: &Authenticator{Service: svc}}
+	key := &models.APIKeyModel{ID: 1}
+
+	for _, test := range []struct {
+		principal *Principal
+		expected  int
+	}{
+		{nil, http.StatusUnauthorized},
+		{&Principal{UserID: 2, APIKey: key}, http.StatusForbidden},
+		{&Principal{UserID: 2, ActorID: 3}, http.StatusForbidden},
+	} {
+		for _, handler := range []http.HandlerFunc{c.DeleteAvatar, c.UploadAvatar} {
+			request := httptest.NewRequest(http.MethodDelete, "/api/v1/user/7/avatar", nil)
+			request.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+			if test.principal != nil {
+				request = request.WithContext(context.WithValue(request.Context(), principalKey, test.principal))
+			}
+			recorder := httptest.NewRecorder()
+			handler(recorder, mux.SetURLVars(request, map[string]string{"id": "7"}))
+			if recorder.Code != test.expected {
+				t.Errorf("Avatar of another user changed by %+v expected to return %d, got %d", test.principal,
+					test.expected, recorder.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/avatar"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type BatchControllerV1 struct {
+	Service *service.UserService
+}
+
+// The modes a batch is run in
+const (
+	// BATCH_ATOMIC applies every operation or, if any fails, none of them
+	BATCH_ATOMIC string = "atomic"
+	// BATCH_BEST_EFFORT applies every operation that succeeds, whether or not the others do
+	BATCH_BEST_EFFORT string = "besteffort"
+)
+
+// batchRequest is the body of a batch
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchOperation is an operation of a batch as it is sent, its user decoded separately so a user that can't be
+// decoded fails that operation alone
+type batchOperation struct {
+	Op   string          `json:"op"`
+	ID   int             `json:"id"`
+	User json.RawMessage `json:"user"`
+}
+
+// BatchResult is what happened to an operation of a batch
+type BatchResult struct {
+	// Index is the position of the operation in the batch, from 0
+	Index int    `json:"index"`
+	Op    string `json:"op"`
+	// Status is the status the operation would have been answered with on its own, or 424 if it was skipped
+	Status int               `json:"status"`
+	ID     int               `json:"id,omitempty"`
+	User   *models.UserModel `json:"user,omitempty"`
+	// Error is why the operation failed, or wasn't applied
+	Error string `json:"error,omitempty"`
+	// Field is the field whose uniqueness a failed operation violated
+	Field  string                `json:"field,omitempty"`
+	Errors []apperror.FieldError `json:"errors,omitempty"`
+}
+
+// BatchReport is the outcome of a batch, with the result of every operation in the order they were given
+type BatchReport struct {
+	Mode      string        `json:"mode"`
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Skipped   int           `json:"skipped"`
+	Results   []BatchResult `json:"results"`
+}
+
+// operation decodes the user of an operation, and for a patch the fields given, as PatchUser does
+// returns the operation, with the error decoding it if it couldn't be
+func (o batchOperation) operation() models.BatchOperation {
+	op := models.BatchOperation{Op: o.Op, ID: o.ID}
+	if len(o.User) == 0 || o.Op == models.BATCH_DELETE {
+		return op
+	}
+
+	var given map[string]json.RawMessage
+	if op.Err = unmarshalJSON(o.User, &op.User); op.Err == nil {
+		op.Err = unmarshalJSON(o.User, &given)
+	}
+	for key := range given {
+		// Field names are matched without regard to case, as when decoding the user
+		if field := strings.ToLower(key); field != "id" {
+			op.Fields = append(op.Fields, field)
+		}
+	}
+	sort.Strings(op.Fields)
+	return op
+}
+
+// parseBatch reads the body of a batch, at most batch.max_bytes with at most batch.max_operations operations
+// writes an error response and returns false if it can't be read
+func (c *BatchControllerV1) parseBatch(writer http.ResponseWriter, request *http.Request) (batch batchRequest,
+	ok bool) {
+	maxBytes := int64(c.Service.Config.Batch.MaxBytes)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxBytes))
+	if err != nil && err.Error() == "http: request body too large" {
+		errorResponse(writer, request, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Batches must be at most %d bytes", maxBytes))
+		return batch, false
+	} else if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Unable to read the request body: "+err.Error())
+		return batch, false
+	}
+
+	if err = unmarshalJSON(body, &batch); err != nil {
+		errResponse(writer, request, err)
+		return batch, false
+	}
+	if batch.Mode == "" {
+		batch.Mode = BATCH_ATOMIC
+	} else if batch.Mode != BATCH_ATOMIC && batch.Mode != BATCH_BEST_EFFORT {
+		errResponse(writer, request, apperror.Invalid("mode", "Invalid mode %q: must be %s or %s", batch.Mode,
+			BATCH_ATOMIC, BATCH_BEST_EFFORT))
+		return batch, false
+	}
+	if len(batch.Operations) == 0 {
+		errResponse(writer, request, apperror.Invalid("operations", "A batch must have at least one operation"))
+		return batch, false
+	}
+	maxOps := c.Service.Config.Batch.MaxOperations
+	if len(batch.Operations) > maxOps {
+		errorResponse(writer, request, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Batches must have at most %d operations, received %d", maxOps, len(batch.Operations)))
+		return batch, false
+	}
+
+	return batch, true
+}
+
+// BatchUsers creates, updates, patches and deletes many users in one request, answering with the result of every
+// operation. An atomic batch, the default, applies every operation or none of them, and is answered with the status
+// of the operation that failed if one did. A best effort batch applies every operation that succeeds, and is
+// answered with 207 if any failed
+func (c *BatchControllerV1) BatchUsers(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "BatchControllerV1.BatchUsers")
+	defer span.End()
+
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+	phoneFormat, ok := parsePhoneFormat(writer, request)
+	if !ok {
+		return
+	}
+	batch, ok := c.parseBatch(writer, request)
+	if !ok {
+		return
+	}
+
+	ops := make([]models.BatchOperation, len(batch.Operations))
+	for i, op := range batch.Operations {
+		ops[i] = op.operation()
+	}
+	orgID := organizationID(request)
+	results, err := models.RunBatch(request.Context(), c.Service.Dbh, orgID, ops, batch.Mode == BATCH_ATOMIC)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	logger := logging.FromContext(request.Context(), c.Service.Logger)
+	sizes, _ := c.Service.Config.Avatar.SizeList()
+	report := BatchReport{Mode: batch.Mode, Total: len(results), Results: make([]BatchResult, len(results))}
+	status := http.StatusOK
+	for i, result := range results {
+		res := BatchResult{Index: i, Op: result.Op, ID: result.ID, User: result.User}
+		switch {
+		case result.Skipped:
+			res.Status, res.Error = http.StatusFailedDependency, "Not applied, as another operation failed"
+			report.Skipped++
+		case result.Err != nil:
+			appErr := apperror.From(result.Err)
+			if appErr.Kind == apperror.KIND_INTERNAL {
+				logger.Error("Batch operation failed", logging.Fields{"index": i, "op": result.Op,
+					"error": result.Err})
+			}
+			res.Status, res.Error, res.Field, res.Errors = kindStatus[appErr.Kind], appErr.Message, appErr.Field,
+				appErr.Fields
+			if status == http.StatusOK {
+				status = res.Status
+			}
+			report.Failed++
+		case result.Op == models.BATCH_CREATE:
+			res.Status = http.StatusCreated
+			report.Succeeded++
+		default:
+			res.Status = http.StatusOK
+			report.Succeeded++
+		}
+
+		if res.User != nil {
+			//blank the password so we don't return it
+			res.User.Password = ""
+			res.User.FormatTelephone(phoneFormat)
+		}
+		// The user is gone either way, so an avatar left behind is only logged
+		if result.Op == models.BATCH_DELETE && result.Err == nil && !result.Skipped {
+			if err = avatar.Delete(request.Context(), c.Service.Blobs, orgID, result.ID, sizes); err != nil {
+				logger.Error("Unable to delete the avatar of a deleted user", logging.Fields{"userid": result.ID,
+					"error": err})
+			}
+		}
+		report.Results[i] = res
+	}
+
+	if report.Failed > 0 && batch.Mode == BATCH_BEST_EFFORT {
+		status = http.StatusMultiStatus
+	}
+	jsonResponse(writer, status, report)
+}
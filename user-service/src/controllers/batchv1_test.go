@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestBatchUsersRejected Checks batches that can't be run are rejected before the database is touched
+func TestBatchUsersRejected(t *testing.T) {
+	cfg := config.Default()
+	cfg.Batch.MaxOperations, cfg.Batch.MaxBytes = 2, 200
+	c := BatchControllerV1{Service: &service.UserService{Config: cfg}}
+
+	del := `{"op": "delete", "id": 1}`
+	cases := []struct {
+		url, contentType, body string
+		status                 int
+	}{
+		{"/api/v1/user/batch", "text/csv", `{"operations": [` + del + `]}`, http.StatusUnsupportedMediaType},
+		{"/api/v1/user/batch?phoneformat=dotted", "application/json", `{"operations": [` + del + `]}`,
+			http.StatusBadRequest},
+		{"/api/v1/user/batch", "application/json", `{"operations": [` + del, http.StatusBadRequest},
+		{"/api/v1/user/batch", "application/json", `{"mode": "eventual", "operations": [` + del + `]}`,
+			http.StatusBadRequest},
+		{"/api/v1/user/batch", "application/json", `{"operations": []}`, http.StatusBadRequest},
+		{"/api/v1/user/batch", "application/json", `{"operations": [` + del + `,` + del + `,` + del + `]}`,
+			http.StatusRequestEntityTooLarge},
+		{"/api/v1/user/batch", "application/json", `{"operations": [` + strings.Repeat(" ", 200) + del + `]}`,
+			http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		request := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body))
+		request.Header.Set("Content-Type", tc.contentType)
+		recorder := httptest.NewRecorder()
+		c.BatchUsers(recorder, request)
+		if recorder.Code != tc.status {
+			t.Errorf("Batch %s expected to return %d, got %d: %s", tc.body, tc.status, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+// TestBatchUsersResults Checks operations that can't be run are reported with their status, and that an atomic
+// batch reports the rest as skipped
+func TestBatchUsersResults(t *testing.T) {
+	c := BatchControllerV1{Service: &service.UserService{Config: config.Default()}}
+
+	cases := []struct {
+		mode     string
+		status   int
+		statuses []int
+	}{
+		{BATCH_ATOMIC, http.StatusBadRequest, []int{http.StatusFailedDependency, http.StatusBadRequest,
+			http.StatusBadRequest}},
+		{BATCH_BEST_EFFORT, http.StatusMultiStatus, []int{http.StatusBadRequest, http.StatusBadRequest}},
+	}
+	for _, tc := range cases {
+		// A best effort batch would run the delete, so it is left out
+		body := `{"mode": "` + tc.mode + `", "operations": [`
+		if tc.mode == BATCH_ATOMIC {
+			body += `{"op": "delete", "id": 1}, `
+		}
+		body += `{"op": "delete"}, {"op": "patch", "id": 2, "user": {"firstname": 5}}]}`
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/user/batch", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		c.BatchUsers(recorder, request)
+		if recorder.Code != tc.status {
+			t.Errorf("Batch %s expected to return %d, got %d: %s", body, tc.status, recorder.Code, recorder.Body)
+			continue
+		}
+
+		var report BatchReport
+		if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Report expected to decode, failed: %s", err)
+		}
+		if len(report.Results) != len(tc.statuses) {
+			t.Fatalf("Batch %s expected %d results, got %d", body, len(tc.statuses), len(report.Results))
+		}
+		for i, status := range tc.statuses {
+			if report.Results[i].Status != status {
+				t.Errorf("Operation %d of %s expected status %d, got %+v", i, body, status, report.Results[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/validation"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// PROBLEM_CONTENT_TYPE is the media type of RFC 7807 problem responses
+const PROBLEM_CONTENT_TYPE string = "application/problem+json"
+
+// PROBLEM_TYPE_PREFIX is prefixed to the kind of an error, e.g. not-found, to make the type of its problem response.
+// Errors without a kind have the type about:blank, and are described by their status alone
+const PROBLEM_TYPE_PREFIX string = "urn:user-service:problem:"
+
+// LEGACY_ERROR_PREFIX is the path under which errors are answered as {"error": ...} unless the caller accepts
+// problem responses
+const LEGACY_ERROR_PREFIX string = "/api/v1/"
+
+// kindStatus is the status each kind of error is answered with
+var kindStatus = map[apperror.Kind]int{
+	apperror.KIND_INTERNAL:     http.StatusInternalServerError,
+	apperror.KIND_NOT_FOUND:    http.StatusNotFound,
+	apperror.KIND_CONFLICT:     http.StatusConflict,
+	apperror.KIND_VALIDATION:   http.StatusBadRequest,
+	apperror.KIND_UNAUTHORIZED: http.StatusUnauthorized,
+	apperror.KIND_FORBIDDEN:    http.StatusForbidden,
+	apperror.KIND_GONE:         http.StatusGone,
+}
+
+// acceptsProblem reports whether the Accept header of the request names application/problem+json
+func acceptsProblem(request *http.Request) bool {
+	for _, accept := range strings.Split(request.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == PROBLEM_CONTENT_TYPE {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsProblem reports whether errors are answered with a problem response rather than the legacy {"error": ...}
+func wantsProblem(request *http.Request) bool {
+	return !strings.HasPrefix(request.URL.Path, LEGACY_ERROR_PREFIX) || acceptsProblem(request)
+}
+
+// writeError answers the request with the error, as a problem response or in the legacy shape. problemType is
+// the type of the problem, about:blank if empty
+func writeError(writer http.ResponseWriter, request *http.Request, status int, problemType string,
+	appErr *apperror.Error) {
+	requestID := writer.Header().Get(logging.REQUEST_ID_HEADER)
+	if len(appErr.Fields) > 0 {
+		// Describe the fields in the caller's language, without touching appErr, which may be shared
+		localized := *appErr
+		localized.Fields = validation.Localize(validation.Negotiate(request.Header.Get("Accept-Language")),
+			appErr.Fields)
+		appErr = &localized
+	}
+	if !wantsProblem(request) {
+		jsonResponse(writer, status, models.ErrorMessage{Message: appErr.Error(), RequestID: requestID,
+			Errors: appErr.Fields})
+		return
+	}
+
+	if problemType == "" {
+		problemType = "about:blank"
+	}
+	writer.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+	jsonResponse(writer, status, models.Problem{Type: problemType, Title: http.StatusText(status), Status: status,
+		Detail: appErr.Message, Instance: request.URL.Path, RequestID: requestID, Field: appErr.Field,
+		Errors: appErr.Fields})
+}
+
+// errorResponse Handles returning an error message with the status, along with the id of the request so it can be
+// found in the logs
+func errorResponse(writer http.ResponseWriter, request *http.Request, status int, message string) {
+	writeError(writer, request, status, "", &apperror.Error{Message: message})
+}
+
+// errResponse Handles returning err with the status of its kind. Internal errors are logged and only reported to
+// the caller as such, so database and other errors don't leak. A request whose context ended is reported instead
+// as timed out, 504, or as canceled, 503, whatever the error was
+func errResponse(writer http.ResponseWriter, request *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		errorResponse(writer, request, http.StatusGatewayTimeout, "Request timed out")
+		return
+	} else if errors.Is(err, context.Canceled) {
+		errorResponse(writer, request, http.StatusServiceUnavailable, "Request canceled")
+		return
+	}
+
+	appErr := apperror.From(err)
+	if appErr.Kind == apperror.KIND_INTERNAL {
+		logging.FromContext(request.Context(), nil).Error("Request failed", logging.Fields{
+			"method": request.Method, "path": request.URL.Path, "error": err})
+	}
+	writeError(writer, request, kindStatus[appErr.Kind], PROBLEM_TYPE_PREFIX+appErr.Kind.String(), appErr)
+}
+
+// decodeJSON decodes the body of the request into v
+// returns a validation error describing what is wrong with the body if it can't be decoded
+func decodeJSON(request *http.Request, v interface{}) error {
+	return decodeError(json.NewDecoder(request.Body).Decode(v))
+}
+
+// unmarshalJSON decodes data, a request body already read, into v
+// returns a validation error describing what is wrong with the body if it can't be decoded
+func unmarshalJSON(data []byte, v interface{}) error {
+	return decodeError(json.Unmarshal(data, v))
+}
+
+// decodeError returns a validation error describing why a request body couldn't be decoded, nil if err is nil
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return apperror.Invalid(typeErr.Field, "Invalid %s: expected a %s, received a %s", typeErr.Field,
+			typeErr.Type, typeErr.Value).Wrap(err)
+	case errors.As(err, &syntaxErr):
+		return apperror.Validation("Malformed JSON: " + err.Error()).Wrap(err)
+	default:
+		return apperror.Validation("Unable to decode the request body: " + err.Error()).Wrap(err)
+	}
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/validation"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// respond answers a request for the path with err, returning the recorder
+func respond(path, accept string, err error) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("X-Request-ID", "request-1")
+	request := httptest.NewRequest(http.MethodPost, path, nil)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	errResponse(recorder, request, err)
+	return recorder
+}
+
+// TestErrResponseStatus Checks each kind of error is answered with its status
+func TestErrResponseStatus(t *testing.T) {
+	for expected, err := range map[int]error{
+		http.StatusNotFound:            apperror.NotFound("No User with ID %d found", 7),
+		http.StatusConflict:            apperror.Conflict("email", "Request violates uniqueness of email"),
+		http.StatusBadRequest:          apperror.Invalid("id", "ID must be null"),
+		http.StatusUnauthorized:        apperror.Unauthorized("Invalid credentials"),
+		http.StatusForbidden:           apperror.Forbidden("Requires membership of the admins group"),
+		http.StatusGone:                apperror.Gone("invitation has expired"),
+		http.StatusInternalServerError: errors.New("pq: connection refused"),
+	} {
+		if recorder := respond("/api/v1/user", "", err); recorder.Code != expected {
+			t.Errorf("Error |%s| expected to return %d, got %d", err, expected, recorder.Code)
+		}
+	}
+}
+
+// TestLegacyErrorResponse Checks errors under /api/v1 keep the {"error": ...} shape, with the fields that failed
+// validation alongside, and internal errors don't leak their cause
+func TestLegacyErrorResponse(t *testing.T) {
+	recorder := respond("/api/v1/user", "", apperror.Validation("UserModel failed validation",
+		apperror.FieldError{Field: "email", Message: "Email is invalid"}))
+	var response models.ErrorMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Caught error while decoding the response: %s", err)
+	}
+	if response.Message != "UserModel failed validation:\n\t- Email is invalid" || response.RequestID != "request-1" ||
+		len(response.Errors) != 1 || response.Errors[0].Field != "email" {
+		t.Errorf("Legacy error response expected to carry the message, request id and fields, got %+v", response)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Legacy error response expected to be application/json, got %s", contentType)
+	}
+
+	recorder = respond("/api/v1/user", "", errors.New("pq: password authentication failed"))
+	if strings.Contains(recorder.Body.String(), "pq:") {
+		t.Errorf("Internal error expected to be hidden from the caller, got %s", recorder.Body)
+	}
+}
+
+// TestProblemResponse Checks errors are answered as problem details outside /api/v1, or when the caller accepts them
+func TestProblemResponse(t *testing.T) {
+	err := apperror.Conflict("email", "Request violates uniqueness of email")
+	for _, recorder := range []*httptest.ResponseRecorder{respond("/organization", "", err),
+		respond("/api/v1/user", "application/json, application/problem+json;q=0.9", err)} {
+		if contentType := recorder.Header().Get("Content-Type"); contentType != PROBLEM_CONTENT_TYPE {
+			t.Errorf("Problem response expected to be %s, got %s", PROBLEM_CONTENT_TYPE, contentType)
+		}
+
+		var problem models.Problem
+		if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+			t.Fatalf("Caught error while decoding the response: %s", err)
+		}
+		if problem.Type != "urn:user-service:problem:conflict" || problem.Title != "Conflict" ||
+			problem.Status != http.StatusConflict || problem.Detail != err.Message || problem.Field != "email" ||
+			problem.RequestID != "request-1" || problem.Instance == "" {
+			t.Errorf("Problem response expected to describe the conflict, got %+v", problem)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	errorResponse(recorder, httptest.NewRequest(http.MethodGet, "/organization/x", nil), http.StatusBadRequest,
+		"Invalid ID x")
+	var problem models.Problem
+	if err := json.Unmarshal(recorder.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("Caught error while decoding the response: %s", err)
+	}
+	if problem.Type != "about:blank" || problem.Detail != "Invalid ID x" {
+		t.Errorf("Problem without a kind expected to have type about:blank, got %+v", problem)
+	}
+}
+
+// TestDecodeJSON Checks a body with a value of the wrong type is reported against its field, and a malformed body
+// as a validation error
+func TestDecodeJSON(t *testing.T) {
+	var user models.UserModel
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/user", strings.NewReader(`{"username": 7}`))
+	err := decodeJSON(request, &user)
+	if appErr := apperror.From(err); appErr.Kind != apperror.KIND_VALIDATION || len(appErr.Fields) != 1 ||
+		appErr.Fields[0].Field != "username" {
+		t.Errorf("Wrongly typed field expected to fail validation on that field, got %+v", appErr)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/api/v1/user", strings.NewReader(`{"username": `))
+	if err = decodeJSON(request, &user); apperror.KindOf(err) != apperror.KIND_VALIDATION {
+		t.Errorf("Malformed body expected to fail validation, got %s", err)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/api/v1/user", strings.NewReader(`{"username": "bob"}`))
+	if err = decodeJSON(request, &user); err != nil || user.Username != "bob" {
+		t.Errorf("Body expected to decode, failed: %s", err)
+	}
+}
+
+// TestLocalizedErrorResponse Checks the fields that failed validation are described in the language the caller
+// accepts, leaving the error itself untouched
+func TestLocalizedErrorResponse(t *testing.T) {
+	validation.AddMessages("fr", map[string]string{validation.CODE_REQUIRED: "{field} est obligatoire"})
+	err := apperror.Validation("UserModel failed validation", apperror.FieldError{Field: "email",
+		Code: validation.CODE_REQUIRED, Message: "Email is not specified!"})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/user", nil)
+	request.Header.Set("Accept-Language", "fr-FR, en;q=0.5")
+	errResponse(recorder, request, err)
+
+	var response models.ErrorMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Caught error while decoding the response: %s", err)
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Message != "email est obligatoire" ||
+		response.Errors[0].Code != validation.CODE_REQUIRED ||
+		response.Message != "UserModel failed validation:\n\t- email est obligatoire" {
+		t.Errorf("Error response expected to be in French, got %+v", response)
+	}
+	if err.Fields[0].Message != "Email is not specified!" {
+		t.Errorf("Localizing expected to leave the error untouched, got %+v", err.Fields)
+	}
+}
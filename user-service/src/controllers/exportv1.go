@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/blob"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/export"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+type ExportControllerV1 struct {
+	Service *service.UserService
+}
+
+// prepareExport reads the export from the query parameters, see export.ParseQuery, and resolves its columns
+// returns a validation error if it can't be exported
+func (c *ExportControllerV1) prepareExport(request *http.Request) (*export.Export, error) {
+	query, err := export.ParseQuery(request.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	return export.Prepare(request.Context(), c.Service.Dbh, organizationID(request), query)
+}
+
+// attachment sets the headers of a download of an export in the format
+func attachment(writer http.ResponseWriter, name string, format export.Format) {
+	writer.Header().Set("Content-Type", format.ContentType)
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+format.Extension))
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+// ExportUsers streams the users matching the query parameters in the body of the response, as they are read from
+// the database. The response must be written within server.write_timeout, so exports too large for that are run as
+// jobs with StartExport instead
+func (c *ExportControllerV1) ExportUsers(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "ExportControllerV1.ExportUsers")
+	defer span.End()
+
+	e, err := c.prepareExport(request)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	attachment(writer, "users-"+organization(request).Slug, e.Format)
+	writer.WriteHeader(http.StatusOK)
+	rows, err := e.Run(request.Context(), writer)
+	if err != nil {
+		logging.FromContext(request.Context(), nil).Error("Export failed", logging.Fields{"rows": rows,
+			"error": err})
+		// The status has been sent, so breaking the connection is the only way left to tell the client the export is
+		// incomplete, rather than ending the body as if it were whole
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// exportJob reads the id of the job from the path and fetches it
+// writes an error response and returns false if it can't
+func (c *ExportControllerV1) exportJob(writer http.ResponseWriter, request *http.Request) (models.ExportJobModel,
+	bool) {
+	idVal := mux.Vars(request)["id"]
+	jobID, err := strconv.Atoi(idVal)
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+idVal)
+		return models.ExportJobModel{}, false
+	}
+
+	job, err := models.GetExportJob(request.Context(), c.Service.Dbh, organizationID(request), jobID)
+	if err != nil {
+		errResponse(writer, request, err)
+		return job, false
+	}
+	return job, true
+}
+
+// StartExport starts a job exporting the users matching the query parameters in the background, answering 202 with
+// the job and its location. Once the job is done its file is downloaded with GetExportFile, until it expires after
+// export.ttl
+func (c *ExportControllerV1) StartExport(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "ExportControllerV1.StartExport")
+	defer span.End()
+
+	e, err := c.prepareExport(request)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	job := models.ExportJobModel{OrgID: organizationID(request), Query: e.Query}
+	if principal := requestPrincipal(request); principal != nil {
+		job.UserID = principal.UserID
+	}
+	if err = job.Create(request.Context(), c.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+	if !c.Service.StartExport(job, e) {
+		errorResponse(writer, request, http.StatusServiceUnavailable, "Shutting down, the export was not started")
+		return
+	}
+
+	writer.Header().Set("Location", fmt.Sprintf("%s/%d", request.URL.Path, job.ID))
+	jsonResponse(writer, http.StatusAccepted, job)
+}
+
+// GetExport gets the status of an export job
+func (c *ExportControllerV1) GetExport(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "ExportControllerV1.GetExport")
+	defer span.End()
+
+	if job, ok := c.exportJob(writer, request); ok {
+		jsonResponse(writer, http.StatusOK, job)
+	}
+}
+
+// GetExportFile downloads the file of an export job that is done
+func (c *ExportControllerV1) GetExportFile(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "ExportControllerV1.GetExportFile")
+	defer span.End()
+
+	job, ok := c.exportJob(writer, request)
+	if !ok {
+		return
+	}
+	if job.Status != models.EXPORT_DONE {
+		errResponse(writer, request, apperror.Conflict("status", "Export ID %d is %s, not done", job.ID, job.Status))
+		return
+	}
+
+	file, err := c.Service.Blobs.Open(request.Context(), job.BlobKey)
+	if err == blob.ErrNotFound {
+		errResponse(writer, request, apperror.NotFound("The file of Export ID %d has expired", job.ID).Wrap(err))
+		return
+	} else if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+	defer file.Close()
+
+	name := fmt.Sprintf("users-%s-%d", organization(request).Slug, job.ID)
+	attachment(writer, name, export.FORMATS[job.Query.Format])
+	if file.Size >= 0 {
+		writer.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	}
+	if file.ETag != "" {
+		writer.Header().Set("ETag", file.ETag)
+	}
+	writer.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(writer, file); err != nil {
+		logging.FromContext(request.Context(), nil).Warn("Unable to send export file", logging.Fields{
+			"export_id": job.ID, "error": err})
+	}
+}
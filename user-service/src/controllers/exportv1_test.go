@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestExportUsersRejected Checks exports that can't be run are rejected before the database is touched
+func TestExportUsersRejected(t *testing.T) {
+	c := ExportControllerV1{Service: &service.UserService{Config: config.Default()}}
+
+	for _, url := range []string{
+		"/api/v1/user/export?format=xlsx",
+		"/api/v1/user/export?group=sales",
+		"/api/v1/user/export?phoneformat=dotted",
+		"/api/v1/user/export?telephone=12",
+		"/api/v1/user/export?attr.Bad-Name=x",
+	} {
+		for method, handler := range map[string]http.HandlerFunc{http.MethodGet: c.ExportUsers,
+			http.MethodPost: c.StartExport} {
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest(method, url, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("%s %s expected to return 400, got %d: %s", method, url, recorder.Code, recorder.Body)
+			}
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	c.GetExport(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/user/export/x", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Export with an invalid ID expected to return 400, got %d", recorder.Code)
+	}
+}
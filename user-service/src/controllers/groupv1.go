@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+type GroupControllerV1 struct {
+	Service *service.UserService
+}
+
+// CreateGroup creates a Group
+func (c *GroupControllerV1) CreateGroup(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	var group models.GroupModel
+	if err := decodeJSON(request, &group); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	group.OrgID = organizationID(request)
+	if err := group.Create(request.Context(), c.Service.Dbh, requestPrivileged(request)); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusCreated, group)
+	}
+}
+
+// GetAllGroups lists the groups
+func (c *GroupControllerV1) GetAllGroups(writer http.ResponseWriter, request *http.Request) {
+	limit, offset, ok := parsePaging(writer, request, c.Service.Config.Paging)
+	if !ok {
+		return
+	}
+
+	groups, err := models.GetGroups(request.Context(), c.Service.Dbh, organizationID(request), 0, limit, offset)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(groups) == 0 {
+			groups = make([]models.GroupModel, 0)
+		}
+		jsonResponse(writer, http.StatusOK, groups)
+	}
+}
+
+// GetGroupById fetches a single group
+func (c *GroupControllerV1) GetGroupById(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	var groups []models.GroupModel
+	groups, err = models.GetGroups(request.Context(), c.Service.Dbh, organizationID(request), id, 1, 0)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else if len(groups) == 0 {
+		errResponse(writer, request, apperror.NotFound("No Group with ID %d found", id))
+	} else {
+		jsonResponse(writer, http.StatusOK, groups[0])
+	}
+}
+
+// UpdateGroup updates the group by the specified ID
+func (c *GroupControllerV1) UpdateGroup(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	var group models.GroupModel
+	if err = decodeJSON(request, &group); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	if id != group.ID {
+		errorResponse(writer, request, http.StatusBadRequest, "changing ID is not permitted")
+		return
+	}
+
+	group.OrgID = organizationID(request)
+	if err = group.Update(request.Context(), c.Service.Dbh, requestPrivileged(request)); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, group)
+	}
+}
+
+// DeleteGroup removes the specified group. Its subgroups become top level groups
+func (c *GroupControllerV1) DeleteGroup(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	group := models.GroupModel{ID: id, OrgID: organizationID(request)}
+	if err = group.Delete(request.Context(), c.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, models.Message{Message: fmt.Sprintf("Group ID %d deleted", id)})
+	}
+}
+
+// GetGroupMembers lists the members of a group. With ?recursive=true members of subgroups are included
+func (c *GroupControllerV1) GetGroupMembers(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	limit, offset, ok := parsePaging(writer, request, c.Service.Config.Paging)
+	if !ok {
+		return
+	}
+	phoneFormat, ok := parsePhoneFormat(writer, request)
+	if !ok {
+		return
+	}
+
+	recursive := false
+	if recursiveVal := request.URL.Query().Get("recursive"); recursiveVal != "" {
+		recursive, err = strconv.ParseBool(recursiveVal)
+		if err != nil {
+			errorResponse(writer, request, http.StatusBadRequest,
+				fmt.Sprintf("query \"recursive\" only accepts booleans: received %s", recursiveVal))
+			return
+		}
+	}
+
+	var groups []models.GroupModel
+	groups, err = models.GetGroups(request.Context(), c.Service.Dbh, organizationID(request), id, 1, 0)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	} else if len(groups) == 0 {
+		errResponse(writer, request, apperror.NotFound("No Group with ID %d found", id))
+		return
+	}
+
+	var users []models.UserModel
+	users, err = models.GetGroupMembers(request.Context(), c.Service.Dbh, organizationID(request), id, recursive,
+		limit, offset)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(users) == 0 {
+			users = make([]models.UserModel, 0)
+		}
+		formatTelephones(users, phoneFormat)
+		jsonResponse(writer, http.StatusOK, users)
+	}
+}
+
+// memberVars reads the group and user ids from the route
+func memberVars(writer http.ResponseWriter, request *http.Request) (groupID, userID int, ok bool) {
+	vars := mux.Vars(request)
+	groupID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+	userID, err = strconv.Atoi(vars["userid"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid User ID "+vars["userid"])
+		return
+	}
+
+	return groupID, userID, true
+}
+
+// AddGroupMember adds the user to the group
+func (c *GroupControllerV1) AddGroupMember(writer http.ResponseWriter, request *http.Request) {
+	groupID, userID, ok := memberVars(writer, request)
+	if !ok {
+		return
+	}
+
+	err := models.AddGroupMember(request.Context(), c.Service.Dbh, organizationID(request), groupID, userID,
+		requestPrivileged(request))
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK,
+			models.Message{Message: fmt.Sprintf("User ID %d added to Group ID %d", userID, groupID)})
+	}
+}
+
+// RemoveGroupMember removes the user from the group
+func (c *GroupControllerV1) RemoveGroupMember(writer http.ResponseWriter, request *http.Request) {
+	groupID, userID, ok := memberVars(writer, request)
+	if !ok {
+		return
+	}
+
+	err := models.RemoveGroupMember(request.Context(), c.Service.Dbh, organizationID(request), groupID, userID)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK,
+			models.Message{Message: fmt.Sprintf("User ID %d removed from Group ID %d", userID, groupID)})
+	}
+}
+
+// GetMembershipChanges serves the membership change feed for downstream systems to sync from
+func (c *GroupControllerV1) GetMembershipChanges(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	sinceVal := query.Get("since")
+	if sinceVal == "" {
+		sinceVal = "0"
+	}
+	since, err := strconv.ParseInt(sinceVal, 10, 64)
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest,
+			fmt.Sprintf("query \"since\" only accepts integers: received %s", sinceVal))
+		return
+	}
+
+	limit, _, ok := parsePaging(writer, request, c.Service.Config.Paging)
+	if !ok {
+		return
+	}
+
+	var changes []models.MembershipChangeModel
+	changes, err = models.GetMembershipChanges(request.Context(), c.Service.Dbh, organizationID(request), since, limit)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(changes) == 0 {
+			changes = make([]models.MembershipChangeModel, 0)
+		}
+		jsonResponse(writer, http.StatusOK, changes)
+	}
+}
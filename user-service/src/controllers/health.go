@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HEALTH_CHECK_TIMEOUT limits how long a single readiness check may take
+const HEALTH_CHECK_TIMEOUT = 2 * time.Second
+
+type HealthController struct {
+	Service *service.UserService
+}
+
+// healthCheck is the result of one readiness check
+type healthCheck struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMS float64 `json:"latencyms"`
+	Detail    string  `json:"detail,omitempty"`
+}
+
+// healthResponse is the body of the health endpoints
+type healthResponse struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// runCheck times the check and records its result
+func runCheck(name string, check func(ctx context.Context) (detail string, err error)) healthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	start := time.Now()
+	detail, err := check(ctx)
+	result := healthCheck{Name: name, Healthy: err == nil, Detail: detail,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Detail = err.Error()
+	}
+
+	return result
+}
+
+// checkDatabase pings the database
+func (c *HealthController) checkDatabase(ctx context.Context) (string, error) {
+	if c.Service.Dbh == nil {
+		return "", errors.New("not connected")
+	}
+	return "", c.Service.Dbh.Ping(ctx)
+}
+
+// checkMigrations checks the schema is at least as new as the latest migration this build knows of. A newer schema
+// is fine: another instance of a later release may have migrated it
+func (c *HealthController) checkMigrations(ctx context.Context) (string, error) {
+	if c.Service.Dbh == nil {
+		return "", errors.New("not connected")
+	}
+
+	expected := models.Migrations[len(models.Migrations)-1].Version
+	version, err := c.Service.Dbh.MigrationVersion(ctx)
+	if err != nil {
+		return "", err
+	} else if version < expected {
+		return "", fmt.Errorf("schema is at version %d, expected %d", version, expected)
+	}
+
+	return fmt.Sprintf("version %d", version), nil
+}
+
+// checkWorkers checks no background worker is wedged or has stopped
+func (c *HealthController) checkWorkers(ctx context.Context) (string, error) {
+	var unhealthy []string
+	workers := c.Service.Workers()
+	for _, worker := range workers {
+		if !worker.Healthy {
+			unhealthy = append(unhealthy, worker.Name+": "+worker.Detail)
+		}
+	}
+	if len(unhealthy) > 0 {
+		return "", errors.New(strings.Join(unhealthy, ", "))
+	}
+
+	return fmt.Sprintf("%d running", len(workers)), nil
+}
+
+// checkShutdown fails once the service begins shutting down, so it stops being sent requests
+func (c *HealthController) checkShutdown(ctx context.Context) (string, error) {
+	if c.Service.ShuttingDown() {
+		return "", errors.New("shutting down")
+	}
+	return "", nil
+}
+
+// Healthz reports the process is alive. It doesn't check dependencies, so an outage of the database doesn't get
+// the process restarted
+func (c *HealthController) Healthz(writer http.ResponseWriter, request *http.Request) {
+	jsonResponse(writer, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Readyz reports whether the service can serve requests, with the result and latency of each check. Responds 503
+// if any check fails
+func (c *HealthController) Readyz(writer http.ResponseWriter, request *http.Request) {
+	checks := []healthCheck{
+		runCheck("shutdown", c.checkShutdown),
+		runCheck("database", c.checkDatabase),
+		runCheck("migrations", c.checkMigrations),
+		runCheck("workers", c.checkWorkers),
+	}
+
+	response := healthResponse{Status: "ready", Checks: checks}
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.Healthy {
+			response.Status = "not ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	jsonResponse(writer, status, response)
+}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	c := HealthController{Service: &service.UserService{}}
+	recorder := httptest.NewRecorder()
+	c.Healthz(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Healthz expected to return 200, got %d", recorder.Code)
+	}
+}
+
+// TestReadyzNotReady Checks each failing check is reported with its detail
+func TestReadyzNotReady(t *testing.T) {
+	c := HealthController{Service: &service.UserService{}}
+	recorder := httptest.NewRecorder()
+	c.Readyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Readyz without a database expected to return 503, got %d", recorder.Code)
+	}
+
+	var response healthResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Caught error while decoding the response: %s", err)
+	}
+	if response.Status != "not ready" {
+		t.Errorf("Status expected to be not ready, got %s", response.Status)
+	}
+
+	expected := map[string]bool{"shutdown": true, "database": false, "migrations": false, "workers": true}
+	for _, check := range response.Checks {
+		if healthy, ok := expected[check.Name]; !ok || healthy != check.Healthy {
+			t.Errorf("Check %s expected healthy %v, got %+v", check.Name, healthy, check)
+		} else if !check.Healthy && check.Detail == "" {
+			t.Errorf("Failing check %s expected to explain why", check.Name)
+		}
+		delete(expected, check.Name)
+	}
+	if len(expected) > 0 {
+		t.Errorf("Checks %v expected to be reported", expected)
+	}
+}
@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// IDEMPOTENCY_HEADER names the header a client sets to make a request safe to retry
+const IDEMPOTENCY_HEADER string = "Idempotency-Key"
+
+// IDEMPOTENCY_REPLAYED_HEADER is set on a response replayed from the first request made with its key
+const IDEMPOTENCY_REPLAYED_HEADER string = "Idempotent-Replayed"
+
+// MAX_IDEMPOTENCY_KEY is the longest Idempotency-Key accepted
+const MAX_IDEMPOTENCY_KEY int = 255
+
+// idempotentMethods are the methods whose requests an Idempotency-Key is honoured on
+var idempotentMethods = map[string]bool{http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true}
+
+// idempotencyExempt are the paths whose requests an Idempotency-Key is ignored on, as their bodies and responses are
+// files too large to keep
+var idempotencyExempt = map[string]bool{"/api/v1/user/import": true, "/api/v1/user/export": true}
+
+// Idempotency answers retries of a request made with an Idempotency-Key with the response to the first, rather
+// than running the request again
+type Idempotency struct {
+	Service *service.UserService
+}
+
+// validIdempotencyKey reports whether key is 1 to MAX_IDEMPOTENCY_KEY printable ASCII characters
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > MAX_IDEMPOTENCY_KEY {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestFingerprint hashes the method, path, query and body of the request
+func requestFingerprint(request *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", request.Method, request.URL.RequestURI())
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response a handler writes, unless its body is larger than max
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	max    int
+	// truncated is whether the body was too large to keep
+	truncated bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	if r.truncated {
+		return n, err
+	}
+	if r.body.Len()+n > r.max {
+		r.truncated = true
+		r.body.Reset()
+	} else {
+		r.body.Write(b[:n])
+	}
+	return n, err
+}
+
+// idempotencyLock is how long a request made with an Idempotency-Key may run, after which its claim is taken to have
+// been abandoned: the longer of server.write_timeout and database.bulk_timeout, which imports and batches run for
+func idempotencyLock(cfg config.Config) time.Duration {
+	if cfg.Database.BulkTimeout > cfg.Server.WriteTimeout {
+		return cfg.Database.BulkTimeout
+	}
+	return cfg.Server.WriteTimeout
+}
+
+// replay answers the request with the response kept with its key
+func replay(writer http.ResponseWriter, key models.IdempotencyKeyModel) {
+	for name, values := range key.Header {
+		writer.Header()[name] = values
+	}
+	writer.Header().Set(IDEMPOTENCY_REPLAYED_HEADER, "true")
+	writer.WriteHeader(key.Status)
+	_, _ = writer.Write(key.Body)
+}
+
+// Middleware honours the Idempotency-Key of POST, PUT, PATCH and DELETE requests. The first request with a key
+// claims it and runs, and its response is kept for idempotency.ttl. Retries with the same key and the same request
+// are answered with that response, while the first is still running with 409, and with a different request with
+// 422. Responses with a 5xx status aren't kept, so the request can be retried. Keys are claimed in the database, so
+// requests to different instances can't both run. Imports and exports ignore the key
+func (i *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		keyVal := request.Header.Get(IDEMPOTENCY_HEADER)
+		if keyVal == "" || !idempotentMethods[request.Method] || idempotencyExempt[request.URL.Path] {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if !validIdempotencyKey(keyVal) {
+			errorResponse(writer, request, http.StatusBadRequest, fmt.Sprintf(
+				"Invalid %s: must be 1 to %d printable ASCII characters", IDEMPOTENCY_HEADER, MAX_IDEMPOTENCY_KEY))
+			return
+		}
+
+		cfg := i.Service.Config
+		maxBytes := int64(cfg.Idempotency.MaxBytes)
+		body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxBytes))
+		if err != nil && err.Error() == "http: request body too large" {
+			errorResponse(writer, request, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Requests with an %s must be at most %d bytes", IDEMPOTENCY_HEADER, maxBytes))
+			return
+		} else if err != nil {
+			errorResponse(writer, request, http.StatusBadRequest, "Unable to read the request body: "+err.Error())
+			return
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		fingerprint := requestFingerprint(request, body)
+		key := models.IdempotencyKeyModel{OrgID: organizationID(request), Key: keyVal, Fingerprint: fingerprint}
+		if principal := requestPrincipal(request); principal != nil {
+			key.UserID = principal.UserID
+		}
+		// The request is stopped when its claim can be taken over, so a retry can't run alongside it. The deadline
+		// is set before the key is locked, so it passes before the lock does
+		lock := idempotencyLock(cfg)
+		ctx, cancel := context.WithTimeout(request.Context(), lock)
+		defer cancel()
+		request = request.WithContext(ctx)
+		claimed, err := key.Claim(request.Context(), i.Service.Dbh, lock, cfg.Idempotency.TTL)
+		if err != nil {
+			errResponse(writer, request, err)
+			return
+		}
+		if !claimed {
+			switch {
+			case key.Fingerprint != fingerprint:
+				errorResponse(writer, request, http.StatusUnprocessableEntity,
+					IDEMPOTENCY_HEADER+" has already been used for a different request")
+			case key.Status == 0:
+				writer.Header().Set("Retry-After", "1")
+				errorResponse(writer, request, http.StatusConflict,
+					"A request with this "+IDEMPOTENCY_HEADER+" is in progress")
+			default:
+				replay(writer, key)
+			}
+			return
+		}
+
+		logger := logging.FromContext(request.Context(), i.Service.Logger)
+		recorder := &responseRecorder{ResponseWriter: writer, max: cfg.Idempotency.MaxBytes}
+		completing := false
+		defer func() {
+			// The key is released, so the request can be retried, unless its response is being kept. This runs
+			// when the handler panics too
+			if completing {
+				return
+			}
+			if err := key.Release(database.Detach(request.Context()), i.Service.Dbh); err != nil {
+				logger.Error("Unable to release idempotency key", logging.Fields{"error": err})
+			}
+		}()
+		next.ServeHTTP(recorder, request)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		if recorder.status >= http.StatusInternalServerError || recorder.truncated {
+			return
+		}
+
+		completing = true
+		key.Status, key.Body = recorder.status, recorder.body.Bytes()
+		key.Header = writer.Header().Clone()
+		delete(key.Header, logging.REQUEST_ID_HEADER)
+		// The response has been sent, so keeping it mustn't be stopped by the request ending
+		if err = key.Complete(database.Detach(request.Context()), i.Service.Dbh); err != nil {
+			logger.Error("Unable to keep the response to an idempotent request", logging.Fields{"error": err})
+		}
+	})
+}
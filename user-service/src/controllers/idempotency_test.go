@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestIdempotencyRejected Checks requests whose Idempotency-Key can't be honoured are rejected before the handler or
+// the database is reached, and that requests it doesn't apply to, including imports and exports, go straight through
+func TestIdempotencyRejected(t *testing.T) {
+	cfg := config.Default()
+	cfg.Idempotency.MaxBytes = 10
+	i := Idempotency{Service: &service.UserService{Config: cfg}}
+	handled := false
+	handler := i.Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handled = true
+	}))
+
+	cases := []struct {
+		method, url, key, body string
+		status                 int
+		handled                bool
+	}{
+		{http.MethodPost, "/api/v1/user", "", "{}", http.StatusOK, true},
+		{http.MethodGet, "/api/v1/user", "abc", "", http.StatusOK, true},
+		{http.MethodPost, "/api/v1/user", strings.Repeat("k", MAX_IDEMPOTENCY_KEY+1), "{}", http.StatusBadRequest, false},
+		{http.MethodPut, "/api/v1/user", "bad\nkey", "{}", http.StatusBadRequest, false},
+		{http.MethodPatch, "/api/v1/user", "abc", `{"username": "jdoe1"}`, http.StatusRequestEntityTooLarge, false},
+		{http.MethodPost, "/api/v1/user/import", "abc", "username\njdoe1\n", http.StatusOK, true},
+		{http.MethodPost, "/api/v1/user/export", "abc", `{"format": "csv"}`, http.StatusOK, true},
+	}
+	for _, tc := range cases {
+		handled = false
+		request := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		if tc.key != "" {
+			request.Header.Set(IDEMPOTENCY_HEADER, tc.key)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != tc.status || handled != tc.handled {
+			t.Errorf("%s %s with key %q expected %d and handled %t, got %d and %t", tc.method, tc.url, tc.key,
+				tc.status, tc.handled, recorder.Code, handled)
+		}
+	}
+}
+
+// TestRequestFingerprint Checks requests differing in method, path, query or body have different fingerprints
+func TestRequestFingerprint(t *testing.T) {
+	fingerprint := func(method, url, body string) string {
+		return requestFingerprint(httptest.NewRequest(method, url, nil), []byte(body))
+	}
+
+	original := fingerprint(http.MethodPost, "/api/v1/user", `{"username": "jdoe1"}`)
+	if fingerprint(http.MethodPost, "/api/v1/user", `{"username": "jdoe1"}`) != original {
+		t.Errorf("Fingerprint of the same request expected to match")
+	}
+	for _, other := range []string{
+		fingerprint(http.MethodPut, "/api/v1/user", `{"username": "jdoe1"}`),
+		fingerprint(http.MethodPost, "/api/v1/group", `{"username": "jdoe1"}`),
+		fingerprint(http.MethodPost, "/api/v1/user?phoneformat=e164", `{"username": "jdoe1"}`),
+		fingerprint(http.MethodPost, "/api/v1/user", `{"username": "JDoe1"}`),
+	} {
+		if other == original {
+			t.Errorf("Fingerprint of a different request expected to differ")
+		}
+	}
+}
+
+// TestResponseRecorder Checks the response is kept as it is written, unless it is too large
+func TestResponseRecorder(t *testing.T) {
+	recorder := &responseRecorder{ResponseWriter: httptest.NewRecorder(), max: 8}
+	_, _ = recorder.Write([]byte("abcd"))
+	recorder.WriteHeader(http.StatusCreated)
+	if recorder.status != http.StatusOK || recorder.body.String() != "abcd" || recorder.truncated {
+		t.Errorf("Response expected to be kept as 200 abcd, got %d %q", recorder.status, recorder.body.String())
+	}
+
+	_, _ = recorder.Write([]byte("efghi"))
+	if !recorder.truncated || recorder.body.Len() != 0 {
+		t.Errorf("Response larger than 8 bytes expected to be dropped, kept %q", recorder.body.String())
+	}
+}
+
+// TestIdempotencyLock Checks a claim lasts as long as the longest a request can run, imports and batches included
+func TestIdempotencyLock(t *testing.T) {
+	cfg := config.Default()
+	if lock := idempotencyLock(cfg); lock != cfg.Database.BulkTimeout {
+		t.Errorf("Lock expected to last database.bulk_timeout, %s, got %s", cfg.Database.BulkTimeout, lock)
+	}
+
+	cfg.Server.WriteTimeout = 2 * cfg.Database.BulkTimeout
+	if lock := idempotencyLock(cfg); lock != cfg.Server.WriteTimeout {
+		t.Errorf("Lock expected to last server.write_timeout, %s, got %s", cfg.Server.WriteTimeout, lock)
+	}
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/token"
+	"net/http"
+	"strconv"
+)
+
+type ImpersonationControllerV1 struct {
+	Auth *Authenticator
+}
+
+// impersonationRequest is the body of a request to start impersonating
+type impersonationRequest struct {
+	UserID int    `json:"userid"`
+	Reason string `json:"reason"`
+}
+
+// impersonationResponse returns the token to act as the subject with
+type impersonationResponse struct {
+	Token   string                           `json:"token"`
+	Session models.ImpersonationSessionModel `json:"session"`
+}
+
+// StartImpersonation issues a short lived token to act as another user. Privileged users can't be impersonated
+func (c *ImpersonationControllerV1) StartImpersonation(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	var impersonate impersonationRequest
+	if err := decodeJSON(request, &impersonate); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	orgID := organizationID(request)
+	privileged, err := c.Auth.isPrivileged(request.Context(), orgID, impersonate.UserID)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	} else if privileged {
+		errorResponse(writer, request, http.StatusForbidden, "Members of the "+c.Auth.Service.Config.Auth.AdminGroup+
+			" group cannot be impersonated")
+		return
+	}
+
+	session := models.ImpersonationSessionModel{OrgID: orgID, ActorID: requestPrincipal(request).UserID,
+		SubjectID: impersonate.UserID, Reason: impersonate.Reason}
+	err = session.Start(request.Context(), c.Auth.Service.Dbh, c.Auth.Service.Config.Auth.ImpersonationTTL)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	attributes, err := models.TokenAttributes(request.Context(), c.Auth.Service.Dbh, orgID, session.SubjectID)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	value, err := token.IssueImpersonation(c.Auth.Service.TokenKey, token.Claims{OrgID: orgID,
+		Subject: session.SubjectID, Actor: session.ActorID, SessionID: session.ID,
+		IssuedAt: session.StartedAt.Unix(), ExpiresAt: session.ExpiresAt.Unix(), Attributes: attributes})
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	jsonResponse(writer, http.StatusCreated, impersonationResponse{Token: value, Session: session})
+}
+
+// StopImpersonation ends the impersonation session of the token the request is made with
+func (c *ImpersonationControllerV1) StopImpersonation(writer http.ResponseWriter, request *http.Request) {
+	principal := requestPrincipal(request)
+	if principal == nil || !principal.Impersonating() {
+		errorResponse(writer, request, http.StatusBadRequest, "Request is not made with an impersonation token")
+		return
+	}
+
+	session := models.ImpersonationSessionModel{ID: principal.SessionID, OrgID: organizationID(request)}
+	if err := session.Stop(request.Context(), c.Auth.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, session)
+	}
+}
+
+// GetAuditEvents serves the organization's audit trail, oldest first
+func (c *ImpersonationControllerV1) GetAuditEvents(writer http.ResponseWriter, request *http.Request) {
+	sinceVal := request.URL.Query().Get("since")
+	if sinceVal == "" {
+		sinceVal = "0"
+	}
+	since, err := strconv.ParseInt(sinceVal, 10, 64)
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest,
+			fmt.Sprintf("query \"since\" only accepts integers: received %s", sinceVal))
+		return
+	}
+
+	limit, _, ok := parsePaging(writer, request, c.Auth.Service.Config.Paging)
+	if !ok {
+		return
+	}
+
+	var events []models.AuditEventModel
+	events, err = models.GetAuditEvents(request.Context(), c.Auth.Service.Dbh, organizationID(request), since, limit)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(events) == 0 {
+			events = make([]models.AuditEventModel, 0)
+		}
+		jsonResponse(writer, http.StatusOK, events)
+	}
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+type ImportControllerV1 struct {
+	Service *service.UserService
+}
+
+// The media types users can be imported from
+const (
+	IMPORT_CSV    string = "text/csv"
+	IMPORT_NDJSON string = "application/x-ndjson"
+)
+
+// parseImportOptions reads the dryrun, upsert and hashedpasswords query parameters
+// writes a 400 response and returns false if any is invalid
+func parseImportOptions(writer http.ResponseWriter, request *http.Request) (opts models.ImportOptions, ok bool) {
+	query := request.URL.Query()
+	for name, value := range map[string]*bool{"dryrun": &opts.DryRun, "hashedpasswords": &opts.HashedPasswords} {
+		if val := query.Get(name); val != "" {
+			var err error
+			if *value, err = strconv.ParseBool(val); err != nil {
+				errorResponse(writer, request, http.StatusBadRequest,
+					fmt.Sprintf("query %q only accepts booleans: received %s", name, val))
+				return opts, false
+			}
+		}
+	}
+
+	opts.Upsert = query.Get("upsert")
+	if opts.Upsert != "" && opts.Upsert != models.IMPORT_UPSERT_USERNAME && opts.Upsert != models.IMPORT_UPSERT_EMAIL {
+		errorResponse(writer, request, http.StatusBadRequest,
+			fmt.Sprintf("query \"upsert\" only accepts username or email: received %s", opts.Upsert))
+		return opts, false
+	}
+
+	return opts, true
+}
+
+// ImportUsers creates, or updates, the users of a CSV or JSON Lines body, answering with the result of every row.
+// Rows that fail don't stop the others being imported
+func (c *ImportControllerV1) ImportUsers(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "ImportControllerV1.ImportUsers")
+	defer span.End()
+
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != IMPORT_CSV && mediaType != IMPORT_NDJSON {
+		errorResponse(writer, request, http.StatusUnsupportedMediaType, fmt.Sprintf(
+			"Illegal Request Content-Type. Only accepts %s or %s. Received: %s", IMPORT_CSV, IMPORT_NDJSON,
+			request.Header.Get("Content-Type")))
+		return
+	}
+
+	opts, ok := parseImportOptions(writer, request)
+	if !ok {
+		return
+	}
+	mapping, err := models.ParseImportMapping(request.URL.Query().Get("map"))
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, fmt.Sprintf("query \"map\" is invalid: %s", err))
+		return
+	}
+
+	maxBytes := int64(c.Service.Config.Import.MaxBytes)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxBytes))
+	if err != nil && err.Error() == "http: request body too large" {
+		errorResponse(writer, request, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Imports must be at most %d bytes", maxBytes))
+		return
+	} else if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Unable to read the request body: "+err.Error())
+		return
+	}
+
+	var rows []models.ImportRow
+	if mediaType == IMPORT_CSV {
+		rows, err = models.ReadImportCSV(bytes.NewReader(body), mapping)
+	} else {
+		rows, err = models.ReadImportNDJSON(bytes.NewReader(body))
+	}
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+	if len(rows) > c.Service.Config.Import.MaxRows {
+		errorResponse(writer, request, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Imports must have at most %d users, received %d", c.Service.Config.Import.MaxRows, len(rows)))
+		return
+	}
+
+	// The response must be written within server.write_timeout, so an import that couldn't hash its passwords in
+	// time is turned away, and one that runs out of time is abandoned rather than written with no one told
+	writeTimeout := c.Service.Config.Server.WriteTimeout
+	if !opts.DryRun && !opts.HashedPasswords {
+		if max := models.PasswordsHashedWithin(writeTimeout); models.PlainPasswords(rows) > max {
+			errorResponse(writer, request, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+				"Imports with plain text passwords must have at most %d of them, to be hashed within %s. Import "+
+					"hashed passwords, or use the import command", max, writeTimeout))
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), writeTimeout)
+	defer cancel()
+
+	report, err := models.ImportUsers(ctx, c.Service.Dbh, organizationID(request), rows, opts)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestImportUsersRejected Checks imports that can't be read are rejected before the database is touched
+func TestImportUsersRejected(t *testing.T) {
+	cfg := config.Default()
+	cfg.Import.MaxRows, cfg.Import.MaxBytes = 2, 100
+	c := ImportControllerV1{Service: &service.UserService{Config: cfg}}
+
+	csv := "username,firstname\njdoe1,John\n"
+	cases := []struct {
+		url, contentType, body string
+		status                 int
+	}{
+		{"/api/v1/user/import", "application/json", `{"username": "jdoe1"}`, http.StatusUnsupportedMediaType},
+		{"/api/v1/user/import?upsert=id", IMPORT_CSV, csv, http.StatusBadRequest},
+		{"/api/v1/user/import?dryrun=maybe", IMPORT_CSV, csv, http.StatusBadRequest},
+		{"/api/v1/user/import?map=firstname", IMPORT_CSV, csv, http.StatusBadRequest},
+		{"/api/v1/user/import", IMPORT_CSV, "username,nickname\njdoe1,JD\n", http.StatusBadRequest},
+		{"/api/v1/user/import", IMPORT_CSV, csv + strings.Repeat("x", 100), http.StatusRequestEntityTooLarge},
+		{"/api/v1/user/import", IMPORT_NDJSON, "{}\n{}\n{}\n", http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		request := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body))
+		request.Header.Set("Content-Type", tc.contentType)
+		recorder := httptest.NewRecorder()
+		c.ImportUsers(recorder, request)
+		if recorder.Code != tc.status {
+			t.Errorf("Import %s of %s expected to return %d, got %d: %s", tc.url, tc.contentType, tc.status,
+				recorder.Code, recorder.Body)
+		}
+	}
+}
+
+// TestImportUsersTooSlow Checks an import with more plain text passwords than can be hashed within
+// server.write_timeout is turned away before the database is touched
+func TestImportUsersTooSlow(t *testing.T) {
+	cfg := config.Default()
+	cfg.Server.WriteTimeout = time.Millisecond
+	c := ImportControllerV1{Service: &service.UserService{Config: cfg}}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/user/import",
+		strings.NewReader("username,password\njdoe1,Passw0rd!\n"))
+	request.Header.Set("Content-Type", IMPORT_CSV)
+	recorder := httptest.NewRecorder()
+	c.ImportUsers(recorder, request)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Import too slow to hash expected to return 413, got %d: %s", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type InvitationControllerV1 struct {
+	Service *service.UserService
+}
+
+// invitationResponse reports whether the invitation email went out along with the invitation
+type invitationResponse struct {
+	models.InvitationModel
+	EmailSent bool `json:"emailsent"`
+}
+
+// acceptInvitationRequest is the body of an accept: the invitation token and the new user's details
+type acceptInvitationRequest struct {
+	Token string `json:"token"`
+	models.UserModel
+}
+
+// sendInvitation emails the invitation's token to the invited address
+// returns false if the email could not be sent, in which case the invitation can be resent
+func (c *InvitationControllerV1) sendInvitation(request *http.Request, org models.OrganizationModel,
+	inv models.InvitationModel) bool {
+	subject := fmt.Sprintf("You have been invited to join %s", org.Name)
+	var body string
+	if c.Service.Config.Invite.URL != "" {
+		body = fmt.Sprintf("You have been invited to create an account with %s.\n\nAccept the invitation at:\n%s%s\n\n"+
+			"This invitation expires %s.\n", org.Name, c.Service.Config.Invite.URL, url.QueryEscape(inv.Token),
+			inv.ExpiresAt.Format("Jan 2, 2006 at 15:04 MST"))
+	} else {
+		body = fmt.Sprintf("You have been invited to create an account with %s.\n\nYour invitation token is:\n%s\n\n"+
+			"This invitation expires %s.\n", org.Name, inv.Token, inv.ExpiresAt.Format("Jan 2, 2006 at 15:04 MST"))
+	}
+
+	if err := c.Service.Mailer.Send(inv.Email, subject, body); err != nil {
+		logging.FromContext(request.Context(), c.Service.Logger).Error("Unable to send invitation",
+			logging.Fields{"invitationid": inv.ID, "error": err})
+		return false
+	}
+
+	return true
+}
+
+// CreateInvitation invites an email address to the organization
+func (c *InvitationControllerV1) CreateInvitation(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	var inv models.InvitationModel
+	if err := decodeJSON(request, &inv); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	inv.OrgID = organizationID(request)
+	if err := inv.Create(request.Context(), c.Service.Dbh, c.Service.Config.Invite.TTL); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		sent := c.sendInvitation(request, organization(request), inv)
+		jsonResponse(writer, http.StatusCreated, invitationResponse{InvitationModel: inv, EmailSent: sent})
+	}
+}
+
+// GetPendingInvitations lists the invitations that have been neither accepted nor revoked
+func (c *InvitationControllerV1) GetPendingInvitations(writer http.ResponseWriter, request *http.Request) {
+	limit, offset, ok := parsePaging(writer, request, c.Service.Config.Paging)
+	if !ok {
+		return
+	}
+
+	invs, err := models.GetPendingInvitations(request.Context(), c.Service.Dbh, organizationID(request), 0, limit, offset)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(invs) == 0 {
+			invs = make([]models.InvitationModel, 0)
+		}
+		jsonResponse(writer, http.StatusOK, invs)
+	}
+}
+
+// ResendInvitation issues a new token for an open invitation, extends its expiry and emails it again
+func (c *InvitationControllerV1) ResendInvitation(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	inv := models.InvitationModel{ID: id, OrgID: organizationID(request)}
+	err = inv.Resend(request.Context(), c.Service.Dbh, c.Service.Config.Invite.TTL)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		sent := c.sendInvitation(request, organization(request), inv)
+		jsonResponse(writer, http.StatusOK, invitationResponse{InvitationModel: inv, EmailSent: sent})
+	}
+}
+
+// RevokeInvitation stops an open invitation from being accepted
+func (c *InvitationControllerV1) RevokeInvitation(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	err = models.RevokeInvitation(request.Context(), c.Service.Dbh, organizationID(request), id)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, models.Message{Message: fmt.Sprintf("Invitation ID %d revoked", id)})
+	}
+}
+
+// AcceptInvitation creates the invited user. The organization comes from the token rather than the request
+func (c *InvitationControllerV1) AcceptInvitation(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	phoneFormat, ok := parsePhoneFormat(writer, request)
+	if !ok {
+		return
+	}
+
+	var accept acceptInvitationRequest
+	if err := decodeJSON(request, &accept); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	user := accept.UserModel
+	if _, err := models.AcceptInvitation(request.Context(), c.Service.Dbh, accept.Token, &user); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		//blank the password so we don't return it
+		user.Password = ""
+		user.FormatTelephone(phoneFormat)
+
+		jsonResponse(writer, http.StatusCreated, user)
+	}
+}
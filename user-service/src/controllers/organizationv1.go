@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// OrganizationControllerV1 serves organizations. Organizations aren't scoped to a tenant, so only privileged users
+// of the platform organization see and create every one; other privileged users only see their own
+type OrganizationControllerV1 struct {
+	Service *service.UserService
+	Auth    *Authenticator
+}
+
+// CreateOrganization creates an Organization
+func (c *OrganizationControllerV1) CreateOrganization(writer http.ResponseWriter, request *http.Request) {
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
+	if !c.Auth.platformOperator(request) {
+		errResponse(writer, request, apperror.Forbidden("Only admins of the platform organization can create "+
+			"organizations"))
+		return
+	}
+
+	var org models.OrganizationModel
+	if err := decodeJSON(request, &org); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	if err := org.Create(request.Context(), c.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusCreated, org)
+	}
+}
+
+// GetAllOrganizations lists the organizations
+func (c *OrganizationControllerV1) GetAllOrganizations(writer http.ResponseWriter, request *http.Request) {
+	limit, offset, ok := parsePaging(writer, request, c.Service.Config.Paging)
+	if !ok {
+		return
+	}
+
+	if !c.Auth.platformOperator(request) {
+		orgs := make([]models.OrganizationModel, 0, 1)
+		if offset == 0 {
+			orgs = append(orgs, organization(request))
+		}
+		jsonResponse(writer, http.StatusOK, orgs)
+		return
+	}
+
+	orgs, err := models.GetOrganizations(request.Context(), c.Service.Dbh, limit, offset)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(orgs) == 0 {
+			orgs = make([]models.OrganizationModel, 0)
+		}
+		jsonResponse(writer, http.StatusOK, orgs)
+	}
+}
+
+// GetOrganizationById fetches a single organization
+func (c *OrganizationControllerV1) GetOrganizationById(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	// Other organizations are hidden as though they don't exist
+	if !c.Auth.platformOperator(request) {
+		if id != organizationID(request) {
+			errResponse(writer, request, apperror.NotFound("No Organization with ID %d found", id))
+		} else {
+			jsonResponse(writer, http.StatusOK, organization(request))
+		}
+		return
+	}
+
+	var org models.OrganizationModel
+	org, err = models.GetOrganization(request.Context(), c.Service.Dbh, "id", vars["id"])
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		jsonResponse(writer, http.StatusOK, org)
+	}
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestOrganizationScope Checks privileged users outside the platform organization only see their own organization,
+// and can't create others, before the database is reached
+func TestOrganizationScope(t *testing.T) {
+	cfg := config.Default()
+	cfg.Auth.PlatformOrganization = "platform"
+	svc := &service.UserService{Config: cfg}
+	c := OrganizationControllerV1{Service: svc, Auth: &Authenticator{Service: svc}}
+	acme := models.OrganizationModel{ID: 3, Slug: "acme", Name: "Acme"}
+
+	serve := func(handler http.HandlerFunc, method, url, id string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, url, strings.NewReader(`{"slug": "globex", "name": "Globex"}`))
+		request.Header.Set("Content-Type", "application/json")
+		ctx := context.WithValue(request.Context(), organizationKey, acme)
+		ctx = context.WithValue(ctx, principalKey, &Principal{UserID: 1, Privileged: true})
+		recorder := httptest.NewRecorder()
+		handler(recorder, mux.SetURLVars(request.WithContext(ctx), map[string]string{"id": id}))
+		return recorder
+	}
+
+	recorder := serve(c.GetAllOrganizations, http.MethodGet, "/api/v1/org", "")
+	var orgs []models.OrganizationModel
+	if err := json.Unmarshal(recorder.Body.Bytes(), &orgs); err != nil || len(orgs) != 1 || orgs[0] != acme {
+		t.Errorf("Organizations expected to be only the admin's own, got %d: %s", recorder.Code, recorder.Body)
+	}
+	recorder = serve(c.GetAllOrganizations, http.MethodGet, "/api/v1/org?offset=1", "")
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != "[]" {
+		t.Errorf("Organizations past the admin's own expected to be empty, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	if recorder = serve(c.GetOrganizationById, http.MethodGet, "/api/v1/org/3", "3"); recorder.Code != http.StatusOK {
+		t.Errorf("Admin's own organization expected to return 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if recorder = serve(c.GetOrganizationById, http.MethodGet, "/api/v1/org/4", "4"); recorder.Code != http.StatusNotFound {
+		t.Errorf("Another organization expected to return 404, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if recorder = serve(c.CreateOrganization, http.MethodPost, "/api/v1/org", ""); recorder.Code != http.StatusForbidden {
+		t.Errorf("Creating an organization outside the platform organization expected to return 403, got %d: %s",
+			recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type contextKey string
+
+const organizationKey contextKey = "organization"
+
+// TENANT_HEADER names the organization by slug or id
+const TENANT_HEADER string = "X-Organization"
+
+// TenantResolver resolves which organization a request is acting on
+type TenantResolver struct {
+	Service *service.UserService
+}
+
+// subdomainTenant extracts the organization from a host of the form <org>.<domain>
+// returns "" if the host is not a direct subdomain of domain
+func subdomainTenant(host, domain string) string {
+	if domain == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	suffix := "." + strings.ToLower(strings.TrimPrefix(domain, "."))
+	if !strings.HasSuffix(host, suffix) {
+		return ""
+	}
+
+	label := strings.TrimSuffix(host, suffix)
+	if label == "" || strings.Contains(label, ".") {
+		return ""
+	}
+
+	return label
+}
+
+// lookup finds an organization by id or slug
+func (t *TenantResolver) lookup(ctx context.Context, value string) (models.OrganizationModel, error) {
+	field := "slug"
+	if _, err := strconv.Atoi(value); err == nil {
+		field = "id"
+	}
+
+	return models.GetOrganization(ctx, t.Service.Dbh, field, value)
+}
+
+// resolve determines the organization for the request. Every place the request names an organization must
+// agree on it, so a header can't be used to step outside the organization of the subdomain or of a token
+func (t *TenantResolver) resolve(request *http.Request) (org models.OrganizationModel, err error) {
+	sources := []struct {
+		name  string
+		value string
+	}{
+		{"header", request.Header.Get(TENANT_HEADER)},
+		{"subdomain", subdomainTenant(request.Host, t.Service.Config.Tenant.Domain)},
+		{"token", tokenTenant(request, t.Service.TokenKey)},
+	}
+
+	var source string
+	for _, s := range sources {
+		if s.value == "" {
+			continue
+		}
+
+		var found models.OrganizationModel
+		found, err = t.lookup(request.Context(), s.value)
+		if errors.Is(err, sql.ErrNoRows) {
+			return org, apperror.NotFound("%s: organization not found", s.name).Wrap(err)
+		} else if err != nil {
+			return org, err
+		}
+
+		if source != "" && found.ID != org.ID {
+			return org, apperror.Validation(
+				fmt.Sprintf("organization from %s does not match organization from %s", s.name, source))
+		}
+		org, source = found, s.name
+	}
+
+	if source == "" {
+		if t.Service.Config.Tenant.Required {
+			return org, apperror.Validation(fmt.Sprintf("no organization specified: set the %s header", TENANT_HEADER))
+		}
+		if org, err = t.lookup(request.Context(), models.DEFAULT_ORGANIZATION); err != nil {
+			return org, apperror.Internal(err)
+		}
+	}
+
+	return org, nil
+}
+
+// Middleware resolves the organization for the request and stores it in the request context
+func (t *TenantResolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		org, err := t.resolve(request)
+		if err != nil {
+			errResponse(writer, request, err)
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), organizationKey, org)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// organization returns the organization resolved for the request
+func organization(request *http.Request) models.OrganizationModel {
+	org, _ := request.Context().Value(organizationKey).(models.OrganizationModel)
+	return org
+}
+
+// organizationID returns the id of the organization resolved for the request, 0 if none was
+func organizationID(request *http.Request) int {
+	return organization(request).ID
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSubdomainTenant(t *testing.T) {
+	tests := []struct {
+		host     string
+		domain   string
+		expected string
+	}{
+		{"acme.users.example.com", "users.example.com", "acme"},
+		{"acme.users.example.com:8080", "users.example.com", "acme"},
+		{"ACME.Users.Example.com", "users.example.com", "acme"},
+		{"users.example.com", "users.example.com", ""},
+		{"a.b.users.example.com", "users.example.com", ""},
+		{"acme.users.example.org", "users.example.com", ""},
+		{"evilusers.example.com", "users.example.com", ""},
+		{"acme.users.example.com", "", ""},
+	}
+
+	for _, test := range tests {
+		if actual := subdomainTenant(test.host, test.domain); actual != test.expected {
+			t.Errorf("Host %s under %s expected to resolve to |%s|, got |%s|", test.host, test.domain,
+				test.expected, actual)
+		}
+	}
+}
+
+// TestRequireAuthenticated Checks anonymous requests are refused before reaching the handler, so naming an
+// organization isn't enough to act on it
+func TestRequireAuthenticated(t *testing.T) {
+	auth := Authenticator{}
+	handled := false
+	handler := auth.RequireAuthenticated(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handled = true
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/user", nil)
+	request.Header.Set(TENANT_HEADER, "acme")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized || handled {
+		t.Errorf("Anonymous request expected to be refused with 401, got %d and handled %t", recorder.Code, handled)
+	}
+
+	ctx := context.WithValue(request.Context(), principalKey, &Principal{UserID: 1, Username: "jdoe1"})
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request.WithContext(ctx))
+	if recorder.Code != http.StatusOK || !handled {
+		t.Errorf("Authenticated request expected to be handled, got %d and handled %t", recorder.Code, handled)
+	}
+}
@@ -2,33 +2,57 @@
 package controllers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
-	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/avatar"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
 	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
 	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type UserControllerV1 struct {
 	Service *service.UserService
+	Auth    *Authenticator
 }
 
-// errorResponse Handles returning a JSON encoded error message
-func errorResponse(writer http.ResponseWriter, errorCode int, errorMessage string) {
-	jsonResponse(writer, errorCode, models.ErrorMessage{Message: errorMessage})
+// checkPassword refuses a change of the user's password by anyone but the user, authenticated with their current
+// password. An admin, an API key or a staff member impersonating the user can't take over the account this way
+// writes the error response and returns false if the password is changed by anyone else
+func checkPassword(writer http.ResponseWriter, request *http.Request, user models.UserModel) bool {
+	if user.Password == "" {
+		return true
+	}
+	if principal := requestPrincipal(request); principal == nil || principal.UserID != user.ID ||
+		!principal.PasswordAuthenticated() {
+		errorResponse(writer, request, http.StatusForbidden,
+			"The password can only be changed by its user, authenticated with their password")
+		return false
+	}
+	return true
 }
 
 // jsonResponse Handlers the boilerplate of encoding the payload to JSON and setting the proper headers
 func jsonResponse(writer http.ResponseWriter, statusCode int, payload interface{}) {
 	response, err := json.Marshal(payload)
 	if err != nil {
-		errorResponse(writer, http.StatusInternalServerError, err.Error())
+		statusCode = http.StatusInternalServerError
+		response, _ = json.Marshal(models.ErrorMessage{Message: apperror.INTERNAL_MESSAGE,
+			RequestID: writer.Header().Get(logging.REQUEST_ID_HEADER)})
 	}
 
+	if writer.Header().Get("Content-Type") == "" {
+		writer.Header().Set("Content-Type", "application/json")
+	}
 	writer.WriteHeader(statusCode)
 	_, _ = writer.Write(response)
 }
@@ -37,7 +61,7 @@ func jsonResponse(writer http.ResponseWriter, statusCode int, payload interface{
 func validateRequest(writer http.ResponseWriter, request *http.Request) bool {
 	contentType := request.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		errorResponse(writer, http.StatusUnsupportedMediaType,
+		errorResponse(writer, request, http.StatusUnsupportedMediaType,
 			fmt.Sprintf("Illegal Request Content-Type. Only accepcts application/json. Received: %s", contentType))
 		return false
 	}
@@ -45,29 +69,40 @@ func validateRequest(writer http.ResponseWriter, request *http.Request) bool {
 	return true
 }
 
+// traceHandler starts the span of a handler
+// returns the request carrying the span, and the span to end when the handler returns
+func traceHandler(request *http.Request, name string) (*http.Request, trace.Span) {
+	ctx, span := tracing.Start(request.Context(), name)
+	return request.WithContext(ctx), span
+}
+
 // CreateUser creates a User
 func (c *UserControllerV1) CreateUser(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "UserControllerV1.CreateUser")
+	defer span.End()
+
 	if !validateRequest(writer, request) { // Make sure we only accept JSON
 		return
 	}
 
-	var user models.UserModel
-	decoder := json.NewDecoder(request.Body)
-	if err := decoder.Decode(&user); err != nil {
-		errorResponse(writer, http.StatusInternalServerError, err.Error())
+	phoneFormat, ok := parsePhoneFormat(writer, request)
+	if !ok {
 		return
 	}
 
-	if err := user.Create(c.Service.Dbh); err != nil {
-		if err == database.ErrDuplicateKey {
-			errorResponse(writer, http.StatusConflict, "Request violates uniqueness")
-		} else {
-			errorResponse(writer, http.StatusBadRequest, err.Error())
-		}
+	var user models.UserModel
+	if err := decodeJSON(request, &user); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
 
+	user.OrgID = organizationID(request)
+	if err := user.Create(request.Context(), c.Service.Dbh); err != nil {
+		errResponse(writer, request, err)
 	} else {
 		//blank the password so we don't return it
 		user.Password = ""
+		user.FormatTelephone(phoneFormat)
 
 		//return the newly created user back to the requester
 		jsonResponse(writer, http.StatusCreated, user)
@@ -76,147 +111,346 @@ func (c *UserControllerV1) CreateUser(writer http.ResponseWriter, request *http.
 
 // DeleteUser removes the specified user id
 func (c *UserControllerV1) DeleteUser(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "UserControllerV1.DeleteUser")
+	defer span.End()
+
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		errorResponse(writer, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	if !c.Auth.selfOrPrivileged(writer, request, id, "delete the user") {
 		return
 	}
 
-	user := models.UserModel{ID: id}
-	err = user.Delete(c.Service.Dbh)
+	user := models.UserModel{ID: id, OrgID: organizationID(request)}
+	err = user.Delete(request.Context(), c.Service.Dbh)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			errorResponse(writer, http.StatusNotFound, fmt.Sprintf("No User with ID %d found", id))
-		} else {
-			errorResponse(writer, http.StatusInternalServerError, err.Error())
-		}
-	} else {
-		jsonResponse(writer, http.StatusOK, models.Message{Message: fmt.Sprintf("User ID %d deleted", id)})
+		errResponse(writer, request, err)
+		return
+	}
+
+	// The user is gone either way, so an avatar left behind is only logged
+	sizes, _ := c.Service.Config.Avatar.SizeList()
+	if err = avatar.Delete(request.Context(), c.Service.Blobs, user.OrgID, id, sizes); err != nil {
+		logging.FromContext(request.Context(), c.Service.Logger).Error("Unable to delete the avatar of a deleted user",
+			logging.Fields{"userid": id, "error": err})
 	}
+	jsonResponse(writer, http.StatusOK, models.Message{Message: fmt.Sprintf("User ID %d deleted", id)})
 }
 
-const (
-	DEFAULT_LIMIT  = "100"
-	DEFAULT_OFFSET = "0"
-)
+const DEFAULT_OFFSET = "0"
 
-// GetAllUsers gets all users
-func (c *UserControllerV1) GetAllUsers(writer http.ResponseWriter, request *http.Request) {
+// parsePaging reads the limit and offset query parameters, applying the configured default limit and capping it at
+// the configured maximum
+// writes a 400 response and returns false if either is not an integer
+func parsePaging(writer http.ResponseWriter, request *http.Request, paging config.PagingConfig) (limit, offset int,
+	ok bool) {
 	query := request.URL.Query()
 	limitVal := query.Get("limit")
 	if limitVal == "" {
-		limitVal = DEFAULT_LIMIT
+		limitVal = strconv.Itoa(paging.DefaultLimit)
 	}
 	limit, err := strconv.Atoi(limitVal)
 	if err != nil {
-		errorResponse(writer, http.StatusBadRequest,
+		errorResponse(writer, request, http.StatusBadRequest,
 			fmt.Sprintf("query \"limit\" only accepts integers: received %s", limitVal))
 		return
 	}
+	if limit > paging.MaxLimit {
+		limit = paging.MaxLimit
+	}
 
 	offsetVal := query.Get("offset")
 	if offsetVal == "" {
 		offsetVal = DEFAULT_OFFSET
 	}
-	var offset int
 	offset, err = strconv.Atoi(offsetVal)
 	if err != nil {
-		errorResponse(writer, http.StatusBadRequest,
+		errorResponse(writer, request, http.StatusBadRequest,
 			fmt.Sprintf("query \"offset\" only accepts integers: received %s", offsetVal))
 		return
 	}
 
+	return limit, offset, true
+}
+
+// parsePhoneFormat reads the phoneformat query parameter, the format telephone numbers are given out in, defaulting
+// to the configured format
+// writes a 400 response and returns false if it is not one of the formats
+func parsePhoneFormat(writer http.ResponseWriter, request *http.Request) (format string, ok bool) {
+	format = request.URL.Query().Get("phoneformat")
+	if format == "" {
+		return models.PHONE_FORMAT, true
+	}
+	if !models.ValidPhoneFormat(format) {
+		errorResponse(writer, request, http.StatusBadRequest, fmt.Sprintf(
+			"query \"phoneformat\" only accepts e164, national or international: received %s", format))
+		return "", false
+	}
+
+	return format, true
+}
+
+// formatTelephones formats the telephone numbers of the users in the format
+func formatTelephones(users []models.UserModel, format string) {
+	for i := range users {
+		users[i].FormatTelephone(format)
+	}
+}
+
+// GetAllUsers gets all users, optionally only those in a group (including its subgroups)
+func (c *UserControllerV1) GetAllUsers(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "UserControllerV1.GetAllUsers")
+	defer span.End()
+
+	limit, offset, ok := parsePaging(writer, request, c.Service.Config.Paging)
+	if !ok {
+		return
+	}
+	phoneFormat, ok := parsePhoneFormat(writer, request)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+	if query.Get("group") != "" && query.Get("telephone") != "" {
+		errorResponse(writer, request, http.StatusBadRequest, "query \"group\" can not be used with \"telephone\"")
+		return
+	}
+	// ?attr.<name>=value filters on the value of an attribute
+	attributes := make(map[string]string)
+	for key := range query {
+		if strings.HasPrefix(key, models.ATTRIBUTE_FILTER_PREFIX) {
+			attributes[strings.TrimPrefix(key, models.ATTRIBUTE_FILTER_PREFIX)] = query.Get(key)
+		}
+	}
+	if len(attributes) > 0 && (query.Get("group") != "" || query.Get("telephone") != "") {
+		errorResponse(writer, request, http.StatusBadRequest,
+			"query \"attr\" can not be used with \"group\" or \"telephone\"")
+		return
+	}
+
 	var users []models.UserModel
-	users, err = models.GetUsers(c.Service.Dbh, "all", "", limit, offset)
+	var err error
+	if groupVal := query.Get("group"); groupVal != "" {
+		groupID, convErr := strconv.Atoi(groupVal)
+		if convErr != nil {
+			errorResponse(writer, request, http.StatusBadRequest,
+				fmt.Sprintf("query \"group\" only accepts integers: received %s", groupVal))
+			return
+		}
+		users, err = models.GetGroupMembers(request.Context(), c.Service.Dbh, organizationID(request), groupID,
+			true, limit, offset)
+	} else if len(attributes) > 0 {
+		users, err = models.GetUsersByAttributes(request.Context(), c.Service.Dbh, organizationID(request), attributes,
+			limit, offset)
+	} else if telephoneVal := query.Get("telephone"); telephoneVal != "" {
+		// The number can be in any format, as it is normalized before searching
+		users, err = models.GetUsers(request.Context(), c.Service.Dbh, organizationID(request), "telephone",
+			telephoneVal, limit, offset)
+	} else {
+		users, err = models.GetUsers(request.Context(), c.Service.Dbh, organizationID(request), "all", "", limit, offset)
+	}
 	if err != nil {
-		errorResponse(writer, http.StatusInternalServerError, err.Error())
+		errResponse(writer, request, err)
 	} else {
 		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
 		if len(users) == 0 {
 			users = make([]models.UserModel, 0)
 		}
+		formatTelephones(users, phoneFormat)
 		jsonResponse(writer, http.StatusOK, users)
 	}
 }
 
 // GetUserById searches for a User by the specified ID
 func (c *UserControllerV1) GetUserById(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "UserControllerV1.GetUserById")
+	defer span.End()
+
 	vars := mux.Vars(request)
 	idVal := vars["id"]
 	// We simply do this to validate it's an integer
 	_, err := strconv.Atoi(idVal)
 	if err != nil {
-		errorResponse(writer, http.StatusBadRequest, fmt.Sprintf("Invalid ID %s", idVal))
+		errorResponse(writer, request, http.StatusBadRequest, fmt.Sprintf("Invalid ID %s", idVal))
+		return
+	}
+	phoneFormat, ok := parsePhoneFormat(writer, request)
+	if !ok {
 		return
 	}
 
 	var users []models.UserModel
-	users, err = models.GetUsers(c.Service.Dbh, "id", idVal, 1, 0)
+	users, err = models.GetUsers(request.Context(), c.Service.Dbh, organizationID(request), "id", idVal, 1, 0)
 	if err != nil {
-		errorResponse(writer, http.StatusInternalServerError, err.Error())
+		errResponse(writer, request, err)
+	} else if len(users) == 0 {
+		errResponse(writer, request, apperror.NotFound("No User with ID %s found", idVal))
 	} else {
 		// return the first element of the slice so it isn't serialized as an array
+		users[0].FormatTelephone(phoneFormat)
 		jsonResponse(writer, http.StatusOK, users[0])
 	}
 }
 
 // GetUserById updates the user by the specified ID
 func (c *UserControllerV1) UpdateUser(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "UserControllerV1.UpdateUser")
+	defer span.End()
+
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+	phoneFormat, ok := parsePhoneFormat(writer, request)
+	if !ok {
+		return
+	}
+
+	var user models.UserModel
+	if err = decodeJSON(request, &user); err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+
+	if id != user.ID {
+		errorResponse(writer, request, http.StatusBadRequest, "changing ID is not permitted")
+		return
+	}
+
+	if !c.Auth.selfOrPrivileged(writer, request, id, "update the user") || !checkPassword(writer, request, user) {
+		return
+	}
+
+	user.OrgID = organizationID(request)
+	err = user.Update(request.Context(), c.Service.Dbh)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		//blank the password so we don't return it
+		user.Password = ""
+		user.FormatTelephone(phoneFormat)
+
+		jsonResponse(writer, http.StatusOK, user)
+	}
+}
+
+// PatchUser updates only the fields given in the body of the user by the specified ID, so a client can change a
+// field without sending the rest of the user back
+func (c *UserControllerV1) PatchUser(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "UserControllerV1.PatchUser")
+	defer span.End()
+
+	if !validateRequest(writer, request) { // Make sure we only accept JSON
+		return
+	}
+
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		errorResponse(writer, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+	phoneFormat, ok := parsePhoneFormat(writer, request)
+	if !ok {
 		return
 	}
 
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	}
+	// The body is decoded twice: for the values, and for which fields it has
 	var user models.UserModel
-	decoder := json.NewDecoder(request.Body)
-	err = decoder.Decode(&user)
+	var given map[string]json.RawMessage
+	if err = unmarshalJSON(body, &user); err == nil {
+		err = unmarshalJSON(body, &given)
+	}
 	if err != nil {
-		errorResponse(writer, http.StatusInternalServerError, err.Error())
+		errResponse(writer, request, err)
 		return
 	}
 
-	if id != user.ID {
-		errorResponse(writer, http.StatusBadRequest, "changing ID is not permitted")
+	var fields []string
+	for key := range given {
+		// Field names are matched without regard to case, as when decoding the user
+		if field := strings.ToLower(key); field != "id" {
+			fields = append(fields, field)
+		} else if user.ID != id {
+			errorResponse(writer, request, http.StatusBadRequest, "changing ID is not permitted")
+			return
+		}
+	}
+	sort.Strings(fields)
+
+	user.ID = id
+	if !c.Auth.selfOrPrivileged(writer, request, id, "update the user") || !checkPassword(writer, request, user) {
 		return
 	}
 
-	err = user.Update(c.Service.Dbh)
-	if err == sql.ErrNoRows {
-		errorResponse(writer, http.StatusNotFound, fmt.Sprintf("no user with id %d found", user.ID))
-	} else if err != nil {
-		errorResponse(writer, http.StatusInternalServerError, err.Error())
+	user.OrgID = organizationID(request)
+	if err = user.Patch(request.Context(), c.Service.Dbh, fields); err != nil {
+		errResponse(writer, request, err)
 	} else {
 		//blank the password so we don't return it
 		user.Password = ""
+		user.FormatTelephone(phoneFormat)
 
 		jsonResponse(writer, http.StatusOK, user)
 	}
 }
 
-// AuthenticateUser using http basic auth, tests for valid credentials
+// AuthenticateUser using http basic auth, tests for valid credentials. Invalid credentials are rejected by the
+// Authenticator before reaching here, so only anonymous requests need turning away
 func (c *UserControllerV1) AuthenticateUser(writer http.ResponseWriter, request *http.Request) {
-	if c.checkAuthentication(request) {
+	request, span := traceHandler(request, "UserControllerV1.AuthenticateUser")
+	defer span.End()
+
+	if requestPrincipal(request) != nil {
 		jsonResponse(writer, http.StatusOK, models.Message{Message: "Success"})
 	} else {
-		errorResponse(writer, http.StatusUnauthorized, "Invalid credentials")
+		errorResponse(writer, request, http.StatusUnauthorized, "Invalid credentials")
 	}
 }
 
-// checkAuthentication Given a request, checks for basic auth and validates credentials
-// separated so it can be used to provide authentication for other routers
-func (c *UserControllerV1) checkAuthentication(request *http.Request) bool {
-	username, password, success := request.BasicAuth()
-	if success {
-		hashedPassword, err := models.GetUserCredentials(c.Service.Dbh, username)
-		if err == nil && password != "" {
-			if models.CheckPassword(hashedPassword, password) {
-				return true
-			}
-		}
+// GetUserGroups lists the effective groups of the user, including groups inherited through nesting
+func (c *UserControllerV1) GetUserGroups(writer http.ResponseWriter, request *http.Request) {
+	request, span := traceHandler(request, "UserControllerV1.GetUserGroups")
+	defer span.End()
+
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		errorResponse(writer, request, http.StatusBadRequest, "Invalid ID "+vars["id"])
+		return
+	}
+
+	var users []models.UserModel
+	users, err = models.GetUsers(request.Context(), c.Service.Dbh, organizationID(request), "id", vars["id"], 1, 0)
+	if err != nil {
+		errResponse(writer, request, err)
+		return
+	} else if len(users) == 0 {
+		errResponse(writer, request, apperror.NotFound("No User with ID %d found", id))
+		return
 	}
 
-	return false
+	var groups []models.UserGroupModel
+	groups, err = models.GetUserGroups(request.Context(), c.Service.Dbh, organizationID(request), id)
+	if err != nil {
+		errResponse(writer, request, err)
+	} else {
+		// if we don't have any, make an empty slice so it serializes as "[]" instead of null
+		if len(groups) == 0 {
+			groups = make([]models.UserGroupModel, 0)
+		}
+		jsonResponse(writer, http.StatusOK, groups)
+	}
 }
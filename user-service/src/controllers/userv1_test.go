@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEndedRequests Checks a request whose context ends is answered 503 when canceled and 504 when timed out,
+// without its query reaching the database
+func TestEndedRequests(t *testing.T) {
+	// Nothing listens on port 1, so a query reaching the database would fail with a connection error instead
+	dbh, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable")
+	if err != nil {
+		t.Fatalf("Caught error while opening the database: %s", err)
+	}
+	defer dbh.Close()
+	c := UserControllerV1{Service: &service.UserService{Dbh: &database.PostGresDB{PgDbSession: dbh},
+		Config: config.Default()}}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	timedOut, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	for ctx, expected := range map[context.Context]int{canceled: http.StatusServiceUnavailable,
+		timedOut: http.StatusGatewayTimeout} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/user", nil).WithContext(ctx)
+		recorder.Header().Set("X-Request-ID", "request-1")
+		c.GetAllUsers(recorder, request)
+
+		if recorder.Code != expected {
+			t.Errorf("Ended request expected to return %d, got %d: %s", expected, recorder.Code, recorder.Body)
+		}
+		var response models.ErrorMessage
+		if err = json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Caught error while decoding the response: %s", err)
+		}
+		if response.RequestID != "request-1" {
+			t.Errorf("Error response expected to carry the request id, got %+v", response)
+		}
+	}
+}
+
+// TestGroupFilter Checks the group filter only takes a group id, and can't be combined with the other filters,
+// before the database is reached
+func TestGroupFilter(t *testing.T) {
+	c := UserControllerV1{Service: &service.UserService{Config: config.Default()}}
+	for _, query := range []string{"group=admins", "group=1.5", "group=1&telephone=2125550123",
+		"group=1&attr.department=sales"} {
+		recorder := httptest.NewRecorder()
+		c.GetAllUsers(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/user?"+query, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("Query %s expected to return 400, got %d: %s", query, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+// TestUserOwner Checks users can only be changed or deleted by themselves or an admin, and their password only by
+// themselves authenticated with their password, before the database is reached
+func TestUserOwner(t *testing.T) {
+	svc := &service.UserService{Config: config.Default()}
+	c := UserControllerV1{Service: svc, Auth: &Authenticator{Service: svc}}
+	key := &models.APIKeyModel{ID: 1}
+	tests := []struct {
+		method    string
+		body      string
+		principal *Principal
+		expected  int
+	}{
+		{http.MethodDelete, "", nil, http.StatusUnauthorized},
+		{http.MethodDelete, "", &Principal{UserID: 2, APIKey: key}, http.StatusForbidden},
+		{http.MethodPut, `{"id": 1, "firstname": "Bob"}`, &Principal{UserID: 2, ActorID: 3}, http.StatusForbidden},
+		{http.MethodPatch, `{"firstname": "Bob"}`, &Principal{UserID: 2, APIKey: key}, http.StatusForbidden},
+		{http.MethodPut, `{"id": 1, "password": "N3w-Passw0rd!"}`, &Principal{UserID: 2, Privileged: true},
+			http.StatusForbidden},
+		{http.MethodPatch, `{"password": "N3w-Passw0rd!"}`, &Principal{UserID: 2, Privileged: true},
+			http.StatusForbidden},
+		{http.MethodPatch, `{"password": "N3w-Passw0rd!"}`, &Principal{UserID: 1, APIKey: key}, http.StatusForbidden},
+		{http.MethodPut, `{"id": 1, "password": "N3w-Passw0rd!"}`, &Principal{UserID: 1, ActorID: 3},
+			http.StatusForbidden},
+	}
+
+	handlers := map[string]http.HandlerFunc{http.MethodDelete: c.DeleteUser, http.MethodPut: c.UpdateUser,
+		http.MethodPatch: c.PatchUser}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/api/v1/user/1", strings.NewReader(test.body))
+		request.Header.Set("Content-Type", "application/json")
+		if test.principal != nil {
+			request = request.WithContext(context.WithValue(request.Context(), principalKey, test.principal))
+		}
+		recorder := httptest.NewRecorder()
+		handlers[test.method](recorder, mux.SetURLVars(request, map[string]string{"id": "1"}))
+		if recorder.Code != test.expected {
+			t.Errorf("%s %s by %+v expected to return %d, got %d: %s", test.method, test.body, test.principal,
+				test.expected, recorder.Code, recorder.Body)
+		}
+	}
+}
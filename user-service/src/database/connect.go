@@ -0,0 +1,186 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/lib/pq"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// CONNECT_ATTEMPT_TIMEOUT limits each attempt to reach the database while connecting
+const CONNECT_ATTEMPT_TIMEOUT = 5 * time.Second
+
+// CONNECT_BACKOFF_MIN and CONNECT_BACKOFF_MAX bound the wait between attempts to connect, which doubles after
+// each failed attempt
+const (
+	CONNECT_BACKOFF_MIN = 250 * time.Millisecond
+	CONNECT_BACKOFF_MAX = 10 * time.Second
+)
+
+// dsnValue quotes a value for a libpq key=value connection string
+func dsnValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// ConnectionString returns the libpq connection string for the configuration: its URL, converted to key=value
+// pairs if it is a postgres:// URL, or else one built from its host, port, user, password, name and ssl settings.
+// Settings missing from the string are read by lib/pq from the PG* environment
+func ConnectionString(cfg config.DatabaseConfig) (string, error) {
+	if strings.HasPrefix(cfg.URL, "postgres://") || strings.HasPrefix(cfg.URL, "postgresql://") {
+		return pq.ParseURL(cfg.URL)
+	} else if cfg.URL != "" {
+		return cfg.URL, nil
+	}
+
+	settings := []struct{ key, value string }{
+		{"host", cfg.Host}, {"port", cfg.Port}, {"user", cfg.User}, {"password", cfg.Password},
+		{"dbname", cfg.Name}, {"sslmode", cfg.SSLMode}, {"sslrootcert", cfg.SSLRootCert}, {"sslcert", cfg.SSLCert},
+		{"sslkey", cfg.SSLKey},
+	}
+	pairs := make([]string, 0, len(settings))
+	for _, setting := range settings {
+		if setting.value != "" {
+			pairs = append(pairs, setting.key+"="+dsnValue(setting.value))
+		}
+	}
+
+	return strings.Join(pairs, " "), nil
+}
+
+// retryable reports whether connecting may succeed if tried again: the database can't be reached yet, or is
+// starting up or out of connections. Errors such as a wrong password or unknown database are not retried
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		class := pqErr.Code.Class()
+		// 08 connection exception, 53 insufficient resources, 57 operator intervention such as starting up
+		return class == "08" || class == "53" || class == "57"
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || strings.Contains(err.Error(), "EOF")
+}
+
+// ping pings the database until it answers, ctx ends or retryFor passes, waiting longer after each failed attempt
+func ping(ctx context.Context, dbh *sql.DB, retryFor time.Duration, logger *logging.Logger) error {
+	deadline := time.Now().Add(retryFor)
+	backoff := CONNECT_BACKOFF_MIN
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, CONNECT_ATTEMPT_TIMEOUT)
+		err := dbh.PingContext(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if !retryable(err) {
+			return err
+		}
+
+		// Jitter so instances booting together don't retry in step
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+		logger.Warn("Unable to reach the database, retrying", logging.Fields{"attempt": attempt, "retryin": wait,
+			"error": err})
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > CONNECT_BACKOFF_MAX {
+			backoff = CONNECT_BACKOFF_MAX
+		}
+	}
+}
+
+// replicaConnectionString returns the connection string of the replica at address, host:port: that of the database
+// with the host and port replaced, as the later of repeated keys wins
+func replicaConnectionString(connectString, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	return connectString + " host=" + dsnValue(host) + " port=" + dsnValue(port), nil
+}
+
+// Connect opens a pool of connections to the database with the configured limits, then waits for the database to
+// answer, retrying for up to database.connect_retry so the service can start before the database is ready.
+// Replicas are opened alongside but not waited for: until a health check reaches them, reads go to the database
+func Connect(ctx context.Context, cfg config.DatabaseConfig, logger *logging.Logger) (*PostGresDB, error) {
+	connectString, err := ConnectionString(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Missing certificates won't appear by retrying
+	for _, path := range []string{cfg.SSLRootCert, cfg.SSLCert, cfg.SSLKey} {
+		if _, err = os.Stat(path); path != "" && err != nil {
+			return nil, err
+		}
+	}
+
+	connector, err := pq.NewConnector(connectString)
+	if err != nil {
+		return nil, err
+	}
+	dbh := sql.OpenDB(connector)
+	dbh.SetMaxOpenConns(cfg.MaxOpenConns)
+	dbh.SetMaxIdleConns(cfg.MaxIdleConns)
+	dbh.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	if err = ping(ctx, dbh, cfg.ConnectRetry, logger); err != nil {
+		_ = dbh.Close()
+		return nil, err
+	}
+
+	pgdbh := &PostGresDB{PgDbSession: dbh, connectionString: connectString, Timeouts: Timeouts{Read: cfg.ReadTimeout,
+		List: cfg.ListTimeout, Write: cfg.WriteTimeout, Bulk: cfg.BulkTimeout}}
+	if err = dbh.QueryRowContext(ctx, `SELECT current_database()`).Scan(&pgdbh.Name); err != nil {
+		_ = dbh.Close()
+		return nil, err
+	}
+
+	pgdbh.MaxReplicaLag, pgdbh.ReadYourWrites, pgdbh.logger = cfg.ReplicaMaxLag, cfg.ReadYourWrites, logger
+	for _, address := range cfg.ReplicaList() {
+		replicaString, err := replicaConnectionString(connectString, address)
+		if err == nil {
+			connector, err = pq.NewConnector(replicaString)
+		}
+		if err != nil {
+			pgdbh.Disconnect()
+			return nil, fmt.Errorf("replica %s: %w", address, err)
+		}
+		replicaDbh := sql.OpenDB(connector)
+		replicaDbh.SetMaxOpenConns(cfg.MaxOpenConns)
+		replicaDbh.SetMaxIdleConns(cfg.MaxIdleConns)
+		replicaDbh.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+		pgdbh.replicas = append(pgdbh.replicas, &replica{name: address, db: replicaDbh, excluded: EXCLUDED_UNREACHABLE,
+			detail: "not checked yet"})
+	}
+	pgdbh.CheckReplicas(ctx)
+	for _, status := range pgdbh.Replicas() {
+		logger.Info("Connected to replica", logging.Fields{"replica": status.Name, "healthy": status.Healthy,
+			"lag": status.Lag, "detail": status.Detail})
+	}
+
+	return pgdbh, nil
+}
+
+// ReplicaHandles returns the connection pool of each replica by its address, such as to collect its statistics
+func (pgdbh *PostGresDB) ReplicaHandles() map[string]*sql.DB {
+	handles := make(map[string]*sql.DB, len(pgdbh.replicas))
+	for _, r := range pgdbh.replicas {
+		handles[r.name] = r.db
+	}
+	return handles
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionString(t *testing.T) {
+	cfg := config.Default().Database
+	cfg.Host, cfg.User, cfg.Name, cfg.Password = "db.internal", "user", "userservice", `it's a p\\ss`
+	cfg.SSLMode, cfg.SSLRootCert = "verify-full", "/etc/ssl/db-ca.pem"
+
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"", `host='db.internal' port='5432' user='user' password='it\'s a p\\\\ss' dbname='userservice' ` +
+			`sslmode='verify-full' sslrootcert='/etc/ssl/db-ca.pem'`},
+		{"host=other dbname=other", "host=other dbname=other"},
+		{"postgres://u:pw@other:6543/otherdb?sslmode=require", "dbname='otherdb' host='other' password='pw' " +
+			"port='6543' sslmode='require' user='u'"},
+	}
+
+	for _, test := range tests {
+		cfg.URL = test.url
+		connectString, err := ConnectionString(cfg)
+		if err != nil {
+			t.Errorf("URL |%s| expected to pass, failed: %s", test.url, err)
+		} else if connectString != test.expected {
+			t.Errorf("URL |%s| expected connection string |%s|, got |%s|", test.url, test.expected, connectString)
+		}
+	}
+
+	// Every value must parse back to what was configured
+	cfg.URL = ""
+	connectString, _ := ConnectionString(cfg)
+	if _, err := pq.NewConnector(connectString); err != nil {
+		t.Errorf("Connection string expected to parse, failed: %s", err)
+	}
+}
+
+// TestReplicaConnectionString Checks a replica is connected to with the settings of the database but its own address
+func TestReplicaConnectionString(t *testing.T) {
+	connectString, err := replicaConnectionString("host='db' port='5432' user='user' dbname='userservice'",
+		"replica1:6432")
+	if err != nil {
+		t.Fatalf("Replica expected to pass, failed: %s", err)
+	}
+
+	// libpq takes the last of repeated keys
+	if !strings.HasSuffix(connectString, " host='replica1' port='6432'") {
+		t.Errorf("Replica connection string expected to end with its address, got |%s|", connectString)
+	}
+	if _, err = pq.NewConnector(connectString); err != nil {
+		t.Errorf("Replica connection string expected to parse, failed: %s", err)
+	}
+	if _, err = replicaConnectionString(connectString, "replica1"); err == nil {
+		t.Errorf("Replica without a port expected to fail, passed")
+	}
+}
+
+// flakyConnector opens connections to a fake database that fails with err the first failures times it is reached
+type flakyConnector struct {
+	failures int
+	err      error
+	attempts int
+}
+
+func (c *flakyConnector) Connect(context.Context) (driver.Conn, error) {
+	c.attempts++
+	if c.attempts <= c.failures {
+		return nil, c.err
+	}
+	return &blockingConn{&blockingConnector{}}, nil
+}
+
+func (c *flakyConnector) Driver() driver.Driver { return nil }
+
+// TestPingRetries Checks connecting retries while the database can't be reached, but not when it refuses the
+// connection, and gives up once the retry period passes
+func TestPingRetries(t *testing.T) {
+	logger := logging.New(ioutil.Discard, logging.LEVEL_INFO)
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		retryFor time.Duration
+		attempts int
+		fails    bool
+	}{
+		{"starting", 2, unreachable, time.Minute, 3, false},
+		{"starting up", 1, &pq.Error{Code: "57P03"}, time.Minute, 2, false},
+		{"wrong password", 5, &pq.Error{Code: "28P01"}, time.Minute, 1, true},
+		{"down", 100, unreachable, 0, 1, true},
+	}
+
+	for _, test := range tests {
+		connector := &flakyConnector{failures: test.failures, err: test.err}
+		dbh := sql.OpenDB(connector)
+		err := ping(context.Background(), dbh, test.retryFor, logger)
+		_ = dbh.Close()
+
+		if (err != nil) != test.fails {
+			t.Errorf("Database %s expected to fail %t, got %v", test.name, test.fails, err)
+		}
+		if connector.attempts != test.attempts {
+			t.Errorf("Database %s expected %d attempts, got %d", test.name, test.attempts, connector.attempts)
+		}
+	}
+}
+
+func TestPingCanceled(t *testing.T) {
+	connector := &flakyConnector{failures: 100, err: &net.OpError{Op: "dial", Err: errors.New("refused")}}
+	dbh := sql.OpenDB(connector)
+	defer dbh.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ping(ctx, dbh, time.Hour, logging.New(ioutil.Discard, logging.LEVEL_INFO)); err != ctx.Err() {
+		t.Errorf("Connecting expected to stop when its context ends, got %v", err)
+	}
+}
+
+func TestConnectMissingCertificate(t *testing.T) {
+	cfg := config.Default().Database
+	cfg.Host, cfg.User, cfg.Name, cfg.SSLMode = "localhost", "user", "userservice", "verify-ca"
+	cfg.SSLRootCert = "/nonexistent/root.crt"
+
+	start := time.Now()
+	_, err := Connect(context.Background(), cfg, logging.New(ioutil.Discard, logging.LEVEL_INFO))
+	if err == nil || !strings.Contains(err.Error(), "root.crt") {
+		t.Errorf("Missing certificate expected to be reported, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Missing certificate expected not to be retried")
+	}
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Migration is a single versioned change to the schema. Versions are applied in ascending order and each is
+// applied exactly once
+type Migration struct {
+	Version   int
+	Name      string
+	Statement string
+	// Apply, if set, makes the changes SQL can't, such as those computed in Go, after Statement and in the same
+	// transaction
+	Apply func(tx *sql.Tx) error
+}
+
+const migrationSchema string = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INT PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// migrationLockID is the advisory lock key held while migrating so that several instances booting at once
+// don't race to apply the same migration
+const migrationLockID = 7267321
+
+// Migrate applies any migrations that have not been applied yet. Each migration runs in its own transaction
+func (pgdbh *PostGresDB) Migrate(migrations []Migration) error {
+	if _, err := pgdbh.PgDbSession.Exec(migrationSchema); err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if err := pgdbh.applyMigration(migration); err != nil {
+			return fmt.Errorf("migration %d (%s): %s", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration applies the migration if it has not already been applied
+func (pgdbh *PostGresDB) applyMigration(migration Migration) error {
+	tx, err := pgdbh.PgDbSession.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+
+	var applied bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, migration.Version).
+		Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	if _, err = tx.Exec(migration.Statement); err != nil {
+		return err
+	}
+	if migration.Apply != nil {
+		if err = migration.Apply(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MigrationVersion returns the version of the latest migration applied, 0 if none have been
+func (pgdbh *PostGresDB) MigrationVersion(ctx context.Context) (version int, err error) {
+	err = pgdbh.PgDbSession.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).
+		Scan(&version)
+	return
+}
@@ -1,17 +1,71 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"regexp"
-
-	_ "github.com/lib/pq"
+	"strconv"
+	"time"
 )
 
 type PostGresDB struct {
 	PgDbSession      *sql.DB
 	connectionString string
+	// Name is the name of the database connected to
+	Name string
+	// Timeouts limit how long each kind of operation may run. Zero leaves it unlimited
+	Timeouts Timeouts
+	// ReadYourWrites sends reads made after a write by the same request to the primary, see TrackWrites
+	ReadYourWrites bool
+	// MaxReplicaLag is how far behind the primary a replica can fall before reads stop being sent to it
+	MaxReplicaLag time.Duration
+
+	replicas []*replica
+	// logger reports replicas being excluded and readmitted
+	logger *logging.Logger
+	// nextReplica picks the replica of the next read, in turn
+	nextReplica uint32
+}
+
+// Operation is a kind of database operation, which decides its timeout
+type Operation int
+
+const (
+	// OP_READ looks up a single row, such as when authenticating
+	OP_READ Operation = iota
+	// OP_LIST lists or counts rows
+	OP_LIST
+	// OP_WRITE creates, updates or deletes rows
+	OP_WRITE
+	// OP_BULK reads or writes many rows at once, such as importing or exporting users
+	OP_BULK
+)
+
+// Timeouts is how long each kind of operation may run
+type Timeouts struct {
+	Read  time.Duration
+	List  time.Duration
+	Write time.Duration
+	Bulk  time.Duration
+}
+
+// WithTimeout returns ctx limited to the timeout of the operation
+func (pgdbh *PostGresDB) WithTimeout(ctx context.Context, op Operation) (context.Context, context.CancelFunc) {
+	timeout := map[Operation]time.Duration{OP_READ: pgdbh.Timeouts.Read, OP_LIST: pgdbh.Timeouts.List,
+		OP_WRITE: pgdbh.Timeouts.Write, OP_BULK: pgdbh.Timeouts.Bulk}[op]
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ContextEnded reports whether err is a context being canceled or passing its deadline
+func ContextEnded(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
 }
 
 // ErrDuplicateKey is used to signify a duplicate key error
@@ -23,29 +77,110 @@ func DuplicateKeyError(err error) bool {
 	return duplicateKeyErrRegex.MatchString(err.Error())
 }
 
-func Connect(host, user, pass, db, port string) (*PostGresDB, error) {
+// DuplicateKeyConstraint returns the name of the unique constraint a Duplicate Key Error violated, "" if err isn't one
+func DuplicateKeyConstraint(err error) string {
+	if match := duplicateKeyErrRegex.FindStringSubmatch(err.Error()); match != nil {
+		return match[1]
+	}
+	return ""
+}
 
-	connectString := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, pass, db)
+// ErrForeignKey is used to signify a reference to a row that does not exist
+var ErrForeignKey = errors.New("database.postgres.foreignkey")
+var foreignKeyErrRegex = regexp.MustCompile("pq: insert or update on table \"([^\"]*)\" violates foreign key constraint")
 
-	dbh, err := sql.Open("postgres", connectString)
-	if err != nil {
-		return nil, err
-	} else if dbh == nil {
-		return nil, errors.New("postgres Open returned nil")
+// ForeignKeyError tests an error to see if it is a Foreign Key violation
+func ForeignKeyError(err error) bool {
+	return foreignKeyErrRegex.MatchString(err.Error())
+}
+
+// Disconnect close down our database connection, and those to the replicas
+func (pgdbh *PostGresDB) Disconnect() {
+	_ = pgdbh.PgDbSession.Close()
+	for _, r := range pgdbh.replicas {
+		_ = r.db.Close()
 	}
+}
 
-	err = dbh.Ping()
+// Ping checks the database can be reached
+func (pgdbh *PostGresDB) Ping(ctx context.Context) error {
+	return pgdbh.PgDbSession.PingContext(ctx)
+}
+
+// TenantRole is the role tenant scoped transactions switch to. Row level security policies are not applied to
+// superusers or table owners, so the service steps down to this role to have them enforced
+const TenantRole = "user_service_tenant"
+
+// transaction runs fn inside a transaction on dbh, committed if fn returns nil. The transaction and its statements
+// run under ctx, limited to the timeout of the operation: if ctx is canceled or the timeout passes, the statement
+// running is canceled on the server and the transaction rolled back. The error is then ctx's, context.Canceled or
+// context.DeadlineExceeded, rather than whichever error the driver reported
+func (pgdbh *PostGresDB) transaction(ctx context.Context, dbh *sql.DB, options *sql.TxOptions, op Operation,
+	fn func(tx *Tx) error) (err error) {
+	ctx, cancel := pgdbh.WithTimeout(ctx, op)
+	defer cancel()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	sqlTx, err := dbh.BeginTx(ctx, options)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer func() { _ = sqlTx.Rollback() }()
+
+	if err = fn(&Tx{Tx: sqlTx, ctx: ctx}); err != nil {
+		return err
 	}
 
-	pgdbh := &PostGresDB{dbh, connectString}
+	return sqlTx.Commit()
+}
 
-	return pgdbh, nil
+// InTransaction runs fn inside a transaction on the primary, see transaction. Writes are recorded against ctx, so
+// later reads of the same request can be sent to the primary too
+func (pgdbh *PostGresDB) InTransaction(ctx context.Context, op Operation, fn func(tx *Tx) error) error {
+	if op == OP_WRITE || op == OP_BULK {
+		recordWrite(ctx)
+	}
+	return pgdbh.transaction(ctx, pgdbh.PgDbSession, nil, op, fn)
 }
 
-// Disconnect close down our database connection
-func (pgdbh *PostGresDB) Disconnect() {
-	_ = pgdbh.PgDbSession.Close()
+// inTenant scopes the transaction fn runs in to the organization orgID before running it
+func inTenant(orgID int, fn func(tx *Tx) error) func(tx *Tx) error {
+	return func(tx *Tx) error {
+		if _, err := tx.Exec(`SET LOCAL ROLE ` + TenantRole); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`SELECT set_config('app.org_id', $1, true)`, strconv.Itoa(orgID)); err != nil {
+			return err
+		}
+
+		return fn(tx)
+	}
+}
+
+// InTenant is InTransaction with the transaction scoped to the organization orgID. Row level security only exposes
+// rows belonging to that organization to statements run on tx
+func (pgdbh *PostGresDB) InTenant(ctx context.Context, op Operation, orgID int, fn func(tx *Tx) error) (err error) {
+	ctx, span := tracing.Start(ctx, "InTenant", attribute.Int("org_id", orgID))
+	defer func() { tracing.End(span, err) }()
+
+	return pgdbh.InTransaction(ctx, op, inTenant(orgID, fn))
+}
+
+// detached is a context with the values of its parent but none of its cancellation
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// Detach returns a context carrying the values of ctx, such as its span, that is never canceled. For writes that
+// must happen even if the request that makes them ends first, such as recording an audit event
+func Detach(ctx context.Context) context.Context {
+	return detached{ctx}
 }
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingConnector opens connections to a fake database on which any statement calling pg_sleep blocks until its
+// context ends, recording the statements that were aborted that way
+type blockingConnector struct {
+	mutex    sync.Mutex
+	started  chan string
+	aborted  []string
+	rollback int
+	commit   int
+}
+
+func (c *blockingConnector) Connect(context.Context) (driver.Conn, error) {
+	return &blockingConn{c}, nil
+}
+func (c *blockingConnector) rollbacks() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.rollback
+}
+
+func (c *blockingConnector) Driver() driver.Driver { return nil }
+
+type blockingConn struct {
+	connector *blockingConnector
+}
+
+func (c *blockingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *blockingConn) Close() error                        { return nil }
+func (c *blockingConn) Begin() (driver.Tx, error)           { return c, nil }
+
+func (c *blockingConn) BeginTx(ctx context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	return c, ctx.Err()
+}
+
+func (c *blockingConn) Commit() error {
+	c.connector.mutex.Lock()
+	defer c.connector.mutex.Unlock()
+	c.connector.commit++
+	return nil
+}
+
+func (c *blockingConn) Rollback() error {
+	c.connector.mutex.Lock()
+	defer c.connector.mutex.Unlock()
+	c.connector.rollback++
+	return nil
+}
+
+// ExecContext blocks statements calling pg_sleep until ctx ends, like lib/pq canceling the statement on the server
+func (c *blockingConn) ExecContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if !strings.Contains(query, "pg_sleep") {
+		return driver.RowsAffected(0), nil
+	}
+
+	c.connector.started <- query
+	<-ctx.Done()
+	c.connector.mutex.Lock()
+	defer c.connector.mutex.Unlock()
+	c.connector.aborted = append(c.connector.aborted, query)
+	return nil, errors.New("pq: canceling statement due to user request")
+}
+
+// blockingDB returns a PostGresDB connected to a fake database that blocks statements calling pg_sleep
+func blockingDB(t *testing.T) (*PostGresDB, *blockingConnector) {
+	connector := &blockingConnector{started: make(chan string, 1)}
+	db := &PostGresDB{PgDbSession: sql.OpenDB(connector)}
+	t.Cleanup(db.Disconnect)
+	return db, connector
+}
+
+// sleep runs a statement that only ends when its context does
+func sleep(tx *Tx) error {
+	_, err := tx.Exec(`SELECT pg_sleep(60)`)
+	return err
+}
+
+// TestInTenantCanceled Checks canceling the context of a transaction aborts the statement it is running and rolls
+// the transaction back, reporting the cancellation rather than the driver's error
+func TestInTenantCanceled(t *testing.T) {
+	db, connector := blockingDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-connector.started
+		cancel()
+	}()
+
+	start := time.Now()
+	err := db.InTenant(ctx, OP_LIST, 1, sleep)
+	if err != context.Canceled {
+		t.Errorf("Canceled transaction expected to return context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Canceled transaction expected to return promptly, took %s", elapsed)
+	}
+
+	// database/sql rolls back a transaction whose context ended in the background
+	for deadline := time.Now().Add(time.Second); connector.rollbacks() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	connector.mutex.Lock()
+	defer connector.mutex.Unlock()
+	if len(connector.aborted) != 1 {
+		t.Errorf("Running statement expected to be aborted, aborted %v", connector.aborted)
+	}
+	if connector.commit != 0 || connector.rollback != 1 {
+		t.Errorf("Canceled transaction expected to be rolled back, got %d commits %d rollbacks", connector.commit,
+			connector.rollback)
+	}
+}
+
+// TestInTenantTimeout Checks a statement running past the timeout of its operation is aborted
+func TestInTenantTimeout(t *testing.T) {
+	db, connector := blockingDB(t)
+	db.Timeouts = Timeouts{Read: time.Minute, List: time.Minute, Write: 50 * time.Millisecond}
+
+	err := db.InTenant(context.Background(), OP_WRITE, 1, sleep)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Transaction past its timeout expected to return context.DeadlineExceeded, got %v", err)
+	}
+
+	connector.mutex.Lock()
+	defer connector.mutex.Unlock()
+	if len(connector.aborted) != 1 || connector.commit != 0 {
+		t.Errorf("Statement past its timeout expected to be aborted, aborted %v with %d commits",
+			connector.aborted, connector.commit)
+	}
+}
+
+// TestInTenantCommits Checks a transaction whose context doesn't end is committed, and an ended context isn't
+// blamed for errors returned before it ended
+func TestInTenantCommits(t *testing.T) {
+	db, connector := blockingDB(t)
+	if err := db.InTenant(context.Background(), OP_READ, 1, func(tx *Tx) error { return nil }); err != nil {
+		t.Errorf("Transaction expected to pass, failed: %s", err)
+	}
+	if connector.commit != 1 {
+		t.Errorf("Transaction expected to be committed, got %d commits", connector.commit)
+	}
+
+	failure := errors.New("failed")
+	if err := db.InTenant(context.Background(), OP_READ, 1, func(tx *Tx) error { return failure }); err != failure {
+		t.Errorf("Transaction expected to return the error of fn, got %v", err)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), valueKey{}, "value"))
+	cancel()
+
+	detached := Detach(ctx)
+	if detached.Err() != nil || detached.Done() != nil || detached.Value(valueKey{}) != "value" {
+		t.Errorf("Detached context expected to keep values without being canceled")
+	}
+}
+
+type valueKey struct{}
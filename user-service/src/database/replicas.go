@@ -0,0 +1,259 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/metrics"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a replica is excluded from reads
+const (
+	EXCLUDED_UNREACHABLE  = "unreachable"
+	EXCLUDED_LAGGING      = "lagging"
+	EXCLUDED_DISCONNECTED = "disconnected"
+)
+
+// RECEIVER_TIMEOUT is how long a replica can go without a message from the primary before it is taken to be
+// disconnected from it. An idle primary still sends a keepalive every wal_sender_timeout / 2, 30s by default
+const RECEIVER_TIMEOUT = time.Minute
+
+// replicaLagQuery measures how far a replica's replay is behind the primary, and how long ago its WAL receiver last
+// heard from the primary, NULL if it isn't streaming. A replica that has replayed all it received is caught up,
+// however long ago the last transaction was, but only while it is still receiving. Seeing the WAL receiver needs
+// the pg_read_all_stats role
+const replicaLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END,
+	CASE WHEN NOT pg_is_in_recovery() THEN 0
+	ELSE (SELECT EXTRACT(EPOCH FROM now() - last_msg_receipt_time) FROM pg_stat_wal_receiver
+		WHERE status = 'streaming') END`
+
+// replica is a read-only copy of the primary that reads can be sent to while it is healthy
+type replica struct {
+	// name is the address of the replica
+	name string
+	db   *sql.DB
+
+	mutex sync.Mutex
+	// excluded is why reads aren't sent to the replica, empty while it is healthy
+	excluded string
+	lag      time.Duration
+	checked  time.Time
+	detail   string
+}
+
+func (r *replica) healthy() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.excluded == ""
+}
+
+// exclude stops reads being sent to the replica until a health check finds it healthy again. Reports whether it was
+// healthy until now
+func (r *replica) exclude(reason, detail string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	metrics.ReplicaHealthy.WithLabelValues(r.name).Set(0)
+	changed := r.excluded == ""
+	if changed {
+		metrics.ReplicaExclusions.WithLabelValues(r.name, reason).Inc()
+	}
+	r.excluded, r.detail = reason, detail
+	return changed
+}
+
+// include resumes sending reads to the replica. Reports whether it was excluded until now
+func (r *replica) include() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	metrics.ReplicaHealthy.WithLabelValues(r.name).Set(1)
+	changed := r.excluded != ""
+	r.excluded, r.detail = "", ""
+	return changed
+}
+
+// ReplicaStatus describes a replica as of its last health check
+type ReplicaStatus struct {
+	Name    string        `json:"name"`
+	Healthy bool          `json:"healthy"`
+	Lag     time.Duration `json:"lag"`
+	Checked time.Time     `json:"checked"`
+	Detail  string        `json:"detail,omitempty"`
+}
+
+// Replicas reports the state of the replicas
+func (pgdbh *PostGresDB) Replicas() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, 0, len(pgdbh.replicas))
+	for _, r := range pgdbh.replicas {
+		r.mutex.Lock()
+		statuses = append(statuses, ReplicaStatus{Name: r.name, Healthy: r.excluded == "", Lag: r.lag,
+			Checked: r.checked, Detail: r.detail})
+		r.mutex.Unlock()
+	}
+
+	return statuses
+}
+
+// CheckReplicas measures the lag of each replica. Replicas that can't be reached, lag more than MaxReplicaLag, or
+// haven't heard from the primary within RECEIVER_TIMEOUT are excluded from reads until a later check finds them
+// healthy
+func (pgdbh *PostGresDB) CheckReplicas(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range pgdbh.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, CONNECT_ATTEMPT_TIMEOUT)
+			defer cancel()
+
+			var seconds float64
+			var received sql.NullFloat64
+			err := r.db.QueryRowContext(checkCtx, replicaLagQuery).Scan(&seconds, &received)
+			lag := time.Duration(seconds * float64(time.Second))
+
+			r.mutex.Lock()
+			r.checked = time.Now()
+			if err == nil {
+				r.lag = lag
+			}
+			r.mutex.Unlock()
+
+			fields := logging.Fields{"replica": r.name, "lag": lag}
+			if err != nil {
+				if r.exclude(EXCLUDED_UNREACHABLE, err.Error()) {
+					pgdbh.logger.Warn("Replica unreachable, reading from the database instead",
+						logging.Fields{"replica": r.name, "error": err})
+				}
+				return
+			}
+			metrics.ReplicaLag.WithLabelValues(r.name).Set(seconds)
+			// A replica cut off from the primary replays all it received and then reports no lag, however stale
+			if silence := time.Duration(received.Float64 * float64(time.Second)); !received.Valid ||
+				silence > RECEIVER_TIMEOUT {
+				detail := "not streaming from the primary"
+				if received.Valid {
+					detail = "no message from the primary for " + silence.Round(time.Second).String()
+				}
+				if r.exclude(EXCLUDED_DISCONNECTED, detail) {
+					pgdbh.logger.Warn("Replica disconnected from the primary, reading from the database instead",
+						logging.Fields{"replica": r.name, "detail": detail})
+				}
+			} else if pgdbh.MaxReplicaLag > 0 && lag > pgdbh.MaxReplicaLag {
+				if r.exclude(EXCLUDED_LAGGING, "lagging "+lag.Round(time.Millisecond).String()) {
+					pgdbh.logger.Warn("Replica lagging, reading from the database instead", fields)
+				}
+			} else if r.include() {
+				pgdbh.logger.Info("Replica healthy, reading from it", fields)
+			}
+		}(r)
+	}
+	wg.Wait()
+}
+
+// writeTracker records whether a request has written
+type writeTracker struct {
+	wrote int32
+}
+
+type writeTrackerKey struct{}
+
+// TrackWrites is middleware recording whether each request writes, so that with ReadYourWrites its reads after the
+// write go to the primary and see it, however far behind the replicas are
+func TrackWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), writeTrackerKey{}, &writeTracker{})
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// recordWrite records a write against the request ctx belongs to, if its writes are tracked
+func recordWrite(ctx context.Context) {
+	if tracker, ok := ctx.Value(writeTrackerKey{}).(*writeTracker); ok {
+		atomic.StoreInt32(&tracker.wrote, 1)
+	}
+}
+
+// wrote reports whether the request ctx belongs to has written
+func wrote(ctx context.Context) bool {
+	tracker, ok := ctx.Value(writeTrackerKey{}).(*writeTracker)
+	return ok && atomic.LoadInt32(&tracker.wrote) == 1
+}
+
+// pickReplica returns the next healthy replica in turn, nil if reads must go to the primary
+func (pgdbh *PostGresDB) pickReplica(ctx context.Context) *replica {
+	if len(pgdbh.replicas) == 0 {
+		return nil
+	}
+	if pgdbh.ReadYourWrites && wrote(ctx) {
+		metrics.DBPrimaryReads.WithLabelValues("read_your_writes").Inc()
+		return nil
+	}
+
+	next := int(atomic.AddUint32(&pgdbh.nextReplica, 1))
+	for i := range pgdbh.replicas {
+		if r := pgdbh.replicas[(next+i)%len(pgdbh.replicas)]; r.healthy() {
+			return r
+		}
+	}
+
+	metrics.DBPrimaryReads.WithLabelValues("no_replica").Inc()
+	return nil
+}
+
+// read runs fn in a read-only transaction, prepared by setup if given, on a healthy replica if there is one and on
+// the primary otherwise. If the replica fails before fn runs, it is excluded and fn runs on the primary instead.
+// Once fn has run it isn't run again, as it may have gathered results
+func (pgdbh *PostGresDB) read(ctx context.Context, op Operation, setup func(tx *Tx) error,
+	fn func(tx *Tx) error) error {
+	readOnly := &sql.TxOptions{ReadOnly: true}
+	ran := false
+	run := func(tx *Tx) error {
+		if setup != nil {
+			if err := setup(tx); err != nil {
+				return err
+			}
+		}
+		ran = true
+		return fn(tx)
+	}
+
+	if r := pgdbh.pickReplica(ctx); r != nil {
+		err := pgdbh.transaction(ctx, r.db, readOnly, op, run)
+		if err == nil || ran || ContextEnded(err) {
+			metrics.DBReads.WithLabelValues(r.name).Inc()
+			return err
+		}
+
+		if r.exclude(EXCLUDED_UNREACHABLE, err.Error()) {
+			logging.FromContext(ctx, pgdbh.logger).Warn("Replica unreachable, reading from the database instead",
+				logging.Fields{"replica": r.name, "error": err})
+		}
+		metrics.DBPrimaryReads.WithLabelValues("replica_failed").Inc()
+	}
+
+	metrics.DBReads.WithLabelValues("primary").Inc()
+	return pgdbh.transaction(ctx, pgdbh.PgDbSession, readOnly, op, run)
+}
+
+// InTransactionReadOnly runs fn inside a read-only transaction, on a replica when one is healthy, see read.
+// Replicas may lag the primary by up to MaxReplicaLag, so reads that must see the latest writes, such as
+// authorization checks, belong on InTransaction
+func (pgdbh *PostGresDB) InTransactionReadOnly(ctx context.Context, op Operation, fn func(tx *Tx) error) error {
+	return pgdbh.read(ctx, op, nil, fn)
+}
+
+// InTenantReadOnly is InTransactionReadOnly with the transaction scoped to the organization orgID
+func (pgdbh *PostGresDB) InTenantReadOnly(ctx context.Context, op Operation, orgID int,
+	fn func(tx *Tx) error) (err error) {
+	ctx, span := tracing.Start(ctx, "InTenant", attribute.Int("org_id", orgID), attribute.Bool("read_only", true))
+	defer func() { tracing.End(span, err) }()
+
+	return pgdbh.read(ctx, op, inTenant(orgID, func(tx *Tx) error { return nil }), fn)
+}
@@ -0,0 +1,274 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer opens connections to a fake database that answers the replica lag query with its lag, and with its
+// WAL receiver streaming unless disconnected, counting the transactions begun on it. While down, connecting to it
+// fails
+type fakeServer struct {
+	mutex        sync.Mutex
+	down         bool
+	disconnected bool
+	lag          float64
+	transactions int
+}
+
+func (s *fakeServer) Connect(context.Context) (driver.Conn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down {
+		return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	}
+	return &fakeConn{s}, nil
+}
+
+func (s *fakeServer) Driver() driver.Driver { return nil }
+
+func (s *fakeServer) set(down bool, lag float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.down, s.lag = down, lag
+}
+
+func (s *fakeServer) begun() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.transactions
+}
+
+type fakeConn struct {
+	server *fakeServer
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return c, nil }
+func (c *fakeConn) Commit() error                       { return nil }
+func (c *fakeConn) Rollback() error                     { return nil }
+
+// BeginTx fails connections to a server that went down, so that database/sql discards them and connects again
+func (c *fakeConn) BeginTx(ctx context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	if c.server.down {
+		return nil, driver.ErrBadConn
+	}
+	c.server.transactions++
+	return c, ctx.Err()
+}
+
+func (c *fakeConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	if c.server.down {
+		return nil, driver.ErrBadConn
+	}
+	return &lagRows{lag: c.server.lag, disconnected: c.server.disconnected}, nil
+}
+
+// lagRows is the single row answering the replica lag query
+type lagRows struct {
+	lag          float64
+	disconnected bool
+	read         bool
+}
+
+func (r *lagRows) Columns() []string { return []string{"lag", "received"} }
+func (r *lagRows) Close() error      { return nil }
+
+func (r *lagRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	dest[0], dest[1] = r.lag, 1.0
+	if r.disconnected {
+		dest[1] = nil
+	}
+	return nil
+}
+
+// replicatedDB returns a PostGresDB whose primary and replicas are fake servers, with the replicas healthy
+func replicatedDB(t *testing.T, replicas int) (*PostGresDB, *fakeServer, []*fakeServer) {
+	primary := &fakeServer{}
+	db := &PostGresDB{PgDbSession: sql.OpenDB(primary), MaxReplicaLag: 10 * time.Second, ReadYourWrites: true,
+		logger: logging.New(ioutil.Discard, logging.LEVEL_INFO)}
+	servers := make([]*fakeServer, replicas)
+	for i := range servers {
+		servers[i] = &fakeServer{}
+		db.replicas = append(db.replicas, &replica{name: "replica" + string(rune('a'+i)), db: sql.OpenDB(servers[i])})
+	}
+	t.Cleanup(db.Disconnect)
+
+	return db, primary, servers
+}
+
+// readAll runs a read on the database count times
+func readAll(t *testing.T, ctx context.Context, db *PostGresDB, count int) {
+	for i := 0; i < count; i++ {
+		if err := db.InTenantReadOnly(ctx, OP_LIST, 1, func(tx *Tx) error { return nil }); err != nil {
+			t.Fatalf("Read expected to pass, failed: %s", err)
+		}
+	}
+}
+
+// TestReadsSpreadOverReplicas Checks reads are shared between the healthy replicas and kept off the primary, and
+// writes stay on the primary
+func TestReadsSpreadOverReplicas(t *testing.T) {
+	db, primary, replicas := replicatedDB(t, 2)
+
+	readAll(t, context.Background(), db, 10)
+	if primary.begun() != 0 || replicas[0].begun() != 5 || replicas[1].begun() != 5 {
+		t.Errorf("Reads expected to be spread over the replicas, got primary %d, replicas %d and %d",
+			primary.begun(), replicas[0].begun(), replicas[1].begun())
+	}
+
+	if err := db.InTenant(context.Background(), OP_WRITE, 1, func(tx *Tx) error { return nil }); err != nil {
+		t.Fatalf("Write expected to pass, failed: %s", err)
+	}
+	if primary.begun() != 1 {
+		t.Errorf("Write expected to go to the primary, primary began %d transactions", primary.begun())
+	}
+}
+
+// TestReadsWithoutReplicas Checks reads go to the primary when there are no replicas
+func TestReadsWithoutReplicas(t *testing.T) {
+	db, primary, _ := replicatedDB(t, 0)
+
+	readAll(t, context.Background(), db, 3)
+	if primary.begun() != 3 {
+		t.Errorf("Reads expected to go to the primary, primary began %d transactions", primary.begun())
+	}
+}
+
+// TestReadFailover Checks a read is retried on the primary when its replica can't be reached, and the replica is
+// excluded until a health check finds it again
+func TestReadFailover(t *testing.T) {
+	db, primary, replicas := replicatedDB(t, 1)
+	replicas[0].set(true, 0)
+
+	readAll(t, context.Background(), db, 2)
+	if primary.begun() != 2 {
+		t.Errorf("Reads expected to fail over to the primary, primary began %d transactions", primary.begun())
+	}
+	if status := db.Replicas()[0]; status.Healthy {
+		t.Errorf("Unreachable replica expected to be excluded, got %+v", status)
+	}
+
+	replicas[0].set(false, 0)
+	db.CheckReplicas(context.Background())
+	readAll(t, context.Background(), db, 1)
+	if primary.begun() != 2 || replicas[0].begun() != 1 {
+		t.Errorf("Recovered replica expected to be read from, got primary %d, replica %d", primary.begun(),
+			replicas[0].begun())
+	}
+}
+
+// TestReplicaLagExclusion Checks a replica lagging more than MaxReplicaLag is excluded from reads until it catches up
+func TestReplicaLagExclusion(t *testing.T) {
+	db, primary, replicas := replicatedDB(t, 2)
+	replicas[1].set(false, 30)
+
+	db.CheckReplicas(context.Background())
+	statuses := db.Replicas()
+	if !statuses[0].Healthy || statuses[1].Healthy || statuses[1].Lag != 30*time.Second {
+		t.Errorf("Lagging replica expected to be excluded, got %+v", statuses)
+	}
+	readAll(t, context.Background(), db, 4)
+	if primary.begun() != 0 || replicas[0].begun() != 4 || replicas[1].begun() != 0 {
+		t.Errorf("Reads expected to avoid the lagging replica, got primary %d, replicas %d and %d",
+			primary.begun(), replicas[0].begun(), replicas[1].begun())
+	}
+
+	replicas[0].set(true, 0)
+	db.CheckReplicas(context.Background())
+	readAll(t, context.Background(), db, 1)
+	if primary.begun() != 1 {
+		t.Errorf("Reads expected to go to the primary without a healthy replica, primary began %d transactions",
+			primary.begun())
+	}
+
+	replicas[1].set(false, 1)
+	db.CheckReplicas(context.Background())
+	if !db.Replicas()[1].Healthy {
+		t.Errorf("Replica expected to be readmitted once caught up, got %+v", db.Replicas()[1])
+	}
+}
+
+// TestReplicaDisconnected Checks a replica without a streaming WAL receiver is excluded from reads, though having
+// replayed all it received it reports no lag, until it streams again
+func TestReplicaDisconnected(t *testing.T) {
+	db, primary, replicas := replicatedDB(t, 1)
+	replicas[0].mutex.Lock()
+	replicas[0].disconnected = true
+	replicas[0].mutex.Unlock()
+
+	db.CheckReplicas(context.Background())
+	if status := db.Replicas()[0]; status.Healthy || status.Lag != 0 || status.Detail != "not streaming from the primary" {
+		t.Errorf("Replica without a WAL receiver expected to be excluded, got %+v", status)
+	}
+	readAll(t, context.Background(), db, 1)
+	if primary.begun() != 1 || replicas[0].begun() != 0 {
+		t.Errorf("Reads expected to avoid the disconnected replica, got primary %d, replica %d", primary.begun(),
+			replicas[0].begun())
+	}
+
+	replicas[0].mutex.Lock()
+	replicas[0].disconnected = false
+	replicas[0].mutex.Unlock()
+	db.CheckReplicas(context.Background())
+	if !db.Replicas()[0].Healthy {
+		t.Errorf("Replica expected to be readmitted once streaming again, got %+v", db.Replicas()[0])
+	}
+}
+
+// TestReadYourWrites Checks reads made after a write by the same request go to the primary, and only with
+// ReadYourWrites
+func TestReadYourWrites(t *testing.T) {
+	for _, readYourWrites := range []bool{true, false} {
+		db, primary, replicas := replicatedDB(t, 1)
+		db.ReadYourWrites = readYourWrites
+
+		handler := TrackWrites(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			readAll(t, request.Context(), db, 1)
+			if err := db.InTransaction(request.Context(), OP_WRITE, func(tx *Tx) error { return nil }); err != nil {
+				t.Fatalf("Write expected to pass, failed: %s", err)
+			}
+			readAll(t, request.Context(), db, 1)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+
+		// Another request doesn't see the write of the first
+		handler = TrackWrites(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			readAll(t, request.Context(), db, 1)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		wantPrimary, wantReplica := 2, 2
+		if !readYourWrites {
+			wantPrimary, wantReplica = 1, 3
+		}
+		if primary.begun() != wantPrimary || replicas[0].begun() != wantReplica {
+			t.Errorf("With read_your_writes %t expected primary %d and replica %d transactions, got %d and %d",
+				readYourWrites, wantPrimary, wantReplica, primary.begun(), replicas[0].begun())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+)
+
+// Tx is a transaction whose statements run under the context it was begun with, each in its own span. Spans
+// carry the statement text but never its parameters, which may be passwords or personal details
+type Tx struct {
+	*sql.Tx
+	ctx context.Context
+}
+
+// Context returns the context the transaction was begun with
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+// statementAttributes returns the operation of the statement, e.g. SELECT, and its text with whitespace collapsed
+func statementAttributes(query string) (operation, statement string) {
+	statement = strings.Join(strings.Fields(query), " ")
+	operation = statement
+	if i := strings.IndexByte(statement, ' '); i > 0 {
+		operation = statement[:i]
+	}
+
+	return strings.ToUpper(operation), statement
+}
+
+// startStatement starts the span of a statement, named after its operation
+func startStatement(ctx context.Context, query string) (context.Context, trace.Span) {
+	operation, statement := statementAttributes(query)
+	return tracing.Start(ctx, operation, attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", operation), attribute.String("db.statement", statement))
+}
+
+// Exec executes a statement that returns no rows
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startStatement(tx.ctx, query)
+	res, err := tx.Tx.ExecContext(ctx, query, args...)
+	tracing.End(span, err)
+
+	return res, err
+}
+
+// Query executes a statement that returns rows. The span covers running the statement, not reading the rows
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startStatement(tx.ctx, query)
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	tracing.End(span, err)
+
+	return rows, err
+}
+
+// QueryRow executes a statement that returns at most one row
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	ctx, span := startStatement(tx.ctx, query)
+	row := tx.Tx.QueryRowContext(ctx, query, args...)
+	tracing.End(span, row.Err())
+
+	return row
+}
@@ -0,0 +1,30 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+// TestStartStatement Checks statement spans are named after the operation and carry only the statement text
+func TestStartStatement(t *testing.T) {
+	tests := []struct {
+		query     string
+		operation string
+		statement string
+	}{
+		{"SELECT id FROM users WHERE username = $1", "SELECT", "SELECT id FROM users WHERE username = $1"},
+		{"\n\tinsert INTO users (username)\n\t\tVALUES ($1)", "INSERT", "insert INTO users (username) VALUES ($1)"},
+		{"SET LOCAL ROLE user_service_tenant", "SET", "SET LOCAL ROLE user_service_tenant"},
+		{"COMMIT", "COMMIT", "COMMIT"},
+	}
+
+	for _, test := range tests {
+		_, span := startStatement(context.Background(), test.query)
+		span.End()
+		if operation, statement := statementAttributes(test.query); operation != test.operation ||
+			statement != test.statement {
+			t.Errorf("Query |%s| expected operation %s statement |%s|, got %s |%s|", test.query, test.operation,
+				test.statement, operation, statement)
+		}
+	}
+}
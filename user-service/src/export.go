@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/export"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// filterFlags collects the -filter flags, each a field=value or attr.<name>=value users must have
+type filterFlags url.Values
+
+func (f filterFlags) String() string {
+	return url.Values(f).Encode()
+}
+
+func (f filterFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q is not field=value", value)
+	}
+	url.Values(f).Set(parts[0], parts[1])
+	return nil
+}
+
+// runExport exports the users of an organization to a file, or stdout, straight from the database rather than
+// through the API, so it is limited by database.bulk_timeout alone. args are the flags of the export, then the
+// arguments of the configuration. The logs are written to stderr
+// returns the status to exit with: 0 if the export was written, 1 if it failed
+func runExport(args []string) int {
+	logger := logging.New(os.Stderr, logging.LEVEL_INFO)
+
+	flags := flag.NewFlagSet("user-service export", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: user-service export -org <slug or id> [flags] [config flags]")
+		flags.PrintDefaults()
+	}
+	org := flags.String("org", "", "slug or id of the organization to export from")
+	format := flags.String("format", export.DEFAULT_FORMAT, "ndjson, csv or parquet")
+	columns := flags.String("columns", "", "comma separated columns to export, by default every field and attribute")
+	group := flags.Int("group", 0, "only export the members of the group and its subgroups")
+	phoneFormat := flags.String("phoneformat", "", "e164, national or international, by default phone.format")
+	output := flags.String("o", "", "file to write, by default stdout")
+	filters := make(filterFlags)
+	flags.Var(filters, "filter", "field=value or attr.<name>=value users must have, repeatable")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 1
+	}
+	if *org == "" {
+		flags.Usage()
+		return 1
+	}
+
+	values := url.Values(filters)
+	values.Set("format", *format)
+	values.Set("columns", *columns)
+	values.Set("phoneformat", *phoneFormat)
+	if *group != 0 {
+		values.Set("group", strconv.Itoa(*group))
+	}
+	query, err := export.ParseQuery(values)
+	if err != nil {
+		logger.Error("Invalid export", logging.Fields{"error": err})
+		return 1
+	}
+
+	cfg, err := config.Load(flags.Args())
+	if err == flag.ErrHelp {
+		return 0
+	} else if err == nil {
+		err = cfg.Check()
+	}
+	if err != nil {
+		logger.Error("Invalid configuration", logging.Fields{"error": err})
+		return 1
+	}
+	level, _ := logging.ParseLevel(cfg.Logging.Level)
+	logger = logging.New(os.Stderr, level)
+
+	userService := service.UserService{Logger: logger}
+	userService.Initialize(cfg)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	field := "slug"
+	if _, err = strconv.Atoi(*org); err == nil {
+		field = "id"
+	}
+	organization, err := models.GetOrganization(ctx, userService.Dbh, field, *org)
+	if err != nil {
+		logger.Error("Unable to find the organization", logging.Fields{"org": *org, "error": err})
+		return 1
+	}
+	e, err := export.Prepare(ctx, userService.Dbh, organization.ID, query)
+	if err != nil {
+		logger.Error("Invalid export", logging.Fields{"error": err})
+		return 1
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			logger.Error("Unable to create the file", logging.Fields{"error": err})
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	rows, err := e.Run(ctx, out)
+	if err != nil {
+		logger.Error("Export failed", logging.Fields{"rows": rows, "error": err})
+		if *output != "" {
+			_ = os.Remove(*output)
+		}
+		return 1
+	}
+	logger.Info("Export finished", logging.Fields{"org": organization.Slug, "format": e.Format.Name, "rows": rows})
+	return 0
+}
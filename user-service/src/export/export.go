@@ -0,0 +1,216 @@
+// Package export writes out the users of an organization as NDJSON, CSV or Parquet. Users are read from a cursor
+// and written as they are read, so an export of any size runs in constant memory
+package export
+
+import (
+	"context"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Format is a format users can be exported in
+type Format struct {
+	Name        string
+	ContentType string
+	Extension   string
+}
+
+// The names of the formats
+const (
+	FORMAT_NDJSON  string = "ndjson"
+	FORMAT_CSV     string = "csv"
+	FORMAT_PARQUET string = "parquet"
+)
+
+// FORMATS are the formats users can be exported in, by name
+var FORMATS = map[string]Format{
+	FORMAT_NDJSON:  {Name: FORMAT_NDJSON, ContentType: "application/x-ndjson", Extension: ".ndjson"},
+	FORMAT_CSV:     {Name: FORMAT_CSV, ContentType: "text/csv; charset=utf-8", Extension: ".csv"},
+	FORMAT_PARQUET: {Name: FORMAT_PARQUET, ContentType: "application/vnd.apache.parquet", Extension: ".parquet"},
+}
+
+// DEFAULT_FORMAT is the format of an export that doesn't ask for one
+const DEFAULT_FORMAT string = FORMAT_NDJSON
+
+// USER_COLUMNS are the columns of the fields of users, the passwords never being exported
+var USER_COLUMNS = []string{"id", "username", "firstname", "middlename", "lastname", "email", "telephone",
+	"extension"}
+
+// ATTRIBUTES_COLUMN is the column of every attribute of a user as a JSON object
+const ATTRIBUTES_COLUMN string = "attributes"
+
+// ATTRIBUTE_COLUMN_PREFIX begins the column of a single attribute, e.g. attributes.department, as imports name them
+const ATTRIBUTE_COLUMN_PREFIX string = "attributes."
+
+// Column is a column of an export
+type Column struct {
+	Name string
+	// Attribute is the attribute of an attributes.<name> column, nil for other columns
+	Attribute *models.AttributeModel
+}
+
+// Columns resolves the columns of the query against the attributes the organization has defined. Without columns
+// the query exports every field, then the attributes: as a single JSON object in NDJSON, which has one for them, and
+// a column for each in the other formats
+// returns a validation error for a column that doesn't exist, or is asked for twice
+func Columns(query models.ExportQuery, attrs []models.AttributeModel) ([]Column, error) {
+	names := query.Columns
+	if len(names) == 0 {
+		names = append(names, USER_COLUMNS...)
+		if query.Format == FORMAT_NDJSON {
+			names = append(names, ATTRIBUTES_COLUMN)
+		} else {
+			for _, attr := range attrs {
+				names = append(names, ATTRIBUTE_COLUMN_PREFIX+attr.Name)
+			}
+		}
+	}
+
+	columns := make([]Column, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return nil, apperror.Invalid("columns", "Column %s is given more than once", name)
+		}
+		seen[name] = true
+
+		column := Column{Name: name}
+		if strings.HasPrefix(name, ATTRIBUTE_COLUMN_PREFIX) {
+			for i := range attrs {
+				if attrs[i].Name == strings.TrimPrefix(name, ATTRIBUTE_COLUMN_PREFIX) {
+					column.Attribute = &attrs[i]
+				}
+			}
+			if column.Attribute == nil {
+				return nil, apperror.Invalid("columns", "Column %s is not an attribute of users", name)
+			}
+		} else if name != ATTRIBUTES_COLUMN && !isUserColumn(name) {
+			return nil, apperror.Invalid("columns", "Unknown column %s. Columns are %s, %s, or %s<name>", name,
+				strings.Join(USER_COLUMNS, ", "), ATTRIBUTES_COLUMN, ATTRIBUTE_COLUMN_PREFIX)
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
+
+func isUserColumn(name string) bool {
+	for _, column := range USER_COLUMNS {
+		if name == column {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseQuery reads an export from query parameters: format, columns as a comma separated list, group, phoneformat,
+// and the filters, each field or attr.<name> to filter on
+// returns a validation error for a parameter that can't be read
+func ParseQuery(values url.Values) (query models.ExportQuery, err error) {
+	query.Format = values.Get("format")
+	if query.Format == "" {
+		query.Format = DEFAULT_FORMAT
+	}
+	if _, ok := FORMATS[query.Format]; !ok {
+		return query, apperror.Invalid("format", "Unsupported format %s. Only accepts %s, %s or %s", query.Format,
+			FORMAT_NDJSON, FORMAT_CSV, FORMAT_PARQUET)
+	}
+
+	if columns := values.Get("columns"); columns != "" {
+		for _, column := range strings.Split(columns, ",") {
+			query.Columns = append(query.Columns, strings.TrimSpace(column))
+		}
+	}
+	if group := values.Get("group"); group != "" {
+		if query.GroupID, err = strconv.Atoi(group); err != nil || query.GroupID <= 0 {
+			return query, apperror.Invalid("group", "Invalid Group ID %s", group)
+		}
+	}
+	query.PhoneFormat = values.Get("phoneformat")
+
+	for key := range values {
+		if strings.HasPrefix(key, models.ATTRIBUTE_FILTER_PREFIX) || isFilterField(key) {
+			if query.Filters == nil {
+				query.Filters = make(map[string]string)
+			}
+			query.Filters[key] = values.Get(key)
+		}
+	}
+
+	return query, query.Validate()
+}
+
+func isFilterField(name string) bool {
+	for _, field := range models.EXPORT_FILTER_FIELDS {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Export is an export whose columns have been resolved, ready to run
+type Export struct {
+	Query   models.ExportQuery
+	Format  Format
+	Columns []Column
+
+	db    *database.PostGresDB
+	orgID int
+}
+
+// Prepare checks the query and resolves its columns, so an export that can't run fails before anything is written
+// returns a validation error if the query can't be exported
+func Prepare(ctx context.Context, db *database.PostGresDB, orgID int, query models.ExportQuery) (*Export, error) {
+	format, ok := FORMATS[query.Format]
+	if !ok {
+		return nil, apperror.Invalid("format", "Unsupported format %s", query.Format)
+	}
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	if query.PhoneFormat == "" {
+		query.PhoneFormat = models.PHONE_FORMAT
+	}
+
+	attrs, err := models.GetAttributes(ctx, db, orgID)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := Columns(query, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Export{Query: query, Format: format, Columns: columns, db: db, orgID: orgID}, nil
+}
+
+// Run writes the users matching the export to w. An error can come after some users have been written, in which case
+// what was written is incomplete
+// returns the number of users written
+func (e *Export) Run(ctx context.Context, w io.Writer) (rows int, err error) {
+	writer, err := NewWriter(w, e.Format.Name, e.Columns)
+	if err != nil {
+		return 0, err
+	}
+
+	err = models.ExportUsers(ctx, e.db, e.orgID, e.Query, func(user models.UserModel) error {
+		user.FormatTelephone(e.Query.PhoneFormat)
+		if err := writer.Write(user); err != nil {
+			return fmt.Errorf("unable to write user %d: %w", user.ID, err)
+		}
+		rows++
+		return nil
+	})
+	if err != nil {
+		return rows, err
+	}
+
+	return rows, writer.Close()
+}
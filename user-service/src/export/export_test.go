@@ -0,0 +1,162 @@
+package export
+
+import (
+	"bytes"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/parquet"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testAttributes are the attributes of the organization the tests export from
+var testAttributes = []models.AttributeModel{
+	{Name: "department", Type: models.ATTRIBUTE_TYPE_STRING},
+	{Name: "level", Type: models.ATTRIBUTE_TYPE_INTEGER},
+	{Name: "remote", Type: models.ATTRIBUTE_TYPE_BOOLEAN},
+}
+
+// testUsers are the users the tests export
+var testUsers = []models.UserModel{
+	{ID: 1, Username: "jdoe1", FirstName: "John", LastName: "Doe", Email: "jdoe@example.com",
+		Telephone: "+12125550123", Attributes: map[string]interface{}{"department": "Sales, East", "level": 3.0}},
+	{ID: 2, Username: "asmith", FirstName: "Ann", MiddleName: "B", LastName: "Smith", Email: "asmith@example.com",
+		Telephone: "+12125550124", Extension: "12", Attributes: map[string]interface{}{"remote": true}},
+}
+
+// TestParseQuery Checks query parameters are read into an export, and ones that can't be used are rejected
+func TestParseQuery(t *testing.T) {
+	values, _ := url.ParseQuery("format=csv&columns=id,+email&group=4&phoneformat=e164&lastname=Doe" +
+		"&attr.department=sales&limit=10")
+	query, err := ParseQuery(values)
+	if err != nil {
+		t.Fatalf("ParseQuery expected to pass, failed: %s", err)
+	}
+	expected := models.ExportQuery{Format: FORMAT_CSV, Columns: []string{"id", "email"}, GroupID: 4,
+		PhoneFormat: "e164", Filters: map[string]string{"lastname": "Doe", "attr.department": "sales"}}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("ParseQuery expected %+v, got %+v", expected, query)
+	}
+
+	if query, err = ParseQuery(url.Values{}); err != nil || query.Format != DEFAULT_FORMAT {
+		t.Errorf("ParseQuery without a format expected to export %s, got %+v, %v", DEFAULT_FORMAT, query, err)
+	}
+
+	for _, invalid := range []string{"format=xml", "group=sales", "group=-1", "phoneformat=dotted",
+		"attr.Not-A-Name=x", "telephone=12"} {
+		values, _ = url.ParseQuery(invalid)
+		if _, err = ParseQuery(values); err == nil {
+			t.Errorf("ParseQuery of %s expected to fail, passed", invalid)
+		}
+	}
+}
+
+// TestColumns Checks the default columns of each format, and that columns that don't exist are rejected
+func TestColumns(t *testing.T) {
+	names := func(columns []Column) []string {
+		var names []string
+		for _, column := range columns {
+			names = append(names, column.Name)
+		}
+		return names
+	}
+
+	columns, err := Columns(models.ExportQuery{Format: FORMAT_NDJSON}, testAttributes)
+	if err != nil || !reflect.DeepEqual(names(columns), append(USER_COLUMNS[:len(USER_COLUMNS):len(USER_COLUMNS)],
+		ATTRIBUTES_COLUMN)) {
+		t.Errorf("NDJSON expected to export the fields and attributes, got %v, %v", names(columns), err)
+	}
+	columns, err = Columns(models.ExportQuery{Format: FORMAT_CSV}, testAttributes)
+	if err != nil || len(columns) != len(USER_COLUMNS)+3 || columns[len(columns)-1].Name != "attributes.remote" ||
+		columns[len(columns)-1].Attribute == nil {
+		t.Errorf("CSV expected to export a column for each attribute, got %v, %v", names(columns), err)
+	}
+
+	columns, err = Columns(models.ExportQuery{Format: FORMAT_CSV, Columns: []string{"email", "attributes.level"}},
+		testAttributes)
+	if err != nil || !reflect.DeepEqual(names(columns), []string{"email", "attributes.level"}) {
+		t.Errorf("Columns expected to be those asked for, got %v, %v", names(columns), err)
+	}
+
+	for _, invalid := range [][]string{{"password"}, {"attributes.salary"}, {"email", "email"}} {
+		if _, err = Columns(models.ExportQuery{Format: FORMAT_CSV, Columns: invalid}, testAttributes); err == nil {
+			t.Errorf("Columns %v expected to fail, passed", invalid)
+		}
+	}
+}
+
+// export writes testUsers in the format, with its default columns
+func export(t *testing.T, format string) []byte {
+	columns, err := Columns(models.ExportQuery{Format: format}, testAttributes)
+	if err != nil {
+		t.Fatalf("Columns expected to pass, failed: %s", err)
+	}
+	var out bytes.Buffer
+	writer, err := NewWriter(&out, format, columns)
+	if err != nil {
+		t.Fatalf("NewWriter expected to pass, failed: %s", err)
+	}
+	for _, user := range testUsers {
+		if err = writer.Write(user); err != nil {
+			t.Fatalf("Write expected to pass, failed: %s", err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("Close expected to pass, failed: %s", err)
+	}
+	return out.Bytes()
+}
+
+// TestWriters Checks users are written in each format
+func TestWriters(t *testing.T) {
+	ndjson := strings.Split(string(export(t, FORMAT_NDJSON)), "\n")
+	if len(ndjson) != 3 || ndjson[0] != `{"id":1,"username":"jdoe1","firstname":"John","middlename":"",`+
+		`"lastname":"Doe","email":"jdoe@example.com","telephone":"+12125550123","extension":"",`+
+		`"attributes":{"department":"Sales, East","level":3}}` {
+		t.Errorf("NDJSON not as expected: %q", ndjson)
+	}
+
+	csv := string(export(t, FORMAT_CSV))
+	expected := "id,username,firstname,middlename,lastname,email,telephone,extension,attributes.department," +
+		"attributes.level,attributes.remote\n" +
+		"1,jdoe1,John,,Doe,jdoe@example.com,+12125550123,,\"Sales, East\",3,\n" +
+		"2,asmith,Ann,B,Smith,asmith@example.com,+12125550124,12,,,true\n"
+	if csv != expected {
+		t.Errorf("CSV expected %q, got %q", expected, csv)
+	}
+
+	file := export(t, FORMAT_PARQUET)
+	if !bytes.HasPrefix(file, []byte(parquet.MAGIC)) || !bytes.HasSuffix(file, []byte(parquet.MAGIC)) {
+		t.Errorf("Parquet expected to be a Parquet file, got %q", file)
+	}
+
+	// Even without users, a CSV export has its header
+	columns, _ := Columns(models.ExportQuery{Format: FORMAT_CSV, Columns: []string{"id", "email"}}, nil)
+	var out bytes.Buffer
+	writer, _ := NewWriter(&out, FORMAT_CSV, columns)
+	if err := writer.Close(); err != nil || out.String() != "id,email\n" {
+		t.Errorf("Empty CSV expected to be its header, got %q, %v", out.String(), err)
+	}
+}
+
+// TestAttributeValue Checks attribute values are converted to the types of their Parquet columns
+func TestAttributeValue(t *testing.T) {
+	cases := []struct {
+		attr     models.AttributeModel
+		value    interface{}
+		expected interface{}
+	}{
+		{testAttributes[0], "sales", "sales"},
+		{testAttributes[1], 3.0, int64(3)},
+		{testAttributes[1], 3.5, nil},
+		{testAttributes[2], true, true},
+		{testAttributes[2], "yes", nil},
+		{testAttributes[0], nil, nil},
+	}
+	for _, tc := range cases {
+		if value := attributeValue(&tc.attr, tc.value); value != tc.expected {
+			t.Errorf("Value %v of %s expected to be %v, got %v", tc.value, tc.attr.Type, tc.expected, value)
+		}
+	}
+}
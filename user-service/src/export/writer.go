@@ -0,0 +1,236 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/parquet"
+	"io"
+	"strconv"
+)
+
+// Writer writes users in a format, a row at a time. Close must be called once every user has been written, to finish
+// the file
+type Writer interface {
+	Write(user models.UserModel) error
+	Close() error
+}
+
+// NewWriter returns a Writer of the columns of users in the format to w. Close doesn't close w
+// returns an error for a format that isn't one of FORMATS
+func NewWriter(w io.Writer, format string, columns []Column) (Writer, error) {
+	switch format {
+	case FORMAT_NDJSON:
+		return &ndjsonWriter{w: bufio.NewWriter(w), columns: columns}, nil
+	case FORMAT_CSV:
+		return &csvWriter{w: csv.NewWriter(w), columns: columns}, nil
+	case FORMAT_PARQUET:
+		return newParquetWriter(w, columns), nil
+	}
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+// value returns the value of the column for the user: an int for id, a string for the other fields, the attributes
+// for ATTRIBUTES_COLUMN, and the value of the attribute as read from JSON, or nil if the user has none, for an
+// attribute column
+func (c Column) value(user models.UserModel) interface{} {
+	switch c.Name {
+	case "id":
+		return user.ID
+	case "username":
+		return user.Username
+	case "firstname":
+		return user.FirstName
+	case "middlename":
+		return user.MiddleName
+	case "lastname":
+		return user.LastName
+	case "email":
+		return user.Email
+	case "telephone":
+		return user.Telephone
+	case "extension":
+		return user.Extension
+	case ATTRIBUTES_COLUMN:
+		if user.Attributes == nil {
+			return map[string]interface{}{}
+		}
+		return user.Attributes
+	}
+	return user.Attributes[c.Attribute.Name]
+}
+
+// ndjsonWriter writes each user as a JSON object of its columns, on a line of its own
+type ndjsonWriter struct {
+	w       *bufio.Writer
+	columns []Column
+}
+
+func (nw *ndjsonWriter) Write(user models.UserModel) error {
+	nw.w.WriteByte('{')
+	for i, column := range nw.columns {
+		if i > 0 {
+			nw.w.WriteByte(',')
+		}
+		name, _ := json.Marshal(column.Name)
+		value, err := json.Marshal(column.value(user))
+		if err != nil {
+			return err
+		}
+		nw.w.Write(name)
+		nw.w.WriteByte(':')
+		nw.w.Write(value)
+	}
+	_, err := nw.w.WriteString("}\n")
+	return err
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nw.w.Flush()
+}
+
+// csvWriter writes a header of the names of the columns, then a record for each user. Attribute values are written as
+// imports read them: numbers in full, booleans as true or false, and nothing for a user without the attribute
+type csvWriter struct {
+	w       *csv.Writer
+	columns []Column
+	// started is set once the header has been written
+	started bool
+	record  []string
+}
+
+// text formats a value of a column for CSV
+func text(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+func (cw *csvWriter) header() error {
+	cw.started = true
+	cw.record = make([]string, len(cw.columns))
+	for i, column := range cw.columns {
+		cw.record[i] = column.Name
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvWriter) Write(user models.UserModel) (err error) {
+	if !cw.started {
+		if err = cw.header(); err != nil {
+			return err
+		}
+	}
+	for i, column := range cw.columns {
+		if cw.record[i], err = text(column.value(user)); err != nil {
+			return err
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+// Close writes the header if no user was written, so even an empty export has its columns
+func (cw *csvWriter) Close() error {
+	if !cw.started {
+		if err := cw.header(); err != nil {
+			return err
+		}
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// parquetWriter writes users as the rows of a Parquet table. The fields are required columns, and each attribute an
+// optional column of its type, so the file can be queried without parsing JSON
+type parquetWriter struct {
+	w       *parquet.Writer
+	columns []Column
+	row     []interface{}
+}
+
+// parquetTypes are the types of the Parquet columns of the types of attributes
+var parquetTypes = map[string]parquet.Type{
+	models.ATTRIBUTE_TYPE_STRING:  parquet.TYPE_BYTE_ARRAY,
+	models.ATTRIBUTE_TYPE_INTEGER: parquet.TYPE_INT64,
+	models.ATTRIBUTE_TYPE_NUMBER:  parquet.TYPE_DOUBLE,
+	models.ATTRIBUTE_TYPE_BOOLEAN: parquet.TYPE_BOOLEAN,
+}
+
+func newParquetWriter(w io.Writer, columns []Column) *parquetWriter {
+	schema := make([]parquet.Column, len(columns))
+	for i, column := range columns {
+		switch {
+		case column.Name == "id":
+			schema[i] = parquet.Column{Name: column.Name, Type: parquet.TYPE_INT64}
+		case column.Name == ATTRIBUTES_COLUMN:
+			schema[i] = parquet.Column{Name: column.Name, Type: parquet.TYPE_BYTE_ARRAY,
+				Converted: parquet.CONVERTED_JSON}
+		case column.Attribute != nil:
+			schema[i] = parquet.Column{Name: column.Name, Type: parquetTypes[column.Attribute.Type], Optional: true}
+			if schema[i].Type == parquet.TYPE_BYTE_ARRAY {
+				schema[i].Converted = parquet.CONVERTED_UTF8
+			}
+		default:
+			schema[i] = parquet.Column{Name: column.Name, Type: parquet.TYPE_BYTE_ARRAY,
+				Converted: parquet.CONVERTED_UTF8}
+		}
+	}
+
+	return &parquetWriter{w: parquet.NewWriter(w, schema), columns: columns, row: make([]interface{}, len(columns))}
+}
+
+// attributeValue converts the value of an attribute to the type of its column. A value that isn't of the type of its
+// attribute, which can only be one stored before the attribute was defined, is written as null
+func attributeValue(attr *models.AttributeModel, value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if attr.Type == models.ATTRIBUTE_TYPE_STRING {
+			return v
+		}
+	case float64:
+		if attr.Type == models.ATTRIBUTE_TYPE_NUMBER {
+			return v
+		} else if attr.Type == models.ATTRIBUTE_TYPE_INTEGER && v == float64(int64(v)) {
+			return int64(v)
+		}
+	case bool:
+		if attr.Type == models.ATTRIBUTE_TYPE_BOOLEAN {
+			return v
+		}
+	}
+	return nil
+}
+
+func (pw *parquetWriter) Write(user models.UserModel) error {
+	for i, column := range pw.columns {
+		value := column.value(user)
+		if column.Name == ATTRIBUTES_COLUMN {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			value = encoded
+		} else if column.Attribute != nil {
+			value = attributeValue(column.Attribute, value)
+		}
+		pw.row[i] = value
+	}
+	return pw.w.Write(pw.row)
+}
+
+func (pw *parquetWriter) Close() error {
+	return pw.w.Close()
+}
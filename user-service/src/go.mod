@@ -3,7 +3,18 @@ module github.com/cclose/go-user-microservice-ex/user-service/src
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/gorilla/mux v1.8.0
 	github.com/lib/pq v1.10.0
+	github.com/nyaruka/phonenumbers v1.1.2
+	github.com/prometheus/client_golang v1.11.1
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.3.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	golang.org/x/text v0.3.7
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// importFormats are the formats users can be imported from, keyed by the extensions of their files
+var importFormats = map[string]string{".csv": "csv", ".ndjson": "ndjson", ".jsonl": "ndjson"}
+
+// runImport imports users from a file into an organization, straight into the database rather than through the API,
+// so it is limited by database.bulk_timeout alone. args are the flags of the import, the file, then the arguments of
+// the configuration. The report is written to stdout, and the logs to stderr
+// returns the status to exit with: 0 if every row was imported, 1 if the import failed, 2 if only some rows were
+func runImport(args []string) int {
+	logger := logging.New(os.Stderr, logging.LEVEL_INFO)
+
+	flags := flag.NewFlagSet("user-service import", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: user-service import -org <slug or id> [flags] <file> [config flags]")
+		flags.PrintDefaults()
+	}
+	org := flags.String("org", "", "slug or id of the organization to import into")
+	format := flags.String("format", "", "csv or ndjson, by default from the extension of the file")
+	mappingVal := flags.String("map", "", "CSV column mapping, e.g. \"First Name=firstname,Notes=-\"")
+	dryRun := flags.Bool("dry-run", false, "check every row without writing any")
+	upsert := flags.String("upsert", "", "update the user with the same username or email")
+	hashedPasswords := flags.Bool("hashed-passwords", false, "take passwords as bcrypt hashes")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 1
+	}
+	if *org == "" || flags.NArg() < 1 {
+		flags.Usage()
+		return 1
+	}
+	file := flags.Arg(0)
+	if *format == "" {
+		*format = importFormats[strings.ToLower(filepath.Ext(file))]
+	}
+	if *format != "csv" && *format != "ndjson" {
+		logger.Error("Unable to tell the format of the file. Give -format csv or ndjson", logging.Fields{"file": file})
+		return 1
+	}
+	mapping, err := models.ParseImportMapping(*mappingVal)
+	if err != nil {
+		logger.Error("Invalid -map", logging.Fields{"error": err})
+		return 1
+	}
+
+	cfg, err := config.Load(flags.Args()[1:])
+	if err == flag.ErrHelp {
+		return 0
+	} else if err == nil {
+		err = cfg.Check()
+	}
+	if err != nil {
+		logger.Error("Invalid configuration", logging.Fields{"error": err})
+		return 1
+	}
+	level, _ := logging.ParseLevel(cfg.Logging.Level)
+	logger = logging.New(os.Stderr, level)
+
+	f, err := os.Open(file)
+	if err != nil {
+		logger.Error("Unable to open the file", logging.Fields{"error": err})
+		return 1
+	}
+	defer f.Close()
+	var rows []models.ImportRow
+	if *format == "csv" {
+		rows, err = models.ReadImportCSV(f, mapping)
+	} else {
+		rows, err = models.ReadImportNDJSON(f)
+	}
+	if err != nil {
+		logger.Error("Unable to read the file", logging.Fields{"file": file, "error": err})
+		return 1
+	}
+
+	userService := service.UserService{Logger: logger}
+	userService.Initialize(cfg)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	field := "slug"
+	if _, err = strconv.Atoi(*org); err == nil {
+		field = "id"
+	}
+	organization, err := models.GetOrganization(ctx, userService.Dbh, field, *org)
+	if err != nil {
+		logger.Error("Unable to find the organization", logging.Fields{"org": *org, "error": err})
+		return 1
+	}
+
+	opts := models.ImportOptions{DryRun: *dryRun, Upsert: *upsert, HashedPasswords: *hashedPasswords}
+	report, err := models.ImportUsers(ctx, userService.Dbh, organization.ID, rows, opts)
+	if err != nil {
+		logger.Error("Import failed", logging.Fields{"error": err})
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		logger.Error("Unable to write the report", logging.Fields{"error": err})
+		return 1
+	}
+	logger.Info("Import finished", logging.Fields{"org": organization.Slug, "dryrun": report.DryRun,
+		"total": report.Total, "created": report.Created, "updated": report.Updated, "failed": report.Failed})
+	if report.Failed > 0 {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// REQUEST_ID_HEADER carries the id of a request, from the caller if it gives one, and back in the response
+const REQUEST_ID_HEADER string = "X-Request-ID"
+
+// MAX_REQUEST_ID_LENGTH limits the request ids accepted from callers. Longer ones are replaced
+const MAX_REQUEST_ID_LENGTH int = 128
+
+type requestIDKey struct{}
+
+// RequestID returns the id of the request ctx belongs to, empty outside a request
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random 128 bit id
+func newRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// validRequestID reports whether a request id given by a caller is safe to log and echo: not too long, and only
+// printable ASCII without spaces
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// redactQuery returns the path and query of the URL with the values of secret query parameters redacted
+func redactQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+
+	query := u.Query()
+	for key, values := range query {
+		if isSecret(key) {
+			for i := range values {
+				values[i] = REDACTED
+			}
+		}
+	}
+
+	return u.Path + "?" + query.Encode()
+}
+
+// statusRecorder captures the status code and size of the response written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Middleware gives each request an id, taken from its X-Request-ID header when the caller sends a valid one, and
+// returns it in the X-Request-ID header of the response. Handlers find a logger that adds the request id, and the
+// trace id when the request is traced, to every entry with FromContext. When accessLog is set, each request is
+// logged once served, with its status, size and duration
+func Middleware(logger *Logger, accessLog bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(REQUEST_ID_HEADER)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		writer.Header().Set(REQUEST_ID_HEADER, id)
+
+		fields := Fields{"requestid": id}
+		if spanContext := trace.SpanContextFromContext(request.Context()); spanContext.HasTraceID() {
+			fields["traceid"] = spanContext.TraceID().String()
+		}
+		requestLogger := logger.With(fields)
+		ctx := context.WithValue(request.Context(), requestIDKey{}, id)
+		ctx = NewContext(ctx, requestLogger)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(recorder, request.WithContext(ctx))
+
+		if accessLog {
+			requestLogger.Info("Served request", Fields{"method": request.Method, "path": redactQuery(request.URL),
+				"status": recorder.status, "bytes": recorder.bytes,
+				"durationms": float64(time.Since(start).Microseconds()) / 1000, "remoteaddr": request.RemoteAddr,
+				"useragent": request.UserAgent()})
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMiddleware Checks request ids are propagated or generated, reach the handler's logger and the response, and
+// requests are logged with secrets in their query redacted
+func TestMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, LEVEL_INFO)
+	handler := Middleware(logger, true, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		FromContext(request.Context(), nil).Info("handling", Fields{"handlerid": RequestID(request.Context())})
+		writer.WriteHeader(http.StatusCreated)
+		_, _ = writer.Write([]byte("created"))
+	}))
+
+	tests := []struct {
+		given     string
+		propagate bool
+	}{
+		{"caller-id-1", true},
+		{"", false},
+		{"has spaces", false},
+		{strings.Repeat("a", MAX_REQUEST_ID_LENGTH+1), false},
+	}
+
+	for _, test := range tests {
+		out.Reset()
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/invitation?token=s3cret&page=2", nil)
+		if test.given != "" {
+			request.Header.Set(REQUEST_ID_HEADER, test.given)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		id := recorder.Header().Get(REQUEST_ID_HEADER)
+		if test.propagate && id != test.given {
+			t.Errorf("Request id %s expected to be propagated, got %s", test.given, id)
+		} else if !test.propagate && (id == test.given || len(id) != 32) {
+			t.Errorf("Request id |%s| expected to be replaced, got %s", test.given, id)
+		}
+
+		logged := entries(t, &out)
+		if len(logged) != 2 {
+			t.Fatalf("Expected a handler entry and an access entry, got %v", logged)
+		}
+		if logged[0]["requestid"] != id || logged[0]["handlerid"] != id {
+			t.Errorf("Handler entry expected to carry request id %s, got %v", id, logged[0])
+		}
+		access := logged[1]
+		if access["requestid"] != id || access["status"] != float64(http.StatusCreated) ||
+			access["bytes"] != float64(len("created")) || access["method"] != http.MethodGet {
+			t.Errorf("Access entry expected to describe the request, got %v", access)
+		}
+		if access["path"] != "/api/v1/invitation?page=2&token=%5BREDACTED%5D" {
+			t.Errorf("Access entry expected to redact the token, got %v", access["path"])
+		}
+	}
+}
+
+func TestMiddlewareWithoutAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	handler := Middleware(New(&out, LEVEL_DEBUG), false, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if out.Len() != 0 {
+		t.Errorf("Requests expected not to be logged, got %s", out.String())
+	}
+}
@@ -0,0 +1,243 @@
+// Package logging provides the structured logger of the service. Each entry is written as a line of JSON holding
+// its time, level, message and fields. Fields whose names mark them as secrets, such as passwords and tokens, are
+// redacted wherever they appear in an entry
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+	LEVEL_FATAL
+)
+
+var levelNames = map[Level]string{LEVEL_DEBUG: "debug", LEVEL_INFO: "info", LEVEL_WARN: "warn",
+	LEVEL_ERROR: "error", LEVEL_FATAL: "fatal"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if level != LEVEL_FATAL && levelName == strings.ToLower(name) {
+			return level, nil
+		}
+	}
+
+	return LEVEL_INFO, fmt.Errorf("unknown log level %s", name)
+}
+
+// REDACTED replaces the value of fields that hold secrets
+const REDACTED string = "[REDACTED]"
+
+// SECRET_FIELDS are the parts of a field name, matched case insensitively, that mark the field as a secret
+var SECRET_FIELDS = []string{"password", "token", "secret", "authorization", "apikey", "api_key"}
+
+// Fields are the structured data attached to a log entry
+type Fields map[string]interface{}
+
+// Logger writes leveled, structured log entries. A Logger is safe for concurrent use, and loggers derived from it
+// with With share its output. A nil Logger writes to stderr at info level
+type Logger struct {
+	out    io.Writer
+	mutex  *sync.Mutex
+	level  Level
+	fields Fields
+	// exit ends the process after a fatal entry
+	exit func(code int)
+}
+
+// std is used in place of a nil Logger
+var std = New(os.Stderr, LEVEL_INFO)
+
+// New returns a logger writing entries of at least the level to out
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, mutex: &sync.Mutex{}, level: level, fields: Fields{}, exit: os.Exit}
+}
+
+// With returns a logger that adds the fields to every entry, after the fields of this logger
+func (l *Logger) With(fields Fields) *Logger {
+	if l == nil {
+		l = std
+	}
+
+	derived := *l
+	derived.fields = make(Fields, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		derived.fields[key] = value
+	}
+	for key, value := range fields {
+		derived.fields[key] = value
+	}
+
+	return &derived
+}
+
+// Enabled reports whether entries of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	if l == nil {
+		l = std
+	}
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, fields ...Fields) {
+	l.log(LEVEL_DEBUG, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...Fields) {
+	l.log(LEVEL_INFO, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...Fields) {
+	l.log(LEVEL_WARN, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...Fields) {
+	l.log(LEVEL_ERROR, msg, fields)
+}
+
+// Fatal logs the entry whatever the level, then exits with status 1
+func (l *Logger) Fatal(msg string, fields ...Fields) {
+	if l == nil {
+		l = std
+	}
+	l.log(LEVEL_FATAL, msg, fields)
+	l.exit(1)
+}
+
+// log writes the entry if its level is enabled. Fields given with the entry override those of the logger, but not
+// the time, level and msg of the entry itself
+func (l *Logger) log(level Level, msg string, fields []Fields) {
+	if l == nil {
+		l = std
+	}
+	if !l.Enabled(level) {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(l.fields)+3)
+	for key, value := range l.fields {
+		entry[key] = redact(key, value)
+	}
+	for _, f := range fields {
+		for key, value := range f {
+			entry[key] = redact(key, value)
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": entry["level"], "msg": msg,
+			"logerror": err.Error()})
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, _ = l.out.Write(append(line, '\n'))
+}
+
+// isSecret reports whether the field name marks its value as a secret
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range SECRET_FIELDS {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redact returns the value to log for the field: REDACTED for secrets that are set, the message of errors,
+// durations as text, and nested fields with their own secrets redacted
+func redact(key string, value interface{}) interface{} {
+	if isSecret(key) {
+		if value == nil || value == "" {
+			return value
+		}
+		return REDACTED
+	}
+
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case Fields:
+		return redactMap(v)
+	case map[string]interface{}:
+		return redactMap(v)
+	case map[string]string:
+		redacted := make(map[string]interface{}, len(v))
+		for nestedKey, nestedValue := range v {
+			redacted[nestedKey] = redact(nestedKey, nestedValue)
+		}
+		return redacted
+	}
+
+	return value
+}
+
+func redactMap(m map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		redacted[key] = redact(key, value)
+	}
+	return redacted
+}
+
+type contextKey int
+
+const loggerKey contextKey = 0
+
+// NewContext returns a copy of ctx carrying the logger
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger carried by ctx, such as the logger of a request with its request id. Returns
+// fallback if ctx carries none
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if logger, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+// lineWriter writes each line written to it as a log entry
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w.logger.log(w.level, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// StdLogger returns a standard library logger that writes each line as an entry of the level, for packages that log
+// through log.Logger, such as the errors of http.Server
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(lineWriter{logger: l, level: level}, "", 0)
+}
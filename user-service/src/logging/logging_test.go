@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// entries decodes the log entries written to out
+func entries(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var decoded []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line |%s| expected to be JSON, got %s", line, err)
+		}
+		decoded = append(decoded, entry)
+	}
+
+	return decoded
+}
+
+// TestLevels Checks entries less severe than the level of the logger are dropped
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, LEVEL_WARN)
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+
+	logged := entries(t, &out)
+	if len(logged) != 2 || logged[0]["level"] != "warn" || logged[1]["level"] != "error" {
+		t.Errorf("Only warn and error entries expected to be logged, got %v", logged)
+	}
+	if logged[0]["msg"] != "warn" || logged[0]["time"] == nil {
+		t.Errorf("Entry expected to hold its message and time, got %v", logged[0])
+	}
+}
+
+// TestFields Checks fields of the logger and the entry are merged, and errors are logged by their message
+func TestFields(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, LEVEL_INFO).With(Fields{"requestid": "abc", "user": 1})
+	logger.Info("with fields", Fields{"user": 2, "error": errors.New("boom"), "msg": "not the message"})
+
+	entry := entries(t, &out)[0]
+	if entry["requestid"] != "abc" || entry["user"] != float64(2) || entry["error"] != "boom" {
+		t.Errorf("Entry expected to merge fields, got %v", entry)
+	}
+	if entry["msg"] != "with fields" {
+		t.Errorf("Fields expected not to override the message, got %v", entry["msg"])
+	}
+}
+
+// TestRedaction Checks secrets are redacted wherever they appear, and empty secrets are left alone
+func TestRedaction(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, LEVEL_INFO).With(Fields{"TokenSigningKey": "key"})
+	logger.Info("secrets", Fields{"password": "hunter2", "passwordhash": "", "user": Fields{"name": "bob",
+		"Password": "hunter2"}, "detail": map[string]string{"invite_token": "t0k3n", "session": "s"}})
+
+	entry := entries(t, &out)[0]
+	if entry["TokenSigningKey"] != REDACTED || entry["password"] != REDACTED {
+		t.Errorf("Secrets expected to be redacted, got %v", entry)
+	}
+	if entry["passwordhash"] != "" {
+		t.Errorf("Empty secrets expected to be logged as empty, got %v", entry["passwordhash"])
+	}
+	user := entry["user"].(map[string]interface{})
+	detail := entry["detail"].(map[string]interface{})
+	if user["Password"] != REDACTED || user["name"] != "bob" || detail["invite_token"] != REDACTED ||
+		detail["session"] != "s" {
+		t.Errorf("Nested secrets expected to be redacted, got %v %v", user, detail)
+	}
+	if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "t0k3n") {
+		t.Errorf("Secret expected not to be written, got %s", out.String())
+	}
+}
+
+func TestFatal(t *testing.T) {
+	var out bytes.Buffer
+	code := -1
+	logger := New(&out, LEVEL_ERROR)
+	logger.exit = func(c int) { code = c }
+	logger.With(Fields{"a": 1}).Fatal("fatal")
+
+	if code != 1 {
+		t.Errorf("Fatal expected to exit with status 1, got %d", code)
+	}
+	if logged := entries(t, &out); len(logged) != 1 || logged[0]["level"] != "fatal" {
+		t.Errorf("Fatal expected to be logged, got %v", logged)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]Level{"debug": LEVEL_DEBUG, "INFO": LEVEL_INFO, "warn": LEVEL_WARN,
+		"error": LEVEL_ERROR} {
+		if level, err := ParseLevel(name); err != nil || level != expected {
+			t.Errorf("Level %s expected to parse as %v, got %v %v", name, expected, level, err)
+		}
+	}
+	for _, name := range []string{"fatal", "verbose", ""} {
+		if _, err := ParseLevel(name); err == nil {
+			t.Errorf("Level %s expected to be rejected", name)
+		}
+	}
+}
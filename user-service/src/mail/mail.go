@@ -0,0 +1,55 @@
+// Package mail provides the ways the service can deliver email to users
+package mail
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Sender delivers a plain text email
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPSender delivers email through an SMTP relay
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers the email. Authenticates with PLAIN auth when a username is configured, which net/smtp only
+// permits over TLS or to localhost
+func (s *SMTPSender) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	// Refuse header injection through the recipient or subject
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid recipient or subject")
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		s.From, to, subject, body)
+
+	return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, s.From, []string{to}, []byte(message))
+}
+
+// LogSender logs emails instead of delivering them. Used when no SMTP relay is configured
+type LogSender struct {
+	Logger *logging.Logger
+}
+
+// Send logs the recipient and subject of the email. The body isn't logged, as it can hold secrets such as invitation
+// tokens
+func (s LogSender) Send(to, subject, body string) error {
+	s.Logger.Info("Email not sent, no SMTP relay is configured", logging.Fields{"to": to, "subject": subject})
+	return nil
+}
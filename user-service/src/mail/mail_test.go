@@ -0,0 +1,24 @@
+package mail
+
+import (
+	"bytes"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"strings"
+	"testing"
+)
+
+// TestLogSender Checks the recipient and subject of an email are logged, but not its body
+func TestLogSender(t *testing.T) {
+	var out bytes.Buffer
+	sender := LogSender{Logger: logging.New(&out, logging.LEVEL_INFO)}
+	if err := sender.Send("bob@bob.win", "Invitation", "Your invitation token is:\nsecret-token"); err != nil {
+		t.Fatalf("Caught error while sending: %s", err)
+	}
+
+	if !strings.Contains(out.String(), "bob@bob.win") || !strings.Contains(out.String(), "Invitation") {
+		t.Errorf("Recipient and subject expected to be logged, got %s", out.String())
+	}
+	if strings.Contains(out.String(), "secret-token") {
+		t.Errorf("Body expected not to be logged, got %s", out.String())
+	}
+}
@@ -1,39 +1,176 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
 	"github.com/cclose/go-user-microservice-ex/user-service/src/controllers"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/metrics"
 	"github.com/cclose/go-user-microservice-ex/user-service/src/service"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	fmt.Println("Booting User Service...")
+	args := os.Args[1:]
+	// "import" imports users from a file instead of serving
+	if len(args) >= 1 && args[0] == "import" {
+		os.Exit(runImport(args[1:]))
+	}
+	// "export" exports users to a file instead of serving
+	if len(args) >= 1 && args[0] == "export" {
+		os.Exit(runExport(args[1:]))
+	}
+
+	// "config print" dumps the effective configuration instead of serving
+	printConfig := len(args) >= 2 && args[0] == "config" && args[1] == "print"
+	if printConfig {
+		args = args[2:]
+	}
+
+	// Until the configuration is loaded, log at info level
+	logger := logging.New(os.Stdout, logging.LEVEL_INFO)
+	cfg, err := config.Load(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		logger.Fatal("Unable to load the configuration", logging.Fields{"error": err})
+	}
+	if printConfig {
+		if err = cfg.Print(os.Stdout); err != nil {
+			logger.Fatal("Unable to print the configuration", logging.Fields{"error": err})
+		}
+	}
+	if err = cfg.Check(); err != nil {
+		logger.Fatal("Invalid configuration", logging.Fields{"error": err})
+	} else if printConfig {
+		return
+	}
 
-	userService := service.UserService{}
-	userService.Initialize()
-	defer userService.Dbh.Disconnect()
+	level, _ := logging.ParseLevel(cfg.Logging.Level)
+	logger = logging.New(os.Stdout, level)
+	logger.Info("Booting User Service...")
+
+	userService := service.UserService{Logger: logger}
+	userService.Initialize(cfg)
 	userService.Router.HandleFunc("/test", ServeTest)
+	// health checks for orchestrators, outside the versioned API
+	hc := controllers.HealthController{Service: &userService}
+	userService.Router.HandleFunc("/healthz", hc.Healthz).Methods(http.MethodGet)
+	userService.Router.HandleFunc("/readyz", hc.Readyz).Methods(http.MethodGet)
+	userService.Router.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
 
 	// api v1 router
 	v1 := userService.Router.PathPrefix("/api/v1").Subrouter()
-	// user v1 controller
-	uc := controllers.UserControllerV1{Service: &userService}
-	v1.HandleFunc("/user", uc.GetAllUsers).Methods(http.MethodGet)
-	v1.HandleFunc("/user", uc.CreateUser).Methods(http.MethodPost)
-	v1.HandleFunc("/user/{id:[0-9]+}", uc.GetUserById).Methods(http.MethodGet)
-	v1.HandleFunc("/user/{id:[0-9]+}", uc.DeleteUser).Methods(http.MethodDelete)
-	v1.HandleFunc("/user/{id:[0-9]+}", uc.UpdateUser).Methods(http.MethodPut)
-	v1.HandleFunc("/user/auth", uc.AuthenticateUser).Methods(http.MethodPost)
-
-	http.Handle("/", userService.Router)
-	err := http.ListenAndServe(fmt.Sprintf(":%s", userService.ServicePort), userService.Router)
+	tenant := controllers.TenantResolver{Service: &userService}
+	auth := controllers.Authenticator{Service: &userService}
+
+	// organization v1 controller; only privileged users see organizations, and only those of the platform organization
+	// see or create others
+	oc := controllers.OrganizationControllerV1{Service: &userService, Auth: &auth}
+	ov1 := v1.NewRoute().Subrouter()
+	ov1.Use(tenant.Middleware, auth.Middleware)
+	ov1.HandleFunc("/org", auth.RequirePrivileged(oc.GetAllOrganizations)).Methods(http.MethodGet)
+	ov1.HandleFunc("/org", auth.RequirePrivileged(oc.CreateOrganization)).Methods(http.MethodPost)
+	ov1.HandleFunc("/org/{id:[0-9]+}", auth.RequirePrivileged(oc.GetOrganizationById)).Methods(http.MethodGet)
+
+	// invitation v1 controller; accepting takes the organization from the invitation token
+	ic := controllers.InvitationControllerV1{Service: &userService}
+	v1.HandleFunc("/invitation/accept", ic.AcceptInvitation).Methods(http.MethodPost)
+
+	// users, groups, invitations and attributes are scoped to the organization the request resolves to
+	// retries of writes made with an Idempotency-Key are answered with the first response, per user
+	idempotency := controllers.Idempotency{Service: &userService}
+	// user v1 controller; signing up and checking credentials are the only organization scoped routes open to
+	// anonymous requests. Registered first, so they are matched before the routes requiring authentication
+	uc := controllers.UserControllerV1{Service: &userService, Auth: &auth}
+	anon := v1.NewRoute().Subrouter()
+	anon.Use(tenant.Middleware, auth.Middleware, idempotency.Middleware)
+	anon.HandleFunc("/user", uc.CreateUser).Methods(http.MethodPost)
+	anon.HandleFunc("/user/auth", uc.AuthenticateUser).Methods(http.MethodPost)
+	// every other route only acts on the organization the request's credentials belong to
+	tv1 := v1.NewRoute().Subrouter()
+	tv1.Use(tenant.Middleware, auth.Middleware, auth.RequireAuthenticated, idempotency.Middleware)
+	tv1.HandleFunc("/user", uc.GetAllUsers).Methods(http.MethodGet)
+	tv1.HandleFunc("/user/{id:[0-9]+}", uc.GetUserById).Methods(http.MethodGet)
+	tv1.HandleFunc("/user/{id:[0-9]+}", uc.DeleteUser).Methods(http.MethodDelete)
+	tv1.HandleFunc("/user/{id:[0-9]+}", uc.UpdateUser).Methods(http.MethodPut)
+	tv1.HandleFunc("/user/{id:[0-9]+}", uc.PatchUser).Methods(http.MethodPatch)
+	tv1.HandleFunc("/user/{id:[0-9]+}/group", uc.GetUserGroups).Methods(http.MethodGet)
+	// import v1 controller; only privileged users import users
+	imp := controllers.ImportControllerV1{Service: &userService}
+	tv1.HandleFunc("/user/import", auth.RequirePrivileged(imp.ImportUsers)).Methods(http.MethodPost)
+	// export v1 controller; only privileged users export users
+	exc := controllers.ExportControllerV1{Service: &userService}
+	tv1.HandleFunc("/user/export", auth.RequirePrivileged(exc.ExportUsers)).Methods(http.MethodGet)
+	tv1.HandleFunc("/user/export", auth.RequirePrivileged(exc.StartExport)).Methods(http.MethodPost)
+	tv1.HandleFunc("/user/export/{id:[0-9]+}", auth.RequirePrivileged(exc.GetExport)).Methods(http.MethodGet)
+	tv1.HandleFunc("/user/export/{id:[0-9]+}/file", auth.RequirePrivileged(exc.GetExportFile)).Methods(http.MethodGet)
+	// batch v1 controller; only privileged users write users in batches
+	bc := controllers.BatchControllerV1{Service: &userService}
+	tv1.HandleFunc("/user/batch", auth.RequirePrivileged(bc.BatchUsers)).Methods(http.MethodPost)
+	// avatar v1 controller
+	avc := controllers.AvatarControllerV1{Service: &userService, Auth: &auth}
+	tv1.HandleFunc("/user/{id:[0-9]+}/avatar", avc.GetAvatar).Methods(http.MethodGet)
+	tv1.HandleFunc("/user/{id:[0-9]+}/avatar", avc.UploadAvatar).Methods(http.MethodPut)
+	tv1.HandleFunc("/user/{id:[0-9]+}/avatar", avc.DeleteAvatar).Methods(http.MethodDelete)
+	// group v1 controller; membership of groups decides who is privileged, so only privileged users change groups
+	gc := controllers.GroupControllerV1{Service: &userService}
+	tv1.HandleFunc("/group", gc.GetAllGroups).Methods(http.MethodGet)
+	tv1.HandleFunc("/group", auth.RequirePrivileged(gc.CreateGroup)).Methods(http.MethodPost)
+	tv1.HandleFunc("/group/changes", gc.GetMembershipChanges).Methods(http.MethodGet)
+	tv1.HandleFunc("/group/{id:[0-9]+}", gc.GetGroupById).Methods(http.MethodGet)
+	tv1.HandleFunc("/group/{id:[0-9]+}", auth.RequirePrivileged(gc.UpdateGroup)).Methods(http.MethodPut)
+	tv1.HandleFunc("/group/{id:[0-9]+}", auth.RequirePrivileged(gc.DeleteGroup)).Methods(http.MethodDelete)
+	tv1.HandleFunc("/group/{id:[0-9]+}/member", gc.GetGroupMembers).Methods(http.MethodGet)
+	tv1.HandleFunc("/group/{id:[0-9]+}/member/{userid:[0-9]+}", auth.RequirePrivileged(gc.AddGroupMember)).
+		Methods(http.MethodPut)
+	tv1.HandleFunc("/group/{id:[0-9]+}/member/{userid:[0-9]+}", auth.RequirePrivileged(gc.RemoveGroupMember)).
+		Methods(http.MethodDelete)
+	// only privileged users invite people, who join the groups named on the invitation
+	tv1.HandleFunc("/invitation", auth.RequirePrivileged(ic.GetPendingInvitations)).Methods(http.MethodGet)
+	tv1.HandleFunc("/invitation", auth.RequirePrivileged(ic.CreateInvitation)).Methods(http.MethodPost)
+	tv1.HandleFunc("/invitation/{id:[0-9]+}", auth.RequirePrivileged(ic.RevokeInvitation)).Methods(http.MethodDelete)
+	tv1.HandleFunc("/invitation/{id:[0-9]+}/resend", auth.RequirePrivileged(ic.ResendInvitation)).
+		Methods(http.MethodPost)
+	// impersonation v1 controller
+	imc := controllers.ImpersonationControllerV1{Auth: &auth}
+	tv1.HandleFunc("/impersonation", auth.RequirePrivileged(imc.StartImpersonation)).Methods(http.MethodPost)
+	tv1.HandleFunc("/impersonation/stop", imc.StopImpersonation).Methods(http.MethodPost)
+	tv1.HandleFunc("/audit", auth.RequirePrivileged(imc.GetAuditEvents)).Methods(http.MethodGet)
+	// api key v1 controller
+	akc := controllers.APIKeyControllerV1{Auth: &auth}
+	tv1.HandleFunc("/user/{id:[0-9]+}/apikey", akc.GetAPIKeys).Methods(http.MethodGet)
+	tv1.HandleFunc("/user/{id:[0-9]+}/apikey", akc.CreateAPIKey).Methods(http.MethodPost)
+	tv1.HandleFunc("/user/{id:[0-9]+}/apikey/{keyid:[0-9]+}", akc.RevokeAPIKey).Methods(http.MethodDelete)
+	// attribute v1 controller; only privileged users define attributes
+	atc := controllers.AttributeControllerV1{Service: &userService}
+	tv1.HandleFunc("/attribute", atc.GetAllAttributes).Methods(http.MethodGet)
+	tv1.HandleFunc("/attribute", auth.RequirePrivileged(atc.CreateAttribute)).Methods(http.MethodPost)
+	tv1.HandleFunc("/attribute/{id:[0-9]+}", auth.RequirePrivileged(atc.UpdateAttribute)).Methods(http.MethodPut)
+	tv1.HandleFunc("/attribute/{id:[0-9]+}", auth.RequirePrivileged(atc.DeleteAttribute)).Methods(http.MethodDelete)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.Server.Port))
 	if err != nil {
-		fmt.Println("[status] [fatal] Caught Error on HTTP ListenAndServer: ", err)
-		os.Exit(1)
+		logger.Fatal("Unable to listen", logging.Fields{"error": err})
+	}
+
+	// Trace, log and measure every request. Logging inside the trace lets log entries carry the trace id
+	handler := tracing.InstrumentRouter(userService.Router, logging.Middleware(logger, cfg.Logging.AccessLog,
+		metrics.InstrumentRouter(userService.Router)))
+
+	// Shut down gracefully on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err = userService.Run(ctx, userService.NewServer(handler), listener); err != nil {
+		logger.Fatal("User Service did not shut down cleanly", logging.Fields{"error": err})
 	}
-	userService.Logger.Println("[status] [online] User Service online and ready to serve")
 }
 
 func ServeTest(writer http.ResponseWriter, request *http.Request) {
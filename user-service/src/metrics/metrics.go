@@ -0,0 +1,141 @@
+// Package metrics holds the Prometheus registry of the service and the metrics shared between subsystems. A
+// subsystem adds its own metrics through Factory, or registers its own collectors with Register
+package metrics
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NAMESPACE prefixes the name of every metric of the service
+const NAMESPACE string = "user_service"
+
+// UNMATCHED_ROUTE labels requests that matched no route, so scans of unknown paths don't create a series each
+const UNMATCHED_ROUTE string = "unmatched"
+
+// Registry holds every metric the service exposes, along with the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+// Factory creates metrics registered with Registry
+var Factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Register adds collectors to Registry. Panics if one is already registered, like prometheus.MustRegister
+func Register(cs ...prometheus.Collector) {
+	Registry.MustRegister(cs...)
+}
+
+// Handler serves the metrics in Registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+var (
+	HTTPRequests = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Subsystem: "http", Name: "requests_total",
+		Help: "HTTP requests by route template, method and status code",
+	}, []string{"route", "method", "status"})
+
+	HTTPDuration = Factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE, Subsystem: "http", Name: "request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests by route template, method and status code",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// PasswordHashDuration times bcrypt, by operation: hash or compare
+	PasswordHashDuration = Factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE, Subsystem: "auth", Name: "password_hash_duration_seconds",
+		Help:    "Time taken to hash or compare passwords with bcrypt",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+
+	// Authentications counts authentication attempts by method (basic, apikey, impersonation) and result, which is
+	// success or the reason the attempt failed
+	Authentications = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Subsystem: "auth", Name: "attempts_total",
+		Help: "Authentication attempts by method and result",
+	}, []string{"method", "result"})
+
+	// DBReads counts read-only transactions by where they ran: primary or the replica's address
+	DBReads = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Subsystem: "db", Name: "reads_total",
+		Help: "Read-only transactions by the database they ran on",
+	}, []string{"target"})
+
+	// DBPrimaryReads counts reads sent to the primary although replicas are configured, by reason: no_replica when
+	// none is healthy, read_your_writes when the request already wrote, or replica_failed when the replica failed
+	// before the read ran
+	DBPrimaryReads = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Subsystem: "db", Name: "primary_fallbacks_total",
+		Help: "Reads sent to the primary instead of a replica, by reason",
+	}, []string{"reason"})
+
+	ReplicaLag = Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE, Subsystem: "db", Name: "replica_lag_seconds",
+		Help: "How far each replica's replay is behind the primary, as of the last health check",
+	}, []string{"replica"})
+
+	ReplicaHealthy = Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE, Subsystem: "db", Name: "replica_healthy",
+		Help: "Whether each replica is receiving reads, 1, or is excluded, 0",
+	}, []string{"replica"})
+
+	// ReplicaExclusions counts replicas being excluded from reads, by reason: lagging, disconnected or unreachable
+	ReplicaExclusions = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Subsystem: "db", Name: "replica_exclusions_total",
+		Help: "Times each replica was excluded from reads, by reason",
+	}, []string{"replica", "reason"})
+
+	// Users is the number of users in each organization, by organization slug
+	Users = Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE, Name: "users",
+		Help: "Users in each organization",
+	}, []string{"organization"})
+)
+
+// ObserveSince records the time elapsed since start in seconds
+func ObserveSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// InstrumentRouter counts and times every request served by the router, labelled by the template of the route it
+// matched rather than its path, so ids in paths don't create a series each
+func InstrumentRouter(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		route := UNMATCHED_ROUTE
+		var match mux.RouteMatch
+		if router.Match(request, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		router.ServeHTTP(recorder, request)
+
+		status := strconv.Itoa(recorder.status)
+		HTTPRequests.WithLabelValues(route, request.Method, status).Inc()
+		ObserveSince(HTTPDuration.WithLabelValues(route, request.Method, status), start)
+	})
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestInstrumentRouter Checks requests are labelled by route template and status
+func TestInstrumentRouter(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/widget/{id:[0-9]+}", func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusTeapot)
+	}).Methods(http.MethodGet)
+	handler := InstrumentRouter(router)
+
+	tests := []struct {
+		method string
+		path   string
+		route  string
+		status string
+	}{
+		{http.MethodGet, "/api/v1/widget/1", "/api/v1/widget/{id:[0-9]+}", "418"},
+		{http.MethodGet, "/api/v1/widget/2", "/api/v1/widget/{id:[0-9]+}", "418"},
+		{http.MethodGet, "/api/v1/nothing/here", UNMATCHED_ROUTE, "404"},
+		{http.MethodPost, "/api/v1/widget/1", UNMATCHED_ROUTE, "405"},
+	}
+
+	for _, test := range tests {
+		counter := HTTPRequests.WithLabelValues(test.route, test.method, test.status)
+		before := testutil.ToFloat64(counter)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, test.path, nil))
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Errorf("%s %s expected to count against route %s status %s", test.method, test.path, test.route,
+				test.status)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Authentications.WithLabelValues("basic", "success").Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Metrics expected to be served, got %d", recorder.Code)
+	}
+
+	body := recorder.Body.String()
+	for _, name := range []string{"user_service_auth_attempts_total", "go_goroutines"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("Metrics expected to include %s", name)
+		}
+	}
+}
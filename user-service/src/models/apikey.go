@@ -0,0 +1,317 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIKeyModel is a named, scoped and expiring credential a user mints for machine clients. The key acts as the
+// user, limited to its scopes
+type APIKeyModel struct {
+	ID         int        `json:"id"`
+	OrgID      int        `json:"orgid"`
+	UserID     int        `json:"userid"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expiresat"`
+	CreatedAt  time.Time  `json:"createdat"`
+	LastUsedAt *time.Time `json:"lastusedat,omitempty"`
+	// Key is the plaintext key, only known when the key is minted. Only its hash is stored
+	Key string `json:"key,omitempty"`
+}
+
+// APIKEY_PREFIX marks API keys so they are recognisable wherever they turn up
+const APIKEY_PREFIX string = "usk_"
+
+// APIKEY_SCOPES are the scopes a key can be granted. A key needs <resource>:read to GET a route under
+// /api/v1/<resource> and <resource>:write for anything else
+var APIKEY_SCOPES = []string{"user:read", "user:write", "group:read", "group:write", "invitation:read",
+	"invitation:write", "attribute:read"}
+
+const (
+	APIKEY_DEFAULT_TTL = 90 * 24 * time.Hour
+	APIKEY_MAX_TTL     = 365 * 24 * time.Hour
+	// APIKEY_LAST_USED_RESOLUTION limits how often using a key writes its last used time
+	APIKEY_LAST_USED_RESOLUTION = time.Minute
+)
+
+const APIKeySchema string = `
+CREATE TABLE api_keys (
+	id SERIAL PRIMARY KEY,
+	org_id INT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL UNIQUE,
+	key_hash TEXT NOT NULL,
+	scopes TEXT[] NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	last_used_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ
+);
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
+
+GRANT SELECT, INSERT, UPDATE ON api_keys TO user_service_tenant;
+GRANT USAGE ON SEQUENCE api_keys_id_seq TO user_service_tenant;
+
+ALTER TABLE api_keys ENABLE ROW LEVEL SECURITY;
+ALTER TABLE api_keys FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON api_keys USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+`
+
+// ErrInvalidAPIKey is returned for keys that are malformed, unknown, revoked or expired
+var ErrInvalidAPIKey = apperror.Unauthorized("invalid, revoked or expired API key")
+
+// IsAPIKey reports whether the value looks like an API key, without verifying it
+func IsAPIKey(value string) bool {
+	return strings.HasPrefix(value, APIKEY_PREFIX)
+}
+
+// parseAPIKey splits a key of the form usk_<org id>_<lookup>_<secret> into its organization and lookup prefix
+func parseAPIKey(value string) (orgID int, prefix string, err error) {
+	parts := strings.SplitN(value, "_", 4)
+	if len(parts) != 4 || parts[0]+"_" != APIKEY_PREFIX || parts[2] == "" || parts[3] == "" {
+		return 0, "", ErrInvalidAPIKey
+	}
+
+	orgID, err = strconv.Atoi(parts[1])
+	if err != nil || orgID <= 0 {
+		return 0, "", ErrInvalidAPIKey
+	}
+
+	return orgID, strings.Join(parts[:3], "_"), nil
+}
+
+// APIKeyOrganization reads the organization id from an API key
+func APIKeyOrganization(value string) (int, error) {
+	orgID, _, err := parseAPIKey(value)
+	return orgID, err
+}
+
+// hashAPIKey hashes a key for storage. The keys are random, so a fast hash is sufficient
+func hashAPIKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey generates a key for the organization and returns it with its lookup prefix
+func newAPIKey(orgID int) (value, prefix string, err error) {
+	lookup := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err = rand.Read(lookup); err != nil {
+		return
+	}
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+
+	prefix = fmt.Sprintf("%s%d_%s", APIKEY_PREFIX, orgID, hex.EncodeToString(lookup))
+	value = prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	return
+}
+
+// ValidScope reports whether scope is one a key can be granted
+func ValidScope(scope string) bool {
+	for _, valid := range APIKEY_SCOPES {
+		if scope == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the key was granted scope
+func (key APIKeyModel) HasScope(scope string) bool {
+	for _, granted := range key.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate Validates that all fields are included and contain proper values
+// returns the list of validation errors
+func (key APIKeyModel) Validate() (errs []apperror.FieldError) {
+	if key.Name == "" {
+		errs = append(errs, apperror.FieldError{Field: "name", Message: "Name is not specified!"})
+	} else if len(key.Name) > 100 {
+		errs = append(errs, apperror.FieldError{Field: "name", Message: "Invalid Name: must be 100 characters or less"})
+	}
+
+	if len(key.Scopes) == 0 {
+		errs = append(errs, apperror.FieldError{Field: "scopes", Message: "Scopes are not specified!"})
+	}
+	for _, scope := range key.Scopes {
+		if !ValidScope(scope) {
+			errs = append(errs, apperror.FieldError{Field: "scopes", Message: fmt.Sprintf(
+				"Invalid Scope %s: must be one of %s", scope, strings.Join(APIKEY_SCOPES, ", "))})
+		}
+	}
+
+	if !key.ExpiresAt.After(time.Now()) {
+		errs = append(errs, apperror.FieldError{Field: "expiresat", Message: "ExpiresAt must be in the future"})
+	} else if key.ExpiresAt.After(time.Now().Add(APIKEY_MAX_TTL)) {
+		errs = append(errs, apperror.FieldError{Field: "expiresat", Message: "ExpiresAt must be within a year"})
+	}
+
+	return
+}
+
+// Create mints the key. Without an expiry it expires after APIKEY_DEFAULT_TTL. The plaintext key is set on the
+// model and can't be recovered afterwards
+// returns a not found error if the user does not exist in the organization
+func (key *APIKeyModel) Create(ctx context.Context, db *database.PostGresDB) error {
+	if key.ID != 0 {
+		return apperror.Invalid("id", "ID must be null when creating an API Key")
+	}
+	if key.ExpiresAt.IsZero() {
+		key.ExpiresAt = time.Now().Add(APIKEY_DEFAULT_TTL)
+	}
+
+	if valErrors := key.Validate(); len(valErrors) > 0 {
+		return apperror.Validation("APIKeyModel failed validation", valErrors...)
+	}
+
+	value, prefix, err := newAPIKey(key.OrgID)
+	if err != nil {
+		return err
+	}
+
+	insertStmt := `INSERT INTO api_keys (org_id, user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+	err = db.InTenant(ctx, database.OP_WRITE, key.OrgID, func(tx *database.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, key.UserID).
+			Scan(&exists); err != nil {
+			return err
+		} else if !exists {
+			return apperror.NotFound("No User with ID %d found", key.UserID).Wrap(sql.ErrNoRows)
+		}
+
+		return tx.QueryRow(insertStmt, key.OrgID, key.UserID, key.Name, prefix, hashAPIKey(value),
+			pq.Array(key.Scopes), key.ExpiresAt).Scan(&key.ID, &key.CreatedAt)
+	})
+	if err != nil {
+		return err
+	}
+	key.Prefix = prefix
+	key.Key = value
+
+	return nil
+}
+
+const APIKEY_GET_FIELDLIST string = "id, org_id, user_id, name, prefix, scopes, expires_at, created_at, last_used_at"
+
+// scanAPIKey reads an APIKEY_GET_FIELDLIST row into an APIKeyModel
+func scanAPIKey(row interface{ Scan(...interface{}) error }, extra ...interface{}) (key APIKeyModel, err error) {
+	var lastUsedAt pq.NullTime
+	dest := append([]interface{}{&key.ID, &key.OrgID, &key.UserID, &key.Name, &key.Prefix,
+		pq.Array(&key.Scopes), &key.ExpiresAt, &key.CreatedAt, &lastUsedAt}, extra...)
+	if err = row.Scan(dest...); err != nil {
+		return
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return
+}
+
+// GetAPIKeys fetches the keys of the user that have not been revoked, including expired ones
+func GetAPIKeys(ctx context.Context, db *database.PostGresDB, orgID, userID int) (keys []APIKeyModel, err error) {
+	selectStmt := `SELECT ` + APIKEY_GET_FIELDLIST + ` FROM api_keys
+		WHERE user_id = $1 AND revoked_at IS NULL ORDER BY id`
+
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			key, err := scanAPIKey(rows)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+
+		return rows.Err()
+	})
+
+	return
+}
+
+// RevokeAPIKey stops the user's key from working
+// returns a not found error if the user has no unrevoked key with that id
+func RevokeAPIKey(ctx context.Context, db *database.PostGresDB, orgID, userID, id int) error {
+	var res sql.Result
+	err := db.InTenant(ctx, database.OP_WRITE, orgID, func(tx *database.Tx) (err error) {
+		res, err = tx.Exec(`UPDATE api_keys SET revoked_at = now()
+			WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`, id, userID)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	var rows int64
+	rows, _ = res.RowsAffected()
+	if int(rows) == 0 {
+		return apperror.NotFound("No API Key with ID %d found", id).Wrap(sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// AuthenticateAPIKey verifies the key and returns it along with the username of its owner. Records when the key
+// was last used, to within APIKEY_LAST_USED_RESOLUTION
+// returns ErrInvalidAPIKey if the key is not valid
+func AuthenticateAPIKey(ctx context.Context, db *database.PostGresDB, value string) (key APIKeyModel, username string, err error) {
+	orgID, prefix, err := parseAPIKey(value)
+	if err != nil {
+		return
+	}
+
+	selectStmt := `SELECT k.id, k.org_id, k.user_id, k.name, k.prefix, k.scopes, k.expires_at, k.created_at,
+			k.last_used_at, k.key_hash, u.username
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.prefix = $1 AND k.revoked_at IS NULL AND k.expires_at > now()`
+	usedStmt := `UPDATE api_keys SET last_used_at = now() WHERE id = $1 AND
+		(last_used_at IS NULL OR last_used_at < now() - $2::int * interval '1 second')`
+
+	err = db.InTenant(ctx, database.OP_READ, orgID, func(tx *database.Tx) error {
+		var keyHash string
+		key, err = scanAPIKey(tx.QueryRow(selectStmt, prefix), &keyHash, &username)
+		if err == sql.ErrNoRows {
+			return ErrInvalidAPIKey
+		} else if err != nil {
+			return err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashAPIKey(value))) != 1 {
+			return ErrInvalidAPIKey
+		}
+
+		_, err = tx.Exec(usedStmt, key.ID, int(APIKEY_LAST_USED_RESOLUTION.Seconds()))
+		return err
+	})
+
+	return
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAPIKey Checks that minted keys carry their organization and lookup prefix
+func TestAPIKey(t *testing.T) {
+	value, prefix, err := newAPIKey(42)
+	if err != nil {
+		t.Fatalf("Caught error while generating key: %s", err)
+	}
+
+	if !IsAPIKey(value) || !strings.HasPrefix(value, prefix+"_") {
+		t.Errorf("Key %s expected to start with its prefix %s", value, prefix)
+	}
+
+	orgID, parsedPrefix, err := parseAPIKey(value)
+	if err != nil || orgID != 42 || parsedPrefix != prefix {
+		t.Errorf("Key %s expected to parse as organization 42 prefix %s, got %d %s (%v)", value, prefix, orgID,
+			parsedPrefix, err)
+	}
+
+	other, otherPrefix, _ := newAPIKey(42)
+	if other == value || otherPrefix == prefix {
+		t.Errorf("Two keys generated for the same organization were identical")
+	}
+}
+
+func TestParseAPIKey(t *testing.T) {
+	//Test keys that can't name an organization
+	for _, value := range []string{"", "usk_", "usk_1_abc", "usk_1__secret", "usk_1_abc_", "usk_x_abc_secret",
+		"usk_0_abc_secret", "imp_1_abc_secret"} {
+		if _, _, err := parseAPIKey(value); err != ErrInvalidAPIKey {
+			t.Errorf("Key |%s| expected to be rejected, got %v", value, err)
+		}
+	}
+}
+
+func TestAPIKeyHasScope(t *testing.T) {
+	key := APIKeyModel{Scopes: []string{"user:read", "group:write"}}
+	for _, scope := range []string{"user:read", "group:write"} {
+		if !key.HasScope(scope) {
+			t.Errorf("Key expected to have scope %s", scope)
+		}
+	}
+	for _, scope := range []string{"user:write", "group:read", "invitation:read", ""} {
+		if key.HasScope(scope) {
+			t.Errorf("Key expected not to have scope %s", scope)
+		}
+	}
+}
+
+func TestAPIKeyValidate(t *testing.T) {
+	key := APIKeyModel{Name: "nightly sync", Scopes: []string{"user:read"},
+		ExpiresAt: time.Now().Add(APIKEY_DEFAULT_TTL)}
+	if errs := key.Validate(); len(errs) > 0 {
+		t.Errorf("Key expected to pass, failed: %v", errs)
+	}
+
+	invalid := []APIKeyModel{
+		{Scopes: []string{"user:read"}, ExpiresAt: key.ExpiresAt},
+		{Name: key.Name, ExpiresAt: key.ExpiresAt},
+		{Name: key.Name, Scopes: []string{"user:admin"}, ExpiresAt: key.ExpiresAt},
+		{Name: key.Name, Scopes: key.Scopes, ExpiresAt: time.Now().Add(-time.Minute)},
+		{Name: key.Name, Scopes: key.Scopes, ExpiresAt: time.Now().Add(APIKEY_MAX_TTL + time.Hour)},
+	}
+	for i, key := range invalid {
+		if errs := key.Validate(); len(errs) == 0 {
+			t.Errorf("Key %d expected to fail, passed", i)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/validation"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// AttributeModel defines a custom attribute the users of an organization can have, such as a department or an
+// employee ID. The values are kept in the attributes of each user
+type AttributeModel struct {
+	ID       int    `json:"id"`
+	OrgID    int    `json:"orgid"` // set from the organization the request was resolved to, never from the client
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	// Enum, if not empty, are the only values the attribute can have
+	Enum []interface{} `json:"enum,omitempty"`
+	// Pattern is a regular expression the whole of a string value must match
+	Pattern string `json:"pattern,omitempty"`
+	// Unique stops two users of the organization having the same value
+	Unique bool `json:"unique"`
+	// Token includes the attribute in the tokens issued for a user
+	Token bool `json:"token"`
+
+	pattern *regexp.Regexp
+}
+
+// The types of attribute values
+const (
+	ATTRIBUTE_TYPE_STRING  string = "string"
+	ATTRIBUTE_TYPE_INTEGER string = "integer"
+	ATTRIBUTE_TYPE_NUMBER  string = "number"
+	ATTRIBUTE_TYPE_BOOLEAN string = "boolean"
+)
+
+// ATTRIBUTE_NAME_REGEX are the names attributes can have, which are safe to use as JSON keys and query parameters
+var ATTRIBUTE_NAME_REGEX = regexp.MustCompile("^[a-z][a-z0-9_]{0,62}$")
+
+// The codes of the failures of attribute values, besides required and pattern
+const (
+	// CODE_TYPE is a value that isn't of the type of the attribute
+	CODE_TYPE string = "type"
+	// CODE_ENUM is a value that isn't one of the enum of the attribute
+	CODE_ENUM string = "enum"
+	// CODE_UNKNOWN is a value of an attribute the organization hasn't defined
+	CODE_UNKNOWN string = "unknown"
+)
+
+// ATTRIBUTE_MESSAGES are the English messages of the failures of attribute values, and of attribute definitions
+var ATTRIBUTE_MESSAGES = map[string]string{
+	CODE_TYPE:       "{field} must be of type {type}",
+	CODE_ENUM:       "{field} must be one of {enum}",
+	CODE_UNKNOWN:    "{field} is not an attribute of users",
+	"name.required": "Name is not specified!",
+	"name.pattern": "Invalid Name: must start with a lower case letter, then be only lower case letters, digits and " +
+		"_, up to 63 characters",
+	"type.enum":      "Invalid Type: must be one of {enum}",
+	"pattern.type":   "Only attributes of type {type} can have a Pattern",
+	"pattern.format": "Invalid Pattern: {error}",
+	"enum.type":      "Invalid Enum: {value} is not of type {type}",
+}
+
+func init() {
+	validation.AddMessages("en", ATTRIBUTE_MESSAGES)
+}
+
+// AttributeSchema creates the table of attribute definitions, and the attributes of users
+const AttributeSchema string = `
+CREATE TABLE attributes (
+	id SERIAL PRIMARY KEY,
+	org_id INT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	type TEXT NOT NULL,
+	required BOOLEAN NOT NULL DEFAULT false,
+	enum JSONB NOT NULL DEFAULT '[]',
+	pattern TEXT NOT NULL DEFAULT '',
+	is_unique BOOLEAN NOT NULL DEFAULT false,
+	in_token BOOLEAN NOT NULL DEFAULT false,
+	CONSTRAINT attributes_org_id_name_key UNIQUE (org_id, name)
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON attributes TO user_service_tenant;
+GRANT USAGE ON SEQUENCE attributes_id_seq TO user_service_tenant;
+
+ALTER TABLE attributes ENABLE ROW LEVEL SECURITY;
+ALTER TABLE attributes FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON attributes USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+
+ALTER TABLE users ADD COLUMN attributes JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX users_attributes_idx ON users USING GIN (attributes);
+`
+
+const ATTRIBUTE_GET_FIELDLIST string = "id, org_id, name, type, required, enum, pattern, is_unique, in_token"
+
+// Validate Validates that all fields are included and contain proper values
+// returns the list of validation errors
+func (attr *AttributeModel) Validate() (errs []apperror.FieldError) {
+	if attr.Name == "" {
+		errs = append(errs, fieldError("name", validation.CODE_REQUIRED, nil))
+	} else if !ATTRIBUTE_NAME_REGEX.MatchString(attr.Name) {
+		errs = append(errs, fieldError("name", validation.CODE_PATTERN,
+			map[string]interface{}{"pattern": ATTRIBUTE_NAME_REGEX.String()}))
+	}
+
+	switch attr.Type {
+	case ATTRIBUTE_TYPE_STRING, ATTRIBUTE_TYPE_INTEGER, ATTRIBUTE_TYPE_NUMBER, ATTRIBUTE_TYPE_BOOLEAN:
+	default:
+		errs = append(errs, fieldError("type", CODE_ENUM, map[string]interface{}{"enum": []string{
+			ATTRIBUTE_TYPE_STRING, ATTRIBUTE_TYPE_INTEGER, ATTRIBUTE_TYPE_NUMBER, ATTRIBUTE_TYPE_BOOLEAN}}))
+		return
+	}
+
+	attr.pattern = nil
+	if attr.Pattern != "" {
+		pattern, err := regexp.Compile("^(?:" + attr.Pattern + ")$")
+		if attr.Type != ATTRIBUTE_TYPE_STRING {
+			errs = append(errs, fieldError("pattern", CODE_TYPE,
+				map[string]interface{}{"type": ATTRIBUTE_TYPE_STRING}))
+		} else if err != nil {
+			errs = append(errs, fieldError("pattern", validation.CODE_FORMAT,
+				map[string]interface{}{"error": err.Error()}))
+		} else {
+			attr.pattern = pattern
+		}
+	}
+
+	for _, value := range attr.Enum {
+		if !attr.hasType(value) {
+			errs = append(errs, fieldError("enum", CODE_TYPE,
+				map[string]interface{}{"type": attr.Type, "value": value}))
+		}
+	}
+
+	return
+}
+
+// fieldError builds the failure of the field with its message in DEFAULT_LOCALE, which the controllers rebuild in
+// the locale of the request
+func fieldError(field, code string, params map[string]interface{}) apperror.FieldError {
+	return apperror.FieldError{Field: field, Code: code,
+		Message: validation.Message(validation.DEFAULT_LOCALE, field, code, params), Params: params}
+}
+
+// hasType reports whether the value, as decoded from JSON, is of the type of the attribute
+func (attr AttributeModel) hasType(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return attr.Type == ATTRIBUTE_TYPE_STRING
+	case float64:
+		return attr.Type == ATTRIBUTE_TYPE_NUMBER || attr.Type == ATTRIBUTE_TYPE_INTEGER && v == math.Trunc(v)
+	case bool:
+		return attr.Type == ATTRIBUTE_TYPE_BOOLEAN
+	}
+
+	return false
+}
+
+// check checks a value of the attribute
+// returns the code and params of its failure, "" if it passes
+func (attr AttributeModel) check(value interface{}) (string, map[string]interface{}) {
+	if !attr.hasType(value) {
+		return CODE_TYPE, map[string]interface{}{"type": attr.Type}
+	}
+
+	if len(attr.Enum) > 0 {
+		found := false
+		for _, allowed := range attr.Enum {
+			found = found || allowed == value
+		}
+		if !found {
+			return CODE_ENUM, map[string]interface{}{"enum": attr.Enum}
+		}
+	}
+
+	if s, ok := value.(string); ok && attr.pattern != nil && !attr.pattern.MatchString(s) {
+		return validation.CODE_PATTERN, map[string]interface{}{"pattern": attr.Pattern}
+	}
+
+	return "", nil
+}
+
+// ValidateAttributes checks the values against the attributes defined, reporting each failure against the field
+// attributes.<name>. A null value is the same as none
+// returns the list of validation errors
+func ValidateAttributes(attrs []AttributeModel, values map[string]interface{}) (errs []apperror.FieldError) {
+	failure := func(name, code string, params map[string]interface{}) {
+		errs = append(errs, fieldError("attributes."+name, code, params))
+	}
+
+	defined := make(map[string]bool)
+	for _, attr := range attrs {
+		defined[attr.Name] = true
+		if value := values[attr.Name]; value == nil {
+			if attr.Required {
+				failure(attr.Name, validation.CODE_REQUIRED, nil)
+			}
+		} else if code, params := attr.check(value); code != "" {
+			failure(attr.Name, code, params)
+		}
+	}
+
+	var unknown []string
+	for name := range values {
+		if !defined[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		failure(name, CODE_UNKNOWN, nil)
+	}
+
+	return
+}
+
+// scanAttribute reads an ATTRIBUTE_GET_FIELDLIST row into an AttributeModel
+func scanAttribute(row scanner) (attr AttributeModel, err error) {
+	var enum []byte
+	err = row.Scan(&attr.ID, &attr.OrgID, &attr.Name, &attr.Type, &attr.Required, &enum, &attr.Pattern, &attr.Unique,
+		&attr.Token)
+	if err == nil {
+		err = json.Unmarshal(enum, &attr.Enum)
+	}
+	if err == nil && attr.Pattern != "" {
+		attr.pattern, err = regexp.Compile("^(?:" + attr.Pattern + ")$")
+	}
+
+	return
+}
+
+// getAttributes fetches the attributes the transaction's organization has defined, ordered by name
+func getAttributes(tx *database.Tx) (attrs []AttributeModel, err error) {
+	rows, err := tx.Query(`SELECT ` + ATTRIBUTE_GET_FIELDLIST + ` FROM attributes ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attr, err := scanAttribute(rows)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+
+	return attrs, rows.Err()
+}
+
+// GetAttributes fetches the attributes the organization orgID has defined, ordered by name
+func GetAttributes(ctx context.Context, db *database.PostGresDB, orgID int) (attrs []AttributeModel, err error) {
+	err = db.InTenantReadOnly(ctx, database.OP_READ, orgID, func(tx *database.Tx) (err error) {
+		attrs, err = getAttributes(tx)
+		return
+	})
+
+	return
+}
+
+// enumParam encodes the Enum for the database
+func (attr AttributeModel) enumParam() []byte {
+	if len(attr.Enum) == 0 {
+		return []byte("[]")
+	}
+	enum, _ := json.Marshal(attr.Enum)
+	return enum
+}
+
+func (attr *AttributeModel) Create(ctx context.Context, db *database.PostGresDB) error {
+	if attr.ID != 0 {
+		return apperror.Invalid("id", "ID must be null when creating an Attribute")
+	}
+
+	if valErrors := attr.Validate(); len(valErrors) > 0 {
+		return apperror.Validation("AttributeModel failed validation", valErrors...)
+	}
+
+	insertStmt := `INSERT INTO attributes (org_id, name, type, required, enum, pattern, is_unique, in_token)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	err := db.InTenant(ctx, database.OP_WRITE, attr.OrgID, func(tx *database.Tx) error {
+		if err := attr.checkUsers(tx, AttributeModel{}); err != nil {
+			return err
+		}
+		return tx.QueryRow(insertStmt, attr.OrgID, attr.Name, attr.Type, attr.Required, attr.enumParam(),
+			attr.Pattern, attr.Unique, attr.Token).Scan(&attr.ID)
+	})
+	if err != nil && database.DuplicateKeyError(err) {
+		return conflict(err)
+	}
+
+	return err
+}
+
+// checkUsers checks the users of the organization can keep the values they have once the attribute is required or
+// unique, or once its enum or pattern is narrowed from those of stored, as each user that can't would fail to be
+// changed at all. stored is the zero AttributeModel for a new attribute
+// returns a conflict error on required if a user has no value, on unique if users share a value, or on enum or
+// pattern if a value no longer passes
+func (attr AttributeModel) checkUsers(tx *database.Tx, stored AttributeModel) error {
+	if attr.Required && !stored.Required {
+		var missing int
+		countStmt := `SELECT count(*) FROM users WHERE NOT attributes ? $1`
+		if err := tx.QueryRow(countStmt, attr.Name).Scan(&missing); err != nil {
+			return err
+		} else if missing > 0 {
+			return apperror.Conflict("required", "Attribute can't be required: %d users have no value of %s",
+				missing, attr.Name)
+		}
+	}
+
+	if attr.Unique && !stored.Unique {
+		var shared int
+		countStmt := `SELECT count(*) FROM (SELECT 1 FROM users WHERE attributes ? $1 GROUP BY attributes -> $1
+			HAVING count(*) > 1) AS duplicates`
+		if err := tx.QueryRow(countStmt, attr.Name).Scan(&shared); err != nil {
+			return err
+		} else if shared > 0 {
+			return apperror.Conflict("unique", "Attribute can't be unique: %d values of %s are shared by users",
+				shared, attr.Name)
+		}
+	}
+
+	enumChanged := len(attr.Enum) > 0 && !reflect.DeepEqual(attr.Enum, stored.Enum)
+	patternChanged := attr.Pattern != "" && attr.Pattern != stored.Pattern
+	if !enumChanged && !patternChanged {
+		return nil
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT attributes -> $1 FROM users WHERE attributes ? $1`, attr.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	failed := make(map[string]int)
+	for rows.Next() {
+		var encoded []byte
+		if err = rows.Scan(&encoded); err != nil {
+			return err
+		}
+		var value interface{}
+		if err = json.Unmarshal(encoded, &value); err != nil {
+			return err
+		}
+		code, _ := attr.check(value)
+		failed[code]++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if failed[CODE_ENUM] > 0 {
+		return apperror.Conflict("enum", "Attribute enum can't be narrowed: %d values users have of %s are not in it",
+			failed[CODE_ENUM], attr.Name)
+	} else if failed[validation.CODE_PATTERN] > 0 {
+		return apperror.Conflict("pattern", "Attribute pattern can't be narrowed: %d values users have of %s don't "+
+			"match it", failed[validation.CODE_PATTERN], attr.Name)
+	}
+
+	return nil
+}
+
+// Update changes the definition of the attribute. Its name and type can't change, as the values users already have
+// are kept. Making it required or unique, or narrowing its enum or pattern, is refused while users have values that
+// would no longer pass
+func (attr *AttributeModel) Update(ctx context.Context, db *database.PostGresDB) error {
+	if attr.ID == 0 {
+		return apperror.NotFound("No Attribute with ID %d found", attr.ID).Wrap(sql.ErrNoRows)
+	}
+
+	if valErrors := attr.Validate(); len(valErrors) > 0 {
+		return apperror.Validation("AttributeModel failed validation", valErrors...)
+	}
+
+	selectStmt := `SELECT ` + ATTRIBUTE_GET_FIELDLIST + ` FROM attributes WHERE id = $1 FOR UPDATE`
+	updateStmt := `UPDATE attributes SET required = $2, enum = $3, pattern = $4, is_unique = $5, in_token = $6
+		WHERE id = $1`
+	return db.InTenant(ctx, database.OP_WRITE, attr.OrgID, func(tx *database.Tx) error {
+		stored, err := scanAttribute(tx.QueryRow(selectStmt, attr.ID))
+		if err == sql.ErrNoRows {
+			return apperror.NotFound("No Attribute with ID %d found", attr.ID).Wrap(err)
+		} else if err != nil {
+			return err
+		} else if stored.Name != attr.Name {
+			return apperror.Invalid("name", "changing Name is not permitted")
+		} else if stored.Type != attr.Type {
+			return apperror.Invalid("type", "changing Type is not permitted")
+		} else if err = attr.checkUsers(tx, stored); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(updateStmt, attr.ID, attr.Required, attr.enumParam(), attr.Pattern, attr.Unique, attr.Token)
+		return err
+	})
+}
+
+// Delete removes the attribute, and its value from every user of the organization
+func (attr *AttributeModel) Delete(ctx context.Context, db *database.PostGresDB) error {
+	deleteStmt := `DELETE FROM attributes WHERE id = $1 RETURNING name`
+	return db.InTenant(ctx, database.OP_WRITE, attr.OrgID, func(tx *database.Tx) error {
+		err := tx.QueryRow(deleteStmt, attr.ID).Scan(&attr.Name)
+		if err == sql.ErrNoRows {
+			return apperror.NotFound("No Attribute with ID %d found", attr.ID).Wrap(err)
+		} else if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE users SET attributes = attributes - $1 WHERE attributes ? $1`, attr.Name)
+		return err
+	})
+}
+
+// attributesParam encodes the Attributes of the user for the database
+func (user UserModel) attributesParam() []byte {
+	if len(user.Attributes) == 0 {
+		return []byte("{}")
+	}
+	attributes, _ := json.Marshal(user.Attributes)
+	return attributes
+}
+
+// checkAttributes validates the attributes of the user against those of its organization, and checks no other user
+// has the value of a unique one
+// returns a validation error, or a conflict error on attributes.<name>
+func (user *UserModel) checkAttributes(tx *database.Tx) error {
+	attrs, err := getAttributes(tx)
+	if err != nil {
+		return err
+	}
+
+	if user.Attributes == nil {
+		user.Attributes = make(map[string]interface{})
+	}
+	for name, value := range user.Attributes {
+		if value == nil {
+			delete(user.Attributes, name)
+		}
+	}
+	if valErrors := ValidateAttributes(attrs, user.Attributes); len(valErrors) > 0 {
+		return apperror.Validation("UserModel failed validation", valErrors...)
+	}
+
+	for _, attr := range attrs {
+		value, ok := user.Attributes[attr.Name]
+		if !attr.Unique || !ok {
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+
+		// Held until the transaction ends, so two users can't take the same value at once
+		lockStmt := `SELECT pg_advisory_xact_lock(hashtext($1))`
+		if _, err = tx.Exec(lockStmt, fmt.Sprintf("attribute:%d:%s:%s", user.OrgID, attr.Name, encoded)); err != nil {
+			return err
+		}
+
+		var exists bool
+		existsStmt := `SELECT EXISTS (SELECT 1 FROM users WHERE attributes -> $1 = $2::jsonb AND id <> $3)`
+		if err = tx.QueryRow(existsStmt, attr.Name, string(encoded), user.ID).Scan(&exists); err != nil {
+			return err
+		} else if exists {
+			return apperror.Conflict("attributes."+attr.Name, "Request violates uniqueness of attributes.%s",
+				attr.Name).Wrap(database.ErrDuplicateKey)
+		}
+	}
+
+	return nil
+}
+
+// mergeAttributes merges the attributes of the user into those it has, as a JSON merge patch: a null value removes
+// the attribute. The merged attributes are then checked
+func (user *UserModel) mergeAttributes(tx *database.Tx) error {
+	var current []byte
+	if err := tx.QueryRow(`SELECT attributes FROM users WHERE id = $1 FOR UPDATE`, user.ID).Scan(&current); err != nil {
+		return err
+	}
+	merged := make(map[string]interface{})
+	if err := json.Unmarshal(current, &merged); err != nil {
+		return err
+	}
+
+	for name, value := range user.Attributes {
+		if value == nil {
+			delete(merged, name)
+		} else {
+			merged[name] = value
+		}
+	}
+	user.Attributes = merged
+
+	return user.checkAttributes(tx)
+}
+
+// ATTRIBUTE_FILTER_PREFIX begins the query parameters that filter users on an attribute, e.g. attr.department=sales
+const ATTRIBUTE_FILTER_PREFIX string = "attr."
+
+// attributeCondition builds the condition of the users whose attribute name has value, numbering its parameters
+// after those in params. The value is matched as a string, and as the number or boolean it is written as, so 42 and
+// true match the integer 42 and the boolean true. Containment (@>) lets the condition use users_attributes_idx
+func attributeCondition(name, value string, params []interface{}) (string, []interface{}) {
+	candidates := []interface{}{value}
+	if json.Valid([]byte(value)) {
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.UseNumber()
+		var typed interface{}
+		if decoder.Decode(&typed) == nil {
+			switch typed.(type) {
+			case json.Number, bool:
+				candidates = append(candidates, typed)
+			}
+		}
+	}
+
+	matches := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		contained, _ := json.Marshal(map[string]interface{}{name: candidate})
+		params = append(params, string(contained))
+		matches = append(matches, fmt.Sprintf("attributes @> $%d::jsonb", len(params)))
+	}
+	if len(matches) == 1 {
+		return matches[0], params
+	}
+	return "(" + strings.Join(matches, " OR ") + ")", params
+}
+
+// GetUsersByAttributes fetches the users of the organization orgID that have every one of the attribute values. Values
+// are matched as their type, see attributeCondition
+func GetUsersByAttributes(ctx context.Context, db *database.PostGresDB, orgID int, values map[string]string, limit,
+	offset int) (users []UserModel, err error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if !ATTRIBUTE_NAME_REGEX.MatchString(name) {
+			return nil, apperror.Invalid("attributes."+name, "Invalid attribute name %s", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []interface{}
+	var conditions []string
+	for _, name := range names {
+		var condition string
+		condition, params = attributeCondition(name, values[name], params)
+		conditions = append(conditions, condition)
+	}
+
+	selectStmt := `SELECT ` + USER_GET_FIELDLIST + ` FROM users WHERE ` + strings.Join(conditions, " AND ") +
+		` ORDER BY id`
+	if limit > 0 {
+		params = append(params, limit, offset)
+		selectStmt += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(params)-1, len(params))
+	}
+
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, params...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+
+		return rows.Err()
+	})
+
+	return
+}
+
+// TokenAttributes fetches the attributes of the user userID that are included in its tokens
+func TokenAttributes(ctx context.Context, db *database.PostGresDB, orgID, userID int) (map[string]interface{}, error) {
+	selectStmt := `SELECT a.name, u.attributes -> a.name FROM attributes a, users u
+		WHERE u.id = $1 AND a.in_token AND u.attributes ? a.name`
+	values := make(map[string]interface{})
+	err := db.InTenantReadOnly(ctx, database.OP_READ, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name string
+			var value []byte
+			if err = rows.Scan(&name, &value); err != nil {
+				return err
+			}
+			var decoded interface{}
+			if err = json.Unmarshal(value, &decoded); err != nil {
+				return err
+			}
+			values[name] = decoded
+		}
+
+		return rows.Err()
+	})
+
+	return values, err
+}
@@ -0,0 +1,285 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestAttributeValidate Checks definitions of attributes are checked
+func TestAttributeValidate(t *testing.T) {
+	valid := []AttributeModel{
+		{Name: "department", Type: ATTRIBUTE_TYPE_STRING, Enum: []interface{}{"sales", "support"}},
+		{Name: "employee_id", Type: ATTRIBUTE_TYPE_STRING, Pattern: "E[0-9]{6}", Unique: true},
+		{Name: "level", Type: ATTRIBUTE_TYPE_INTEGER, Enum: []interface{}{1.0, 2.0}},
+		{Name: "contractor", Type: ATTRIBUTE_TYPE_BOOLEAN, Required: true, Token: true},
+	}
+	for _, attr := range valid {
+		if errs := attr.Validate(); len(errs) > 0 {
+			t.Errorf("Attribute %s expected to pass, failed: %+v", attr.Name, errs)
+		}
+	}
+
+	invalid := []AttributeModel{
+		{Type: ATTRIBUTE_TYPE_STRING},
+		{Name: "Department", Type: ATTRIBUTE_TYPE_STRING},
+		{Name: "dept-name", Type: ATTRIBUTE_TYPE_STRING},
+		{Name: "department", Type: "date"},
+		{Name: "department", Type: ATTRIBUTE_TYPE_STRING, Pattern: "[a-z"},
+		{Name: "level", Type: ATTRIBUTE_TYPE_INTEGER, Pattern: "[0-9]+"},
+		{Name: "level", Type: ATTRIBUTE_TYPE_INTEGER, Enum: []interface{}{1.5}},
+		{Name: "department", Type: ATTRIBUTE_TYPE_STRING, Enum: []interface{}{true}},
+	}
+	for _, attr := range invalid {
+		errs := attr.Validate()
+		if len(errs) == 0 {
+			t.Errorf("Attribute %+v expected to fail, passed", attr)
+		}
+		for _, err := range errs {
+			if err.Code == "" || err.Message == "" || err.Message == err.Code {
+				t.Errorf("Attribute %+v expected to fail with a code and message, got %+v", attr, err)
+			}
+		}
+	}
+}
+
+// TestValidateAttributes Checks the values of attributes are checked against their definitions
+func TestValidateAttributes(t *testing.T) {
+	attrs := []AttributeModel{
+		{Name: "department", Type: ATTRIBUTE_TYPE_STRING, Required: true, Enum: []interface{}{"sales", "support"}},
+		{Name: "employee_id", Type: ATTRIBUTE_TYPE_STRING, Pattern: "E[0-9]{6}"},
+		{Name: "level", Type: ATTRIBUTE_TYPE_INTEGER},
+		{Name: "score", Type: ATTRIBUTE_TYPE_NUMBER},
+		{Name: "contractor", Type: ATTRIBUTE_TYPE_BOOLEAN},
+	}
+	for i := range attrs {
+		if errs := attrs[i].Validate(); len(errs) > 0 {
+			t.Fatalf("Attribute %s expected to pass, failed: %+v", attrs[i].Name, errs)
+		}
+	}
+
+	decode := func(body string) map[string]interface{} {
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &values); err != nil {
+			t.Fatalf("Values %s expected to decode, failed: %s", body, err)
+		}
+		return values
+	}
+
+	for _, body := range []string{
+		`{"department": "sales"}`,
+		`{"department": "support", "employee_id": "E123456", "level": 3, "score": 4.5, "contractor": false}`,
+		`{"department": "sales", "level": 3.0, "score": 4}`,
+	} {
+		if errs := ValidateAttributes(attrs, decode(body)); len(errs) > 0 {
+			t.Errorf("Attributes %s expected to pass, failed: %+v", body, errs)
+		}
+	}
+
+	for body, expected := range map[string]string{
+		`{}`:                          "attributes.department required",
+		`{"department": null}`:        "attributes.department required",
+		`{"department": "marketing"}`: "attributes.department enum",
+		`{"department": 1}`:           "attributes.department type",
+		`{"department": "sales", "employee_id": "E12"}`: "attributes.employee_id pattern",
+		`{"department": "sales", "level": 2.5}`:         "attributes.level type",
+		`{"department": "sales", "score": "high"}`:      "attributes.score type",
+		`{"department": "sales", "contractor": "yes"}`:  "attributes.contractor type",
+		`{"department": "sales", "office": "London"}`:   "attributes.office unknown",
+	} {
+		errs := ValidateAttributes(attrs, decode(body))
+		if len(errs) != 1 {
+			t.Errorf("Attributes %s expected to fail once, failed %d times: %+v", body, len(errs), errs)
+		} else if failure := errs[0].Field + " " + errs[0].Code; failure != expected {
+			t.Errorf("Attributes %s expected to fail with %s, failed with %s", body, expected, failure)
+		}
+	}
+}
+
+// attributesConnector opens connections to a fake database holding one attribute, defined as stored, whose value
+// missing users don't have, shared values are had by several users and values are the distinct values users have,
+// recording the statements executed
+type attributesConnector struct {
+	stored  AttributeModel
+	missing int64
+	shared  int64
+	values  []string
+	execs   []string
+}
+
+func (c *attributesConnector) Connect(context.Context) (driver.Conn, error) {
+	return &attributesConn{c}, nil
+}
+func (c *attributesConnector) Driver() driver.Driver { return nil }
+
+type attributesConn struct {
+	connector *attributesConnector
+}
+
+func (c *attributesConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *attributesConn) Close() error              { return nil }
+func (c *attributesConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *attributesConn) Commit() error             { return nil }
+func (c *attributesConn) Rollback() error           { return nil }
+
+func (c *attributesConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.connector.execs = append(c.connector.execs, query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *attributesConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	stored := c.connector.stored
+	switch {
+	case strings.HasPrefix(query, "SELECT "+ATTRIBUTE_GET_FIELDLIST+" FROM attributes"):
+		return &rowRows{row: []driver.Value{int64(stored.ID), int64(stored.OrgID), stored.Name, stored.Type,
+			stored.Required, stored.enumParam(), stored.Pattern, stored.Unique, stored.Token}}, nil
+	case strings.HasPrefix(query, "INSERT INTO attributes"):
+		return &rowRows{row: []driver.Value{int64(1)}}, nil
+	case strings.Contains(query, "NOT attributes ?"):
+		return &rowRows{row: []driver.Value{c.connector.missing}}, nil
+	case strings.Contains(query, "GROUP BY attributes"):
+		return &rowRows{row: []driver.Value{c.connector.shared}}, nil
+	case strings.HasPrefix(query, "SELECT DISTINCT attributes"):
+		return &valueRows{values: c.connector.values}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+// rowRows is the single row of a query
+type rowRows struct {
+	row  []driver.Value
+	read bool
+}
+
+func (r *rowRows) Columns() []string { return make([]string, len(r.row)) }
+func (r *rowRows) Close() error      { return nil }
+
+func (r *rowRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.read = true
+	return nil
+}
+
+// valueRows are the values of a single column query
+type valueRows struct {
+	values []string
+}
+
+func (r *valueRows) Columns() []string { return []string{""} }
+func (r *valueRows) Close() error      { return nil }
+
+func (r *valueRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = []byte(r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// TestAttributeCheckUsers Checks an attribute can't be made required while users have no value, or unique while
+// users share a value, or have its enum or pattern narrowed while users have values outside them, unless it already
+// was
+func TestAttributeCheckUsers(t *testing.T) {
+	stored := AttributeModel{ID: 1, OrgID: 1, Name: "employee_id", Type: ATTRIBUTE_TYPE_STRING}
+	narrowed := AttributeModel{ID: 1, OrgID: 1, Name: "employee_id", Type: ATTRIBUTE_TYPE_STRING,
+		Enum: []interface{}{"E000001", "E000002"}, Pattern: "E[0-9]{6}"}
+	values := []string{`"E000001"`, `"X1"`}
+	tests := []struct {
+		stored  AttributeModel
+		attr    AttributeModel
+		missing int64
+		shared  int64
+		values  []string
+		field   string
+	}{
+		{stored, AttributeModel{Required: true}, 0, 0, nil, ""},
+		{stored, AttributeModel{Required: true}, 2, 0, nil, "required"},
+		{stored, AttributeModel{Unique: true}, 0, 0, nil, ""},
+		{stored, AttributeModel{Unique: true}, 0, 3, nil, "unique"},
+		{stored, AttributeModel{Required: true, Unique: true}, 0, 3, nil, "unique"},
+		{AttributeModel{Name: "employee_id", Type: ATTRIBUTE_TYPE_STRING, Required: true, Unique: true},
+			AttributeModel{Required: true, Unique: true}, 2, 3, nil, ""},
+		{stored, AttributeModel{Enum: []interface{}{"E000001", "X1"}}, 0, 0, values, ""},
+		{stored, AttributeModel{Enum: []interface{}{"E000001"}}, 0, 0, values, "enum"},
+		{stored, AttributeModel{Pattern: "[A-Z][0-9]+"}, 0, 0, values, ""},
+		{stored, AttributeModel{Pattern: "E[0-9]{6}"}, 0, 0, values, "pattern"},
+		{narrowed, AttributeModel{Enum: narrowed.Enum, Pattern: narrowed.Pattern}, 0, 0, values, ""},
+	}
+
+	for _, test := range tests {
+		connector := &attributesConnector{stored: test.stored, missing: test.missing, shared: test.shared,
+			values: test.values}
+		db := &database.PostGresDB{PgDbSession: sql.OpenDB(connector)}
+
+		attr := test.attr
+		attr.ID, attr.OrgID, attr.Name, attr.Type = stored.ID, stored.OrgID, stored.Name, stored.Type
+		err := attr.Update(context.Background(), db)
+		updated := false
+		for _, query := range connector.execs {
+			updated = updated || strings.HasPrefix(query, "UPDATE attributes")
+		}
+		var appErr *apperror.Error
+		if test.field == "" && (err != nil || !updated) {
+			t.Errorf("Attribute %+v with %d users missing and %d values shared expected to be updated, got %v",
+				test.attr, test.missing, test.shared, err)
+		} else if test.field != "" && (!errors.As(err, &appErr) || appErr.Kind != apperror.KIND_CONFLICT ||
+			appErr.Field != test.field || updated) {
+			t.Errorf("Attribute %+v with %d users missing and %d values shared expected to conflict on %s, got %v",
+				test.attr, test.missing, test.shared, test.field, err)
+		}
+		db.Disconnect()
+	}
+
+	// defining a required attribute needs every user to already have a value
+	connector := &attributesConnector{missing: 2}
+	db := &database.PostGresDB{PgDbSession: sql.OpenDB(connector)}
+	defer db.Disconnect()
+	attr := AttributeModel{OrgID: 1, Name: "employee_id", Type: ATTRIBUTE_TYPE_STRING, Required: true}
+	var appErr *apperror.Error
+	if err := attr.Create(context.Background(), db); !errors.As(err, &appErr) || appErr.Field != "required" {
+		t.Errorf("Required attribute users have no value of expected to conflict on required, got %v", err)
+	}
+}
+
+// TestAttributeCondition Checks attribute filters match values by containment, as strings and as the number or
+// boolean they are written as
+func TestAttributeCondition(t *testing.T) {
+	tests := []struct {
+		value     string
+		condition string
+		params    []interface{}
+	}{
+		{"sales", "attributes @> $2::jsonb", []interface{}{0, `{"department":"sales"}`}},
+		{"42", "(attributes @> $2::jsonb OR attributes @> $3::jsonb)",
+			[]interface{}{0, `{"department":"42"}`, `{"department":42}`}},
+		{"1.50", "(attributes @> $2::jsonb OR attributes @> $3::jsonb)",
+			[]interface{}{0, `{"department":"1.50"}`, `{"department":1.50}`}},
+		{"true", "(attributes @> $2::jsonb OR attributes @> $3::jsonb)",
+			[]interface{}{0, `{"department":"true"}`, `{"department":true}`}},
+		{"42}", "attributes @> $2::jsonb", []interface{}{0, `{"department":"42}"}`}},
+		{"null", "attributes @> $2::jsonb", []interface{}{0, `{"department":"null"}`}},
+		{`"sales"`, "attributes @> $2::jsonb", []interface{}{0, `{"department":"\"sales\""}`}},
+	}
+
+	for _, test := range tests {
+		condition, params := attributeCondition("department", test.value, []interface{}{0})
+		if condition != test.condition || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("Value %s expected %q with %v, got %q with %v", test.value, test.condition, test.params,
+				condition, params)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"time"
+)
+
+// AuditEventModel records a security relevant action. ActorID is the user who performed it and SubjectID the user
+// it was performed on or as, 0 when not applicable
+type AuditEventModel struct {
+	ID        int64             `json:"id"`
+	OrgID     int               `json:"orgid"`
+	Action    string            `json:"action"`
+	ActorID   int               `json:"actorid,omitempty"`
+	SubjectID int               `json:"subjectid,omitempty"`
+	Detail    map[string]string `json:"detail"`
+	CreatedAt time.Time         `json:"createdat"`
+}
+
+const (
+	AUDIT_IMPERSONATION_START   = "impersonation.start"
+	AUDIT_IMPERSONATION_STOP    = "impersonation.stop"
+	AUDIT_IMPERSONATION_REQUEST = "impersonation.request"
+)
+
+const AuditSchema string = `
+CREATE TABLE audit_events (
+	id BIGSERIAL PRIMARY KEY,
+	org_id INT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+	action TEXT NOT NULL,
+	actor_id INT,
+	subject_id INT,
+	detail JSONB NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- The audit trail is append only for the service
+GRANT SELECT, INSERT ON audit_events TO user_service_tenant;
+GRANT USAGE ON SEQUENCE audit_events_id_seq TO user_service_tenant;
+
+ALTER TABLE audit_events ENABLE ROW LEVEL SECURITY;
+ALTER TABLE audit_events FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON audit_events
+	USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+`
+
+// nullableID converts an optional id to a nullable value for the database
+func nullableID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// insert writes the event within a tenant transaction, so it is only recorded if the audited action commits
+func (event *AuditEventModel) insert(tx *database.Tx) error {
+	if event.Detail == nil {
+		event.Detail = map[string]string{}
+	}
+	detail, err := json.Marshal(event.Detail)
+	if err != nil {
+		return err
+	}
+
+	insertStmt := `INSERT INTO audit_events (org_id, action, actor_id, subject_id, detail)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`
+	return tx.QueryRow(insertStmt, event.OrgID, event.Action, nullableID(event.ActorID),
+		nullableID(event.SubjectID), detail).Scan(&event.ID, &event.CreatedAt)
+}
+
+// Record writes the event to the audit trail
+func (event *AuditEventModel) Record(ctx context.Context, db *database.PostGresDB) error {
+	return db.InTenant(ctx, database.OP_WRITE, event.OrgID, event.insert)
+}
+
+// GetAuditEvents fetches the audit events of the organization recorded after the event id since, oldest first
+func GetAuditEvents(ctx context.Context, db *database.PostGresDB, orgID int, since int64, limit int) (events []AuditEventModel, err error) {
+	selectStmt := `SELECT id, org_id, action, actor_id, subject_id, detail, created_at FROM audit_events
+		WHERE id > $1 ORDER BY id LIMIT $2`
+
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, since, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var event AuditEventModel
+			var actorID, subjectID sql.NullInt64
+			var detail []byte
+			err = rows.Scan(&event.ID, &event.OrgID, &event.Action, &actorID, &subjectID, &detail, &event.CreatedAt)
+			if err != nil {
+				return err
+			}
+			if err = json.Unmarshal(detail, &event.Detail); err != nil {
+				return err
+			}
+			event.ActorID = int(actorID.Int64)
+			event.SubjectID = int(subjectID.Int64)
+			events = append(events, event)
+		}
+
+		return rows.Err()
+	})
+
+	return
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"context"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The operations of a batch
+const (
+	BATCH_CREATE string = "create"
+	BATCH_UPDATE string = "update"
+	BATCH_PATCH  string = "patch"
+	BATCH_DELETE string = "delete"
+)
+
+// BatchOperation is a write to a user in a batch
+type BatchOperation struct {
+	// Op is BATCH_CREATE, BATCH_UPDATE, BATCH_PATCH or BATCH_DELETE
+	Op string
+	// ID is the id of the user updated, patched or deleted
+	ID int
+	// User is the user created, or the values the user is updated or patched to
+	User UserModel
+	// Fields are the fields patched
+	Fields []string
+	// Err is why the operation couldn't be read, if it couldn't
+	Err error
+}
+
+// BatchResult is what happened to an operation of a batch
+type BatchResult struct {
+	Op string
+	ID int
+	// User is the user as written, nil if it was deleted or the operation wasn't applied
+	User *UserModel
+	// Err is why the operation failed
+	Err error
+	// Skipped is whether the operation wasn't applied because another operation of an atomic batch failed
+	Skipped bool
+}
+
+// prepare validates the operation, and hashes the password of its user, ahead of running it
+// returns the write, to run within a tenant transaction
+func (op *BatchOperation) prepare(ctx context.Context, orgID int) (func(tx *database.Tx) error, error) {
+	if op.Err != nil {
+		return nil, op.Err
+	}
+
+	op.User.OrgID = orgID
+	if op.Op == BATCH_CREATE {
+		if op.ID != 0 {
+			return nil, apperror.Invalid("id", "ID must be null when creating a User")
+		}
+		if err := op.User.prepareCreate(ctx); err != nil {
+			return nil, err
+		}
+		return op.User.insert, nil
+	}
+
+	if op.Op != BATCH_UPDATE && op.Op != BATCH_PATCH && op.Op != BATCH_DELETE {
+		return nil, apperror.Invalid("op", "Invalid op %q: must be create, update, patch or delete", op.Op)
+	}
+	if op.ID <= 0 {
+		return nil, apperror.Invalid("id", "ID is required to %s a User", op.Op)
+	}
+	if op.User.ID != 0 && op.User.ID != op.ID {
+		return nil, apperror.Invalid("id", "changing ID is not permitted")
+	}
+	op.User.ID = op.ID
+
+	switch op.Op {
+	case BATCH_UPDATE:
+		return op.User.prepareUpdate(ctx)
+	case BATCH_PATCH:
+		return op.User.preparePatch(ctx, op.Fields)
+	default:
+		return op.User.remove, nil
+	}
+}
+
+// RunBatch runs the operations of a batch on the users of the organization orgID, in order. Each operation is
+// validated as the same write through the API is. An atomic batch applies every operation in one transaction, or
+// none of them if any fails: the operation that failed has its error, and the rest are skipped. Otherwise each
+// operation is applied in a transaction of its own, and those that fail don't stop the rest. Internal errors fail an
+// atomic batch as a whole, as does the context ending either kind
+// returns the result of every operation, in the order they were given
+func RunBatch(ctx context.Context, db *database.PostGresDB, orgID int, ops []BatchOperation,
+	atomic bool) (results []BatchResult, err error) {
+	ctx, span := tracing.Start(ctx, "RunBatch", attribute.Int("operations", len(ops)),
+		attribute.Bool("atomic", atomic))
+	defer func() { tracing.End(span, err) }()
+
+	results = make([]BatchResult, len(ops))
+	writes := make([]func(tx *database.Tx) error, len(ops))
+	failed := -1
+	for i := range ops {
+		// Preparing hashes passwords, which is slow enough to be worth giving up on when the caller has
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		results[i] = BatchResult{Op: ops[i].Op, ID: ops[i].ID}
+		if writes[i], results[i].Err = ops[i].prepare(ctx, orgID); results[i].Err != nil && failed < 0 {
+			failed = i
+		}
+	}
+
+	if !atomic {
+		for i, write := range writes {
+			if write == nil {
+				continue
+			}
+			err = db.InTenant(ctx, database.OP_WRITE, orgID, write)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			results[i].Err = err
+		}
+		return written(ops, results), nil
+	}
+
+	if failed < 0 {
+		err = db.InTenant(ctx, database.OP_BULK, orgID, func(tx *database.Tx) error {
+			for i, write := range writes {
+				if err := write(tx); err != nil {
+					if apperror.KindOf(err) != apperror.KIND_INTERNAL {
+						failed, results[i].Err = i, err
+					}
+					return err
+				}
+			}
+			return nil
+		})
+		// An error other than that of the operation that failed, such as the commit failing, fails the batch
+		if err != nil && (failed < 0 || err != results[failed].Err) {
+			return nil, err
+		}
+	}
+	if failed >= 0 {
+		for i := range results {
+			results[i].Skipped = results[i].Err == nil
+		}
+		return results, nil
+	}
+
+	return written(ops, results), nil
+}
+
+// written sets the user of each operation applied, but for deletes, in its result
+// returns the results
+func written(ops []BatchOperation, results []BatchResult) []BatchResult {
+	for i := range results {
+		if results[i].Err == nil && ops[i].Op != BATCH_DELETE {
+			user := ops[i].User
+			results[i].User, results[i].ID = &user, user.ID
+		}
+	}
+	return results
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"testing"
+)
+
+// TestBatchPrepare Checks operations that can't be run fail before the database is touched
+func TestBatchPrepare(t *testing.T) {
+	invalid := []BatchOperation{
+		{Op: "rename", ID: 1},
+		{Op: BATCH_CREATE, ID: 1, User: UserModel{Username: "jdoe1"}},
+		{Op: BATCH_UPDATE},
+		{Op: BATCH_DELETE, ID: -1},
+		{Op: BATCH_PATCH, ID: 1, User: UserModel{ID: 2, FirstName: "John"}, Fields: []string{"firstname"}},
+		{Op: BATCH_PATCH, ID: 1},
+		{Op: BATCH_DELETE, ID: 1, Err: apperror.Invalid("user", "Invalid user")},
+	}
+	for _, op := range invalid {
+		if _, err := op.prepare(context.Background(), 1); apperror.KindOf(err) != apperror.KIND_VALIDATION {
+			t.Errorf("Operation %+v expected to fail validation, got %v", op, err)
+		}
+	}
+
+	op := BatchOperation{Op: BATCH_PATCH, ID: 1, User: UserModel{FirstName: "John"}, Fields: []string{"firstname"}}
+	if write, err := op.prepare(context.Background(), 1); err != nil || write == nil {
+		t.Errorf("Patch expected to pass, failed: %v", err)
+	}
+	if op.User.ID != 1 || op.User.OrgID != 1 {
+		t.Errorf("Patch expected to be of User ID 1 of organization 1, got %d of %d", op.User.ID, op.User.OrgID)
+	}
+}
+
+// TestRunBatchAtomicSkips Checks an atomic batch with an operation that can't be run applies none of the others
+func TestRunBatchAtomicSkips(t *testing.T) {
+	ops := []BatchOperation{
+		{Op: BATCH_DELETE, ID: 1},
+		{Op: BATCH_DELETE},
+		{Op: BATCH_DELETE, ID: 3, Err: errors.New("unreadable")},
+	}
+	results, err := RunBatch(context.Background(), nil, 1, ops, true)
+	if err != nil {
+		t.Fatalf("Batch expected to pass, failed: %s", err)
+	}
+	if !results[0].Skipped || results[0].Err != nil {
+		t.Errorf("Operation 0 expected to be skipped, got %+v", results[0])
+	}
+	for _, i := range []int{1, 2} {
+		if results[i].Skipped || results[i].Err == nil {
+			t.Errorf("Operation %d expected to fail, got %+v", i, results[i])
+		}
+	}
+}
@@ -1,9 +1,62 @@
 package models
 
+import (
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/validation"
+)
+
 type Message struct {
 	Message string `json:"message"`
 }
 
 type ErrorMessage struct {
 	Message string `json:"error"`
+	// RequestID identifies the request in the service's logs
+	RequestID string `json:"requestid,omitempty"`
+	// Errors are the problems with each field of a request that failed validation
+	Errors []apperror.FieldError `json:"errors,omitempty"`
+}
+
+// Problem is an RFC 7807 problem response
+type Problem struct {
+	// Type identifies the kind of problem
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail describes this occurrence of the problem
+	Detail string `json:"detail,omitempty"`
+	// Instance is the path of the request
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestid,omitempty"`
+	// Field is the field whose uniqueness a conflict violated
+	Field  string                `json:"field,omitempty"`
+	Errors []apperror.FieldError `json:"errors,omitempty"`
+}
+
+// UNIQUE_FIELDS maps each unique constraint onto the field whose uniqueness it enforces
+var UNIQUE_FIELDS = map[string]string{
+	"users_org_id_username_key":            "username",
+	"users_org_id_email_key":               "email",
+	"users_org_id_email_canonical_key":     "email",
+	"groups_org_id_name_key":               "name",
+	"organizations_slug_key":               "slug",
+	"invitations_org_id_pending_email_key": "email",
+	"attributes_org_id_name_key":           "name",
+}
+
+// conflict returns the conflict error for a duplicate key error, naming the field whose uniqueness was violated
+func conflict(err error) *apperror.Error {
+	field := UNIQUE_FIELDS[database.DuplicateKeyConstraint(err)]
+	if field == "" {
+		return apperror.Conflict("", "Request violates uniqueness").Wrap(database.ErrDuplicateKey)
+	}
+	return apperror.Conflict(field, "Request violates uniqueness of %s", field).Wrap(database.ErrDuplicateKey)
+}
+
+// fieldFailure returns a validation error of a failure of the field that its rule can't describe, with the message
+// built from the catalog
+func fieldFailure(message, field, code string, params map[string]interface{}) error {
+	return apperror.Validation(message, apperror.FieldError{Field: field, Code: code,
+		Message: validation.Message(validation.DEFAULT_LOCALE, field, code, params), Params: params})
 }
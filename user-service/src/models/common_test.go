@@ -0,0 +1,22 @@
+package models
+
+import (
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"testing"
+)
+
+// TestConflict Checks a duplicate key error is reported against the field of its constraint, and still matches
+// database.ErrDuplicateKey
+func TestConflict(t *testing.T) {
+	err := conflict(errors.New(`pq: duplicate key value violates unique constraint "users_org_id_email_key"`))
+	if err.Kind != apperror.KIND_CONFLICT || err.Field != "email" || !errors.Is(err, database.ErrDuplicateKey) {
+		t.Errorf("Email conflict expected to name the email field, got %+v", err)
+	}
+
+	err = conflict(errors.New(`pq: duplicate key value violates unique constraint "apikeys_prefix_key"`))
+	if err.Field != "" || err.Message != "Request violates uniqueness" {
+		t.Errorf("Conflict on an unmapped constraint expected to name no field, got %+v", err)
+	}
+}
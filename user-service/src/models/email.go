@@ -0,0 +1,217 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"golang.org/x/net/idna"
+	"net/mail"
+	"strings"
+)
+
+// EmailSchema adds the canonical form of each email address, used to find duplicates. The addresses already stored
+// are normalised, and the addresses made unique within an organization regardless of case, by migrateEmails
+const EmailSchema string = `
+ALTER TABLE users DROP CONSTRAINT users_org_id_email_key;
+ALTER TABLE users ADD COLUMN email_canonical TEXT;
+`
+
+// migrateEmails normalises the addresses stored before addresses were parsed, sets their canonical forms, then makes
+// both unique within an organization. An address that can't be parsed is kept, with only its domain lowercased, and
+// its canonical form is the lowercased address. Row level security is lifted while the rows of every organization
+// are changed
+// returns an error listing the users of each organization whose addresses differ only in case, or share a canonical
+// form, before any index is created, as one of each must be changed first
+func migrateEmails(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE users NO FORCE ROW LEVEL SECURITY`); err != nil {
+		return err
+	}
+
+	users, err := readMigratedUsers(tx, "email")
+	if err != nil {
+		return err
+	}
+	for i, user := range users {
+		if email, canonical, err := ParseEmail(user.value); err == nil {
+			users[i].value, users[i].canonical = email, canonical
+		} else {
+			if at := strings.LastIndexByte(user.value, '@'); at >= 0 {
+				users[i].value = user.value[:at] + strings.ToLower(user.value[at:])
+			}
+			users[i].canonical = strings.ToLower(users[i].value)
+		}
+	}
+
+	// Addresses that differ only in case share a canonical form too
+	duplicates := findDuplicates(users, func(user migratedUser) string { return user.canonical })
+	if len(duplicates) > 0 {
+		return fmt.Errorf("users have the same email address, or addresses that are the same mailbox; change all "+
+			"but one of each first: %s", strings.Join(duplicates, "; "))
+	}
+
+	for _, user := range users {
+		updateStmt := `UPDATE users SET email = $2, email_canonical = $3 WHERE id = $1`
+		if _, err = tx.Exec(updateStmt, user.id, user.value, user.canonical); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		ALTER TABLE users ALTER COLUMN email_canonical SET NOT NULL;
+		CREATE UNIQUE INDEX users_org_id_email_key ON users (org_id, lower(email));
+		CREATE UNIQUE INDEX users_org_id_email_canonical_key ON users (org_id, email_canonical);
+		ALTER TABLE users FORCE ROW LEVEL SECURITY;
+	`)
+	return err
+}
+
+// MAX_EMAIL_LENGTH is the longest address that can be delivered to, per RFC 5321
+const MAX_EMAIL_LENGTH int = 254
+
+// MAX_EMAIL_LOCAL_LENGTH is the longest local part, before the @, per RFC 5321
+const MAX_EMAIL_LOCAL_LENGTH int = 64
+
+// EMAIL_ALLOWED_DOMAINS are the only domains, with their subdomains, addresses can be at. Any domain is allowed if
+// it is empty. It is set from the configuration at boot
+var EMAIL_ALLOWED_DOMAINS []string
+
+// EMAIL_DENIED_DOMAINS are the domains, with their subdomains, addresses can't be at. It is set from the
+// configuration at boot
+var EMAIL_DENIED_DOMAINS []string
+
+// EMAIL_CANONICALIZE applies the rules of EMAIL_PROVIDERS to the canonical form of addresses, so addresses a
+// provider delivers to the same mailbox are duplicates. It is set from the configuration at boot
+var EMAIL_CANONICALIZE = false
+
+// CODE_DOMAIN is the code of the failure of an address at a domain that isn't allowed
+const CODE_DOMAIN string = "domain"
+
+// emailProvider is how a mail provider delivers to addresses other than the mailbox's own
+type emailProvider struct {
+	// domain is the domain of the mailbox, where the provider has more than one
+	domain string
+	// ignoresDots is whether dots in the local part are ignored
+	ignoresDots bool
+	// tagSeparator begins a tag in the local part, which is ignored along with the rest of the local part
+	tagSeparator string
+}
+
+// EMAIL_PROVIDERS are the providers whose addresses have a canonical form, keyed by domain
+var EMAIL_PROVIDERS = map[string]emailProvider{
+	"gmail.com":      {domain: "gmail.com", ignoresDots: true, tagSeparator: "+"},
+	"googlemail.com": {domain: "gmail.com", ignoresDots: true, tagSeparator: "+"},
+	"outlook.com":    {domain: "outlook.com", tagSeparator: "+"},
+	"hotmail.com":    {domain: "hotmail.com", tagSeparator: "+"},
+	"live.com":       {domain: "live.com", tagSeparator: "+"},
+	"icloud.com":     {domain: "icloud.com", tagSeparator: "+"},
+	"fastmail.com":   {domain: "fastmail.com", tagSeparator: "+"},
+	"proton.me":      {domain: "proton.me", tagSeparator: "+"},
+	"protonmail.com": {domain: "proton.me", tagSeparator: "+"},
+	"yahoo.com":      {domain: "yahoo.com", tagSeparator: "-"},
+}
+
+// emailDomainProfile checks and converts the domains of addresses, which must be host names
+var emailDomainProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true),
+	idna.StrictDomainName(true))
+
+// ParseEmail reads an address per RFC 5322, allowing UTF-8 per RFC 6531 and internationalised domains. Display
+// names, comments and domain literals aren't allowed. The domain is lowercased and given in Unicode, so the same
+// address is always written the same way
+// returns the address, and its canonical form, which is lowercased, has the domain in ASCII, and if
+// EMAIL_CANONICALIZE is set, follows the rules of its provider
+func ParseEmail(address string) (email, canonical string, err error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", "", err
+	}
+	// A comment is read as the name
+	if parsed.Name != "" || strings.HasSuffix(strings.TrimSpace(address), ">") {
+		return "", "", errors.New("only the address is allowed, without a name or comment")
+	}
+
+	at := strings.LastIndexByte(parsed.Address, '@')
+	local, domain := parsed.Address[:at], parsed.Address[at+1:]
+	if len(local) > MAX_EMAIL_LOCAL_LENGTH {
+		return "", "", fmt.Errorf("the part before the @ is longer than %d characters", MAX_EMAIL_LOCAL_LENGTH)
+	}
+	if !strings.Contains(domain, ".") {
+		return "", "", fmt.Errorf("domain %s is not a fully qualified domain name", domain)
+	}
+	asciiDomain, err := emailDomainProfile.ToASCII(domain)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid domain %s: %s", domain, err)
+	}
+	unicodeDomain, err := emailDomainProfile.ToUnicode(asciiDomain)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid domain %s: %s", domain, err)
+	}
+
+	// Formatting quotes the local part again if it needs to be
+	email = strings.Trim((&mail.Address{Address: local + "@" + unicodeDomain}).String(), "<>")
+	if len(email) > MAX_EMAIL_LENGTH {
+		return "", "", fmt.Errorf("address is longer than %d characters", MAX_EMAIL_LENGTH)
+	}
+
+	return email, canonicalEmail(strings.ToLower(local), asciiDomain), nil
+}
+
+// canonicalEmail builds the canonical form of the lowercased local part and the ASCII domain of an address
+func canonicalEmail(local, domain string) string {
+	if provider, ok := EMAIL_PROVIDERS[domain]; ok && EMAIL_CANONICALIZE {
+		if i := strings.Index(local, provider.tagSeparator); i > 0 {
+			local = local[:i]
+		}
+		if provider.ignoresDots {
+			local = strings.ReplaceAll(local, ".", "")
+		}
+		domain = provider.domain
+	}
+
+	return local + "@" + domain
+}
+
+// validateEmail verifies that the email address is a valid email
+func validateEmail(emailAddress string) bool {
+	_, _, err := ParseEmail(emailAddress)
+	return err == nil
+}
+
+// emailDomainAllowed checks the ASCII domain is at one of EMAIL_ALLOWED_DOMAINS, if there are any, and not at any of
+// EMAIL_DENIED_DOMAINS
+func emailDomainAllowed(domain string) bool {
+	within := func(domains []string) bool {
+		for _, d := range domains {
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return (len(EMAIL_ALLOWED_DOMAINS) == 0 || within(EMAIL_ALLOWED_DOMAINS)) && !within(EMAIL_DENIED_DOMAINS)
+}
+
+// normalizeEmail parses the address and checks its domain is allowed
+// returns the address and its canonical form, or a validation error of the field
+func normalizeEmail(address string) (email, canonical string, err error) {
+	email, canonical, err = ParseEmail(address)
+	if err != nil {
+		return "", "", apperror.Invalid("email", "Invalid Email specified! %s", err).Wrap(err)
+	}
+
+	// The domain is checked before any provider's rules are applied to it
+	domain, _ := emailDomainProfile.ToASCII(email[strings.LastIndexByte(email, '@')+1:])
+	if !emailDomainAllowed(domain) {
+		return "", "", fieldFailure("Email domain is not allowed", "email", CODE_DOMAIN,
+			map[string]interface{}{"domain": domain})
+	}
+
+	return email, canonical, nil
+}
+
+// normalizeEmail writes the email address of the user the way it is stored, and sets its canonical form
+func (user *UserModel) normalizeEmail() (err error) {
+	user.Email, user.canonicalEmail, err = normalizeEmail(user.Email)
+	return err
+}
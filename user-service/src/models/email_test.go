@@ -0,0 +1,72 @@
+package models
+
+import (
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"testing"
+)
+
+// TestParseEmail Checks addresses are read per RFC 5322 and 6531, with the domain lowercased, and anything that
+// isn't only an address fails
+func TestParseEmail(t *testing.T) {
+	for address, expected := range map[string][2]string{
+		"Bob@Bob.WIN":            {"Bob@bob.win", "bob@bob.win"},
+		`"john doe"@example.com`: {`"john doe"@example.com`, "john doe@example.com"},
+		"jörg@Bücher.DE":         {"jörg@bücher.de", "jörg@xn--bcher-kva.de"},
+		"bob@xn--bcher-kva.de":   {"bob@bücher.de", "bob@xn--bcher-kva.de"},
+	} {
+		email, canonical, err := ParseEmail(address)
+		if err != nil {
+			t.Errorf("Email %s expected to pass, failed: %s", address, err)
+		} else if email != expected[0] || canonical != expected[1] {
+			t.Errorf("Email %s expected to read as %s, %s, got %s, %s", address, expected[0], expected[1], email,
+				canonical)
+		}
+	}
+
+	for _, address := range []string{"@", "bob@", "too@many@atsigns.fail", "Bob <bob@bob.win>", "bob@bob.win (Bob)",
+		"bob@localhost", "bob@bad_domain.com", "bob@[127.0.0.1]", "a.@bob.win",
+		"abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyzabcdefghijklm@bob.win"} {
+		if _, _, err := ParseEmail(address); err == nil {
+			t.Errorf("Email %s expected to fail, passed", address)
+		}
+	}
+}
+
+// TestCanonicalEmail Checks the rules of a provider are only applied to its addresses, and only when configured
+func TestCanonicalEmail(t *testing.T) {
+	if _, canonical, _ := ParseEmail("J.Doe+news@GoogleMail.com"); canonical != "j.doe+news@googlemail.com" {
+		t.Errorf("Email expected to only be lowercased, got %s", canonical)
+	}
+
+	EMAIL_CANONICALIZE = true
+	defer func() { EMAIL_CANONICALIZE = false }()
+	for address, expected := range map[string]string{
+		"J.Doe+news@GoogleMail.com": "jdoe@gmail.com",
+		"j.doe+news@outlook.com":    "j.doe@outlook.com",
+		"j.doe-news@yahoo.com":      "j.doe@yahoo.com",
+		"j.doe+news@example.com":    "j.doe+news@example.com",
+	} {
+		if _, canonical, _ := ParseEmail(address); canonical != expected {
+			t.Errorf("Email %s expected to have canonical form %s, got %s", address, expected, canonical)
+		}
+	}
+}
+
+// TestEmailDomains Checks addresses are only accepted at allowed domains and their subdomains, and not at denied ones
+func TestEmailDomains(t *testing.T) {
+	EMAIL_ALLOWED_DOMAINS, EMAIL_DENIED_DOMAINS = []string{"example.com"}, []string{"spam.example.com"}
+	defer func() { EMAIL_ALLOWED_DOMAINS, EMAIL_DENIED_DOMAINS = nil, nil }()
+
+	for _, address := range []string{"bob@example.com", "bob@mail.EXAMPLE.com"} {
+		if _, _, err := normalizeEmail(address); err != nil {
+			t.Errorf("Email %s expected to pass, failed: %s", address, err)
+		}
+	}
+	for _, address := range []string{"bob@bob.win", "bob@notexample.com", "bob@spam.example.com",
+		"bob@a.spam.example.com"} {
+		_, _, err := normalizeEmail(address)
+		if appErr := apperror.From(err); err == nil || len(appErr.Fields) != 1 || appErr.Fields[0].Code != CODE_DOMAIN {
+			t.Errorf("Email %s expected to fail on its domain, got %v", address, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportQuery is what an export of users includes, and how it is written
+type ExportQuery struct {
+	// Format is the format the users are written in, see the export package
+	Format string `json:"format"`
+	// Columns are the columns written, in order. Empty writes the default columns of the format
+	Columns []string `json:"columns,omitempty"`
+	// Filters are values users must have, keyed by field, or by ATTRIBUTE_FILTER_PREFIX and the name of an attribute
+	Filters map[string]string `json:"filters,omitempty"`
+	// GroupID, if set, only exports the members of the group and of its subgroups
+	GroupID int `json:"groupid,omitempty"`
+	// PhoneFormat is the format telephone numbers are written in, PHONE_FORMAT if empty
+	PhoneFormat string `json:"phoneformat,omitempty"`
+}
+
+// EXPORT_FILTER_FIELDS are the fields users can be filtered on when exporting, besides attributes
+var EXPORT_FILTER_FIELDS = []string{"username", "firstname", "middlename", "lastname", "email", "telephone"}
+
+// EXPORT_FETCH_SIZE is the number of users fetched from the cursor at a time, which bounds the memory an export uses
+const EXPORT_FETCH_SIZE int = 1000
+
+// conditions builds the WHERE clause of the users matching the query, numbering its parameters after those in params
+// returns a validation error for a filter that can't be used
+func (query ExportQuery) conditions(params []interface{}) (string, []interface{}, error) {
+	keys := make([]string, 0, len(query.Filters))
+	for key := range query.Filters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var conditions []string
+	for _, key := range keys {
+		value := query.Filters[key]
+		if strings.HasPrefix(key, ATTRIBUTE_FILTER_PREFIX) {
+			name := strings.TrimPrefix(key, ATTRIBUTE_FILTER_PREFIX)
+			if !ATTRIBUTE_NAME_REGEX.MatchString(name) {
+				return "", nil, apperror.Invalid("attributes."+name, "Invalid attribute name %s", name)
+			}
+			var condition string
+			condition, params = attributeCondition(name, value, params)
+			conditions = append(conditions, condition)
+			continue
+		}
+
+		switch key {
+		case "telephone":
+			// Numbers are stored in E.164, so one given in any format is found
+			e164, _, err := ParseTelephone(value)
+			if err != nil {
+				return "", nil, apperror.Invalid("telephone", "Invalid Telephone specified! %s", err).Wrap(err)
+			}
+			value = e164
+		case "username":
+			value = lookupUsername(value)
+		case "email":
+			if email, _, err := ParseEmail(value); err == nil {
+				value = email
+			}
+		case "firstname", "middlename", "lastname":
+		default:
+			return "", nil, apperror.Invalid(key, "Unsupported filter %s. Users can be filtered on %s, or on "+
+				"attributes with %s<name>", key, strings.Join(EXPORT_FILTER_FIELDS, ", "), ATTRIBUTE_FILTER_PREFIX)
+		}
+		params = append(params, value)
+		if key == "email" || key == "username" {
+			// Addresses and usernames are unique regardless of case
+			conditions = append(conditions, fmt.Sprintf("lower(%s) = lower($%d)", key, len(params)))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", key, len(params)))
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", params, nil
+	}
+	return " AND " + strings.Join(conditions, " AND "), params, nil
+}
+
+// Validate checks the filters and phone format of the query can be used. The format and columns are checked by the
+// export package, which writes them
+// returns a validation error for the first that can't
+func (query ExportQuery) Validate() error {
+	if query.PhoneFormat != "" && !ValidPhoneFormat(query.PhoneFormat) {
+		return apperror.Invalid("phoneformat", "Unsupported phone format %s. Only accepts e164, national or "+
+			"international", query.PhoneFormat)
+	}
+	if query.GroupID < 0 {
+		return apperror.Invalid("group", "Invalid Group ID %d", query.GroupID)
+	}
+	_, _, err := query.conditions(nil)
+	return err
+}
+
+// ExportUsers calls fn with every user of the organization orgID that matches the query, in order of id. The users
+// are read through a cursor EXPORT_FETCH_SIZE at a time, so however many there are only that many are held in
+// memory. The export runs in a single read-only transaction, so it sees the users as they were when it began, and
+// is limited by database.bulk_timeout
+// returns the error of fn, which stops the export
+func ExportUsers(ctx context.Context, db *database.PostGresDB, orgID int, query ExportQuery,
+	fn func(user UserModel) error) (err error) {
+	ctx, span := tracing.Start(ctx, "ExportUsers", attribute.Int("group_id", query.GroupID))
+	defer func() { tracing.End(span, err) }()
+
+	// The group is always $1, so the CTE finding its subgroups can be used as it is
+	params := []interface{}{query.GroupID}
+	selectStmt := `SELECT ` + USER_GET_FIELDLIST + ` FROM users WHERE ($1 = 0 OR id IN (
+		SELECT ug.user_id FROM user_groups ug JOIN subgroups s ON ug.group_id = s.id))`
+	where, params, err := query.conditions(params)
+	if err != nil {
+		return err
+	}
+	declareStmt := `DECLARE export_users NO SCROLL CURSOR FOR ` + subgroupsCTE + selectStmt + where + ` ORDER BY id`
+	fetchStmt := fmt.Sprintf(`FETCH %d FROM export_users`, EXPORT_FETCH_SIZE)
+
+	return db.InTenantReadOnly(ctx, database.OP_BULK, orgID, func(tx *database.Tx) error {
+		if _, err := tx.Exec(declareStmt, params...); err != nil {
+			return err
+		}
+
+		for {
+			fetched := 0
+			rows, err := tx.Query(fetchStmt)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				fetched++
+				user, err := scanUser(rows)
+				if err == nil {
+					err = fn(user)
+				}
+				if err != nil {
+					_ = rows.Close()
+					return err
+				}
+			}
+			if err = rows.Close(); err == nil {
+				err = rows.Err()
+			}
+			if err != nil || fetched < EXPORT_FETCH_SIZE {
+				return err
+			}
+		}
+	})
+}
+
+// ExportJobModel is an export run in the background, for exports too large to stream in a single request. The file
+// it writes is kept in the blob store until the job expires
+type ExportJobModel struct {
+	ID    int `json:"id"`
+	OrgID int `json:"orgid"`
+	// UserID is the user that started the export
+	UserID     int         `json:"userid"`
+	Query      ExportQuery `json:"query"`
+	Status     string      `json:"status"`
+	Rows       int         `json:"rows"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"createdat"`
+	FinishedAt *time.Time  `json:"finishedat,omitempty"`
+	ExpiresAt  *time.Time  `json:"expiresat,omitempty"`
+	// BlobKey is the key the file is stored under, once the job is done
+	BlobKey string `json:"-"`
+}
+
+// The statuses of an export job
+const (
+	EXPORT_PENDING string = "pending"
+	EXPORT_RUNNING string = "running"
+	EXPORT_DONE    string = "done"
+	EXPORT_FAILED  string = "failed"
+)
+
+// ExportJobSchema creates the table of export jobs
+const ExportJobSchema string = `
+CREATE TABLE export_jobs (
+	id SERIAL PRIMARY KEY,
+	org_id INT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+	user_id INT REFERENCES users (id) ON DELETE SET NULL,
+	query JSONB NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	row_count INT NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	blob_key TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	finished_at TIMESTAMPTZ,
+	expires_at TIMESTAMPTZ
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON export_jobs TO user_service_tenant;
+GRANT USAGE ON SEQUENCE export_jobs_id_seq TO user_service_tenant;
+
+ALTER TABLE export_jobs ENABLE ROW LEVEL SECURITY;
+ALTER TABLE export_jobs FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON export_jobs USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+`
+
+const EXPORT_JOB_GET_FIELDLIST string = "id, org_id, COALESCE(user_id, 0), query, status, row_count, error, " +
+	"blob_key, created_at, finished_at, expires_at"
+
+// scanExportJob reads an EXPORT_JOB_GET_FIELDLIST row into an ExportJobModel
+func scanExportJob(row scanner) (job ExportJobModel, err error) {
+	var query []byte
+	var finishedAt, expiresAt sql.NullTime
+	err = row.Scan(&job.ID, &job.OrgID, &job.UserID, &query, &job.Status, &job.Rows, &job.Error, &job.BlobKey,
+		&job.CreatedAt, &finishedAt, &expiresAt)
+	if err != nil {
+		return
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	if expiresAt.Valid {
+		job.ExpiresAt = &expiresAt.Time
+	}
+	err = json.Unmarshal(query, &job.Query)
+	return
+}
+
+// Create records the job as pending, setting its ID and creation time
+func (job *ExportJobModel) Create(ctx context.Context, db *database.PostGresDB) error {
+	query, err := json.Marshal(job.Query)
+	if err != nil {
+		return err
+	}
+
+	var userID interface{}
+	if job.UserID != 0 {
+		userID = job.UserID
+	}
+	insertStmt := `INSERT INTO export_jobs (org_id, user_id, query) VALUES ($1, $2, $3) RETURNING ` +
+		EXPORT_JOB_GET_FIELDLIST
+	return db.InTenant(ctx, database.OP_WRITE, job.OrgID, func(tx *database.Tx) error {
+		created, err := scanExportJob(tx.QueryRow(insertStmt, job.OrgID, userID, query))
+		if err == nil {
+			*job = created
+		}
+		return err
+	})
+}
+
+// Start marks the pending job as running
+// returns a not found error if the job isn't pending, such as when it was deleted
+func (job *ExportJobModel) Start(ctx context.Context, db *database.PostGresDB) error {
+	updateStmt := `UPDATE export_jobs SET status = $2 WHERE id = $1 AND status = $3 RETURNING ` +
+		EXPORT_JOB_GET_FIELDLIST
+	return db.InTenant(ctx, database.OP_WRITE, job.OrgID, func(tx *database.Tx) error {
+		started, err := scanExportJob(tx.QueryRow(updateStmt, job.ID, EXPORT_RUNNING, EXPORT_PENDING))
+		if err == sql.ErrNoRows {
+			return apperror.NotFound("No pending Export Job with ID %d found", job.ID).Wrap(err)
+		} else if err == nil {
+			*job = started
+		}
+		return err
+	})
+}
+
+// Finish records how the job ended: done with the key of its file if failure is empty, failed otherwise. The job
+// expires after ttl, when its file is deleted
+func (job *ExportJobModel) Finish(ctx context.Context, db *database.PostGresDB, rows int, blobKey, failure string,
+	ttl time.Duration) error {
+	status := EXPORT_DONE
+	if failure != "" {
+		status = EXPORT_FAILED
+	}
+
+	updateStmt := `UPDATE export_jobs SET status = $2, row_count = $3, blob_key = $4, error = $5, finished_at = now(),
+		expires_at = now() + $6 * interval '1 microsecond' WHERE id = $1 RETURNING ` + EXPORT_JOB_GET_FIELDLIST
+	return db.InTenant(ctx, database.OP_WRITE, job.OrgID, func(tx *database.Tx) error {
+		finished, err := scanExportJob(tx.QueryRow(updateStmt, job.ID, status, rows, blobKey, failure,
+			ttl.Microseconds()))
+		if err == sql.ErrNoRows {
+			return apperror.NotFound("No Export Job with ID %d found", job.ID).Wrap(err)
+		} else if err == nil {
+			*job = finished
+		}
+		return err
+	})
+}
+
+// GetExportJob fetches the export job jobID of the organization orgID
+func GetExportJob(ctx context.Context, db *database.PostGresDB, orgID, jobID int) (job ExportJobModel, err error) {
+	selectStmt := `SELECT ` + EXPORT_JOB_GET_FIELDLIST + ` FROM export_jobs WHERE id = $1`
+	err = db.InTenant(ctx, database.OP_READ, orgID, func(tx *database.Tx) error {
+		job, err = scanExportJob(tx.QueryRow(selectStmt, jobID))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		err = apperror.NotFound("No Export Job with ID %d found", jobID).Wrap(err)
+	}
+
+	return
+}
+
+// ExpireExportJobs deletes the jobs of the organization orgID that have expired, and fails those that have been
+// pending or running for longer than stale, as the instance running them must have stopped
+// returns the keys of the files of the deleted jobs, which the caller deletes from the blob store
+func ExpireExportJobs(ctx context.Context, db *database.PostGresDB, orgID int, stale time.Duration) (keys []string,
+	err error) {
+	deleteStmt := `DELETE FROM export_jobs WHERE expires_at < now() RETURNING blob_key`
+	failStmt := `UPDATE export_jobs SET status = $1, error = 'export was interrupted', finished_at = now(),
+		expires_at = now() WHERE status IN ($2, $3) AND created_at < now() - $4 * interval '1 microsecond'`
+	err = db.InTenant(ctx, database.OP_WRITE, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(deleteStmt)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			if err = rows.Scan(&key); err != nil {
+				return err
+			}
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(failStmt, EXPORT_FAILED, EXPORT_PENDING, EXPORT_RUNNING, stale.Microseconds())
+		return err
+	})
+
+	return
+}
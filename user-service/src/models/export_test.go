@@ -0,0 +1,40 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestExportConditions Checks the filters of an export are turned into conditions, numbered after the group
+func TestExportConditions(t *testing.T) {
+	query := ExportQuery{Filters: map[string]string{"lastname": "Doe", "email": "JDoe@Example.com",
+		"attr.department": "sales"}}
+	where, params, err := query.conditions([]interface{}{0})
+	if err != nil {
+		t.Fatalf("Conditions expected to pass, failed: %s", err)
+	}
+	expected := " AND attributes @> $2::jsonb AND lower(email) = lower($3) AND lastname = $4"
+	if where != expected {
+		t.Errorf("Conditions expected %q, got %q", expected, where)
+	}
+	if !reflect.DeepEqual(params, []interface{}{0, `{"department":"sales"}`, "JDoe@example.com", "Doe"}) {
+		t.Errorf("Parameters not as expected: %v", params)
+	}
+
+	if where, _, err = (ExportQuery{}).conditions(nil); err != nil || where != "" {
+		t.Errorf("Query without filters expected to have no conditions, got %q, %v", where, err)
+	}
+
+	invalid := []ExportQuery{
+		{Filters: map[string]string{"password": "x"}},
+		{Filters: map[string]string{"attr.Dept": "sales"}},
+		{Filters: map[string]string{"telephone": "12"}},
+		{PhoneFormat: "dotted"},
+		{GroupID: -1},
+	}
+	for _, query := range invalid {
+		if err = query.Validate(); err == nil {
+			t.Errorf("Query %+v expected to fail, passed", query)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"time"
+)
+
+type GroupModel struct {
+	ID          int    `json:"id"`
+	OrgID       int    `json:"orgid"` // set from the organization the request was resolved to, never from the client
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ParentID    int    `json:"parentid,omitempty"` // 0 means a top level group
+}
+
+// UserGroupModel is a group a user belongs to, either directly or through a nested child group
+type UserGroupModel struct {
+	GroupModel
+	Direct bool `json:"direct"`
+}
+
+// MembershipChangeModel is a single entry in the membership change feed
+type MembershipChangeModel struct {
+	ID        int64     `json:"id"`
+	OrgID     int       `json:"orgid"`
+	GroupID   int       `json:"groupid"`
+	UserID    int       `json:"userid"`
+	Action    string    `json:"action"`
+	ChangedAt time.Time `json:"changedat"`
+}
+
+const (
+	MEMBERSHIP_ADDED   = "added"
+	MEMBERSHIP_REMOVED = "removed"
+)
+
+// GroupSchema creates the group tables. Membership changes are recorded by a trigger rather than by the model so
+// that memberships removed by a cascading user or group delete still show up in the change feed
+const GroupSchema string = `
+CREATE TABLE IF NOT EXISTS groups (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT '',
+	parent_id INT REFERENCES groups (id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_groups (
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	group_id INT NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, group_id)
+);
+
+CREATE TABLE IF NOT EXISTS group_membership_changes (
+	id BIGSERIAL PRIMARY KEY,
+	group_id INT NOT NULL,
+	user_id INT NOT NULL,
+	action TEXT NOT NULL,
+	changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE OR REPLACE FUNCTION record_membership_change() RETURNS TRIGGER AS $$
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		INSERT INTO group_membership_changes (group_id, user_id, action) VALUES (NEW.group_id, NEW.user_id, 'added');
+	ELSE
+		INSERT INTO group_membership_changes (group_id, user_id, action) VALUES (OLD.group_id, OLD.user_id, 'removed');
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_groups_changes ON user_groups;
+CREATE TRIGGER user_groups_changes AFTER INSERT OR DELETE ON user_groups
+	FOR EACH ROW EXECUTE FUNCTION record_membership_change();
+`
+
+// MembershipChangeOrderSchema records the transaction that made each membership change, so the change feed can be
+// read in an order changes can't later appear behind. The changes already recorded share the migration's
+// transaction, so keep their order by id
+const MembershipChangeOrderSchema string = `
+ALTER TABLE group_membership_changes ADD COLUMN tx_id xid8 NOT NULL DEFAULT pg_current_xact_id();
+CREATE INDEX group_membership_changes_tx_id_idx ON group_membership_changes (tx_id, id);
+`
+
+// ErrGroupCycle is returned when an update would make a group its own ancestor
+var ErrGroupCycle = apperror.Invalid("parentid", "a group cannot be nested under itself or one of its subgroups")
+
+// ErrNoParentGroup is returned when the parent group does not exist in the group's organization
+var ErrNoParentGroup = apperror.Invalid("parentid", "parent group does not exist")
+
+// ErrPrivilegedGroup is returned when a caller that isn't privileged changes the admin group or a group nested
+// beneath it, or makes a group one of those, as that would change who is privileged
+var ErrPrivilegedGroup = apperror.Forbidden("Only admins can change the admin group or the groups nested beneath it")
+
+// ADMIN_GROUP names the group whose members, directly or through a group nested beneath it, are privileged
+var ADMIN_GROUP = "admins"
+
+// grantsPrivilege reports whether the members of group id are privileged: it is the admin group or is nested
+// beneath it
+func grantsPrivilege(tx *database.Tx, id int) (privileged bool, err error) {
+	selectStmt := `WITH RECURSIVE ancestors AS (
+			SELECT id, name, parent_id FROM groups WHERE id = $1
+			UNION
+			SELECT p.id, p.name, p.parent_id FROM groups p JOIN ancestors a ON p.id = a.parent_id
+		)
+		SELECT EXISTS (SELECT 1 FROM ancestors WHERE name = $2)`
+	err = tx.QueryRow(selectStmt, id, ADMIN_GROUP).Scan(&privileged)
+	return
+}
+
+// checkPrivilege refuses a caller that isn't privileged making a group that grants privilege, by its name or by
+// nesting it beneath one that does. A group that already grants privilege can't be changed either
+// returns ErrPrivilegedGroup if it would
+func (group GroupModel) checkPrivilege(tx *database.Tx, privileged bool) error {
+	if privileged {
+		return nil
+	} else if group.Name == ADMIN_GROUP {
+		return ErrPrivilegedGroup
+	}
+
+	for _, id := range []int{group.ID, group.ParentID} {
+		if id == 0 {
+			continue
+		}
+		if grants, err := grantsPrivilege(tx, id); err != nil {
+			return err
+		} else if grants {
+			return ErrPrivilegedGroup
+		}
+	}
+
+	return nil
+}
+
+// subgroupsCTE selects the id of group $1 and every group nested beneath it
+const subgroupsCTE string = `WITH RECURSIVE subgroups AS (
+		SELECT id FROM groups WHERE id = $1
+		UNION
+		SELECT g.id FROM groups g JOIN subgroups s ON g.parent_id = s.id
+	)`
+
+const GROUP_GET_FIELDLIST string = "id, org_id, name, description, parent_id"
+
+// Validate Validates that all fields are included and contain proper values
+// returns the list of validation errors
+func (group GroupModel) Validate() (errs []apperror.FieldError) {
+	if group.Name == "" {
+		errs = append(errs, apperror.FieldError{Field: "name", Message: "Name is not specified!"})
+	} else if len(group.Name) > 100 {
+		errs = append(errs, apperror.FieldError{Field: "name", Message: "Invalid Name: must be 100 characters or less"})
+	}
+
+	if group.ParentID < 0 {
+		errs = append(errs, apperror.FieldError{Field: "parentid", Message: "Invalid ParentID specified!"})
+	} else if group.ID != 0 && group.ParentID == group.ID {
+		errs = append(errs, apperror.FieldError{Field: "parentid", Message: "ParentID cannot be the group's own ID"})
+	}
+
+	return
+}
+
+// parentParam converts the ParentID to a nullable value for the database
+func (group GroupModel) parentParam() sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(group.ParentID), Valid: group.ParentID != 0}
+}
+
+// checkParent verifies the parent group is visible to the transaction's organization. The foreign key alone
+// would accept a parent belonging to another organization
+func (group GroupModel) checkParent(tx *database.Tx) error {
+	if group.ParentID == 0 {
+		return nil
+	}
+
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM groups WHERE id = $1)`, group.ParentID).Scan(&exists)
+	if err == nil && !exists {
+		err = ErrNoParentGroup
+	}
+
+	return err
+}
+
+// Create creates the group. Only a privileged caller can create the admin group, or nest a group beneath it
+func (group *GroupModel) Create(ctx context.Context, db *database.PostGresDB, privileged bool) error {
+	if group.ID != 0 {
+		return apperror.Invalid("id", "ID must be null when creating a Group")
+	}
+
+	if valErrors := group.Validate(); len(valErrors) > 0 {
+		return apperror.Validation("GroupModel failed validation", valErrors...)
+	}
+
+	insertStmt := `INSERT INTO groups (org_id, name, description, parent_id) VALUES($1, $2, $3, $4) RETURNING id`
+	err := db.InTenant(ctx, database.OP_WRITE, group.OrgID, func(tx *database.Tx) error {
+		if err := group.checkParent(tx); err != nil {
+			return err
+		} else if err = group.checkPrivilege(tx, privileged); err != nil {
+			return err
+		}
+		return tx.QueryRow(insertStmt, group.OrgID, group.Name, group.Description, group.parentParam()).
+			Scan(&group.ID)
+	})
+	if err != nil {
+		if database.DuplicateKeyError(err) {
+			return conflict(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Update changes the group. Only a privileged caller can change the admin group or a group nested beneath it, or
+// make a group one of those
+func (group *GroupModel) Update(ctx context.Context, db *database.PostGresDB, privileged bool) error {
+	if group.ID == 0 {
+		return apperror.NotFound("No Group with ID %d found", group.ID).Wrap(sql.ErrNoRows)
+	}
+
+	if valErrors := group.Validate(); len(valErrors) > 0 {
+		return apperror.Validation("GroupModel failed validation", valErrors...)
+	}
+
+	updateStmt := `UPDATE groups SET name = $2, description = $3, parent_id = $4 WHERE id = $1`
+	var res sql.Result
+	err := db.InTenant(ctx, database.OP_WRITE, group.OrgID, func(tx *database.Tx) (err error) {
+		// Held until the transaction ends, so two groups can't be nested beneath each other at once, each passing
+		// the cycle check before the other is re-parented
+		if group.ParentID != 0 {
+			lockStmt := `SELECT pg_advisory_xact_lock(hashtext($1))`
+			if _, err = tx.Exec(lockStmt, fmt.Sprintf("groups:%d", group.OrgID)); err != nil {
+				return
+			}
+		}
+
+		if err = group.checkParent(tx); err != nil {
+			return
+		} else if err = group.checkPrivilege(tx, privileged); err != nil {
+			return
+		}
+
+		// Re-parenting a group beneath one of its own subgroups would create a loop
+		if group.ParentID != 0 {
+			var cycle bool
+			cycleStmt := subgroupsCTE + ` SELECT EXISTS (SELECT 1 FROM subgroups WHERE id = $2)`
+			if err = tx.QueryRow(cycleStmt, group.ID, group.ParentID).Scan(&cycle); err != nil {
+				return
+			}
+			if cycle {
+				return ErrGroupCycle
+			}
+		}
+
+		res, err = tx.Exec(updateStmt, group.ID, group.Name, group.Description, group.parentParam())
+		return
+	})
+	if err != nil {
+		if database.DuplicateKeyError(err) {
+			return conflict(err)
+		}
+		return err
+	}
+
+	var rows int64
+	rows, _ = res.RowsAffected()
+	// If we didnt update anything, the group does not exist
+	if int(rows) == 0 {
+		return apperror.NotFound("No Group with ID %d found", group.ID).Wrap(sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// Delete removes the group. Subgroups are moved up to the top level and memberships are dropped
+func (group *GroupModel) Delete(ctx context.Context, db *database.PostGresDB) error {
+	if group.ID == 0 {
+		return apperror.NotFound("No Group with ID %d found", group.ID).Wrap(sql.ErrNoRows)
+	}
+
+	var res sql.Result
+	err := db.InTenant(ctx, database.OP_WRITE, group.OrgID, func(tx *database.Tx) (err error) {
+		res, err = tx.Exec(`DELETE FROM groups WHERE id = $1`, group.ID)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	var rows int64
+	rows, _ = res.RowsAffected()
+	// If we didnt delete anything, the group does not exist
+	if int(rows) == 0 {
+		return apperror.NotFound("No Group with ID %d found", group.ID).Wrap(sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// scanGroup reads a GROUP_GET_FIELDLIST row into a GroupModel
+func scanGroup(rows *sql.Rows, extra ...interface{}) (group GroupModel, err error) {
+	var parentID sql.NullInt64
+	dest := append([]interface{}{&group.ID, &group.OrgID, &group.Name, &group.Description, &parentID}, extra...)
+	err = rows.Scan(dest...)
+	group.ParentID = int(parentID.Int64)
+	return
+}
+
+// GetGroups fetches groups of the organization orgID ordered by id. If id is non-zero only that group is returned
+func GetGroups(ctx context.Context, db *database.PostGresDB, orgID, id, limit, offset int) (groups []GroupModel, err error) {
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		var rows *sql.Rows
+		var err error
+		if id != 0 {
+			rows, err = tx.Query(`SELECT `+GROUP_GET_FIELDLIST+` FROM groups WHERE id = $1`, id)
+		} else {
+			rows, err = tx.Query(`SELECT `+GROUP_GET_FIELDLIST+` FROM groups ORDER BY id LIMIT $1 OFFSET $2`,
+				limit, offset)
+		}
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			group, err := scanGroup(rows)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, group)
+		}
+
+		return rows.Err()
+	})
+
+	return
+}
+
+// AddGroupMember adds the user to the group. Adding an existing member is not an error. Only a privileged caller
+// can add members to the admin group or a group nested beneath it
+// returns a not found error, wrapping database.ErrForeignKey, if either the group or the user does not exist in the
+// organization, or ErrPrivilegedGroup
+func AddGroupMember(ctx context.Context, db *database.PostGresDB, orgID, groupID, userID int, privileged bool) error {
+	return db.InTenant(ctx, database.OP_WRITE, orgID, func(tx *database.Tx) error {
+		// The foreign keys can't tell which organization a row belongs to, but row level security hides the
+		// rows of other organizations from this check
+		var found int
+		existsStmt := `SELECT (SELECT count(*) FROM users WHERE id = $1) + (SELECT count(*) FROM groups WHERE id = $2)`
+		if err := tx.QueryRow(existsStmt, userID, groupID).Scan(&found); err != nil {
+			return err
+		} else if found != 2 {
+			return apperror.NotFound("No Group with ID %d or no User with ID %d found", groupID, userID).
+				Wrap(database.ErrForeignKey)
+		}
+		if !privileged {
+			if grants, err := grantsPrivilege(tx, groupID); err != nil {
+				return err
+			} else if grants {
+				return ErrPrivilegedGroup
+			}
+		}
+
+		insertStmt := `INSERT INTO user_groups (org_id, user_id, group_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+		_, err := tx.Exec(insertStmt, orgID, userID, groupID)
+		return err
+	})
+}
+
+// RemoveGroupMember removes the user from the group
+// returns a not found error if the user was not a direct member
+func RemoveGroupMember(ctx context.Context, db *database.PostGresDB, orgID, groupID, userID int) error {
+	var res sql.Result
+	err := db.InTenant(ctx, database.OP_WRITE, orgID, func(tx *database.Tx) (err error) {
+		res, err = tx.Exec(`DELETE FROM user_groups WHERE user_id = $1 AND group_id = $2`, userID, groupID)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	var rows int64
+	rows, _ = res.RowsAffected()
+	if int(rows) == 0 {
+		return apperror.NotFound("User ID %d is not a member of Group ID %d", userID, groupID).Wrap(sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// GetGroupMembers fetches the users in a group. When recursive is set, members of nested subgroups are included
+func GetGroupMembers(ctx context.Context, db *database.PostGresDB, orgID, groupID int, recursive bool, limit, offset int) (users []UserModel, err error) {
+	var selectStmt string
+	if recursive {
+		selectStmt = subgroupsCTE + ` SELECT ` + USER_GET_FIELDLIST + ` FROM users WHERE id IN (
+			SELECT ug.user_id FROM user_groups ug JOIN subgroups s ON ug.group_id = s.id)`
+	} else {
+		selectStmt = `SELECT ` + USER_GET_FIELDLIST + ` FROM users WHERE id IN (
+			SELECT user_id FROM user_groups WHERE group_id = $1)`
+	}
+	selectStmt += ` ORDER BY id LIMIT $2 OFFSET $3`
+
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, groupID, limit, offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+
+		return rows.Err()
+	})
+
+	return
+}
+
+// GetUserGroups fetches the effective groups of a user: the groups they were added to directly plus every
+// group those are nested under
+func GetUserGroups(ctx context.Context, db *database.PostGresDB, orgID, userID int) (groups []UserGroupModel, err error) {
+	selectStmt := `WITH RECURSIVE effective AS (
+			SELECT g.id, g.org_id, g.name, g.description, g.parent_id, TRUE AS direct
+			FROM groups g JOIN user_groups ug ON ug.group_id = g.id WHERE ug.user_id = $1
+			UNION
+			SELECT p.id, p.org_id, p.name, p.description, p.parent_id, FALSE
+			FROM groups p JOIN effective e ON p.id = e.parent_id
+		)
+		SELECT ` + GROUP_GET_FIELDLIST + `, bool_or(direct) FROM effective
+		GROUP BY ` + GROUP_GET_FIELDLIST + ` ORDER BY id`
+
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var group UserGroupModel
+			group.GroupModel, err = scanGroup(rows, &group.Direct)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, group)
+		}
+
+		return rows.Err()
+	})
+
+	return
+}
+
+// GetMembershipChanges fetches the membership changes recorded after the change id since, in the order of the
+// transactions that made them. Consumers keep the id of the last change they processed and pass it back to resume
+// the feed. Ids are taken before the transaction commits, so a change can commit behind one with a higher id. Only
+// the changes of transactions older than every transaction still running are returned, as no change can appear
+// behind those, so a consumer never moves past a change it hasn't seen
+func GetMembershipChanges(ctx context.Context, db *database.PostGresDB, orgID int, since int64, limit int) (changes []MembershipChangeModel, err error) {
+	selectStmt := `SELECT id, org_id, group_id, user_id, action, changed_at FROM group_membership_changes
+		WHERE (tx_id, id) > (COALESCE((SELECT tx_id FROM group_membership_changes WHERE id = $1), '0'::xid8), $1)
+		AND tx_id < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY tx_id, id LIMIT $2`
+
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, since, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var change MembershipChangeModel
+			err = rows.Scan(&change.ID, &change.OrgID, &change.GroupID, &change.UserID, &change.Action,
+				&change.ChangedAt)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+
+		return rows.Err()
+	})
+
+	return
+}
+
+// UserInGroup reports whether the user is an effective member of the named group, directly or through a nested
+// subgroup
+func UserInGroup(ctx context.Context, db *database.PostGresDB, orgID, userID int, groupName string) (member bool, err error) {
+	selectStmt := `WITH RECURSIVE effective AS (
+			SELECT g.id, g.name, g.parent_id FROM groups g JOIN user_groups ug ON ug.group_id = g.id
+			WHERE ug.user_id = $1
+			UNION
+			SELECT p.id, p.name, p.parent_id FROM groups p JOIN effective e ON p.id = e.parent_id
+		)
+		SELECT EXISTS (SELECT 1 FROM effective WHERE name = $2)`
+
+	err = db.InTenant(ctx, database.OP_READ, orgID, func(tx *database.Tx) error {
+		return tx.QueryRow(selectStmt, userID, groupName).Scan(&member)
+	})
+
+	return
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestGroupValidate Checks groups need a name of at most 100 characters, and a parent that isn't themselves
+func TestGroupValidate(t *testing.T) {
+	tests := []struct {
+		group  GroupModel
+		fields []string
+	}{
+		{GroupModel{Name: "admins"}, nil},
+		{GroupModel{ID: 2, Name: "engineering", ParentID: 1}, nil},
+		{GroupModel{Name: strings.Repeat("g", 100)}, nil},
+		{GroupModel{}, []string{"name"}},
+		{GroupModel{Name: strings.Repeat("g", 101)}, []string{"name"}},
+		{GroupModel{Name: "admins", ParentID: -1}, []string{"parentid"}},
+		{GroupModel{ID: 2, Name: "admins", ParentID: 2}, []string{"parentid"}},
+		{GroupModel{ID: 2, ParentID: 2}, []string{"name", "parentid"}},
+	}
+
+	for _, test := range tests {
+		errs := test.group.Validate()
+		fields := make([]string, len(errs))
+		for i, err := range errs {
+			fields[i] = err.Field
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") {
+			t.Errorf("Group %+v expected to fail on %v, got %v", test.group, test.fields, fields)
+		}
+	}
+}
+
+// groupsConnector opens connections to a fake database in which every user and group exists, the group being
+// updated has the parent among its subgroups if cycle is set, and every group is nested beneath the admin group if
+// admin is set, recording the statements run
+type groupsConnector struct {
+	cycle bool
+	admin bool
+	execs []string
+}
+
+func (c *groupsConnector) Connect(context.Context) (driver.Conn, error) { return &groupsConn{c}, nil }
+func (c *groupsConnector) Driver() driver.Driver                        { return nil }
+
+type groupsConn struct {
+	connector *groupsConnector
+}
+
+func (c *groupsConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *groupsConn) Close() error                        { return nil }
+func (c *groupsConn) Begin() (driver.Tx, error)           { return c, nil }
+func (c *groupsConn) Commit() error                       { return nil }
+func (c *groupsConn) Rollback() error                     { return nil }
+
+func (c *groupsConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.connector.execs = append(c.connector.execs, query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *groupsConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.connector.execs = append(c.connector.execs, query)
+	switch {
+	case strings.Contains(query, "FROM ancestors"):
+		return &existsRows{exists: c.connector.admin}, nil
+	case strings.Contains(query, "SELECT (SELECT count(*) FROM users"):
+		return &rowRows{row: []driver.Value{int64(2)}}, nil
+	case strings.Contains(query, "FROM subgroups"):
+		return &existsRows{exists: c.connector.cycle}, nil
+	case strings.Contains(query, "FROM groups WHERE id"):
+		return &existsRows{exists: true}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+// existsRows is the single row of a SELECT EXISTS
+type existsRows struct {
+	exists bool
+	read   bool
+}
+
+func (r *existsRows) Columns() []string { return []string{"exists"} }
+func (r *existsRows) Close() error      { return nil }
+
+func (r *existsRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	dest[0], r.read = r.exists, true
+	return nil
+}
+
+// TestGroupCycle Checks a group can't be nested beneath one of its own subgroups, and is left as it was. The
+// organization's groups are locked before the check, so concurrent re-parents can't make a cycle between them
+func TestGroupCycle(t *testing.T) {
+	for _, cycle := range []bool{true, false} {
+		connector := &groupsConnector{cycle: cycle}
+		db := &database.PostGresDB{PgDbSession: sql.OpenDB(connector)}
+
+		group := GroupModel{ID: 1, OrgID: 1, Name: "engineering", ParentID: 3}
+		err := group.Update(context.Background(), db, true)
+		updated, locked := false, -1
+		for i, query := range connector.execs {
+			updated = updated || strings.HasPrefix(query, "UPDATE groups")
+			if strings.Contains(query, "pg_advisory_xact_lock") && locked < 0 {
+				locked = i
+			} else if strings.Contains(query, "FROM subgroups") && (locked < 0 || locked > i) {
+				t.Errorf("Groups expected to be locked before checking for a cycle, ran %v", connector.execs)
+			}
+		}
+		if cycle && (err != ErrGroupCycle || updated) {
+			t.Errorf("Group nested beneath its subgroup expected to fail with a cycle and not be updated, got %v and "+
+				"updated %t", err, updated)
+		} else if !cycle && (err != nil || !updated) {
+			t.Errorf("Group nested beneath another group expected to be updated, got %v and updated %t", err, updated)
+		}
+		db.Disconnect()
+	}
+}
+
+// TestGroupPrivilege Checks only a privileged caller can join the admin group or a group nested beneath it, or make
+// a group one of those by its name or parent
+func TestGroupPrivilege(t *testing.T) {
+	for _, privileged := range []bool{false, true} {
+		connector := &groupsConnector{admin: true}
+		db := &database.PostGresDB{PgDbSession: sql.OpenDB(connector)}
+
+		err := AddGroupMember(context.Background(), db, 1, 1, 2, privileged)
+		added := false
+		for _, query := range connector.execs {
+			added = added || strings.HasPrefix(query, "INSERT INTO user_groups")
+		}
+		if !privileged && (err != ErrPrivilegedGroup || added) {
+			t.Errorf("User who isn't an admin expected to be refused joining the admin group, got %v and added %t",
+				err, added)
+		} else if privileged && (err != nil || !added) {
+			t.Errorf("Admin expected to add a member to the admin group, got %v and added %t", err, added)
+		}
+
+		for _, group := range []GroupModel{{ID: 2, OrgID: 1, Name: "support"},
+			{ID: 2, OrgID: 1, Name: "support", ParentID: 1}} {
+			if err = group.Update(context.Background(), db, privileged); !privileged && err != ErrPrivilegedGroup {
+				t.Errorf("User who isn't an admin expected to be refused changing group %+v, got %v", group, err)
+			} else if privileged && err != nil {
+				t.Errorf("Admin expected to change group %+v, got %v", group, err)
+			}
+		}
+		db.Disconnect()
+	}
+
+	// a group named for the admin group is refused, even when nothing nests beneath it yet
+	connector := &groupsConnector{}
+	db := &database.PostGresDB{PgDbSession: sql.OpenDB(connector)}
+	defer db.Disconnect()
+	group := GroupModel{OrgID: 1, Name: ADMIN_GROUP}
+	if err := group.Create(context.Background(), db, false); err != ErrPrivilegedGroup {
+		t.Errorf("User who isn't an admin expected to be refused creating the admin group, got %v", err)
+	}
+	group = GroupModel{ID: 2, OrgID: 1, Name: "support"}
+	if err := group.Update(context.Background(), db, false); err != nil {
+		t.Errorf("Group unrelated to the admin group expected to be changed, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"time"
+)
+
+// IdempotencyKeyModel is a request made with an Idempotency-Key and, once it has been answered, its response, so a
+// retry of the request is answered with the same response rather than run again. Keys are scoped to the user who
+// sent them, 0 for anonymous requests
+type IdempotencyKeyModel struct {
+	OrgID  int
+	UserID int
+	Key    string
+	// Fingerprint is a hash of the request, so the key being reused for a different request is caught
+	Fingerprint string
+	// Status is the status of the response, 0 while the request is in progress
+	Status int
+	Header map[string][]string
+	Body   []byte
+	// ExpiresAt is when the key can be used again for a new request
+	ExpiresAt time.Time
+	// ClaimID identifies the claim taken on the key by Claim, so only the request holding it can complete or release
+	// the key, not one whose claim was taken over
+	ClaimID string
+}
+
+// IdempotencyKeySchema creates the table of idempotency keys. A key in progress is locked until locked_until, after
+// which the instance running its request is taken to have stopped
+const IdempotencyKeySchema string = `
+CREATE TABLE idempotency_keys (
+	org_id INT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+	user_id INT NOT NULL DEFAULT 0,
+	idempotency_key TEXT NOT NULL,
+	fingerprint TEXT NOT NULL,
+	status INT NOT NULL DEFAULT 0,
+	header JSONB,
+	body BYTEA,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	locked_until TIMESTAMPTZ,
+	expires_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (org_id, user_id, idempotency_key)
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON idempotency_keys TO user_service_tenant;
+
+ALTER TABLE idempotency_keys ENABLE ROW LEVEL SECURITY;
+ALTER TABLE idempotency_keys FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON idempotency_keys
+	USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+`
+
+// IdempotencyClaimSchema adds the id of the claim on each key. Keys claimed before it was added have none, so
+// requests still running with them can't complete them
+const IdempotencyClaimSchema string = `
+ALTER TABLE idempotency_keys ADD COLUMN claim_id TEXT NOT NULL DEFAULT '';
+`
+
+// Claim takes the key for the request, locking it for lock and keeping it for ttl. The key is taken if it is new,
+// has expired, or is locked by a request with the same fingerprint that has been running for longer than lock, so
+// the request must not run for longer than lock. Replicas claiming the same key at once are serialized by its row,
+// so only one of them takes it
+// returns true if the key was taken, with ClaimID set, otherwise false with the key filled in as it is stored
+func (k *IdempotencyKeyModel) Claim(ctx context.Context, db *database.PostGresDB, lock, ttl time.Duration) (bool,
+	error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return false, err
+	}
+	k.ClaimID = hex.EncodeToString(id)
+
+	claimStmt := `INSERT INTO idempotency_keys (org_id, user_id, idempotency_key, fingerprint, claim_id,
+		locked_until, expires_at) VALUES ($1, $2, $3, $4, $5, now() + $6 * interval '1 microsecond',
+		now() + $7 * interval '1 microsecond')
+		ON CONFLICT (org_id, user_id, idempotency_key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, status = 0,
+		header = NULL, body = NULL, created_at = now(), claim_id = EXCLUDED.claim_id,
+		locked_until = EXCLUDED.locked_until, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < now() OR (idempotency_keys.status = 0
+		AND idempotency_keys.locked_until < now() AND idempotency_keys.fingerprint = EXCLUDED.fingerprint)
+		RETURNING expires_at`
+	selectStmt := `SELECT fingerprint, status, header, body, expires_at FROM idempotency_keys
+		WHERE user_id = $1 AND idempotency_key = $2`
+
+	claimed := false
+	err := db.InTenant(ctx, database.OP_WRITE, k.OrgID, func(tx *database.Tx) error {
+		err := tx.QueryRow(claimStmt, k.OrgID, k.UserID, k.Key, k.Fingerprint, k.ClaimID, lock.Microseconds(),
+			ttl.Microseconds()).Scan(&k.ExpiresAt)
+		if err != sql.ErrNoRows {
+			claimed = err == nil
+			return err
+		}
+
+		var header []byte
+		err = tx.QueryRow(selectStmt, k.UserID, k.Key).Scan(&k.Fingerprint, &k.Status, &header, &k.Body,
+			&k.ExpiresAt)
+		if err == sql.ErrNoRows {
+			// Released between the statements, by a request that failed, so it is as good as in progress
+			return nil
+		} else if err != nil || header == nil {
+			return err
+		}
+		return json.Unmarshal(header, &k.Header)
+	})
+
+	if !claimed {
+		k.ClaimID = ""
+	}
+	return claimed, err
+}
+
+// Complete stores the response to the request that claimed the key, unlocking it
+// returns a not found error if the key is no longer claimed by the request's claim, ClaimID, such as when it was
+// taken over
+func (k *IdempotencyKeyModel) Complete(ctx context.Context, db *database.PostGresDB) error {
+	header, err := json.Marshal(k.Header)
+	if err != nil {
+		return err
+	}
+
+	updateStmt := `UPDATE idempotency_keys SET status = $4, header = $5, body = $6, locked_until = NULL
+		WHERE user_id = $1 AND idempotency_key = $2 AND claim_id = $3 AND status = 0`
+	return db.InTenant(ctx, database.OP_WRITE, k.OrgID, func(tx *database.Tx) error {
+		res, err := tx.Exec(updateStmt, k.UserID, k.Key, k.ClaimID, k.Status, header, k.Body)
+		if err != nil {
+			return err
+		}
+		if count, err := res.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			return apperror.NotFound("Idempotency key %q is not in progress", k.Key)
+		}
+		return nil
+	})
+}
+
+// Release gives up the claim on the key without storing a response, so the request can be retried with it. A key
+// whose claim was taken over is left to the request that took it
+func (k *IdempotencyKeyModel) Release(ctx context.Context, db *database.PostGresDB) error {
+	deleteStmt := `DELETE FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2 AND claim_id = $3
+		AND status = 0`
+	return db.InTenant(ctx, database.OP_WRITE, k.OrgID, func(tx *database.Tx) error {
+		_, err := tx.Exec(deleteStmt, k.UserID, k.Key, k.ClaimID)
+		return err
+	})
+}
+
+// ExpireIdempotencyKeys deletes the keys of the organization orgID that have expired
+// returns the number of keys deleted
+func ExpireIdempotencyKeys(ctx context.Context, db *database.PostGresDB, orgID int) (count int64, err error) {
+	err = db.InTenant(ctx, database.OP_WRITE, orgID, func(tx *database.Tx) error {
+		res, err := tx.Exec(`DELETE FROM idempotency_keys WHERE expires_at < now()`)
+		if err != nil {
+			return err
+		}
+		count, err = res.RowsAffected()
+		return err
+	})
+
+	return
+}
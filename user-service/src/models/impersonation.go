@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"time"
+)
+
+// ImpersonationSessionModel is a period during which a staff member (the actor) acts as another user (the subject)
+type ImpersonationSessionModel struct {
+	ID        string     `json:"id"`
+	OrgID     int        `json:"orgid"`
+	ActorID   int        `json:"actorid"`
+	SubjectID int        `json:"subjectid"`
+	Reason    string     `json:"reason"`
+	StartedAt time.Time  `json:"startedat"`
+	ExpiresAt time.Time  `json:"expiresat"`
+	EndedAt   *time.Time `json:"endedat,omitempty"`
+}
+
+const ImpersonationSchema string = `
+CREATE TABLE impersonation_sessions (
+	id TEXT PRIMARY KEY,
+	org_id INT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+	actor_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	subject_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	reason TEXT NOT NULL,
+	started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	expires_at TIMESTAMPTZ NOT NULL,
+	ended_at TIMESTAMPTZ
+);
+
+GRANT SELECT, INSERT, UPDATE ON impersonation_sessions TO user_service_tenant;
+
+ALTER TABLE impersonation_sessions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE impersonation_sessions FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON impersonation_sessions
+	USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+`
+
+// ErrImpersonationEnded is returned for sessions that were stopped or have expired
+var ErrImpersonationEnded = apperror.Unauthorized("impersonation session has ended")
+
+// Start opens the session for ttl and records it in the audit trail
+// returns a not found error if the subject does not exist in the organization
+func (session *ImpersonationSessionModel) Start(ctx context.Context, db *database.PostGresDB, ttl time.Duration) error {
+	if session.Reason == "" {
+		return apperror.Invalid("reason", "a reason for impersonating is required")
+	}
+	if session.ActorID == session.SubjectID {
+		return apperror.Invalid("userid", "cannot impersonate yourself")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	session.ID = hex.EncodeToString(id)
+
+	insertStmt := `INSERT INTO impersonation_sessions (id, org_id, actor_id, subject_id, reason, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING started_at, expires_at`
+	return db.InTenant(ctx, database.OP_WRITE, session.OrgID, func(tx *database.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, session.SubjectID).
+			Scan(&exists); err != nil {
+			return err
+		} else if !exists {
+			return apperror.NotFound("No User with ID %d found", session.SubjectID).Wrap(sql.ErrNoRows)
+		}
+
+		err := tx.QueryRow(insertStmt, session.ID, session.OrgID, session.ActorID, session.SubjectID, session.Reason,
+			time.Now().Add(ttl)).Scan(&session.StartedAt, &session.ExpiresAt)
+		if err != nil {
+			return err
+		}
+
+		event := AuditEventModel{OrgID: session.OrgID, Action: AUDIT_IMPERSONATION_START, ActorID: session.ActorID,
+			SubjectID: session.SubjectID, Detail: map[string]string{"session": session.ID, "reason": session.Reason,
+				"expires": session.ExpiresAt.Format(time.RFC3339)}}
+		return event.insert(tx)
+	})
+}
+
+// Stop ends the session early and records it in the audit trail
+// returns ErrImpersonationEnded if it had already ended
+func (session *ImpersonationSessionModel) Stop(ctx context.Context, db *database.PostGresDB) error {
+	updateStmt := `UPDATE impersonation_sessions SET ended_at = now()
+		WHERE id = $1 AND ended_at IS NULL AND expires_at > now()
+		RETURNING actor_id, subject_id, reason, started_at, expires_at, ended_at`
+	return db.InTenant(ctx, database.OP_WRITE, session.OrgID, func(tx *database.Tx) error {
+		var endedAt time.Time
+		err := tx.QueryRow(updateStmt, session.ID).Scan(&session.ActorID, &session.SubjectID, &session.Reason,
+			&session.StartedAt, &session.ExpiresAt, &endedAt)
+		if err == sql.ErrNoRows {
+			return ErrImpersonationEnded
+		} else if err != nil {
+			return err
+		}
+		session.EndedAt = &endedAt
+
+		event := AuditEventModel{OrgID: session.OrgID, Action: AUDIT_IMPERSONATION_STOP, ActorID: session.ActorID,
+			SubjectID: session.SubjectID, Detail: map[string]string{"session": session.ID}}
+		return event.insert(tx)
+	})
+}
+
+// CheckImpersonationSession verifies the session is still open
+// returns ErrImpersonationEnded if it was stopped, has expired or does not exist
+func CheckImpersonationSession(ctx context.Context, db *database.PostGresDB, orgID int, id string) error {
+	var open bool
+	err := db.InTenant(ctx, database.OP_READ, orgID, func(tx *database.Tx) error {
+		return tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM impersonation_sessions
+			WHERE id = $1 AND ended_at IS NULL AND expires_at > now())`, id).Scan(&open)
+	})
+	if err == nil && !open {
+		err = ErrImpersonationEnded
+	}
+
+	return err
+}
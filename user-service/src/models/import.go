@@ -0,0 +1,825 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The fields users can be upserted by
+const (
+	IMPORT_UPSERT_USERNAME string = "username"
+	IMPORT_UPSERT_EMAIL    string = "email"
+)
+
+// ImportOptions are how ImportUsers treats the rows it is given
+type ImportOptions struct {
+	// DryRun checks every row, reporting what would happen, without writing any
+	DryRun bool
+	// Upsert, IMPORT_UPSERT_USERNAME or IMPORT_UPSERT_EMAIL, updates the user with the same username or email rather
+	// than failing the row as a conflict. Empty only creates users
+	Upsert string
+	// HashedPasswords takes the passwords as bcrypt hashes made elsewhere, rather than plain text
+	HashedPasswords bool
+}
+
+// The statuses of the rows of an import
+const (
+	IMPORT_CREATED string = "created"
+	IMPORT_UPDATED string = "updated"
+	IMPORT_FAILED  string = "failed"
+)
+
+// IMPORT_BATCH_SIZE is the number of users copied into the database at a time
+const IMPORT_BATCH_SIZE int = 1000
+
+// ImportRow is a user read from an import file
+type ImportRow struct {
+	// Row is the number of the user in the file, from 1, not counting the header or blank lines
+	Row  int
+	User UserModel
+	// Err is why the row couldn't be read, if it couldn't
+	Err error
+
+	// textAttributes are the attribute values of a CSV row, converted to the type of their attribute once the
+	// attributes of the organization are known
+	textAttributes map[string]string
+	// hasPassword is whether a password was given for the user
+	hasPassword bool
+	// existingID is the id of the user the row updates, 0 if it creates one
+	existingID int
+	// err is why the row failed
+	err error
+}
+
+// ImportResult is what happened to a row of an import
+type ImportResult struct {
+	Row    int    `json:"row"`
+	Status string `json:"status"`
+	// ID is the id of the user created or updated. It is 0 for users a dry run would create
+	ID       int    `json:"id,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Error is why the row failed
+	Error string `json:"error,omitempty"`
+	// Field is the field whose uniqueness a failed row violated
+	Field  string                `json:"field,omitempty"`
+	Errors []apperror.FieldError `json:"errors,omitempty"`
+}
+
+// ImportReport is the outcome of an import, with the result of every row in the order they were read
+type ImportReport struct {
+	DryRun  bool           `json:"dryrun"`
+	Total   int            `json:"total"`
+	Created int            `json:"created"`
+	Updated int            `json:"updated"`
+	Failed  int            `json:"failed"`
+	Results []ImportResult `json:"results"`
+}
+
+// IMPORT_CSV_FIELDS are the fields CSV columns can be mapped onto, besides attributes.<name>
+var IMPORT_CSV_FIELDS = []string{"username", "password", "firstname", "middlename", "lastname", "email",
+	"telephone", "extension"}
+
+// IMPORT_IGNORE maps a CSV column onto nothing, so it is ignored
+const IMPORT_IGNORE string = "-"
+
+// ParseImportMapping reads a column mapping of the form "column=field,column=field", where the field - ignores the
+// column
+// returns an error naming the first pair that isn't of that form
+func ParseImportMapping(s string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		eq := strings.LastIndexByte(pair, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%q is not of the form column=field", pair)
+		}
+		column, field := strings.TrimSpace(pair[:eq]), strings.ToLower(strings.TrimSpace(pair[eq+1:]))
+		if column == "" || field == "" {
+			return nil, fmt.Errorf("%q is not of the form column=field", pair)
+		}
+		mapping[strings.ToLower(column)] = field
+	}
+
+	return mapping, nil
+}
+
+// importField checks the field a CSV column is mapped onto is one users have
+func importField(field string) bool {
+	if strings.HasPrefix(field, "attributes.") {
+		return ATTRIBUTE_NAME_REGEX.MatchString(strings.TrimPrefix(field, "attributes."))
+	}
+	for _, f := range IMPORT_CSV_FIELDS {
+		if field == f {
+			return true
+		}
+	}
+	return field == IMPORT_IGNORE
+}
+
+// ReadImportCSV reads users from CSV with a header row. Each column is the field named by its header, regardless of
+// case, unless the mapping, keyed by lowercased header, maps it onto another. Empty attribute values are left out
+// returns a validation error if the header has a column that isn't mapped onto a field, names a field twice, or the
+// CSV is malformed
+func ReadImportCSV(r io.Reader, mapping map[string]string) ([]ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, apperror.Validation("The CSV has no header row")
+	} else if err != nil {
+		return nil, apperror.Validation("Malformed CSV: " + err.Error()).Wrap(err)
+	}
+
+	fields := make([]string, len(header))
+	mapped := make(map[string]string)
+	for i, column := range header {
+		// A byte order mark, which spreadsheets write, begins the first column
+		column = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+		field, ok := mapping[strings.ToLower(column)]
+		if !ok {
+			field = strings.ToLower(column)
+		}
+		if !importField(field) {
+			return nil, apperror.Validation(fmt.Sprintf("Column %q is not a field of users. Map it onto one, or "+
+				"onto - to ignore it", column))
+		}
+		if other, ok := mapped[field]; ok && field != IMPORT_IGNORE {
+			return nil, apperror.Validation(fmt.Sprintf("Columns %q and %q are both %s", other, column, field))
+		}
+		mapped[field], fields[i] = column, field
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, apperror.Validation("Malformed CSV: " + err.Error()).Wrap(err)
+		}
+
+		row := ImportRow{Row: len(rows) + 1}
+		if len(record) != len(fields) {
+			row.Err = apperror.Validation(fmt.Sprintf("Row has %d columns, the header has %d", len(record),
+				len(fields)))
+			rows = append(rows, row)
+			continue
+		}
+		for i, value := range record {
+			row.setField(fields[i], value)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// setField sets the field of the user of a CSV row
+func (row *ImportRow) setField(field, value string) {
+	user := &row.User
+	switch field {
+	case "username":
+		user.Username = value
+	case "password":
+		user.Password = value
+	case "firstname":
+		user.FirstName = value
+	case "middlename":
+		user.MiddleName = value
+	case "lastname":
+		user.LastName = value
+	case "email":
+		user.Email = value
+	case "telephone":
+		user.Telephone = value
+	case "extension":
+		user.Extension = value
+	default:
+		if name := strings.TrimPrefix(field, "attributes."); name != field && value != "" {
+			if row.textAttributes == nil {
+				row.textAttributes = make(map[string]string)
+			}
+			row.textAttributes[name] = value
+		}
+	}
+}
+
+// IMPORT_MAX_LINE is the longest line of JSON Lines that can be read
+const IMPORT_MAX_LINE int = 1 << 20
+
+// ReadImportNDJSON reads users from JSON Lines, a user on each line. Blank lines are skipped, and a line that isn't
+// a user is a failed row
+// returns an error if a line is longer than IMPORT_MAX_LINE, or r can't be read
+func ReadImportNDJSON(r io.Reader) ([]ImportRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), IMPORT_MAX_LINE)
+
+	var rows []ImportRow
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		row := ImportRow{Row: len(rows) + 1}
+		var typeErr *json.UnmarshalTypeError
+		if err := json.Unmarshal([]byte(line), &row.User); errors.As(err, &typeErr) && typeErr.Field != "" {
+			row.Err = apperror.Invalid(typeErr.Field, "Invalid %s: expected a %s, received a %s", typeErr.Field,
+				typeErr.Type, typeErr.Value).Wrap(err)
+		} else if err != nil {
+			row.Err = apperror.Validation("Malformed JSON: " + err.Error()).Wrap(err)
+		}
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return nil, apperror.Validation(fmt.Sprintf("Line %d is longer than %d bytes", len(rows)+1,
+			IMPORT_MAX_LINE)).Wrap(err)
+	} else if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// importHash reads a bcrypt hash given for a user, either as it is or base64 encoded as it is stored
+// returns the hash as it is stored, or a validation error if it isn't a bcrypt hash
+func importHash(hash string) (string, error) {
+	raw := []byte(hash)
+	if !strings.HasPrefix(hash, "$") {
+		raw, _ = base64.URLEncoding.DecodeString(hash)
+	}
+	if _, err := bcrypt.Cost(raw); err != nil {
+		return "", apperror.Invalid("password", "Password is not a bcrypt hash").Wrap(err)
+	}
+
+	return base64.URLEncoding.EncodeToString(raw), nil
+}
+
+// prepare validates and normalizes the user of the row, without looking at the database. A missing password is
+// only a failure once the row is known to create a user
+func (row *ImportRow) prepare(opts ImportOptions) error {
+	if row.Err != nil {
+		return row.Err
+	}
+	user := &row.User
+	if user.ID != 0 {
+		return apperror.Invalid("id", "ID must be null when importing a User")
+	}
+
+	row.hasPassword = user.Password != ""
+	var fields []string
+	for _, field := range USER_FIELDS {
+		if field != "password" || row.hasPassword && !opts.HashedPasswords {
+			fields = append(fields, field)
+		}
+	}
+	if err := user.validate(fields...); err != nil {
+		return err
+	}
+	if row.hasPassword && opts.HashedPasswords {
+		hash, err := importHash(user.Password)
+		if err != nil {
+			return err
+		}
+		user.Password = hash
+	}
+
+	if err := user.normalizeUsername(); err != nil {
+		return err
+	}
+	if err := user.normalizeEmail(); err != nil {
+		return err
+	}
+	return user.normalizeTelephone()
+}
+
+// convertAttributes converts the attribute values of a CSV row to the types of their attributes. A value that isn't
+// of its type, or of an attribute that isn't defined, is kept as text, for validation to report
+func (row *ImportRow) convertAttributes(attrs []AttributeModel) {
+	if row.textAttributes == nil {
+		return
+	}
+
+	types := make(map[string]string)
+	for _, attr := range attrs {
+		types[attr.Name] = attr.Type
+	}
+	row.User.Attributes = make(map[string]interface{})
+	for name, text := range row.textAttributes {
+		var value interface{} = text
+		switch types[name] {
+		case ATTRIBUTE_TYPE_INTEGER, ATTRIBUTE_TYPE_NUMBER:
+			if f, err := strconv.ParseFloat(text, 64); err == nil {
+				value = f
+			}
+		case ATTRIBUTE_TYPE_BOOLEAN:
+			if b, err := strconv.ParseBool(text); err == nil {
+				value = b
+			}
+		}
+		row.User.Attributes[name] = value
+	}
+}
+
+// checkDuplicates fails each row whose username, or email, is the same as, or looks like, that of an earlier row
+// that hasn't failed
+func checkDuplicates(rows []ImportRow) {
+	skeletons, canonical, emails := make(map[string]int), make(map[string]int), make(map[string]int)
+	for i := range rows {
+		row := &rows[i]
+		if row.err != nil {
+			continue
+		}
+
+		lowerEmail := strings.ToLower(row.User.Email)
+		if earlier, ok := skeletons[row.User.usernameSkeleton]; ok {
+			row.err = apperror.Conflict("username", "Username is the same as, or looks too like, the username "+
+				"of row %d", earlier)
+		} else if earlier, ok = canonical[row.User.canonicalEmail]; ok {
+			row.err = apperror.Conflict("email", "Email is the same as the email of row %d", earlier)
+		} else if earlier, ok = emails[lowerEmail]; ok {
+			row.err = apperror.Conflict("email", "Email is the same as the email of row %d", earlier)
+		} else {
+			skeletons[row.User.usernameSkeleton] = row.Row
+			canonical[row.User.canonicalEmail] = row.Row
+			emails[lowerEmail] = row.Row
+		}
+	}
+}
+
+// matchUsers runs a query for the users matching each of the keys, which it is given as a text array, $1, along
+// with any other params. The query selects the id of each user and the ordinality, from 1, of the key it matched
+// returns the ids of the users matching each key, by its index
+func matchUsers(tx *database.Tx, query string, keys []string, params ...interface{}) (map[int][]int, error) {
+	rows, err := tx.Query(query, append([]interface{}{pq.Array(keys)}, params...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make(map[int][]int)
+	for rows.Next() {
+		var id, ordinality int
+		if err = rows.Scan(&id, &ordinality); err != nil {
+			return nil, err
+		}
+		matches[ordinality-1] = append(matches[ordinality-1], id)
+	}
+
+	return matches, rows.Err()
+}
+
+// pending returns the indexes of the rows that haven't failed
+func pending(rows []ImportRow) (indexes []int) {
+	for i := range rows {
+		if rows[i].err == nil {
+			indexes = append(indexes, i)
+		}
+	}
+	return
+}
+
+// findExisting sets the id of the user each row updates, found by the field users are upserted by
+func findExisting(tx *database.Tx, rows []ImportRow, upsert string) error {
+	indexes := pending(rows)
+	keys := make([]string, len(indexes))
+	for k, i := range indexes {
+		keys[k] = rows[i].User.Username
+		if upsert == IMPORT_UPSERT_EMAIL {
+			keys[k] = rows[i].User.canonicalEmail
+		}
+	}
+
+	matchStmt := `SELECT u.id, k.i FROM users u JOIN unnest($1::text[]) WITH ORDINALITY k(key, i)
+		ON lower(u.username) = lower(k.key)`
+	if upsert == IMPORT_UPSERT_EMAIL {
+		matchStmt = `SELECT u.id, k.i FROM users u JOIN unnest($1::text[]) WITH ORDINALITY k(key, i)
+			ON u.email_canonical = k.key`
+	}
+	matches, err := matchUsers(tx, matchStmt, keys)
+	if err != nil {
+		return err
+	}
+	for k, i := range indexes {
+		if ids := matches[k]; len(ids) > 0 {
+			rows[i].existingID = ids[0]
+		}
+	}
+
+	return nil
+}
+
+// checkExisting fails each row whose username looks like, or whose email is the same as, that of a user other than
+// the one it updates. As when a user is updated, one whose username already had the same skeleton keeps it
+func checkExisting(tx *database.Tx, rows []ImportRow) error {
+	checks := []struct {
+		field, message, stmt string
+		key                  func(user UserModel) string
+		// keeps lets a user keep a key other users have, if it already has it
+		keeps bool
+	}{
+		{"username", "Username looks too like the username of another user",
+			`ON u.username_skeleton = k.key`, func(user UserModel) string { return user.usernameSkeleton }, true},
+		{"email", "Request violates uniqueness of email",
+			`ON u.email_canonical = k.key`, func(user UserModel) string { return user.canonicalEmail }, false},
+		{"email", "Request violates uniqueness of email",
+			`ON lower(u.email) = lower(k.key)`, func(user UserModel) string { return user.Email }, false},
+	}
+
+	for _, check := range checks {
+		indexes := pending(rows)
+		keys := make([]string, len(indexes))
+		for k, i := range indexes {
+			keys[k] = check.key(rows[i].User)
+		}
+		matchStmt := `SELECT u.id, k.i FROM users u JOIN unnest($1::text[]) WITH ORDINALITY k(key, i) ` + check.stmt
+		matches, err := matchUsers(tx, matchStmt, keys)
+		if err != nil {
+			return err
+		}
+
+		for k, i := range indexes {
+			other, kept := false, false
+			for _, id := range matches[k] {
+				other = other || id != rows[i].existingID
+				kept = kept || id == rows[i].existingID
+			}
+			if other && !(check.keeps && kept) {
+				rows[i].err = apperror.Conflict(check.field, check.message).Wrap(database.ErrDuplicateKey)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkImportAttributes validates the attributes of each row against those of the organization, and fails each row
+// with the value of a unique attribute another user, or an earlier row, has. A user that is updated without
+// attributes keeps those it has
+func checkImportAttributes(tx *database.Tx, rows []ImportRow) error {
+	attrs, err := getAttributes(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range pending(rows) {
+		row := &rows[i]
+		row.convertAttributes(attrs)
+		if row.User.Attributes == nil && row.existingID != 0 {
+			continue
+		}
+		if row.User.Attributes == nil {
+			row.User.Attributes = make(map[string]interface{})
+		}
+		for name, value := range row.User.Attributes {
+			if value == nil {
+				delete(row.User.Attributes, name)
+			}
+		}
+		if valErrors := ValidateAttributes(attrs, row.User.Attributes); len(valErrors) > 0 {
+			row.err = apperror.Validation("UserModel failed validation", valErrors...)
+		}
+	}
+
+	for _, attr := range attrs {
+		if !attr.Unique {
+			continue
+		}
+
+		var indexes []int
+		var values []string
+		earlier := make(map[string]int)
+		for _, i := range pending(rows) {
+			value, ok := rows[i].User.Attributes[attr.Name]
+			if !ok {
+				continue
+			}
+			encoded, _ := json.Marshal(value)
+			if row, ok := earlier[string(encoded)]; ok {
+				rows[i].err = apperror.Conflict("attributes."+attr.Name, "attributes.%s is the same as that of row %d",
+					attr.Name, row)
+				continue
+			}
+			earlier[string(encoded)] = rows[i].Row
+			indexes, values = append(indexes, i), append(values, string(encoded))
+		}
+
+		matchStmt := `SELECT u.id, k.i FROM users u JOIN unnest($1::text[]) WITH ORDINALITY k(value, i)
+			ON u.attributes -> $2 = k.value::jsonb`
+		matches, err := matchUsers(tx, matchStmt, values, attr.Name)
+		if err != nil {
+			return err
+		}
+		for k, i := range indexes {
+			for _, id := range matches[k] {
+				if id != rows[i].existingID {
+					rows[i].err = apperror.Conflict("attributes."+attr.Name, "Request violates uniqueness of "+
+						"attributes.%s", attr.Name).Wrap(database.ErrDuplicateKey)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkImport checks the rows that passed prepare against the users of the organization
+func checkImport(tx *database.Tx, rows []ImportRow, opts ImportOptions) error {
+	if opts.Upsert != "" {
+		if err := findExisting(tx, rows, opts.Upsert); err != nil {
+			return err
+		}
+	}
+
+	for _, i := range pending(rows) {
+		row := &rows[i]
+		if row.existingID == 0 && !row.hasPassword {
+			// Fails the password rule the way a missing password does
+			row.err = row.User.validate("password")
+		}
+	}
+
+	if err := checkExisting(tx, rows); err != nil {
+		return err
+	}
+	return checkImportAttributes(tx, rows)
+}
+
+// hashPasswords hashes the plain text passwords of the rows that haven't failed, using every CPU, as hashing is by
+// far the slowest part of an import
+func hashPasswords(ctx context.Context, rows []ImportRow) error {
+	work := make(chan int)
+	errs := make(chan error, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if err := rows[i].User.handlePassword(ctx); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+	for _, i := range pending(rows) {
+		if !rows[i].hasPassword {
+			continue
+		}
+		select {
+		case work <- i:
+			continue
+		case err = <-errs:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		break
+	}
+	close(work)
+	wg.Wait()
+
+	if err == nil && len(errs) > 0 {
+		err = <-errs
+	}
+	return err
+}
+
+// passwordHashTime is how long hashing a password at BCRYPT_COST takes, measured the first time it is needed
+var passwordHashTime struct {
+	once     sync.Once
+	duration time.Duration
+}
+
+// PasswordsHashedWithin estimates how many plain text passwords hashPasswords can hash in half of d, using every
+// CPU, leaving the other half for the rest of an import
+func PasswordsHashedWithin(d time.Duration) int {
+	passwordHashTime.once.Do(func() {
+		start := time.Now()
+		_, _ = bcrypt.GenerateFromPassword([]byte("Measur3d!"), BCRYPT_COST)
+		passwordHashTime.duration = time.Since(start)
+	})
+
+	return int(d/2/passwordHashTime.duration) * runtime.NumCPU()
+}
+
+// PlainPasswords counts the rows giving a password, which is hashed unless the import has ImportOptions.HashedPasswords
+func PlainPasswords(rows []ImportRow) (count int) {
+	for _, row := range rows {
+		if row.User.Password != "" {
+			count++
+		}
+	}
+	return
+}
+
+// IMPORT_COLUMNS are the columns of users an import copies in
+var IMPORT_COLUMNS = []string{"username", "username_skeleton", "password_hash", "firstname", "middlename", "lastname",
+	"email", "email_canonical", "telephone", "extension", "attributes"}
+
+// createUsers creates the users of the rows, copying a batch at a time into a temporary table, then inserting them
+// from it, as COPY can't write to a table with row level security
+func createUsers(tx *database.Tx, orgID int, rows []ImportRow, indexes []int) error {
+	createStmt := `CREATE TEMP TABLE import_users (username TEXT, username_skeleton TEXT, password_hash TEXT,
+		firstname TEXT, middlename TEXT, lastname TEXT, email TEXT, email_canonical TEXT, telephone TEXT,
+		extension TEXT, attributes JSONB) ON COMMIT DROP`
+	if _, err := tx.Exec(createStmt); err != nil {
+		return err
+	}
+
+	columns := strings.Join(IMPORT_COLUMNS, ", ")
+	insertStmt := `INSERT INTO users (org_id, ` + columns + `) SELECT $1, ` + columns +
+		` FROM import_users RETURNING id, username`
+	for start := 0; start < len(indexes); start += IMPORT_BATCH_SIZE {
+		end := start + IMPORT_BATCH_SIZE
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+
+		stmt, err := tx.Tx.PrepareContext(tx.Context(), pq.CopyIn("import_users", IMPORT_COLUMNS...))
+		if err != nil {
+			return err
+		}
+		byUsername := make(map[string]*ImportRow)
+		for _, i := range indexes[start:end] {
+			user := rows[i].User
+			byUsername[user.Username] = &rows[i]
+			// Copied as text, as COPY would write []byte as bytea
+			_, err = stmt.ExecContext(tx.Context(), user.Username, user.usernameSkeleton, user.Password,
+				user.FirstName, user.MiddleName, user.LastName, user.Email, user.canonicalEmail, user.Telephone,
+				user.Extension, string(user.attributesParam()))
+			if err != nil {
+				_ = stmt.Close()
+				return err
+			}
+		}
+		if _, err = stmt.ExecContext(tx.Context()); err != nil {
+			_ = stmt.Close()
+			return err
+		}
+		if err = stmt.Close(); err != nil {
+			return err
+		}
+
+		inserted, err := tx.Query(insertStmt, orgID)
+		if err != nil {
+			return err
+		}
+		for inserted.Next() {
+			var id int
+			var username string
+			if err = inserted.Scan(&id, &username); err != nil {
+				_ = inserted.Close()
+				return err
+			}
+			if row, ok := byUsername[username]; ok {
+				row.User.ID = id
+			}
+		}
+		_ = inserted.Close()
+		if err = inserted.Err(); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(`TRUNCATE import_users`); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateUsers updates the users of the rows one at a time. Those given without a password, or attributes, keep the
+// ones they have
+func updateUsers(tx *database.Tx, rows []ImportRow, indexes []int) error {
+	for _, i := range indexes {
+		row := &rows[i]
+		user := &row.User
+		user.ID = row.existingID
+
+		updateStmt := `UPDATE users SET username = $2, firstname = $3, middlename = $4, lastname = $5, email = $6,
+			telephone = $7, extension = $8, email_canonical = $9, username_skeleton = $10`
+		params := []interface{}{user.ID, user.Username, user.FirstName, user.MiddleName, user.LastName, user.Email,
+			user.Telephone, user.Extension, user.canonicalEmail, user.usernameSkeleton}
+		if row.hasPassword {
+			params = append(params, user.Password)
+			updateStmt += fmt.Sprintf(", password_hash = $%d", len(params))
+		}
+		if user.Attributes != nil {
+			params = append(params, user.attributesParam())
+			updateStmt += fmt.Sprintf(", attributes = $%d", len(params))
+		}
+
+		if _, err := tx.Exec(updateStmt+` WHERE id = $1`, params...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reportRows builds the report of the rows
+func reportRows(rows []ImportRow, dryRun bool) ImportReport {
+	report := ImportReport{DryRun: dryRun, Total: len(rows), Results: make([]ImportResult, len(rows))}
+	for i, row := range rows {
+		result := ImportResult{Row: row.Row, Username: row.User.Username}
+		switch {
+		case row.err != nil:
+			appErr := apperror.From(row.err)
+			result.Status, result.Error, result.Field, result.Errors = IMPORT_FAILED, appErr.Message, appErr.Field,
+				appErr.Fields
+			report.Failed++
+		case row.existingID != 0:
+			result.Status, result.ID = IMPORT_UPDATED, row.existingID
+			report.Updated++
+		default:
+			result.Status, result.ID = IMPORT_CREATED, row.User.ID
+			report.Created++
+		}
+		report.Results[i] = result
+	}
+
+	return report
+}
+
+// ImportUsers creates, or with opts.Upsert updates, the users of the rows in the organization orgID. Each row is
+// validated as a user created through the API is, and checked against the users of the organization and the rows
+// before it. The rows that pass are written together in one transaction, so either all of them are or none are, and
+// the rows that fail are reported. Internal errors and conflicts with users written while the import runs fail the
+// whole import
+// returns the report of every row
+func ImportUsers(ctx context.Context, db *database.PostGresDB, orgID int, rows []ImportRow,
+	opts ImportOptions) (report ImportReport, err error) {
+	ctx, span := tracing.Start(ctx, "ImportUsers", attribute.Int("rows", len(rows)),
+		attribute.Bool("dry_run", opts.DryRun))
+	defer func() { tracing.End(span, err) }()
+
+	if opts.Upsert != "" && opts.Upsert != IMPORT_UPSERT_USERNAME && opts.Upsert != IMPORT_UPSERT_EMAIL {
+		return report, apperror.Invalid("upsert", "Invalid upsert: must be username or email")
+	}
+
+	for i := range rows {
+		rows[i].User.OrgID = orgID
+		rows[i].err = rows[i].prepare(opts)
+	}
+	checkDuplicates(rows)
+
+	if opts.DryRun {
+		err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+			return checkImport(tx, rows, opts)
+		})
+		return reportRows(rows, opts.DryRun), err
+	}
+
+	if !opts.HashedPasswords {
+		if err = hashPasswords(ctx, rows); err != nil {
+			return report, err
+		}
+	}
+
+	err = db.InTenant(ctx, database.OP_BULK, orgID, func(tx *database.Tx) error {
+		if err := checkImport(tx, rows, opts); err != nil {
+			return err
+		}
+
+		var creates, updates []int
+		for _, i := range pending(rows) {
+			if rows[i].existingID != 0 {
+				updates = append(updates, i)
+			} else {
+				creates = append(creates, i)
+			}
+		}
+		if err := createUsers(tx, orgID, rows, creates); err != nil {
+			return err
+		}
+		return updateUsers(tx, rows, updates)
+	})
+	if err != nil && database.DuplicateKeyError(err) {
+		return report, conflict(err)
+	} else if err != nil {
+		return report, err
+	}
+
+	return reportRows(rows, opts.DryRun), nil
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"encoding/base64"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseImportMapping Checks column mappings are read
+func TestParseImportMapping(t *testing.T) {
+	mapping, err := ParseImportMapping("First Name=firstname, E-mail = Email,Notes=-,")
+	if err != nil {
+		t.Fatalf("Mapping expected to pass, failed: %s", err)
+	}
+	expected := map[string]string{"first name": "firstname", "e-mail": "email", "notes": "-"}
+	for column, field := range expected {
+		if mapping[column] != field {
+			t.Errorf("Column %s expected to map onto %s, received %s", column, field, mapping[column])
+		}
+	}
+
+	for _, invalid := range []string{"firstname", "=firstname", "First Name="} {
+		if _, err = ParseImportMapping(invalid); err == nil {
+			t.Errorf("Mapping %q expected to fail, passed", invalid)
+		}
+	}
+}
+
+// TestReadImportCSV Checks users are read from CSV, with their columns mapped
+func TestReadImportCSV(t *testing.T) {
+	data := "\ufeffUsername,Given,LastName,Email,Telephone,Notes,attributes.level\n" +
+		"jdoe1,John,Doe,jdoe@example.com,555-555-5555,ignored,3\n" +
+		"\"asmith1\",\"Anne, Jr\",Smith,asmith@example.com,555-555-5556,,\n" +
+		"short,row\n"
+	mapping := map[string]string{"given": "firstname", "notes": IMPORT_IGNORE}
+	rows, err := ReadImportCSV(strings.NewReader(data), mapping)
+	if err != nil {
+		t.Fatalf("CSV expected to pass, failed: %s", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("CSV expected to have 3 rows, received %d", len(rows))
+	}
+
+	if user := rows[0].User; user.Username != "jdoe1" || user.FirstName != "John" || user.Email != "jdoe@example.com" {
+		t.Errorf("Row 1 read wrongly: %+v", user)
+	}
+	if rows[0].textAttributes["level"] != "3" {
+		t.Errorf("Row 1 expected attribute level 3, received %v", rows[0].textAttributes)
+	}
+	if rows[1].User.FirstName != "Anne, Jr" || rows[1].textAttributes != nil {
+		t.Errorf("Row 2 read wrongly: %+v, attributes %v", rows[1].User, rows[1].textAttributes)
+	}
+	if rows[2].Err == nil || rows[2].Row != 3 {
+		t.Errorf("Row 3 expected to fail for its columns, received %+v", rows[2])
+	}
+
+	invalid := []string{
+		"",
+		"username,nickname\njdoe1,JD\n",
+		"username,Username\njdoe1,jdoe1\n",
+		"username,attributes.dept-name\njdoe1,sales\n",
+		"username,email\n\"jdoe1,jdoe@example.com\n",
+	}
+	for _, data := range invalid {
+		if _, err = ReadImportCSV(strings.NewReader(data), nil); err == nil {
+			t.Errorf("CSV %q expected to fail, passed", data)
+		}
+	}
+}
+
+// TestReadImportNDJSON Checks users are read from JSON Lines, each line that isn't a user failing on its own
+func TestReadImportNDJSON(t *testing.T) {
+	data := `{"username": "jdoe1", "attributes": {"level": 3}}
+
+{"username": 5}
+{"username": "asmith1"
+{"username": "bjones1"}
+`
+	rows, err := ReadImportNDJSON(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("JSON Lines expected to pass, failed: %s", err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("JSON Lines expected to have 4 rows, received %d", len(rows))
+	}
+	if rows[0].Err != nil || rows[0].User.Username != "jdoe1" || rows[0].User.Attributes["level"] != 3.0 {
+		t.Errorf("Row 1 read wrongly: %+v", rows[0])
+	}
+	if rows[1].Err == nil || rows[2].Err == nil {
+		t.Errorf("Rows 2 and 3 expected to fail, received %v and %v", rows[1].Err, rows[2].Err)
+	}
+	if rows[3].Err != nil || rows[3].Row != 4 || rows[3].User.Username != "bjones1" {
+		t.Errorf("Row 4 read wrongly: %+v", rows[3])
+	}
+
+	long := `{"username": "` + strings.Repeat("a", IMPORT_MAX_LINE) + `"}`
+	if _, err = ReadImportNDJSON(strings.NewReader(long)); err == nil {
+		t.Errorf("JSON Lines with a line longer than %d bytes expected to fail, passed", IMPORT_MAX_LINE)
+	}
+}
+
+// importUser returns a user that passes validation
+func importUser(username, email string) UserModel {
+	return UserModel{Username: username, Password: "Password1!", FirstName: "John", LastName: "Doe",
+		Email: email, Telephone: "555-555-5555"}
+}
+
+// TestImportPrepare Checks each row is validated and normalized, with passwords only required of new users
+func TestImportPrepare(t *testing.T) {
+	row := ImportRow{User: importUser("jdoe1", "jdoe@EXAMPLE.com")}
+	if err := row.prepare(ImportOptions{}); err != nil {
+		t.Fatalf("Row expected to pass, failed: %s", err)
+	}
+	if row.User.Email != "jdoe@example.com" || row.User.Telephone != "+15555555555" || !row.hasPassword {
+		t.Errorf("Row expected to be normalized, received %+v", row.User)
+	}
+
+	noPassword := ImportRow{User: importUser("jdoe1", "jdoe@example.com")}
+	noPassword.User.Password = ""
+	if err := noPassword.prepare(ImportOptions{}); err != nil || noPassword.hasPassword {
+		t.Errorf("Row without a password expected to pass until it is known to create a user, failed: %v", err)
+	}
+
+	invalid := []ImportRow{
+		{User: UserModel{ID: 4, Username: "jdoe1"}},
+		{User: importUser("jd", "jdoe@example.com")},
+		{User: importUser("jdoe1", "jdoe")},
+		{User: importUser("jdоe1", "jdoe@example.com")},
+		{User: importUser("jdoe1", "jdoe@example.com"),
+			Err: apperror.Validation("Row has 1 columns, the header has 2")},
+	}
+	weak := ImportRow{User: importUser("jdoe1", "jdoe@example.com")}
+	weak.User.Password = "password"
+	invalid = append(invalid, weak)
+	for _, row := range invalid {
+		if err := row.prepare(ImportOptions{}); err == nil {
+			t.Errorf("Row %+v expected to fail, passed", row.User)
+		}
+	}
+}
+
+// TestImportHashedPasswords Checks bcrypt hashes are taken as they are, or base64 encoded, and anything else fails
+func TestImportHashedPasswords(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("Password1!"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Hashing expected to pass, failed: %s", err)
+	}
+	stored := base64.URLEncoding.EncodeToString(hash)
+
+	for _, given := range []string{string(hash), stored} {
+		row := ImportRow{User: importUser("jdoe1", "jdoe@example.com")}
+		row.User.Password = given
+		if err = row.prepare(ImportOptions{HashedPasswords: true}); err != nil {
+			t.Errorf("Hash %s expected to pass, failed: %s", given, err)
+		} else if row.User.Password != stored {
+			t.Errorf("Hash %s expected to be stored as %s, received %s", given, stored, row.User.Password)
+		}
+	}
+
+	row := ImportRow{User: importUser("jdoe1", "jdoe@example.com")}
+	if err = row.prepare(ImportOptions{HashedPasswords: true}); err == nil {
+		t.Errorf("Plain text password expected to fail as a hash, passed")
+	}
+}
+
+// TestImportDuplicates Checks rows with the username or email of an earlier row fail
+func TestImportDuplicates(t *testing.T) {
+	users := []UserModel{
+		importUser("jdoe1", "jdoe@example.com"),
+		importUser("JDOE1", "other@example.com"),
+		importUser("jdoeI", "another@example.com"),
+		importUser("asmith1", "JDOE@example.com"),
+		importUser("bjones1", "bjones@example.com"),
+	}
+	rows := make([]ImportRow, len(users))
+	for i, user := range users {
+		rows[i] = ImportRow{Row: i + 1, User: user}
+		if err := rows[i].prepare(ImportOptions{}); err != nil {
+			t.Fatalf("Row %d expected to pass, failed: %s", i+1, err)
+		}
+	}
+
+	checkDuplicates(rows)
+	for i, row := range rows {
+		if failed := row.err != nil; failed != (i >= 1 && i <= 3) {
+			t.Errorf("Row %d expected failed %v, received %v", i+1, !failed, row.err)
+		}
+	}
+}
+
+// TestConvertAttributes Checks attribute values read from CSV are converted to the types of their attributes
+func TestConvertAttributes(t *testing.T) {
+	attrs := []AttributeModel{
+		{Name: "department", Type: ATTRIBUTE_TYPE_STRING},
+		{Name: "level", Type: ATTRIBUTE_TYPE_INTEGER},
+		{Name: "contractor", Type: ATTRIBUTE_TYPE_BOOLEAN},
+	}
+	row := ImportRow{textAttributes: map[string]string{"department": "42", "level": "3", "contractor": "true",
+		"missing": "x"}}
+	row.convertAttributes(attrs)
+
+	expected := map[string]interface{}{"department": "42", "level": 3.0, "contractor": true, "missing": "x"}
+	for name, value := range expected {
+		if row.User.Attributes[name] != value {
+			t.Errorf("Attribute %s expected %v, received %v", name, value, row.User.Attributes[name])
+		}
+	}
+
+	bad := ImportRow{textAttributes: map[string]string{"level": "three"}}
+	bad.convertAttributes(attrs)
+	if errs := ValidateAttributes(attrs, bad.User.Attributes); len(errs) != 1 || errs[0].Code != CODE_TYPE {
+		t.Errorf("Attribute level three expected to fail its type, received %+v", errs)
+	}
+}
+
+// TestPasswordsHashedWithin Checks more passwords can be hashed the longer an import has, and none in no time
+func TestPasswordsHashedWithin(t *testing.T) {
+	if n := PasswordsHashedWithin(0); n != 0 {
+		t.Errorf("No passwords expected to be hashed in no time, got %d", n)
+	}
+	if short, long := PasswordsHashedWithin(time.Second), PasswordsHashedWithin(time.Minute); long <= short ||
+		long < 1 {
+		t.Errorf("More passwords expected to be hashed in a minute than a second, got %d and %d", long, short)
+	}
+
+	rows := []ImportRow{{User: UserModel{Password: "Passw0rd!"}}, {}, {User: UserModel{Password: "Passw0rd!"}}}
+	if count := PlainPasswords(rows); count != 2 {
+		t.Errorf("Rows expected to give 2 passwords, got %d", count)
+	}
+}
@@ -0,0 +1,391 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InvitationModel invites someone by email to create their own account in an organization. When accepted, the
+// new user is added to the invitation's groups
+type InvitationModel struct {
+	ID         int        `json:"id"`
+	OrgID      int        `json:"orgid"`
+	Email      string     `json:"email"`
+	GroupIDs   []int      `json:"groupids"`
+	ExpiresAt  time.Time  `json:"expiresat"`
+	CreatedAt  time.Time  `json:"createdat"`
+	AcceptedAt *time.Time `json:"acceptedat,omitempty"`
+	RevokedAt  *time.Time `json:"revokedat,omitempty"`
+	UserID     int        `json:"userid,omitempty"`
+	// Token is the plaintext token, only known when the invitation is issued. Only its hash is stored
+	Token string `json:"-"`
+}
+
+const InvitationSchema string = `
+CREATE TABLE invitations (
+	id SERIAL PRIMARY KEY,
+	org_id INT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	group_ids INT[] NOT NULL DEFAULT '{}',
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	accepted_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ,
+	user_id INT REFERENCES users (id) ON DELETE SET NULL
+);
+-- Only one open invitation per address; an expired one is renewed with resend
+CREATE UNIQUE INDEX invitations_org_id_pending_email_key ON invitations (org_id, lower(email))
+	WHERE accepted_at IS NULL AND revoked_at IS NULL;
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON invitations TO user_service_tenant;
+GRANT USAGE ON SEQUENCE invitations_id_seq TO user_service_tenant;
+
+ALTER TABLE invitations ENABLE ROW LEVEL SECURITY;
+ALTER TABLE invitations FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON invitations
+	USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+`
+
+// ErrInvitationNotFound is returned when a token doesn't match an open invitation
+var ErrInvitationNotFound = apperror.NotFound("invitation not found, already accepted or revoked")
+
+// ErrInvitationExpired is returned when accepting an invitation after it expired
+var ErrInvitationExpired = apperror.Gone("invitation has expired")
+
+// ErrAlreadyMember is returned when inviting an email address that already has an account in the organization
+var ErrAlreadyMember = apperror.Conflict("email", "a user with that email already exists")
+
+const INVITATION_GET_FIELDLIST string = "id, org_id, email, group_ids, expires_at, created_at, accepted_at, " +
+	"revoked_at, user_id"
+
+// newInvitationToken generates a token for an invitation. The token is prefixed with the organization id so the
+// invitation can be found without the accepting request naming an organization
+func newInvitationToken(orgID int) (token, tokenHash string, err error) {
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+
+	token = fmt.Sprintf("%d.%s", orgID, base64.RawURLEncoding.EncodeToString(secret))
+	tokenHash = hashInvitationToken(token)
+
+	return
+}
+
+// hashInvitationToken hashes a token for storage. The tokens are random, so a fast hash is sufficient
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// InvitationTokenOrganization reads the organization id from an invitation token
+func InvitationTokenOrganization(token string) (int, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, ErrInvitationNotFound
+	}
+
+	orgID, err := strconv.Atoi(parts[0])
+	if err != nil || orgID <= 0 {
+		return 0, ErrInvitationNotFound
+	}
+
+	return orgID, nil
+}
+
+// Validate Validates that all fields are included and contain proper values
+// returns the list of validation errors
+func (inv InvitationModel) Validate() (errs []apperror.FieldError) {
+	if inv.Email == "" {
+		errs = append(errs, apperror.FieldError{Field: "email", Message: "Email is not specified!"})
+	} else if !validateEmail(inv.Email) {
+		errs = append(errs, apperror.FieldError{Field: "email", Message: "Invalid Email specified!"})
+	}
+
+	for _, groupID := range inv.GroupIDs {
+		if groupID <= 0 {
+			errs = append(errs, apperror.FieldError{Field: "groupids",
+				Message: fmt.Sprintf("Invalid GroupID %d specified!", groupID)})
+		}
+	}
+
+	return
+}
+
+// groupIDsParam converts the GroupIDs into a postgres array
+func (inv InvitationModel) groupIDsParam() pq.Int64Array {
+	ids := make(pq.Int64Array, len(inv.GroupIDs))
+	for i, id := range inv.GroupIDs {
+		ids[i] = int64(id)
+	}
+	return ids
+}
+
+// Create issues the invitation, valid for ttl. The plaintext token is set on the model
+// returns a conflict error if the address already has an open invitation or belongs to a user
+func (inv *InvitationModel) Create(ctx context.Context, db *database.PostGresDB, ttl time.Duration) error {
+	if inv.ID != 0 {
+		return apperror.Invalid("id", "ID must be null when creating an Invitation")
+	}
+
+	if valErrors := inv.Validate(); len(valErrors) > 0 {
+		return apperror.Validation("InvitationModel failed validation", valErrors...)
+	}
+	// An address at a domain that isn't allowed couldn't be used to accept the invitation
+	email, canonical, err := normalizeEmail(inv.Email)
+	if err != nil {
+		return err
+	}
+	inv.Email = email
+
+	token, tokenHash, err := newInvitationToken(inv.OrgID)
+	if err != nil {
+		return err
+	}
+
+	insertStmt := `INSERT INTO invitations (org_id, email, token_hash, group_ids, expires_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, expires_at, created_at`
+	err = db.InTenant(ctx, database.OP_WRITE, inv.OrgID, func(tx *database.Tx) error {
+		var exists bool
+		existsStmt := `SELECT EXISTS (SELECT 1 FROM users WHERE email_canonical = $1)`
+		if err := tx.QueryRow(existsStmt, canonical).Scan(&exists); err != nil {
+			return err
+		} else if exists {
+			return ErrAlreadyMember
+		}
+
+		// Groups are only checked now; any deleted before the invitation is accepted are skipped
+		var found int
+		groupsStmt := `SELECT count(*) FROM groups WHERE id = ANY($1)`
+		if err := tx.QueryRow(groupsStmt, inv.groupIDsParam()).Scan(&found); err != nil {
+			return err
+		} else if found != len(uniqueInts(inv.GroupIDs)) {
+			return apperror.Invalid("groupids", "One or more groups do not exist").Wrap(database.ErrForeignKey)
+		}
+
+		return tx.QueryRow(insertStmt, inv.OrgID, inv.Email, tokenHash, inv.groupIDsParam(),
+			time.Now().Add(ttl)).Scan(&inv.ID, &inv.ExpiresAt, &inv.CreatedAt)
+	})
+	if err != nil {
+		if database.DuplicateKeyError(err) {
+			return apperror.Conflict("email", "An open invitation for that email already exists, resend it instead").
+				Wrap(database.ErrDuplicateKey)
+		}
+		return err
+	}
+	inv.Token = token
+
+	return nil
+}
+
+// Resend issues a new token for an open invitation and extends it for ttl. The previous token stops working
+// returns a not found error if there is no open invitation with that id
+func (inv *InvitationModel) Resend(ctx context.Context, db *database.PostGresDB, ttl time.Duration) error {
+	token, tokenHash, err := newInvitationToken(inv.OrgID)
+	if err != nil {
+		return err
+	}
+
+	updateStmt := `UPDATE invitations SET token_hash = $2, expires_at = $3
+		WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL RETURNING ` + INVITATION_GET_FIELDLIST
+	err = db.InTenant(ctx, database.OP_WRITE, inv.OrgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(updateStmt, inv.ID, tokenHash, time.Now().Add(ttl))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if !rows.Next() {
+			if err = rows.Err(); err == nil {
+				err = apperror.NotFound("No open Invitation with ID %d found", inv.ID).Wrap(sql.ErrNoRows)
+			}
+			return err
+		}
+		*inv, err = scanInvitation(rows)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	inv.Token = token
+
+	return nil
+}
+
+// RevokeInvitation stops an open invitation from being accepted
+// returns a not found error if there is no open invitation with that id
+func RevokeInvitation(ctx context.Context, db *database.PostGresDB, orgID, id int) error {
+	var res sql.Result
+	err := db.InTenant(ctx, database.OP_WRITE, orgID, func(tx *database.Tx) (err error) {
+		res, err = tx.Exec(`UPDATE invitations SET revoked_at = now()
+			WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL`, id)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	var rows int64
+	rows, _ = res.RowsAffected()
+	if int(rows) == 0 {
+		return apperror.NotFound("No open Invitation with ID %d found", id).Wrap(sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// scanInvitation reads an INVITATION_GET_FIELDLIST row into an InvitationModel
+func scanInvitation(rows *sql.Rows) (inv InvitationModel, err error) {
+	var groupIDs pq.Int64Array
+	var acceptedAt, revokedAt pq.NullTime
+	var userID sql.NullInt64
+	err = rows.Scan(&inv.ID, &inv.OrgID, &inv.Email, &groupIDs, &inv.ExpiresAt, &inv.CreatedAt, &acceptedAt,
+		&revokedAt, &userID)
+	if err != nil {
+		return
+	}
+
+	inv.GroupIDs = make([]int, len(groupIDs))
+	for i, id := range groupIDs {
+		inv.GroupIDs[i] = int(id)
+	}
+	if acceptedAt.Valid {
+		inv.AcceptedAt = &acceptedAt.Time
+	}
+	if revokedAt.Valid {
+		inv.RevokedAt = &revokedAt.Time
+	}
+	inv.UserID = int(userID.Int64)
+
+	return
+}
+
+// GetPendingInvitations fetches the invitations of the organization that have been neither accepted nor revoked,
+// including expired ones that can still be resent. If id is non-zero only that invitation is returned
+func GetPendingInvitations(ctx context.Context, db *database.PostGresDB, orgID, id, limit, offset int) (invs []InvitationModel, err error) {
+	selectStmt := `SELECT ` + INVITATION_GET_FIELDLIST + ` FROM invitations
+		WHERE accepted_at IS NULL AND revoked_at IS NULL AND ($1 = 0 OR id = $1) ORDER BY id LIMIT $2 OFFSET $3`
+
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, id, limit, offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			inv, err := scanInvitation(rows)
+			if err != nil {
+				return err
+			}
+			invs = append(invs, inv)
+		}
+
+		return rows.Err()
+	})
+
+	return
+}
+
+// openInvitation fetches the open invitation the token is for, with lock appended to the query
+// returns ErrInvitationNotFound if there isn't one, or ErrInvitationExpired
+func openInvitation(tx *database.Tx, token, lock string) (inv InvitationModel, err error) {
+	selectStmt := `SELECT ` + INVITATION_GET_FIELDLIST + ` FROM invitations
+		WHERE token_hash = $1 AND accepted_at IS NULL AND revoked_at IS NULL` + lock
+	rows, err := tx.Query(selectStmt, hashInvitationToken(token))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		inv, err = scanInvitation(rows)
+	} else if err = rows.Err(); err == nil {
+		err = ErrInvitationNotFound
+	}
+	if err == nil && time.Now().After(inv.ExpiresAt) {
+		err = ErrInvitationExpired
+	}
+
+	return
+}
+
+// AcceptInvitation creates the invited user from the token and user details, then adds them to the invitation's
+// groups. The user's email is always the address the invitation was sent to. The user is validated and the
+// password policy applied exactly as when creating a user
+func AcceptInvitation(ctx context.Context, db *database.PostGresDB, token string, user *UserModel) (inv InvitationModel, err error) {
+	orgID, err := InvitationTokenOrganization(token)
+	if err != nil {
+		return
+	}
+
+	// The password is hashed before the invitation is locked, so the lock isn't held, nor the write timeout spent,
+	// while hashing. The invitation is looked up again under the lock, in case it was accepted, revoked or resent
+	// in the meantime. Both are read from the primary, which a new invitation has reached
+	err = db.InTenant(ctx, database.OP_READ, orgID, func(tx *database.Tx) (err error) {
+		inv, err = openInvitation(tx, token, "")
+		return
+	})
+	if err != nil {
+		return
+	}
+	user.OrgID = inv.OrgID
+	user.Email = inv.Email
+	if err = user.prepareCreate(ctx); err != nil {
+		return
+	}
+
+	err = db.InTenant(ctx, database.OP_WRITE, orgID, func(tx *database.Tx) error {
+		inv, err = openInvitation(tx, token, " FOR UPDATE")
+		if err != nil {
+			return err
+		}
+		if err = user.insert(tx); err != nil {
+			return err
+		}
+
+		// Groups deleted since the invitation was issued are skipped
+		groupStmt := `INSERT INTO user_groups (org_id, user_id, group_id)
+			SELECT $1, $2, id FROM groups WHERE id = ANY($3)`
+		if _, err = tx.Exec(groupStmt, inv.OrgID, user.ID, inv.groupIDsParam()); err != nil {
+			return err
+		}
+
+		acceptStmt := `UPDATE invitations SET accepted_at = now(), user_id = $2 WHERE id = $1 RETURNING accepted_at`
+		var acceptedAt time.Time
+		if err = tx.QueryRow(acceptStmt, inv.ID, user.ID).Scan(&acceptedAt); err != nil {
+			return err
+		}
+		inv.AcceptedAt = &acceptedAt
+		inv.UserID = user.ID
+
+		return nil
+	})
+
+	return
+}
+
+// uniqueInts returns the distinct values of ids
+func uniqueInts(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	var unique []int
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,34 @@
+package models
+
+import "testing"
+
+// TestInvitationToken Checks that issued tokens carry their organization and hash consistently
+func TestInvitationToken(t *testing.T) {
+	token, tokenHash, err := newInvitationToken(42)
+	if err != nil {
+		t.Fatalf("Caught error while generating token: %s", err)
+	}
+
+	orgID, err := InvitationTokenOrganization(token)
+	if err != nil || orgID != 42 {
+		t.Errorf("Token %s expected to belong to organization 42, got %d (%v)", token, orgID, err)
+	}
+
+	if hashInvitationToken(token) != tokenHash {
+		t.Errorf("Token %s did not hash to the stored hash", token)
+	}
+
+	other, _, _ := newInvitationToken(42)
+	if other == token {
+		t.Errorf("Two tokens generated for the same organization were identical")
+	}
+}
+
+func TestInvitationTokenOrganization(t *testing.T) {
+	//Test tokens that can't name an organization
+	for _, token := range []string{"", "nodot", "abc.secret", "0.secret", "-1.secret", "7."} {
+		if _, err := InvitationTokenOrganization(token); err != ErrInvitationNotFound {
+			t.Errorf("Token |%s| expected to be rejected, got %v", token, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"strings"
+)
+
+// Migrations is the ordered list of schema changes applied at boot. Append new migrations to the end; never
+// edit or reorder one that has shipped
+var Migrations = []database.Migration{
+	{Version: 1, Name: "create users", Statement: UserSchema},
+	{Version: 2, Name: "create groups", Statement: GroupSchema},
+	{Version: 3, Name: "organizations and tenant isolation", Statement: OrganizationSchema},
+	{Version: 4, Name: "create invitations", Statement: InvitationSchema},
+	{Version: 5, Name: "create audit events", Statement: AuditSchema},
+	{Version: 6, Name: "create impersonation sessions", Statement: ImpersonationSchema},
+	{Version: 7, Name: "create api keys", Statement: APIKeySchema},
+	{Version: 8, Name: "international telephone numbers", Statement: PhoneSchema},
+	{Version: 9, Name: "normalized email addresses", Statement: EmailSchema, Apply: migrateEmails},
+	{Version: 10, Name: "case insensitive usernames", Statement: UsernameSchema, Apply: migrateUsernames},
+	{Version: 11, Name: "custom profile attributes", Statement: AttributeSchema},
+	{Version: 12, Name: "create export jobs", Statement: ExportJobSchema},
+	{Version: 13, Name: "create idempotency keys", Statement: IdempotencyKeySchema},
+	{Version: 14, Name: "idempotency key claims", Statement: IdempotencyClaimSchema},
+	{Version: 15, Name: "commit ordered membership changes", Statement: MembershipChangeOrderSchema},
+}
+
+// migratedUser is a column of a user as a migration reads it, and the values the migration writes back
+type migratedUser struct {
+	id    int
+	orgID int
+	value string
+	// canonical is the form of value duplicates or look alikes share
+	canonical string
+}
+
+// readMigratedUsers reads the column of every user, of every organization, ordered by organization and id. Row level
+// security must already be lifted
+func readMigratedUsers(tx *sql.Tx, column string) ([]migratedUser, error) {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT id, org_id, %s FROM users ORDER BY org_id, id`, column))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var users []migratedUser
+	for rows.Next() {
+		var user migratedUser
+		if err = rows.Scan(&user.id, &user.orgID, &user.value); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// findDuplicates groups the users of each organization by key
+// returns a description of each group of more than one user, naming the value and id of each, in the order the
+// users are given
+func findDuplicates(users []migratedUser, key func(migratedUser) string) []string {
+	type group struct {
+		orgID int
+		key   string
+	}
+	groups := make(map[group][]migratedUser)
+	var order []group
+	for _, user := range users {
+		g := group{user.orgID, key(user)}
+		if _, ok := groups[g]; !ok {
+			order = append(order, g)
+		}
+		groups[g] = append(groups[g], user)
+	}
+
+	var duplicates []string
+	for _, g := range order {
+		if len(groups[g]) < 2 {
+			continue
+		}
+		names := make([]string, len(groups[g]))
+		for i, user := range groups[g] {
+			names[i] = fmt.Sprintf("%s (user %d)", user.value, user.id)
+		}
+		duplicates = append(duplicates, fmt.Sprintf("organization %d: %s", g.orgID, strings.Join(names, ", ")))
+	}
+
+	return duplicates
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// usersConnector opens connections to a fake database holding the column a migration reads of each user, as rows
+// of id, org_id and value, and recording the statements the migration executes
+type usersConnector struct {
+	users []driver.Value
+	execs []executed
+}
+
+// executed is a statement executed on the fake database, with its arguments
+type executed struct {
+	query string
+	args  []driver.Value
+}
+
+func (c *usersConnector) Connect(context.Context) (driver.Conn, error) { return &usersConn{c}, nil }
+func (c *usersConnector) Driver() driver.Driver                        { return nil }
+
+// executedLike returns the statements executed containing text
+func (c *usersConnector) executedLike(text string) []executed {
+	var found []executed
+	for _, e := range c.execs {
+		if strings.Contains(e.query, text) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+type usersConn struct {
+	connector *usersConnector
+}
+
+func (c *usersConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *usersConn) Close() error                        { return nil }
+func (c *usersConn) Begin() (driver.Tx, error)           { return c, nil }
+func (c *usersConn) Commit() error                       { return nil }
+func (c *usersConn) Rollback() error                     { return nil }
+
+func (c *usersConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e := executed{query: query}
+	for _, arg := range args {
+		e.args = append(e.args, arg.Value)
+	}
+	c.connector.execs = append(c.connector.execs, e)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *usersConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT id, org_id,") {
+		return nil, errors.New("not supported")
+	}
+	return &usersRows{values: c.connector.users}, nil
+}
+
+// usersRows are the rows of id, org_id and value of a usersConnector
+type usersRows struct {
+	values []driver.Value
+}
+
+func (r *usersRows) Columns() []string { return []string{"id", "org_id", "value"} }
+func (r *usersRows) Close() error      { return nil }
+
+func (r *usersRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[:3])
+	r.values = r.values[3:]
+	return nil
+}
+
+// migrate runs the Apply func of a migration against a fake database holding the users, given as id, org_id and
+// value in turn
+func migrate(t *testing.T, apply func(tx *sql.Tx) error, users ...driver.Value) (*usersConnector, error) {
+	connector := &usersConnector{users: users}
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() { _ = db.Close() })
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Caught error while beginning a transaction: %s", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	return connector, apply(tx)
+}
+
+// TestMigrateEmails Checks the addresses already stored are normalised and given the canonical form ParseEmail
+// gives them, before the addresses are made unique
+func TestMigrateEmails(t *testing.T) {
+	connector, err := migrate(t, migrateEmails,
+		int64(1), int64(1), "Jörg@Bücher.DE",
+		int64(2), int64(1), "bob@bob.win",
+		int64(3), int64(2), "Bob@Bob.WIN",
+		int64(4), int64(1), "not an address@Bob.WIN")
+	if err != nil {
+		t.Fatalf("Emails expected to migrate, failed: %s", err)
+	}
+
+	updates := connector.executedLike("UPDATE users")
+	expected := map[int64][2]string{1: {"Jörg@bücher.de", "jörg@xn--bcher-kva.de"}, 2: {"bob@bob.win", "bob@bob.win"},
+		3: {"Bob@bob.win", "bob@bob.win"}, 4: {"not an address@bob.win", "not an address@bob.win"}}
+	if len(updates) != len(expected) {
+		t.Fatalf("Every user expected to be updated, got %+v", updates)
+	}
+	for _, update := range updates {
+		if e := expected[update.args[0].(int64)]; update.args[1] != e[0] || update.args[2] != e[1] {
+			t.Errorf("User %d expected to be updated to %s, %s, got %v", update.args[0], e[0], e[1], update.args[1:])
+		}
+	}
+	if len(connector.executedLike("CREATE UNIQUE INDEX")) != 1 {
+		t.Errorf("Emails expected to be made unique after being updated")
+	}
+}
+
+// TestMigrateEmailDuplicates Checks addresses already stored that differ only in case, or are the same mailbox, are
+// reported before any index is created
+func TestMigrateEmailDuplicates(t *testing.T) {
+	EMAIL_CANONICALIZE = true
+	defer func() { EMAIL_CANONICALIZE = false }()
+
+	connector, err := migrate(t, migrateEmails,
+		int64(1), int64(1), "Bob@x.com",
+		int64(2), int64(1), "bob@x.com",
+		int64(3), int64(2), "bob@x.com",
+		int64(4), int64(2), "j.doe@gmail.com",
+		int64(5), int64(2), "JDoe+news@googlemail.com")
+	if err == nil {
+		t.Fatalf("Duplicate emails expected to fail the migration, passed")
+	}
+	for _, duplicate := range []string{"organization 1: Bob@x.com (user 1), bob@x.com (user 2)",
+		"organization 2: j.doe@gmail.com (user 4), JDoe+news@googlemail.com (user 5)"} {
+		if !strings.Contains(err.Error(), duplicate) {
+			t.Errorf("Migration expected to report %s, got %s", duplicate, err)
+		}
+	}
+	if len(connector.executedLike("CREATE UNIQUE INDEX")) != 0 || len(connector.executedLike("UPDATE users")) != 0 {
+		t.Errorf("Duplicate emails expected to fail before any user is changed")
+	}
+}
+
+// TestMigrateUsernames Checks the usernames already stored are normalized and given their skeletons before the
+// usernames are made unique
+func TestMigrateUsernames(t *testing.T) {
+	connector, err := migrate(t, migrateUsernames,
+		int64(1), int64(1), "Ｊｏｈｎｎｙ",
+		int64(2), int64(2), "johnny",
+		int64(3), int64(1), "аlice")
+	if err != nil {
+		t.Fatalf("Usernames expected to migrate, failed: %s", err)
+	}
+
+	updates := connector.executedLike("UPDATE users")
+	expected := map[int64][2]string{1: {"Johnny", "johnny"}, 2: {"johnny", "johnny"}, 3: {"аlice", "alice"}}
+	if len(updates) != len(expected) {
+		t.Fatalf("Every user expected to be updated, got %+v", updates)
+	}
+	for _, update := range updates {
+		if e := expected[update.args[0].(int64)]; update.args[1] != e[0] || update.args[2] != e[1] {
+			t.Errorf("User %d expected to be updated to %s, %s, got %v", update.args[0], e[0], e[1], update.args[1:])
+		}
+	}
+	if len(connector.executedLike("CREATE UNIQUE INDEX")) != 1 {
+		t.Errorf("Usernames expected to be made unique after being updated")
+	}
+}
+
+// TestMigrateUsernameDuplicates Checks usernames already stored that differ only in case, once normalized, are
+// reported before the index is created
+func TestMigrateUsernameDuplicates(t *testing.T) {
+	connector, err := migrate(t, migrateUsernames,
+		int64(1), int64(1), "Alice",
+		int64(2), int64(1), "alice",
+		int64(3), int64(2), "alice",
+		int64(4), int64(2), "Ｂob",
+		int64(5), int64(2), "BOB")
+	if err == nil {
+		t.Fatalf("Case variant usernames expected to fail the migration, passed")
+	}
+	for _, duplicate := range []string{"organization 1: Alice (user 1), alice (user 2)",
+		"organization 2: Bob (user 4), BOB (user 5)"} {
+		if !strings.Contains(err.Error(), duplicate) {
+			t.Errorf("Migration expected to report %s, got %s", duplicate, err)
+		}
+	}
+	if len(connector.executedLike("CREATE UNIQUE INDEX")) != 0 || len(connector.executedLike("UPDATE users")) != 0 {
+		t.Errorf("Case variant usernames expected to fail before any user is changed")
+	}
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"regexp"
+	"strings"
+)
+
+// OrganizationModel is a tenant. Every user and group belongs to exactly one organization
+type OrganizationModel struct {
+	ID   int    `json:"id"`
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// DEFAULT_ORGANIZATION is the slug of the organization that users created before multi-tenancy were moved into
+const DEFAULT_ORGANIZATION string = "default"
+
+// OrganizationSchema introduces organizations, moves every existing row into the default organization and
+// isolates tenants with row level security. Queries only see rows belonging to the organization set in the
+// app.org_id setting by database.InTenant, and see nothing when it is unset
+const OrganizationSchema string = `
+CREATE TABLE organizations (
+	id SERIAL PRIMARY KEY,
+	slug TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL
+);
+INSERT INTO organizations (slug, name) VALUES ('default', 'Default Organization');
+
+ALTER TABLE users ADD COLUMN org_id INT REFERENCES organizations (id) ON DELETE CASCADE;
+UPDATE users SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE users ALTER COLUMN org_id SET NOT NULL,
+	DROP CONSTRAINT users_username_key,
+	DROP CONSTRAINT users_email_key,
+	ADD CONSTRAINT users_org_id_username_key UNIQUE (org_id, username),
+	ADD CONSTRAINT users_org_id_email_key UNIQUE (org_id, email);
+
+ALTER TABLE groups ADD COLUMN org_id INT REFERENCES organizations (id) ON DELETE CASCADE;
+UPDATE groups SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE groups ALTER COLUMN org_id SET NOT NULL,
+	DROP CONSTRAINT groups_name_key,
+	ADD CONSTRAINT groups_org_id_name_key UNIQUE (org_id, name);
+
+ALTER TABLE user_groups ADD COLUMN org_id INT;
+UPDATE user_groups SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE user_groups ALTER COLUMN org_id SET NOT NULL;
+
+ALTER TABLE group_membership_changes ADD COLUMN org_id INT;
+UPDATE group_membership_changes SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE group_membership_changes ALTER COLUMN org_id SET NOT NULL;
+
+CREATE OR REPLACE FUNCTION record_membership_change() RETURNS TRIGGER AS $$
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		INSERT INTO group_membership_changes (org_id, group_id, user_id, action)
+			VALUES (NEW.org_id, NEW.group_id, NEW.user_id, 'added');
+	ELSE
+		INSERT INTO group_membership_changes (org_id, group_id, user_id, action)
+			VALUES (OLD.org_id, OLD.group_id, OLD.user_id, 'removed');
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'user_service_tenant') THEN
+		CREATE ROLE user_service_tenant NOLOGIN;
+	END IF;
+END
+$$;
+GRANT user_service_tenant TO CURRENT_USER;
+GRANT SELECT, INSERT, UPDATE, DELETE ON users, groups, user_groups, group_membership_changes TO user_service_tenant;
+GRANT USAGE ON ALL SEQUENCES IN SCHEMA public TO user_service_tenant;
+
+ALTER TABLE users ENABLE ROW LEVEL SECURITY;
+ALTER TABLE users FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON users USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+
+ALTER TABLE groups ENABLE ROW LEVEL SECURITY;
+ALTER TABLE groups FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON groups USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+
+ALTER TABLE user_groups ENABLE ROW LEVEL SECURITY;
+ALTER TABLE user_groups FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON user_groups
+	USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+
+ALTER TABLE group_membership_changes ENABLE ROW LEVEL SECURITY;
+ALTER TABLE group_membership_changes FORCE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON group_membership_changes
+	USING (org_id = NULLIF(current_setting('app.org_id', true), '')::int);
+`
+
+var SLUG_REGEX = regexp.MustCompile("^[a-z0-9][a-z0-9-]{1,62}$")
+
+// validateSlug verifies the slug is usable as a subdomain label and can't be mistaken for a numeric id
+func validateSlug(slug string) bool {
+	if !SLUG_REGEX.MatchString(slug) {
+		return false
+	}
+
+	return strings.Trim(slug, "0123456789") != ""
+}
+
+// Validate Validates that all fields are included and contain proper values
+// returns the list of validation errors
+func (org OrganizationModel) Validate() (errs []apperror.FieldError) {
+	if org.Name == "" {
+		errs = append(errs, apperror.FieldError{Field: "name", Message: "Name is not specified!"})
+	}
+
+	if org.Slug == "" {
+		errs = append(errs, apperror.FieldError{Field: "slug", Message: "Slug is not specified!"})
+	} else if !validateSlug(org.Slug) {
+		errs = append(errs, apperror.FieldError{Field: "slug", Message: "Invalid Slug: must be between 2 and 63 " +
+			"lower case letters, numbers or dashes, not start with a dash, and not be entirely numeric"})
+	}
+
+	return
+}
+
+func (org *OrganizationModel) Create(ctx context.Context, db *database.PostGresDB) error {
+	if org.ID != 0 {
+		return apperror.Invalid("id", "ID must be null when creating an Organization")
+	}
+
+	if valErrors := org.Validate(); len(valErrors) > 0 {
+		return apperror.Validation("OrganizationModel failed validation", valErrors...)
+	}
+
+	insertStmt := `INSERT INTO organizations (slug, name) VALUES($1, $2) RETURNING id`
+	err := db.InTransaction(ctx, database.OP_WRITE, func(tx *database.Tx) error {
+		return tx.QueryRow(insertStmt, org.Slug, org.Name).Scan(&org.ID)
+	})
+	if err != nil {
+		if database.DuplicateKeyError(err) {
+			return conflict(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// GetOrganizations fetches organizations ordered by id
+func GetOrganizations(ctx context.Context, db *database.PostGresDB, limit, offset int) (orgs []OrganizationModel, err error) {
+	err = db.InTransactionReadOnly(ctx, database.OP_LIST, func(tx *database.Tx) error {
+		rows, err := tx.Query(`SELECT id, slug, name FROM organizations ORDER BY id LIMIT $1 OFFSET $2`, limit,
+			offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var org OrganizationModel
+			if err = rows.Scan(&org.ID, &org.Slug, &org.Name); err != nil {
+				return err
+			}
+			orgs = append(orgs, org)
+		}
+		return rows.Err()
+	})
+
+	return
+}
+
+// GetOrganization fetches a single organization by its id or slug
+// returns a not found error, wrapping sql.ErrNoRows, if it does not exist
+func GetOrganization(ctx context.Context, db *database.PostGresDB, field, value string) (org OrganizationModel, err error) {
+	if field != "id" && field != "slug" {
+		err = errors.New(fmt.Sprintf("Unsupported search field |%s|", field))
+		return
+	}
+
+	selectStmt := `SELECT id, slug, name FROM organizations WHERE ` + field + ` = $1`
+	err = db.InTransaction(ctx, database.OP_READ, func(tx *database.Tx) error {
+		return tx.QueryRow(selectStmt, value).Scan(&org.ID, &org.Slug, &org.Name)
+	})
+	if err == sql.ErrNoRows && field == "id" {
+		err = apperror.NotFound("No Organization with ID %s found", value).Wrap(err)
+	} else if err == sql.ErrNoRows {
+		err = apperror.NotFound("No Organization with slug %s found", value).Wrap(err)
+	}
+
+	return
+}
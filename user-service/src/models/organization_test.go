@@ -0,0 +1,41 @@
+package models
+
+import "testing"
+
+func TestValidateSlug(t *testing.T) {
+	//Test a good slug
+	goodSlug := "acme-corp2"
+	if !validateSlug(goodSlug) {
+		t.Errorf("Slug %s expected to pass, failed", goodSlug)
+	}
+
+	//Test a slug too short to be useful
+	shortSlug := "a"
+	if validateSlug(shortSlug) {
+		t.Errorf("Slug %s expected to fail, passed", shortSlug)
+	}
+
+	//Test upper case, which would never match a lower cased host name
+	upperSlug := "AcmeCorp"
+	if validateSlug(upperSlug) {
+		t.Errorf("Slug %s expected to fail, passed", upperSlug)
+	}
+
+	//Test a slug starting with a dash
+	dashSlug := "-acme"
+	if validateSlug(dashSlug) {
+		t.Errorf("Slug %s expected to fail, passed", dashSlug)
+	}
+
+	//Test a numeric slug that would be mistaken for an id
+	numericSlug := "1234"
+	if validateSlug(numericSlug) {
+		t.Errorf("Slug %s expected to fail, passed", numericSlug)
+	}
+
+	//Test a slug with a dot, which would be a second subdomain
+	dotSlug := "acme.corp"
+	if validateSlug(dotSlug) {
+		t.Errorf("Slug %s expected to fail, passed", dotSlug)
+	}
+}
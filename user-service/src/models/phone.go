@@ -0,0 +1,115 @@
+package models
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/nyaruka/phonenumbers"
+	"strings"
+)
+
+// PhoneSchema adds the extension of a telephone number, and moves the US numbers stored before numbers were
+// normalised, (###) ###-####[ x#####], to E.164 with the extension split out. Row level security is lifted while
+// the rows of every organization are moved
+const PhoneSchema string = `
+ALTER TABLE users ADD COLUMN extension TEXT NOT NULL DEFAULT '';
+ALTER TABLE users NO FORCE ROW LEVEL SECURITY;
+UPDATE users SET extension = COALESCE(substring(telephone FROM 'x(\d+)$'), ''),
+	telephone = '+1' || regexp_replace(regexp_replace(telephone, '\s?x\d*$', ''), '\D', '', 'g')
+	WHERE telephone NOT LIKE '+%';
+ALTER TABLE users FORCE ROW LEVEL SECURITY;
+`
+
+// DEFAULT_REGION is the region, as an ISO 3166 code such as US, of telephone numbers given without a country
+// code. It is set from the configuration at boot
+var DEFAULT_REGION = "US"
+
+// The formats a telephone number can be given out in
+const (
+	// PHONE_FORMAT_E164 is the canonical form numbers are stored in, e.g. +12125550123
+	PHONE_FORMAT_E164 string = "e164"
+	// PHONE_FORMAT_NATIONAL is the form dialled within the number's country, e.g. (212) 555-0123. Numbers outside
+	// DEFAULT_REGION are given in PHONE_FORMAT_INTERNATIONAL instead, as they can't be dialled that way here
+	PHONE_FORMAT_NATIONAL string = "national"
+	// PHONE_FORMAT_INTERNATIONAL is the form dialled from another country, e.g. +1 212-555-0123
+	PHONE_FORMAT_INTERNATIONAL string = "international"
+)
+
+// PHONE_FORMAT is the format telephone numbers are given out in when a request doesn't ask for one. It is set from
+// the configuration at boot
+var PHONE_FORMAT = PHONE_FORMAT_NATIONAL
+
+// ValidPhoneFormat checks format is one of the PHONE_FORMAT_ constants
+func ValidPhoneFormat(format string) bool {
+	return format == PHONE_FORMAT_E164 || format == PHONE_FORMAT_NATIONAL || format == PHONE_FORMAT_INTERNATIONAL
+}
+
+// MAX_EXTENSION_LENGTH is the most digits an extension can have
+const MAX_EXTENSION_LENGTH int = 5
+
+// ParseTelephone reads a telephone number in any format, national numbers being in DEFAULT_REGION, e.g.
+// (212) 555-0123 x12, +44 20 7946 0018 or 011 49 30 901820. The number must be possible for its country, judged
+// by the country's numbering metadata
+// returns the number in E.164 and its extension, "" if it has none
+func ParseTelephone(phone string) (e164, extension string, err error) {
+	number, err := phonenumbers.Parse(phone, DEFAULT_REGION)
+	if err != nil {
+		return "", "", err
+	}
+	if !phonenumbers.IsPossibleNumber(number) {
+		return "", "", fmt.Errorf("%s is not a possible telephone number", phone)
+	}
+
+	extension = number.GetExtension()
+	if len(extension) > MAX_EXTENSION_LENGTH {
+		return "", "", fmt.Errorf("extension of %s is longer than %d digits", phone, MAX_EXTENSION_LENGTH)
+	}
+
+	return phonenumbers.Format(number, phonenumbers.E164), extension, nil
+}
+
+// validateTelephone verifies that the Telephone number is a valid phone number
+func validateTelephone(phone string) bool {
+	_, _, err := ParseTelephone(phone)
+	return err == nil
+}
+
+// FormatTelephone formats a number stored in E.164 in one of the PHONE_FORMAT_ constants. A number that can't be
+// read is returned as it is
+func FormatTelephone(e164, format string) string {
+	number, err := phonenumbers.Parse(e164, DEFAULT_REGION)
+	if err != nil || format == PHONE_FORMAT_E164 {
+		return e164
+	}
+
+	// Matched by country code, as regions such as the US and Canada share one
+	if format == PHONE_FORMAT_NATIONAL &&
+		int(number.GetCountryCode()) == phonenumbers.GetCountryCodeForRegion(strings.ToUpper(DEFAULT_REGION)) {
+		return phonenumbers.Format(number, phonenumbers.NATIONAL)
+	}
+	return phonenumbers.Format(number, phonenumbers.INTERNATIONAL)
+}
+
+// normalizeTelephone stores the telephone number of the user in E.164, moving any extension written in the number
+// to the extension field. An extension given in both must agree
+func (user *UserModel) normalizeTelephone() error {
+	e164, extension, err := ParseTelephone(user.Telephone)
+	if err != nil {
+		return apperror.Invalid("telephone", "Invalid Telephone specified! %s", err).Wrap(err)
+	}
+
+	if extension != "" && user.Extension != "" && extension != user.Extension {
+		return apperror.Invalid("extension", "Extension %s does not match the extension of the telephone number, %s",
+			user.Extension, extension)
+	}
+	if extension != "" {
+		user.Extension = extension
+	}
+	user.Telephone = e164
+
+	return nil
+}
+
+// FormatTelephone formats the telephone number of the user in one of the PHONE_FORMAT_ constants
+func (user *UserModel) FormatTelephone(format string) {
+	user.Telephone = FormatTelephone(user.Telephone, format)
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"testing"
+)
+
+// TestParseTelephone Checks numbers in national and international formats are read into E.164, with the extension
+// split out
+func TestParseTelephone(t *testing.T) {
+	for phone, expected := range map[string][2]string{
+		"(212) 555-0123":          {"+12125550123", ""},
+		"212.555.0123 x12":        {"+12125550123", "12"},
+		"+44 20 7946 0018":        {"+442079460018", ""},
+		"011 49 30 901820":        {"+4930901820", ""},
+		"+1 (212) 555-0123;ext=4": {"+12125550123", "4"},
+	} {
+		e164, extension, err := ParseTelephone(phone)
+		if err != nil {
+			t.Errorf("Telephone %s expected to pass, failed: %s", phone, err)
+		} else if e164 != expected[0] || extension != expected[1] {
+			t.Errorf("Telephone %s expected to read as %s x%s, got %s x%s", phone, expected[0], expected[1], e164,
+				extension)
+		}
+	}
+
+	for _, phone := range []string{"12", "+44 20", "(212) 555-0123 x123456", "not a number"} {
+		if _, _, err := ParseTelephone(phone); err == nil {
+			t.Errorf("Telephone %s expected to fail, passed", phone)
+		}
+	}
+}
+
+// TestFormatTelephone Checks numbers are given out in each format, numbers outside DEFAULT_REGION being given
+// internationally in place of nationally
+func TestFormatTelephone(t *testing.T) {
+	for _, test := range []struct{ e164, format, expected string }{
+		{"+12125550123", PHONE_FORMAT_NATIONAL, "(212) 555-0123"},
+		{"+12125550123", PHONE_FORMAT_INTERNATIONAL, "+1 212-555-0123"},
+		{"+12125550123", PHONE_FORMAT_E164, "+12125550123"},
+		{"+442079460018", PHONE_FORMAT_NATIONAL, "+44 20 7946 0018"},
+		{"garbage", PHONE_FORMAT_NATIONAL, "garbage"},
+	} {
+		if formatted := FormatTelephone(test.e164, test.format); formatted != test.expected {
+			t.Errorf("Telephone %s expected to format as %s in %s, got %s", test.e164, test.expected, test.format,
+				formatted)
+		}
+	}
+
+	DEFAULT_REGION = "GB"
+	defer func() { DEFAULT_REGION = "US" }()
+	if formatted := FormatTelephone("+442079460018", PHONE_FORMAT_NATIONAL); formatted != "020 7946 0018" {
+		t.Errorf("Telephone in the default region expected to format nationally, got %s", formatted)
+	}
+}
+
+// TestNormalizeTelephone Checks the extension written in the number is moved to the extension field, and must agree
+// with one already there
+func TestNormalizeTelephone(t *testing.T) {
+	user := UserModel{Telephone: "(212) 555-0123 x12"}
+	if err := user.normalizeTelephone(); err != nil {
+		t.Errorf("Telephone %s expected to pass, failed: %s", user.Telephone, err)
+	} else if user.Telephone != "+12125550123" || user.Extension != "12" {
+		t.Errorf("Telephone expected to normalize to +12125550123 x12, got %s x%s", user.Telephone, user.Extension)
+	}
+
+	user = UserModel{Telephone: "(212) 555-0123 x12", Extension: "34"}
+	if err := user.normalizeTelephone(); err == nil {
+		t.Errorf("Telephone with a different extension expected to fail, passed")
+	}
+}
@@ -1,25 +1,41 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
 	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/metrics"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/validation"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/bcrypt"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type UserModel struct {
 	ID         int    `json:"id"`
+	OrgID      int    `json:"orgid"` // set from the organization the request was resolved to, never from the client
 	Username   string `json:"username"`
 	Password   string `json:"password,omitempty"` //omit on empty so we avoid sending this field to the client
 	FirstName  string `json:"firstname"`
 	MiddleName string `json:"middlename"`
 	LastName   string `json:"lastname"`
 	Email      string `json:"email"`
-	Telephone  string `json:"telephone"`
+	Telephone  string `json:"telephone"` // stored in E.164, and given out in the format the request asks for
+	Extension  string `json:"extension"`
+	// Attributes are the values of the custom attributes the organization has defined, see AttributeModel
+	Attributes map[string]interface{} `json:"attributes"`
+	// canonicalEmail is the canonical form of Email, used to find duplicates. It is set when Email is normalized
+	canonicalEmail string
+	// usernameSkeleton is the form of Username that look alike usernames share. It is set when Username is normalized
+	usernameSkeleton string
 }
 
 const UserSchema string = `
@@ -35,10 +51,17 @@ CREATE TABLE IF NOT EXISTS users (
 );
 `
 
+// BCRYPT_COST is the work factor passwords are hashed with. It is set from the configuration at boot
+var BCRYPT_COST = bcrypt.DefaultCost
+
 // hashPassword safely converts a plaintext password into a salted, hashed, base64 value
-func hashPassword(password string) (string, error) {
+func hashPassword(ctx context.Context, password string) (string, error) {
 	// Hash the password with bcrypt Note: bcrypt autosalts!
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	_, span := tracing.Start(ctx, "bcrypt.hash", attribute.Int("bcrypt.cost", BCRYPT_COST))
+	start := time.Now()
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
+	metrics.ObserveSince(metrics.PasswordHashDuration.WithLabelValues("hash"), start)
+	tracing.End(span, err)
 	if err != nil {
 		return "", err
 	}
@@ -50,69 +73,32 @@ func hashPassword(password string) (string, error) {
 }
 
 // CheckPassword compares the specified plaintext password with the stared hash to see if they match
-func CheckPassword(hashedPassword, password string) bool {
+func CheckPassword(ctx context.Context, hashedPassword, password string) bool {
 	//We store our passwords as base64, so decode this
 	decodedHash, _ := base64.URLEncoding.DecodeString(hashedPassword)
+	_, span := tracing.Start(ctx, "bcrypt.compare")
+	start := time.Now()
 	err := bcrypt.CompareHashAndPassword(
 		decodedHash, []byte(password))
+	metrics.ObserveSince(metrics.PasswordHashDuration.WithLabelValues("compare"), start)
+	span.End()
 	return err == nil
 }
 
-// handlePassword encapsulates all the logic to validate and hash the password
-func (user *UserModel) handlePassword() error {
-	if !ValidatePassword(user.Password) {
-		return errors.New("UserModel failed validation:\n\t- Password must be between 8 and 25 characters, " +
-			"contain upper and lower case, at least one number, and at least one symbol from " + PASS_SPECIAL_CHARS)
-	}
-
+// handlePassword hashes the password, which has already been validated
+func (user *UserModel) handlePassword(ctx context.Context) error {
 	var err error
-	user.Password, err = hashPassword(user.Password)
+	user.Password, err = hashPassword(ctx, user.Password)
 	if err != nil {
-		return errors.New("failed to Encode Password")
+		return apperror.Internal(err)
 	}
 
 	return nil
 }
 
-// validateEmail verifies that the email address is a valid email
-func validateEmail(emailAddress string) bool {
-	// TODO: Improve validation. Currently only tests if it has an @ sign. Email Validation is tricky. Better get a lib
-	emailParts := strings.Split(emailAddress, "@")
-	return len(emailParts) == 2
-}
-
-var US_PHONE_REGEX = regexp.MustCompile("^\\(\\d{3}\\) \\d{3}-\\d{4}(\\s?x\\d{1,5})?$")
-
-//var INT_PHONE_REGEX = regexp.MustCompile("")
-// validateTelephone verifies that the Telephone number is a valid phone number
-func validateTelephone(phone string) bool {
-	// Test US Phone numbers of the form (###) ###-####[x#####]
-	if US_PHONE_REGEX.MatchString(phone) {
-		return true
-	}
-
-	//TODO add support for international numbers
-	//// Test International Phone numbers
-	//if INT_PHONE_REGEX.MatchString(phone) {
-	//	return true
-	//}
-
-	// we didn't match any of our regexs, so this is invalid
-	return false
-}
-
-var USERNAME_REGEX = regexp.MustCompile("[^a-zA-Z0-9]")
-
-// validateUsername verifies that the Username is valid per the standards
+// validateUsername verifies that the Username is valid per the username rule
 func validateUsername(username string) bool {
-	if len(username) >= 5 && len(username) <= 25 {
-		// This regex tests for invalid characters (non alphanumeric)
-		if !USERNAME_REGEX.MatchString(username) {
-			return true
-		}
-	}
-
-	return false
+	return len(UserValidator.Check(map[string]string{"username": username}, "username")) == 0
 }
 
 var PASS_HAS_UPPERCASE = regexp.MustCompile("[A-Z]")
@@ -153,139 +139,395 @@ func ValidatePassword(password string) bool {
 	return true
 }
 
-// validate Validates that all fields are included and container proper values
-// returns the list of validation errors
-// Does not validate the password as this is handled independently
-func (user UserModel) Validate() (errs []string) {
-	if user.FirstName == "" {
-		errs = append(errs, "FirstName is not specified!")
-	}
+// USER_FIELDS are the fields of a user that can have validation rules, in the order their failures are reported
+var USER_FIELDS = []string{"firstname", "middlename", "lastname", "email", "telephone", "extension", "username",
+	"password"}
+
+// USER_RULES are the validation rules built into users. A rules file can override them, see validation.File
+var USER_RULES = map[string]validation.Rule{
+	"firstname": {Required: true},
+	"lastname":  {Required: true},
+	"email":     {Required: true, Format: "email"},
+	"telephone": {Required: true, Format: "telephone"},
+	"extension": {MaxLength: MAX_EXTENSION_LENGTH, Pattern: "[0-9]*"},
+	"username":  {Required: true, MinLength: 5, MaxLength: 25, Pattern: UsernamePattern("")},
+	"password":  {Required: true, Format: "password"},
+}
 
-	if user.LastName == "" {
-		errs = append(errs, "LastName is not specified!")
-	}
+// USER_MESSAGES are the English messages of the failures of USER_RULES
+var USER_MESSAGES = map[string]string{
+	"firstname.required": "FirstName is not specified!",
+	"lastname.required":  "LastName is not specified!",
+	"email.required":     "Email is not specified!",
+	"email.format":       "Invalid Email specified!",
+	"email.domain":       "Email addresses at {domain} are not allowed",
+	"telephone.required": "Telephone is not specified!",
+	"telephone.format": "Invalid Telephone specified! Accepts a national number, or + and the country code then " +
+		"the number, with an optional extension such as x123",
+	"extension.too_long":    "Invalid Extension: must be at most {max} digits",
+	"extension.pattern":     "Invalid Extension: must be only digits",
+	"username.required":     "Username is not specified!",
+	"username.too_short":    "Invalid Username: must be at least {min} characters",
+	"username.too_long":     "Invalid Username: must be at most {max} characters",
+	"username.pattern":      "Invalid Username: must be only letters and digits",
+	"username.format":       "Invalid Username: contains characters that are not allowed",
+	"username.reserved":     "Username {reserved}, or one that looks like it, is reserved",
+	"username.mixed_script": "Invalid Username: must not mix letters of different scripts",
+	"password.required":     "Password is not specified!",
+	"password.format": "Password must be between 8 and 25 characters, contain upper and lower case, at least one " +
+		"number, and at least one symbol from " + PASS_SPECIAL_CHARS,
+}
 
-	if user.Email == "" {
-		errs = append(errs, "Email is not specified!")
-	} else if !validateEmail(user.Email) {
-		errs = append(errs, "Invalid Email specified!")
-	}
+// UserValidator checks users against USER_RULES, as overridden by the rules file
+var UserValidator *validation.Validator
 
-	if user.Telephone == "" {
-		errs = append(errs, "Telephone is not specified!")
-	} else if !validateTelephone(user.Telephone) {
-		errs = append(errs, "Invalid Telephone specified! Accepts (###) ###-####[[ ]x#####]")
-	}
+func init() {
+	validation.RegisterFormat("email", validateEmail)
+	validation.RegisterFormat("telephone", validateTelephone)
+	validation.RegisterFormat("password", ValidatePassword)
+	validation.AddMessages("en", USER_MESSAGES)
+	UserValidator = validation.MustNew(USER_FIELDS, USER_RULES)
+}
+
+// values returns the fields of the user that can have validation rules, keyed by field
+func (user UserModel) values() map[string]string {
+	return map[string]string{"firstname": user.FirstName, "middlename": user.MiddleName, "lastname": user.LastName,
+		"email": user.Email, "telephone": user.Telephone, "extension": user.Extension, "username": user.Username,
+		"password": user.Password}
+}
 
-	if user.Username == "" {
-		errs = append(errs, "Username is not specified!")
-	} else if !validateUsername(user.Username) {
-		errs = append(errs, "Invalid Username: must be between 5 and 25 characters and be only alphanumeric")
+// Validate Validates the named fields, or every field if none are named, against UserValidator
+// returns the list of validation errors
+func (user UserModel) Validate(fields ...string) []apperror.FieldError {
+	return UserValidator.Check(user.values(), fields...)
+}
+
+// validate is Validate, returning the failures as a validation error
+func (user UserModel) validate(fields ...string) error {
+	if valErrors := user.Validate(fields...); len(valErrors) > 0 {
+		return apperror.Validation("UserModel failed validation", valErrors...)
 	}
 
-	return
+	return nil
 }
 
-func (user *UserModel) Create(db *database.PostGresDB) error {
+// prepareCreate validates a new user and hashes its password ahead of inserting it
+func (user *UserModel) prepareCreate(ctx context.Context) error {
 	if user.ID != 0 {
-		return errors.New("ID must be null when creating a User")
+		return apperror.Invalid("id", "ID must be null when creating a User")
 	}
 
-	valErrors := user.Validate()
-	if len(valErrors) > 0 {
-		return errors.New(
-			fmt.Sprintf("UserModel failed validation:\n\t- %s", strings.Join(valErrors, "\n\t- ")))
+	if err := user.validate(); err != nil {
+		return err
+	}
+	if err := user.normalizeUsername(); err != nil {
+		return err
+	}
+	if err := user.normalizeEmail(); err != nil {
+		return err
+	}
+	if err := user.normalizeTelephone(); err != nil {
+		return err
 	}
 
-	err := user.handlePassword()
-	if err != nil {
+	return user.handlePassword(ctx)
+}
+
+// insert writes a prepared user to the database within a tenant transaction
+func (user *UserModel) insert(tx *database.Tx) error {
+	if err := user.checkConfusable(tx); err != nil {
+		return err
+	}
+	if err := user.checkAttributes(tx); err != nil {
 		return err
 	}
 
-	insertStmt := `INSERT INTO users (username, password_hash, firstname, middlename, lastname, email, telephone)
-		VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id`
-	err = db.PgDbSession.QueryRow(insertStmt, user.Username, user.Password, user.FirstName, user.MiddleName,
-		user.LastName, user.Email, user.Telephone).Scan(&user.ID)
+	insertStmt := `INSERT INTO users (org_id, username, username_skeleton, password_hash, firstname, middlename,
+		lastname, email, email_canonical, telephone, extension, attributes)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`
+	err := tx.QueryRow(insertStmt, user.OrgID, user.Username, user.usernameSkeleton, user.Password, user.FirstName,
+		user.MiddleName, user.LastName, user.Email, user.canonicalEmail, user.Telephone, user.Extension,
+		user.attributesParam()).Scan(&user.ID)
+	if err != nil && database.DuplicateKeyError(err) {
+		return conflict(err)
+	}
+
+	return err
+}
+
+func (user *UserModel) Create(ctx context.Context, db *database.PostGresDB) (err error) {
+	ctx, span := tracing.Start(ctx, "UserModel.Create")
+	defer func() { tracing.End(span, err) }()
+
+	err = user.prepareCreate(ctx)
 	if err != nil {
-		if database.DuplicateKeyError(err) {
-			return database.ErrDuplicateKey
-		}
 		return err
 	}
 
-	return nil
+	return db.InTenant(ctx, database.OP_WRITE, user.OrgID, user.insert)
 }
 
-func (user *UserModel) Delete(db *database.PostGresDB) error {
+func (user *UserModel) Delete(ctx context.Context, db *database.PostGresDB) (err error) {
+	ctx, span := tracing.Start(ctx, "UserModel.Delete")
+	defer func() { tracing.End(span, err) }()
+
 	if user.ID == 0 {
-		return sql.ErrNoRows
+		return apperror.NotFound("No User with ID %d found", user.ID).Wrap(sql.ErrNoRows)
 	}
 
-	deleteStmt := `DELETE FROM users WHERE id = $1`
-	res, err := db.PgDbSession.Exec(deleteStmt, user.ID)
+	return db.InTenant(ctx, database.OP_WRITE, user.OrgID, user.remove)
+}
+
+// remove deletes the user within a tenant transaction
+func (user *UserModel) remove(tx *database.Tx) error {
+	res, err := tx.Exec(`DELETE FROM users WHERE id = $1`, user.ID)
 	if err != nil {
 		return err
 	}
 
 	var rows int64
 	rows, _ = res.RowsAffected()
-	// If we didnt delete anything, return the no rows error to tell the controller to 404
+	// If we didnt delete anything, the user does not exist
 	if int(rows) == 0 {
-		return sql.ErrNoRows
+		return apperror.NotFound("No User with ID %d found", user.ID).Wrap(sql.ErrNoRows)
 	}
 
 	return nil
 }
 
-func (user *UserModel) Update(db *database.PostGresDB) error {
+func (user *UserModel) Update(ctx context.Context, db *database.PostGresDB) (err error) {
+	ctx, span := tracing.Start(ctx, "UserModel.Update")
+	defer func() { tracing.End(span, err) }()
+
+	write, err := user.prepareUpdate(ctx)
+	if err != nil {
+		return err
+	}
+
+	return db.InTenant(ctx, database.OP_WRITE, user.OrgID, write)
+}
+
+// prepareUpdate validates the user and hashes its password ahead of updating it
+// returns the update, to run within a tenant transaction
+func (user *UserModel) prepareUpdate(ctx context.Context) (func(tx *database.Tx) error, error) {
 	if user.ID == 0 {
-		return sql.ErrNoRows
+		return nil, apperror.NotFound("No User with ID %d found", user.ID).Wrap(sql.ErrNoRows)
 	}
 
-	valErrors := user.Validate()
-	if len(valErrors) > 0 {
-		return errors.New(
-			fmt.Sprintf("UserModel failed validation:\n\t- %s", strings.Join(valErrors, "\n\t- ")))
+	// A blank password isn't being updated, so it isn't validated either
+	var fields []string
+	for _, field := range USER_FIELDS {
+		if field != "password" || user.Password != "" {
+			fields = append(fields, field)
+		}
+	}
+	if err := user.validate(fields...); err != nil {
+		return nil, err
+	}
+	if err := user.normalizeUsername(); err != nil {
+		return nil, err
+	}
+	if err := user.normalizeEmail(); err != nil {
+		return nil, err
+	}
+	if err := user.normalizeTelephone(); err != nil {
+		return nil, err
 	}
 
-	updateStmt := `UPDATE users SET username = $2, firstname = $3, middlename = $4, lastname = $5, email = $6, telephone = $7`
+	updateStmt := `UPDATE users SET username = $2, firstname = $3, middlename = $4, lastname = $5, email = $6,
+		telephone = $7, extension = $8, email_canonical = $9, username_skeleton = $10`
+	params := []interface{}{user.ID, user.Username, user.FirstName, user.MiddleName, user.LastName, user.Email,
+		user.Telephone, user.Extension, user.canonicalEmail, user.usernameSkeleton}
 
 	// If the password is blank, the user isn't updating it at this time
 	if user.Password != "" {
-		err := user.handlePassword()
-		if err != nil {
-			return errors.New("Bad Password: " + user.Password + ":: " + err.Error())
+		if err := user.handlePassword(ctx); err != nil {
+			return nil, err
 		}
-		updateStmt += `, password_hash = $8`
+		params = append(params, user.Password)
+		updateStmt += fmt.Sprintf(", password_hash = $%d", len(params))
 	}
 
-	updateStmt += ` WHERE id = $1`
-	var res sql.Result
-	var err error
-	if user.Password != "" {
-		res, err = db.PgDbSession.Exec(updateStmt, user.ID, user.Username, user.FirstName, user.MiddleName,
-			user.LastName, user.Email, user.Telephone, user.Password)
-	} else {
-		res, err = db.PgDbSession.Exec(updateStmt, user.ID, user.Username, user.FirstName, user.MiddleName,
-			user.LastName, user.Email, user.Telephone)
+	// Without attributes, the user keeps those it has
+	keepAttributes := user.Attributes == nil
+	if !keepAttributes {
+		params = append(params, nil)
+		updateStmt += fmt.Sprintf(", attributes = $%d", len(params))
 	}
+
+	updateStmt += ` WHERE id = $1 RETURNING attributes`
+	return func(tx *database.Tx) error {
+		if err := user.checkConfusable(tx); err != nil {
+			return err
+		}
+		if !keepAttributes {
+			if err := user.checkAttributes(tx); err != nil {
+				return err
+			}
+			params[len(params)-1] = user.attributesParam()
+		}
+
+		var attributes []byte
+		err := tx.QueryRow(updateStmt, params...).Scan(&attributes)
+		if err == sql.ErrNoRows {
+			// If we didnt update anything, the user does not exist
+			return apperror.NotFound("No User with ID %d found", user.ID).Wrap(err)
+		} else if err != nil {
+			if database.DuplicateKeyError(err) {
+				return conflict(err)
+			}
+			return err
+		}
+
+		return json.Unmarshal(attributes, &user.Attributes)
+	}, nil
+}
+
+// Patch updates only the named fields of the user to their values in user, then reads the rest of the user back.
+// Only the named fields are validated, so a user that no longer passes a rule that has since changed can still be
+// patched
+func (user *UserModel) Patch(ctx context.Context, db *database.PostGresDB, fields []string) (err error) {
+	ctx, span := tracing.Start(ctx, "UserModel.Patch")
+	defer func() { tracing.End(span, err) }()
+
+	write, err := user.preparePatch(ctx, fields)
 	if err != nil {
 		return err
 	}
 
-	var rows int64
-	rows, _ = res.RowsAffected()
-	// If we didnt update anything, return the no rows error to tell the controller to 404
-	if int(rows) == 0 {
-		return sql.ErrNoRows
+	return db.InTenant(ctx, database.OP_WRITE, user.OrgID, write)
+}
+
+// preparePatch validates the named fields of the user, and hashes its password if it is one, ahead of patching them
+// returns the patch, to run within a tenant transaction
+func (user *UserModel) preparePatch(ctx context.Context, fields []string) (func(tx *database.Tx) error, error) {
+	if user.ID == 0 {
+		return nil, apperror.NotFound("No User with ID %d found", user.ID).Wrap(sql.ErrNoRows)
+	}
+	if len(fields) == 0 {
+		return nil, apperror.Validation("No fields given to patch")
 	}
 
-	return nil
+	values := user.values()
+	patching := make(map[string]bool)
+	var checked []string
+	for _, field := range fields {
+		if _, ok := values[field]; !ok && field != "attributes" {
+			return nil, apperror.Invalid(field, "%s can not be patched", field)
+		}
+		patching[field] = true
+		// The attributes are checked once merged into those the user has
+		if field != "attributes" {
+			checked = append(checked, field)
+		}
+	}
+	if len(checked) > 0 {
+		if err := user.validate(checked...); err != nil {
+			return nil, err
+		}
+	}
+	if patching["username"] {
+		if err := user.normalizeUsername(); err != nil {
+			return nil, err
+		}
+		values = user.values()
+	}
+	if patching["email"] {
+		if err := user.normalizeEmail(); err != nil {
+			return nil, err
+		}
+		values = user.values()
+	}
+	// The telephone number may carry an extension, so patching it sets the extension as well
+	if patching["telephone"] {
+		if err := user.normalizeTelephone(); err != nil {
+			return nil, err
+		}
+		values = user.values()
+		if !patching["extension"] {
+			fields = append(fields, "extension")
+		}
+	}
+
+	params := []interface{}{user.ID}
+	var sets []string
+	for _, field := range fields {
+		if field == "attributes" {
+			continue
+		}
+		column := field
+		if field == "password" {
+			if err := user.handlePassword(ctx); err != nil {
+				return nil, err
+			}
+			column, values[field] = "password_hash", user.Password
+		}
+		params = append(params, values[field])
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(params)))
+	}
+	if patching["username"] {
+		params = append(params, user.usernameSkeleton)
+		sets = append(sets, fmt.Sprintf("username_skeleton = $%d", len(params)))
+	}
+	if patching["email"] {
+		params = append(params, user.canonicalEmail)
+		sets = append(sets, fmt.Sprintf("email_canonical = $%d", len(params)))
+	}
+	if patching["attributes"] {
+		// Set once the attributes are merged
+		params = append(params, nil)
+		sets = append(sets, fmt.Sprintf("attributes = $%d", len(params)))
+	}
+
+	updateStmt := `UPDATE users SET ` + strings.Join(sets, ", ") + ` WHERE id = $1 RETURNING ` + USER_GET_FIELDLIST
+	return func(tx *database.Tx) error {
+		if patching["username"] {
+			if err := user.checkConfusable(tx); err != nil {
+				return err
+			}
+		}
+		if patching["attributes"] {
+			if err := user.mergeAttributes(tx); err != nil {
+				return err
+			}
+			params[len(params)-1] = user.attributesParam()
+		}
+		patched, err := scanUser(tx.QueryRow(updateStmt, params...))
+		if err == sql.ErrNoRows {
+			return apperror.NotFound("No User with ID %d found", user.ID).Wrap(err)
+		} else if err != nil && database.DuplicateKeyError(err) {
+			return conflict(err)
+		} else if err == nil {
+			*user = patched
+		}
+		return err
+	}, nil
 }
 
-const USER_GET_FIELDLIST string = "id, username, firstname, middlename, lastname, email, telephone"
+const USER_GET_FIELDLIST string = "id, org_id, username, firstname, middlename, lastname, email, telephone, " +
+	"extension, attributes"
+
+// scanner is a row that can be scanned, *sql.Row or *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a USER_GET_FIELDLIST row into a UserModel
+func scanUser(row scanner) (user UserModel, err error) {
+	var attributes []byte
+	err = row.Scan(&user.ID, &user.OrgID, &user.Username, &user.FirstName, &user.MiddleName, &user.LastName,
+		&user.Email, &user.Telephone, &user.Extension, &attributes)
+	if err == nil {
+		err = json.Unmarshal(attributes, &user.Attributes)
+	}
+	return
+}
+
+// GetUsers fetches users of the organization orgID, optionally searching on a single field
+func GetUsers(ctx context.Context, db *database.PostGresDB, orgID int, field, value string, limit, offset int) (users []UserModel, err error) {
+	ctx, span := tracing.Start(ctx, "GetUsers", attribute.String("field", field))
+	defer func() { tracing.End(span, err) }()
 
-func GetUsers(db *database.PostGresDB, field, value string, limit, offset int) (users []UserModel, err error) {
 	var params []interface{}
 
 	selectStmt := `SELECT ` + USER_GET_FIELDLIST + ` FROM users`
@@ -294,9 +536,29 @@ func GetUsers(db *database.PostGresDB, field, value string, limit, offset int) (
 		err = errors.New(fmt.Sprintf("Unsupported search field |%s|", field))
 		return
 	}
+	if field == "telephone" {
+		// Numbers are stored in E.164, so one given in any format is found
+		if value, _, err = ParseTelephone(value); err != nil {
+			return nil, apperror.Invalid("telephone", "Invalid Telephone specified! %s", err).Wrap(err)
+		}
+	}
+	if field == "username" {
+		value = lookupUsername(value)
+	}
+	if field == "email" {
+		// Addresses are stored normalized, but one that can't be read is searched for as it is
+		if email, _, parseErr := ParseEmail(value); parseErr == nil {
+			value = email
+		}
+	}
 	if field != "all" {
 		params = append(params, value)
-		selectStmt += " WHERE " + field + " = $1 "
+		if field == "email" || field == "username" {
+			// Addresses and usernames are unique regardless of case
+			selectStmt += " WHERE lower(" + field + ") = lower($1) "
+		} else {
+			selectStmt += " WHERE " + field + " = $1 "
+		}
 		if offset > 0 {
 			selectStmt += " LIMIT $2"
 			params = append(params, limit)
@@ -316,35 +578,46 @@ func GetUsers(db *database.PostGresDB, field, value string, limit, offset int) (
 		}
 	}
 
-	var rows *sql.Rows
-	rows, err = db.PgDbSession.Query(selectStmt, params...)
-	if err != nil {
-		return
-	}
-
-	for rows.Next() {
-		var user UserModel
-		err = rows.Scan(&user.ID, &user.Username, &user.FirstName, &user.MiddleName, &user.LastName, &user.Email,
-			&user.Telephone)
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		rows, err := tx.Query(selectStmt, params...)
 		if err != nil {
-			return
+			return err
 		}
-		users = append(users, user)
-	}
+		defer rows.Close()
+
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+
+		return rows.Err()
+	})
 
 	return
 }
 
-// GetPassword fetchs the password hash for the user from the Database
-func GetUserCredentials(db *database.PostGresDB, username string) (hashedPassword string, err error) {
-	selectStmt := `SELECT password_hash FROM users WHERE username = $1`
-	row := db.PgDbSession.QueryRow(selectStmt, username)
-	if row == nil {
-		err = sql.ErrNoRows
-		return
-	}
+// GetUserCredentials fetchs the id and password hash for the user of the organization orgID from the Database
+func GetUserCredentials(ctx context.Context, db *database.PostGresDB, orgID int, username string) (userID int, hashedPassword string, err error) {
+	ctx, span := tracing.Start(ctx, "GetUserCredentials")
+	defer func() { tracing.End(span, err) }()
+
+	// Usernames are unique regardless of case
+	selectStmt := `SELECT id, password_hash FROM users WHERE lower(username) = lower($1)`
+	err = db.InTenant(ctx, database.OP_READ, orgID, func(tx *database.Tx) error {
+		return tx.QueryRow(selectStmt, lookupUsername(username)).Scan(&userID, &hashedPassword)
+	})
+
+	return
+}
 
-	err = row.Scan(&hashedPassword)
+// CountUsers returns the number of users in the organization orgID
+func CountUsers(ctx context.Context, db *database.PostGresDB, orgID int) (count int, err error) {
+	err = db.InTenantReadOnly(ctx, database.OP_LIST, orgID, func(tx *database.Tx) error {
+		return tx.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	})
 
 	return
 }
@@ -1,20 +1,23 @@
 package models
 
-import "testing"
+import (
+	"context"
+	"testing"
+)
 
 // TestUserPassword Checks both the hashPassword function and the CheckPassword function.
 func TestUserPassword(t *testing.T) {
 	password := "SuperSecure123@#Pass"
-	hash, err := hashPassword(password)
+	hash, err := hashPassword(context.Background(), password)
 	if err != nil {
 		t.Errorf("Caught error while hasing password |%s|: %s", password, err)
 	}
 
-	if !CheckPassword(hash, password) {
+	if !CheckPassword(context.Background(), hash, password) {
 		t.Errorf("Password |%s| did not hash and then check successfully", password)
 	}
 
-	if CheckPassword(hash, "Imnotetheoriginsla") {
+	if CheckPassword(context.Background(), hash, "Imnotetheoriginsla") {
 		t.Errorf("Incorrect password validated against the hash!!")
 	}
 }
@@ -164,3 +167,26 @@ func TestValidatePassword(t *testing.T) {
 		t.Errorf("Password %s expected to fail, passed", illegalPass)
 	}
 }
+
+// TestUserValidate Checks each field failing validation is reported with its code, and only the named fields are
+// checked when some are
+func TestUserValidate(t *testing.T) {
+	user := UserModel{Username: "bob", FirstName: "Bob", LastName: "Bobson", Email: "bob.bob.win",
+		Telephone: "(555) 555-5555"}
+	errs := user.Validate()
+	codes := make(map[string]string)
+	for _, err := range errs {
+		codes[err.Field] = err.Code
+	}
+	if len(errs) != 3 || codes["email"] != "format" || codes["username"] != "too_short" ||
+		codes["password"] != "required" {
+		t.Errorf("User expected to fail validation on email, username and password, got %+v", errs)
+	}
+	if errs[1].Message != "Invalid Username: must be at least 5 characters" || errs[1].Params["min"] != 5 {
+		t.Errorf("Username failure expected to give the minimum length, got %+v", errs[1])
+	}
+
+	if errs = user.Validate("firstname", "telephone"); len(errs) != 0 {
+		t.Errorf("Named fields expected to pass, failed: %+v", errs)
+	}
+}
@@ -0,0 +1,238 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/validation"
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+// UsernameSchema adds the skeleton of each username, used to find usernames that look alike. The usernames already
+// stored are normalized, given their skeletons and made unique within an organization regardless of case by
+// migrateUsernames
+const UsernameSchema string = `
+ALTER TABLE users DROP CONSTRAINT users_org_id_username_key;
+ALTER TABLE users ADD COLUMN username_skeleton TEXT NOT NULL DEFAULT '';
+CREATE INDEX users_org_id_username_skeleton_idx ON users (org_id, username_skeleton);
+`
+
+// migrateUsernames normalizes the usernames stored before usernames were normalized and sets their skeletons, then
+// makes them unique within an organization regardless of case. A username that can't be normalized is kept as it
+// is. Row level security is lifted while the rows of every organization are changed
+// returns an error listing the users of each organization whose usernames differ only in case once normalized,
+// before the index is created, as all but one of each must be renamed first
+func migrateUsernames(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE users NO FORCE ROW LEVEL SECURITY`); err != nil {
+		return err
+	}
+
+	users, err := readMigratedUsers(tx, "username")
+	if err != nil {
+		return err
+	}
+	for i, user := range users {
+		users[i].value = lookupUsername(user.value)
+		users[i].canonical = usernameSkeleton(users[i].value)
+	}
+
+	// Folded the way the unique index is
+	duplicates := findDuplicates(users, func(user migratedUser) string { return strings.ToLower(user.value) })
+	if len(duplicates) > 0 {
+		return fmt.Errorf("users have usernames that differ only in case; rename all but one of each first: %s",
+			strings.Join(duplicates, "; "))
+	}
+
+	for _, user := range users {
+		updateStmt := `UPDATE users SET username = $2, username_skeleton = $3 WHERE id = $1`
+		if _, err = tx.Exec(updateStmt, user.id, user.value, user.canonical); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX users_org_id_username_key ON users (org_id, lower(username));
+		ALTER TABLE users FORCE ROW LEVEL SECURITY;
+	`)
+	return err
+}
+
+// USERNAME_LETTER matches a letter or digit of a username, along with the marks combined with it
+const USERNAME_LETTER string = `(?:[\p{L}\p{N}]\p{M}*)`
+
+// UsernamePattern builds the pattern of usernames: letters and digits of any script, and the punctuation, which
+// can only be between them, and not twice in a row
+func UsernamePattern(punctuation string) string {
+	if punctuation == "" {
+		return USERNAME_LETTER + "*"
+	}
+
+	var class strings.Builder
+	for _, r := range punctuation {
+		class.WriteString(`\` + string(r))
+	}
+	return fmt.Sprintf(`(?:%s+(?:[%s]%s+)*)?`, USERNAME_LETTER, class.String(), USERNAME_LETTER)
+}
+
+// AllowUsernamePunctuation lets usernames contain the punctuation, such as ._-, by replacing the pattern of the
+// username rule
+// returns an error if anything but ASCII punctuation is given
+func AllowUsernamePunctuation(punctuation string) error {
+	for _, r := range punctuation {
+		if r > unicode.MaxASCII || !unicode.IsPunct(r) && !unicode.IsSymbol(r) {
+			return fmt.Errorf("%q is not ASCII punctuation", r)
+		}
+	}
+
+	rule, _ := UserValidator.Rule("username")
+	rule.Pattern = UsernamePattern(punctuation)
+	return UserValidator.Override(map[string]validation.Rule{"username": rule})
+}
+
+// USERNAME_RESERVED are the usernames no one can take, nor any that looks like one. It is set from the
+// configuration at boot
+var USERNAME_RESERVED []string
+
+// The codes of the failures of usernames the username rule can't describe
+const (
+	// CODE_RESERVED is a username that is, or looks like, one of USERNAME_RESERVED
+	CODE_RESERVED string = "reserved"
+	// CODE_MIXED_SCRIPT is a username with letters of more than one script, e.g. Latin and Cyrillic
+	CODE_MIXED_SCRIPT string = "mixed_script"
+)
+
+// CONFUSABLES maps letters onto the Latin letters or digits they can't be told apart from. It is the part of the
+// Unicode confusables, https://www.unicode.org/reports/tr39/, that letters of usernames most often borrow from
+var CONFUSABLES = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y',
+	'х': 'x', 'ѕ': 's', 'і': 'i', 'ј': 'j', 'ԁ': 'd', 'һ': 'h', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l', 'ү': 'y',
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O', 'Р': 'P', 'С': 'C', 'Т': 'T', 'Х': 'X',
+	'Ѕ': 'S', 'І': 'l', 'Ј': 'J', 'Ӏ': 'l',
+	// Greek
+	'α': 'a', 'ο': 'o', 'ρ': 'p', 'ν': 'v', 'ι': 'i', 'κ': 'k', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+	'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'l', 'Κ': 'K', 'Μ': 'M', 'Ν': 'N', 'Ο': 'O', 'Ρ': 'P',
+	'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+	// Latin and digits
+	'ɡ': 'g', 'ɑ': 'a', 'ı': 'i', 'I': 'l', '1': 'l', '|': 'l', '0': 'O',
+}
+
+// normalizeUsername applies NFKC, then the PRECIS UsernameCasePreserved profile, RFC 8265, to the username, so the
+// same username is always written the same way
+func normalizeUsername(username string) (string, error) {
+	return precis.UsernameCasePreserved.String(norm.NFKC.String(username))
+}
+
+// usernameSkeleton is the form of the username that looks alike usernames share: each letter that can be confused
+// with another is replaced by it, then the username is case folded
+func usernameSkeleton(username string) string {
+	mapped := []rune(norm.NFKC.String(username))
+	for i, r := range mapped {
+		if to, ok := CONFUSABLES[r]; ok {
+			mapped[i] = to
+		}
+	}
+
+	skeleton, err := precis.UsernameCaseMapped.String(string(mapped))
+	if err != nil {
+		return strings.ToLower(string(mapped))
+	}
+	return skeleton
+}
+
+// lookupUsername normalizes a username being searched for, as usernames are stored normalized. One that can't be
+// normalized is searched for as it is
+func lookupUsername(username string) string {
+	if normalized, err := normalizeUsername(username); err == nil {
+		return normalized
+	}
+	return username
+}
+
+// SameUsername reports whether the usernames are the same, regardless of case
+func SameUsername(a, b string) bool {
+	return precis.UsernameCaseMapped.Compare(norm.NFKC.String(a), norm.NFKC.String(b))
+}
+
+// scriptOf returns the script of a letter, treating the scripts written together in Chinese, Japanese and Korean as
+// one. Digits, marks and punctuation, which are common to or inherit the script of their neighbours, have none
+func scriptOf(r rune) string {
+	if unicode.In(r, unicode.Common, unicode.Inherited) {
+		return ""
+	}
+	if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Bopomofo) {
+		return "Han"
+	}
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// mixedScript reports whether the username has letters of more than one script
+func mixedScript(username string) bool {
+	script := ""
+	for _, r := range username {
+		if s := scriptOf(r); s != "" && script != "" && s != script {
+			return true
+		} else if s != "" {
+			script = s
+		}
+	}
+
+	return false
+}
+
+// normalizeUsername writes the username of the user the way it is stored, and sets its skeleton
+// returns a validation error if the username can't be normalized, is mixed script or looks like a reserved one
+func (user *UserModel) normalizeUsername() error {
+	username, err := normalizeUsername(user.Username)
+	if err != nil {
+		return fieldFailure("UserModel failed validation", "username", validation.CODE_FORMAT,
+			map[string]interface{}{"format": "username"})
+	}
+	if mixedScript(username) {
+		return fieldFailure("UserModel failed validation", "username", CODE_MIXED_SCRIPT, nil)
+	}
+
+	skeleton := usernameSkeleton(username)
+	for _, reserved := range USERNAME_RESERVED {
+		if skeleton == usernameSkeleton(reserved) {
+			return fieldFailure("UserModel failed validation", "username", CODE_RESERVED,
+				map[string]interface{}{"reserved": reserved})
+		}
+	}
+
+	user.Username, user.usernameSkeleton = username, skeleton
+	return nil
+}
+
+// checkConfusable checks no other user of the organization has a username that looks like the user's. A user whose
+// username already had the same skeleton, having been taken before looking alike was checked, keeps it
+// returns a conflict error on username if one does
+func (user *UserModel) checkConfusable(tx *database.Tx) error {
+	// Held until the transaction ends, so two users can't take look alike usernames at once
+	lockStmt := `SELECT pg_advisory_xact_lock(hashtext($1))`
+	if _, err := tx.Exec(lockStmt, fmt.Sprintf("username:%d:%s", user.OrgID, user.usernameSkeleton)); err != nil {
+		return err
+	}
+
+	var confusable bool
+	existsStmt := `SELECT EXISTS (SELECT 1 FROM users WHERE username_skeleton = $1 AND id <> $2)
+		AND NOT EXISTS (SELECT 1 FROM users WHERE id = $2 AND username_skeleton = $1)`
+	if err := tx.QueryRow(existsStmt, user.usernameSkeleton, user.ID).Scan(&confusable); err != nil {
+		return err
+	} else if confusable {
+		return apperror.Conflict("username", "Username looks too like the username of another user").
+			Wrap(database.ErrDuplicateKey)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/validation"
+	"testing"
+)
+
+// TestNormalizeUsername Checks usernames are written the same way however they are typed, keeping their case
+func TestNormalizeUsername(t *testing.T) {
+	for username, expected := range map[string]string{
+		"Johnny005": "Johnny005",
+		"Ｊｏｈｎｎｙ":    "Johnny",
+		"ﬁona":      "fiona",
+		"Zoë":       "Zoë",
+	} {
+		if normalized, err := normalizeUsername(username); err != nil {
+			t.Errorf("Username %s expected to pass, failed: %s", username, err)
+		} else if normalized != expected {
+			t.Errorf("Username %s expected to normalize to %s, got %s", username, expected, normalized)
+		}
+	}
+
+	if !SameUsername("Johnny", "jOHNNY") || !SameUsername("Ｊｏｈｎｎｙ", "johnny") || SameUsername("johnny", "johnnie") {
+		t.Errorf("Usernames expected to be compared regardless of case and width")
+	}
+}
+
+// TestUsernamePattern Checks the allowed punctuation can only be between letters and digits
+func TestUsernamePattern(t *testing.T) {
+	validator := validation.MustNew([]string{"username"},
+		map[string]validation.Rule{"username": {Pattern: UsernamePattern("._-")}})
+	for _, username := range []string{"johnny", "john.doe", "john_doe-2", "Jürgen", "ユーザー", "नमस्ते"} {
+		if errs := validator.Check(map[string]string{"username": username}); len(errs) > 0 {
+			t.Errorf("Username %s expected to pass, failed: %+v", username, errs)
+		}
+	}
+	for _, username := range []string{".john", "john.", "john..doe", "john+doe", "john doe"} {
+		if errs := validator.Check(map[string]string{"username": username}); len(errs) == 0 {
+			t.Errorf("Username %s expected to fail, passed", username)
+		}
+	}
+}
+
+// TestUsernameSkeleton Checks usernames that look alike share a skeleton, and others don't
+func TestUsernameSkeleton(t *testing.T) {
+	for _, lookalike := range []string{"Alice", "аlice", "AIice", "a1ice", "ａｌｉｃｅ"} {
+		if usernameSkeleton(lookalike) != usernameSkeleton("alice") {
+			t.Errorf("Username %s expected to look like alice", lookalike)
+		}
+	}
+	if usernameSkeleton("alicia") == usernameSkeleton("alice") {
+		t.Errorf("Username alicia expected not to look like alice")
+	}
+}
+
+// TestUsernameNormalizeFailures Checks mixed script and reserved usernames fail with their codes
+func TestUsernameNormalizeFailures(t *testing.T) {
+	USERNAME_RESERVED = []string{"admin", "root"}
+	defer func() { USERNAME_RESERVED = nil }()
+
+	for username, code := range map[string]string{
+		"pаypal": CODE_MIXED_SCRIPT,
+		"Admin":  CODE_RESERVED,
+		"аdmin":  CODE_MIXED_SCRIPT,
+		"R00T":   CODE_RESERVED,
+	} {
+		user := UserModel{Username: username}
+		err := user.normalizeUsername()
+		if appErr := apperror.From(err); err == nil || len(appErr.Fields) != 1 || appErr.Fields[0].Code != code {
+			t.Errorf("Username %s expected to fail with %s, got %v", username, code, err)
+		}
+	}
+
+	user := UserModel{Username: "Ｊｏｈｎｎｙ"}
+	if err := user.normalizeUsername(); err != nil {
+		t.Errorf("Username %s expected to pass, failed: %s", user.Username, err)
+	} else if user.Username != "Johnny" || user.usernameSkeleton != "johnny" {
+		t.Errorf("Username expected to normalize to Johnny, johnny, got %s, %s", user.Username, user.usernameSkeleton)
+	}
+}
@@ -0,0 +1,371 @@
+// Package parquet writes Apache Parquet files, https://parquet.apache.org/docs/file-format/, of flat tables. Only
+// what exporting needs is supported: required and optional columns of the primitive types, PLAIN encoded into one
+// gzip compressed data page per column of each row group
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Type is the physical type of a column
+type Type int32
+
+// The physical types, as numbered by the format
+const (
+	TYPE_BOOLEAN    Type = 0
+	TYPE_INT64      Type = 2
+	TYPE_DOUBLE     Type = 5
+	TYPE_BYTE_ARRAY Type = 6
+)
+
+// Converted is how the values of a column are to be read, beyond their physical type
+type Converted int
+
+const (
+	CONVERTED_NONE Converted = iota
+	// CONVERTED_UTF8 is a BYTE_ARRAY of UTF-8 text
+	CONVERTED_UTF8
+	// CONVERTED_JSON is a BYTE_ARRAY of a JSON document
+	CONVERTED_JSON
+)
+
+// convertedTypes are the numbers the format gives the converted types
+var convertedTypes = map[Converted]int32{CONVERTED_UTF8: 0, CONVERTED_JSON: 19}
+
+// The other enums of the format used in the metadata written
+const (
+	REPETITION_REQUIRED int32 = 0
+	REPETITION_OPTIONAL int32 = 1
+	ENCODING_PLAIN      int32 = 0
+	ENCODING_RLE        int32 = 3
+	CODEC_GZIP          int32 = 2
+	PAGE_DATA           int32 = 0
+)
+
+// MAGIC begins and ends every Parquet file
+const MAGIC string = "PAR1"
+
+// CREATED_BY names the writer of the files in their metadata
+const CREATED_BY string = "user-service"
+
+// DEFAULT_ROW_GROUP_SIZE is the number of rows kept in memory before they are written out as a row group
+const DEFAULT_ROW_GROUP_SIZE int = 10000
+
+// Column is a column of the table
+type Column struct {
+	Name      string
+	Type      Type
+	Converted Converted
+	// Optional columns can have null values
+	Optional bool
+}
+
+// columnChunk is a column of the row group being buffered
+type columnChunk struct {
+	values bytes.Buffer
+	// defined is whether each value of an optional column is set
+	defined []bool
+	// bits and nbits are the booleans not yet packed into a whole byte of values
+	bits, nbits byte
+}
+
+// chunkMeta is where a column of a row group was written
+type chunkMeta struct {
+	offset, uncompressed, compressed int64
+}
+
+// rowGroup is a row group that has been written
+type rowGroup struct {
+	rows   int64
+	chunks []chunkMeta
+}
+
+// Writer writes a Parquet file to an io.Writer. Rows are buffered, then written a row group at a time, so memory
+// is bounded by RowGroupSize however many rows there are. Close writes the footer, without which the file can't
+// be read
+type Writer struct {
+	// RowGroupSize is the number of rows in each row group
+	RowGroupSize int
+
+	w         io.Writer
+	columns   []Column
+	chunks    []columnChunk
+	rows      int
+	offset    int64
+	rowGroups []rowGroup
+	err       error
+}
+
+// NewWriter returns a Writer of a table of the columns to w
+func NewWriter(w io.Writer, columns []Column) *Writer {
+	return &Writer{RowGroupSize: DEFAULT_ROW_GROUP_SIZE, w: w, columns: columns,
+		chunks: make([]columnChunk, len(columns))}
+}
+
+// write writes to the underlying writer, keeping track of the offset and the first error
+func (pw *Writer) write(data []byte) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if pw.offset == 0 {
+		if _, pw.err = io.WriteString(pw.w, MAGIC); pw.err != nil {
+			return pw.err
+		}
+		pw.offset = int64(len(MAGIC))
+	}
+
+	n, err := pw.w.Write(data)
+	pw.offset += int64(n)
+	pw.err = err
+	return err
+}
+
+// Write adds a row, a value for each column: an int64 or int for INT64, a float64 for DOUBLE, a bool for BOOLEAN,
+// or a string or []byte for BYTE_ARRAY. Optional columns can be nil
+// returns an error if a value isn't of the type of its column
+func (pw *Writer) Write(row []interface{}) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if len(row) != len(pw.columns) {
+		return fmt.Errorf("parquet: row has %d values, the table has %d columns", len(row), len(pw.columns))
+	}
+	for i, column := range pw.columns {
+		if err := pw.chunks[i].check(column, row[i]); err != nil {
+			return err
+		}
+	}
+
+	for i, column := range pw.columns {
+		pw.chunks[i].add(column, row[i])
+	}
+	pw.rows++
+	if pw.rows >= pw.RowGroupSize {
+		return pw.flush()
+	}
+	return nil
+}
+
+// check checks the value can be added to the column
+func (chunk *columnChunk) check(column Column, value interface{}) error {
+	ok := false
+	switch value.(type) {
+	case nil:
+		ok = column.Optional
+	case int, int64:
+		ok = column.Type == TYPE_INT64
+	case float64:
+		ok = column.Type == TYPE_DOUBLE
+	case bool:
+		ok = column.Type == TYPE_BOOLEAN
+	case string, []byte:
+		ok = column.Type == TYPE_BYTE_ARRAY
+	}
+	if !ok {
+		return fmt.Errorf("parquet: %v (%T) can't be a value of column %s", value, value, column.Name)
+	}
+	return nil
+}
+
+// add appends a checked value to the column, PLAIN encoded
+func (chunk *columnChunk) add(column Column, value interface{}) {
+	if column.Optional {
+		chunk.defined = append(chunk.defined, value != nil)
+	}
+
+	var b [8]byte
+	switch v := value.(type) {
+	case int:
+		binary.LittleEndian.PutUint64(b[:], uint64(v))
+		chunk.values.Write(b[:])
+	case int64:
+		binary.LittleEndian.PutUint64(b[:], uint64(v))
+		chunk.values.Write(b[:])
+	case float64:
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		chunk.values.Write(b[:])
+	case bool:
+		// Booleans are packed 8 to a byte, the first in the least significant bit
+		if v {
+			chunk.bits |= 1 << chunk.nbits
+		}
+		if chunk.nbits++; chunk.nbits == 8 {
+			chunk.values.WriteByte(chunk.bits)
+			chunk.bits, chunk.nbits = 0, 0
+		}
+	case string:
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+		chunk.values.Write(b[:4])
+		chunk.values.WriteString(v)
+	case []byte:
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+		chunk.values.Write(b[:4])
+		chunk.values.Write(v)
+	}
+}
+
+// levels encodes the definition levels of an optional column, bit width 1, as a single bit packed run of the
+// RLE/bit packing hybrid, preceded by its length
+func levels(defined []bool) []byte {
+	groups := (len(defined) + 7) / 8
+	var run bytes.Buffer
+	var header [binary.MaxVarintLen64]byte
+	run.Write(header[:binary.PutUvarint(header[:], uint64(groups)<<1|1)])
+	packed := make([]byte, groups)
+	for i, d := range defined {
+		if d {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	run.Write(packed)
+
+	encoded := make([]byte, 4, 4+run.Len())
+	binary.LittleEndian.PutUint32(encoded, uint32(run.Len()))
+	return append(encoded, run.Bytes()...)
+}
+
+// flush writes the buffered rows as a row group, a page for each column
+func (pw *Writer) flush() error {
+	if pw.rows == 0 {
+		return pw.err
+	}
+
+	group := rowGroup{rows: int64(pw.rows)}
+	for i, column := range pw.columns {
+		chunk := &pw.chunks[i]
+		if chunk.nbits > 0 {
+			chunk.values.WriteByte(chunk.bits)
+		}
+		var data []byte
+		if column.Optional {
+			data = levels(chunk.defined)
+		}
+		data = append(data, chunk.values.Bytes()...)
+
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		_, _ = gz.Write(data)
+		_ = gz.Close()
+
+		var header compactWriter
+		header.beginStruct()
+		header.i32(1, PAGE_DATA)
+		header.i32(2, int32(len(data)))
+		header.i32(3, int32(compressed.Len()))
+		header.structField(5)
+		header.i32(1, int32(pw.rows))
+		header.i32(2, ENCODING_PLAIN)
+		header.i32(3, ENCODING_RLE)
+		header.i32(4, ENCODING_RLE)
+		header.endStruct()
+		header.endStruct()
+
+		meta := chunkMeta{offset: pw.offset, uncompressed: int64(header.buf.Len() + len(data)),
+			compressed: int64(header.buf.Len() + compressed.Len())}
+		if meta.offset == 0 {
+			meta.offset = int64(len(MAGIC))
+		}
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(compressed.Bytes()); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, meta)
+
+		*chunk = columnChunk{}
+	}
+
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.rows = 0
+	return nil
+}
+
+// footer encodes the metadata of the file
+func (pw *Writer) footer() []byte {
+	var rows int64
+	for _, group := range pw.rowGroups {
+		rows += group.rows
+	}
+
+	var meta compactWriter
+	meta.beginStruct()
+	meta.i32(1, 1)
+	meta.list(2, COMPACT_STRUCT, len(pw.columns)+1)
+	meta.beginStruct()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(pw.columns)))
+	meta.endStruct()
+	for _, column := range pw.columns {
+		meta.beginStruct()
+		meta.i32(1, int32(column.Type))
+		repetition := REPETITION_REQUIRED
+		if column.Optional {
+			repetition = REPETITION_OPTIONAL
+		}
+		meta.i32(3, repetition)
+		meta.binary(4, column.Name)
+		if converted, ok := convertedTypes[column.Converted]; ok {
+			meta.i32(6, converted)
+		}
+		meta.endStruct()
+	}
+	meta.i64(3, rows)
+
+	meta.list(4, COMPACT_STRUCT, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		meta.beginStruct()
+		meta.list(1, COMPACT_STRUCT, len(group.chunks))
+		var size int64
+		for i, chunk := range group.chunks {
+			size += chunk.uncompressed
+			meta.beginStruct()
+			meta.i64(2, chunk.offset)
+			meta.structField(3)
+			meta.i32(1, int32(pw.columns[i].Type))
+			meta.i32List(2, []int32{ENCODING_PLAIN, ENCODING_RLE})
+			meta.binaryList(3, []string{pw.columns[i].Name})
+			meta.i32(4, CODEC_GZIP)
+			meta.i64(5, group.rows)
+			meta.i64(6, chunk.uncompressed)
+			meta.i64(7, chunk.compressed)
+			meta.i64(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.i64(2, size)
+		meta.i64(3, group.rows)
+		meta.endStruct()
+	}
+	meta.binary(6, CREATED_BY)
+	meta.endStruct()
+
+	return meta.buf.Bytes()
+}
+
+// ErrClosed is returned for rows written after the Writer is closed
+var ErrClosed = errors.New("parquet: writer is closed")
+
+// Close writes the buffered rows and the footer. It doesn't close the underlying writer
+func (pw *Writer) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	footer := pw.footer()
+	tail := make([]byte, 4, 4+len(MAGIC))
+	binary.LittleEndian.PutUint32(tail, uint32(len(footer)))
+	tail = append(tail, MAGIC...)
+	if err := pw.write(append(footer, tail...)); err != nil {
+		return err
+	}
+
+	pw.err = ErrClosed
+	return nil
+}
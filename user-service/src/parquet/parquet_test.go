@@ -0,0 +1,179 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+// compactReader reads Thrift compact structs into maps of field id to value, enough to check what Writer writes
+type compactReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *compactReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *compactReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *compactReader) value(valueType byte) interface{} {
+	switch valueType {
+	case COMPACT_I32, COMPACT_I64:
+		return r.varint()
+	case COMPACT_BINARY:
+		n := int(r.uvarint())
+		r.pos += n
+		return string(r.data[r.pos-n : r.pos])
+	case COMPACT_LIST:
+		header := r.data[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case COMPACT_STRUCT:
+		fields := make(map[int16]interface{})
+		var id int16
+		for {
+			header := r.data[r.pos]
+			r.pos++
+			if header == 0 {
+				return fields
+			}
+			if delta := int16(header >> 4); delta != 0 {
+				id += delta
+			} else {
+				id = int16(r.varint())
+			}
+			fields[id] = r.value(header & 0x0f)
+		}
+	}
+	panic(fmt.Sprintf("unexpected type %d", valueType))
+}
+
+// field follows the path of field ids through nested structs
+func field(s interface{}, path ...int16) interface{} {
+	for _, id := range path {
+		s = s.(map[int16]interface{})[id]
+	}
+	return s
+}
+
+// TestWriter Checks the footer describes the table and its row groups, and the pages hold the values
+func TestWriter(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: TYPE_INT64},
+		{Name: "name", Type: TYPE_BYTE_ARRAY, Converted: CONVERTED_UTF8, Optional: true},
+		{Name: "score", Type: TYPE_DOUBLE, Optional: true},
+		{Name: "active", Type: TYPE_BOOLEAN, Optional: true},
+	}
+	var file bytes.Buffer
+	writer := NewWriter(&file, columns)
+	writer.RowGroupSize = 2
+	rows := [][]interface{}{{1, "jdoe", 1.5, true}, {int64(2), nil, nil, false}, {3, []byte("asmith"), 3.0, nil}}
+	for _, row := range rows {
+		if err := writer.Write(row); err != nil {
+			t.Fatalf("Row %v expected to be written, failed: %s", row, err)
+		}
+	}
+	if err := writer.Write([]interface{}{nil, "x", 1.0, true}); err == nil {
+		t.Errorf("Row with a null of a required column expected to fail, passed")
+	}
+	if err := writer.Write([]interface{}{4, 5, 1.0, true}); err == nil {
+		t.Errorf("Row with a value of the wrong type expected to fail, passed")
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close expected to pass, failed: %s", err)
+	}
+	if err := writer.Write(rows[0]); err != ErrClosed {
+		t.Errorf("Row written after closing expected to fail with ErrClosed, received %v", err)
+	}
+
+	data := file.Bytes()
+	if string(data[:4]) != MAGIC || string(data[len(data)-4:]) != MAGIC {
+		t.Fatalf("File expected to begin and end with %s", MAGIC)
+	}
+	length := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := compactReader{data: data[len(data)-8-length : len(data)-8]}
+	meta := footer.value(COMPACT_STRUCT)
+	if footer.pos != length {
+		t.Errorf("Footer expected to be %d bytes, read %d", length, footer.pos)
+	}
+
+	if rows := field(meta, 3); rows != int64(3) {
+		t.Errorf("File expected to have 3 rows, has %v", rows)
+	}
+	schema := field(meta, 2).([]interface{})
+	if len(schema) != 5 || field(schema[0], 5) != int64(4) || field(schema[2], 4) != "name" ||
+		field(schema[2], 3) != int64(REPETITION_OPTIONAL) || field(schema[2], 6) != int64(0) ||
+		field(schema[1], 3) != int64(REPETITION_REQUIRED) {
+		t.Errorf("Schema not as expected: %v", schema)
+	}
+	groups := field(meta, 4).([]interface{})
+	if len(groups) != 2 || field(groups[0], 3) != int64(2) || field(groups[1], 3) != int64(1) {
+		t.Fatalf("File expected to have row groups of 2 and 1 rows, has %v", groups)
+	}
+
+	// page reads the header and values of a column of a row group
+	page := func(group, column int) (map[int16]interface{}, []byte) {
+		chunk := field(groups[group], 1).([]interface{})[column]
+		offset := int(field(chunk, 3, 9).(int64))
+		reader := compactReader{data: data, pos: offset}
+		header := reader.value(COMPACT_STRUCT).(map[int16]interface{})
+		compressed := data[reader.pos : reader.pos+int(header[3].(int64))]
+		gz, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("Page expected to be gzip, failed: %s", err)
+		}
+		values, _ := ioutil.ReadAll(gz)
+		if len(values) != int(header[2].(int64)) {
+			t.Errorf("Page expected to be %d bytes uncompressed, is %d", header[2], len(values))
+		}
+		return header, values
+	}
+
+	header, values := page(0, 0)
+	if field(header, 5, 1) != int64(2) || binary.LittleEndian.Uint64(values[8:]) != 2 {
+		t.Errorf("Page of ids not as expected: %v %v", header, values)
+	}
+	// 4 byte length, run header of one group of 8, then the bits of the levels, then the values
+	_, values = page(0, 1)
+	if !bytes.Equal(values, []byte{2, 0, 0, 0, 3, 1, 4, 0, 0, 0, 'j', 'd', 'o', 'e'}) {
+		t.Errorf("Page of names not as expected: %v", values)
+	}
+	_, values = page(0, 3)
+	if !bytes.Equal(values, []byte{2, 0, 0, 0, 3, 3, 1}) {
+		t.Errorf("Page of booleans not as expected: %v", values)
+	}
+	_, values = page(1, 2)
+	if math.Float64frombits(binary.LittleEndian.Uint64(values[6:])) != 3.0 {
+		t.Errorf("Page of scores not as expected: %v", values)
+	}
+}
+
+// TestWriterEmpty Checks a table without rows is still a file
+func TestWriterEmpty(t *testing.T) {
+	var file bytes.Buffer
+	if err := NewWriter(&file, []Column{{Name: "id", Type: TYPE_INT64}}).Close(); err != nil {
+		t.Fatalf("Close expected to pass, failed: %s", err)
+	}
+	if data := file.Bytes(); string(data[:4]) != MAGIC || string(data[len(data)-4:]) != MAGIC {
+		t.Errorf("File expected to begin and end with %s: %v", MAGIC, data)
+	}
+}
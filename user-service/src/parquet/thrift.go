@@ -0,0 +1,106 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The types of the Thrift compact protocol that the metadata of Parquet files is written in, see
+// https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+const (
+	COMPACT_I32    byte = 5
+	COMPACT_I64    byte = 6
+	COMPACT_BINARY byte = 8
+	COMPACT_LIST   byte = 9
+	COMPACT_STRUCT byte = 12
+)
+
+// compactWriter writes Thrift structs with the compact protocol. Fields are written in the order of their ids,
+// each struct begun with beginStruct and ended with endStruct
+type compactWriter struct {
+	buf bytes.Buffer
+	// lastField is the id of the last field written of each struct being written, innermost last
+	lastField []int16
+}
+
+func (c *compactWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	c.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+// varint writes a signed integer zigzag encoded, so small negative numbers are short too
+func (c *compactWriter) varint(v int64) {
+	c.uvarint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+// field writes the header of a field of the current struct, its id as a delta from the last when it can be
+func (c *compactWriter) field(id int16, fieldType byte) {
+	last := &c.lastField[len(c.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		c.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		c.buf.WriteByte(fieldType)
+		c.varint(int64(id))
+	}
+	*last = id
+}
+
+func (c *compactWriter) i32(id int16, v int32) {
+	c.field(id, COMPACT_I32)
+	c.varint(int64(v))
+}
+
+func (c *compactWriter) i64(id int16, v int64) {
+	c.field(id, COMPACT_I64)
+	c.varint(v)
+}
+
+func (c *compactWriter) binary(id int16, v string) {
+	c.field(id, COMPACT_BINARY)
+	c.uvarint(uint64(len(v)))
+	c.buf.WriteString(v)
+}
+
+// list writes the header of a list field of size elements of elemType, which the caller then writes
+func (c *compactWriter) list(id int16, elemType byte, size int) {
+	c.field(id, COMPACT_LIST)
+	if size < 15 {
+		c.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		c.buf.WriteByte(0xf0 | elemType)
+		c.uvarint(uint64(size))
+	}
+}
+
+// i32List writes a list field of integers
+func (c *compactWriter) i32List(id int16, values []int32) {
+	c.list(id, COMPACT_I32, len(values))
+	for _, v := range values {
+		c.varint(int64(v))
+	}
+}
+
+// binaryList writes a list field of strings
+func (c *compactWriter) binaryList(id int16, values []string) {
+	c.list(id, COMPACT_BINARY, len(values))
+	for _, v := range values {
+		c.uvarint(uint64(len(v)))
+		c.buf.WriteString(v)
+	}
+}
+
+// structField begins a struct field. A struct that is an element of a list is begun with beginStruct alone
+func (c *compactWriter) structField(id int16) {
+	c.field(id, COMPACT_STRUCT)
+	c.beginStruct()
+}
+
+func (c *compactWriter) beginStruct() {
+	c.lastField = append(c.lastField, 0)
+}
+
+// endStruct writes the stop field ending the current struct
+func (c *compactWriter) endStruct() {
+	c.buf.WriteByte(0)
+	c.lastField = c.lastField[:len(c.lastField)-1]
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/export"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ExportKey is the key the file of an export job is stored under in the blob store
+func ExportKey(job models.ExportJobModel, format export.Format) string {
+	return fmt.Sprintf("exports/%d/%d%s", job.OrgID, job.ID, format.Extension)
+}
+
+// StartExport runs the export of the pending job in the background. The users are written to a temporary file, which
+// is then uploaded to the blob store, so the export never holds more than a batch of users in memory. The job is
+// kept for export.ttl once it finishes, whether it is done or failed
+// returns false if the service is shutting down, in which case the job is left to be failed by the cleanup
+func (s *UserService) StartExport(job models.ExportJobModel, e *export.Export) bool {
+	return s.Task(fmt.Sprintf("export-%d", job.ID), func(ctx context.Context) {
+		logger := s.Logger.With(logging.Fields{"org_id": job.OrgID, "export_id": job.ID})
+		if err := job.Start(ctx, s.Dbh); err != nil {
+			logger.Error("Unable to start export", logging.Fields{"error": err})
+			return
+		}
+
+		start := time.Now()
+		rows, key, err := s.runExport(ctx, job, e)
+		failure := ""
+		if err != nil {
+			failure = apperror.From(err).Message
+			if errors.Is(err, context.DeadlineExceeded) {
+				failure = "export timed out"
+			} else if errors.Is(err, context.Canceled) {
+				failure = "export was interrupted"
+			}
+			logger.Error("Export failed", logging.Fields{"rows": rows, "error": err})
+		} else {
+			logger.Info("Export finished", logging.Fields{"rows": rows, "format": e.Format.Name,
+				"duration": time.Since(start).String()})
+		}
+
+		// ctx is canceled when shutting down, which mustn't stop the outcome being recorded
+		if err = job.Finish(database.Detach(ctx), s.Dbh, rows, key, failure, s.Config.Export.TTL); err != nil {
+			logger.Error("Unable to record the end of the export", logging.Fields{"error": err})
+		}
+	})
+}
+
+// runExport writes the export to a temporary file and uploads it
+// returns the number of users exported and the key of the file
+func (s *UserService) runExport(ctx context.Context, job models.ExportJobModel, e *export.Export) (int, string,
+	error) {
+	file, err := ioutil.TempFile("", "export-*"+e.Format.Extension)
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	rows, err := e.Run(ctx, file)
+	if err != nil {
+		return rows, "", err
+	}
+
+	key := ExportKey(job, e.Format)
+	if err = s.Blobs.Upload(ctx, key, file, e.Format.ContentType); err != nil {
+		return rows, "", err
+	}
+	return rows, key, nil
+}
+
+// cleanExports is a worker that deletes expired export jobs, and their files, each export.cleanup_interval. Jobs
+// still unfinished well after database.bulk_timeout, the longest an export can run, are failed, as the instance
+// running them must have stopped
+func (s *UserService) cleanExports(ctx context.Context, heartbeat func()) {
+	ticker := time.NewTicker(s.Config.Export.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.expireExports(ctx); err != nil {
+			s.Logger.Error("Unable to clean up exports", logging.Fields{"error": err})
+		}
+		heartbeat()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireExports expires the export jobs of every organization
+func (s *UserService) expireExports(ctx context.Context) error {
+	const pageSize = 100
+	// A job is failed once it has run longer than an export can, plus time to upload the file
+	stale := 2 * s.Config.Database.BulkTimeout
+	for offset := 0; ; offset += pageSize {
+		orgs, err := models.GetOrganizations(ctx, s.Dbh, pageSize, offset)
+		if err != nil {
+			return err
+		}
+
+		for _, org := range orgs {
+			if ctx.Err() != nil {
+				return nil
+			}
+			keys, err := models.ExpireExportJobs(ctx, s.Dbh, org.ID, stale)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err = s.Blobs.Delete(ctx, key); err != nil {
+					s.Logger.Warn("Unable to delete the file of an expired export", logging.Fields{"key": key,
+						"error": err})
+				}
+			}
+		}
+		if len(orgs) < pageSize {
+			return nil
+		}
+	}
+}
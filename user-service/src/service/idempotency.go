@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"time"
+)
+
+// cleanIdempotencyKeys is a worker that deletes expired idempotency keys, and the responses kept with them, each
+// idempotency.cleanup_interval
+func (s *UserService) cleanIdempotencyKeys(ctx context.Context, heartbeat func()) {
+	ticker := time.NewTicker(s.Config.Idempotency.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.expireIdempotencyKeys(ctx); err != nil {
+			s.Logger.Error("Unable to clean up idempotency keys", logging.Fields{"error": err})
+		}
+		heartbeat()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireIdempotencyKeys expires the idempotency keys of every organization
+func (s *UserService) expireIdempotencyKeys(ctx context.Context) error {
+	const pageSize = 100
+	for offset := 0; ; offset += pageSize {
+		orgs, err := models.GetOrganizations(ctx, s.Dbh, pageSize, offset)
+		if err != nil {
+			return err
+		}
+
+		for _, org := range orgs {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if _, err = models.ExpireIdempotencyKeys(ctx, s.Dbh, org.ID); err != nil {
+				return err
+			}
+		}
+		if len(orgs) < pageSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WORKER_WEDGED_INTERVALS is how many heartbeat intervals a worker can miss before it is reported as wedged
+const WORKER_WEDGED_INTERVALS = 3
+
+// workerState is the last known state of a background worker
+type workerState struct {
+	name      string
+	interval  time.Duration
+	heartbeat time.Time
+	stopped   bool
+}
+
+// workers tracks the background workers of the service so shutting down can stop them and wait for them
+type workers struct {
+	mutex  sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	states []*workerState
+}
+
+// WorkerStatus describes a background worker for the readiness check
+type WorkerStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Go runs the worker in the background until the service shuts down. The worker must return promptly once ctx is
+// done. A worker given an interval must call heartbeat at least that often, or it is reported as wedged once it
+// misses WORKER_WEDGED_INTERVALS of them. Workers started after shutting down began are not run
+func (s *UserService) Go(name string, interval time.Duration, worker func(ctx context.Context, heartbeat func())) {
+	s.workers.mutex.Lock()
+	defer s.workers.mutex.Unlock()
+	if s.workers.ctx == nil {
+		s.workers.ctx, s.workers.cancel = context.WithCancel(context.Background())
+	}
+	if s.workers.ctx.Err() != nil {
+		s.Logger.Warn("Not starting worker while shutting down", logging.Fields{"worker": name})
+		return
+	}
+
+	state := &workerState{name: name, interval: interval, heartbeat: time.Now()}
+	s.workers.states = append(s.workers.states, state)
+	heartbeat := func() {
+		s.workers.mutex.Lock()
+		state.heartbeat = time.Now()
+		s.workers.mutex.Unlock()
+	}
+
+	s.workers.wg.Add(1)
+	go func() {
+		defer s.workers.wg.Done()
+		worker(s.workers.ctx, heartbeat)
+		s.workers.mutex.Lock()
+		state.stopped = true
+		s.workers.mutex.Unlock()
+		s.Logger.Info("Worker stopped", logging.Fields{"worker": name})
+	}()
+}
+
+// Task runs fn once in the background, such as an export job. Like a worker, it is cancelled when the service shuts
+// down and waited for, but as it is meant to finish it isn't reported by Workers
+// returns false, without running fn, once shutting down has begun
+func (s *UserService) Task(name string, fn func(ctx context.Context)) bool {
+	s.workers.mutex.Lock()
+	defer s.workers.mutex.Unlock()
+	if s.workers.ctx == nil {
+		s.workers.ctx, s.workers.cancel = context.WithCancel(context.Background())
+	}
+	if s.workers.ctx.Err() != nil {
+		s.Logger.Warn("Not starting task while shutting down", logging.Fields{"task": name})
+		return false
+	}
+
+	s.workers.wg.Add(1)
+	go func() {
+		defer s.workers.wg.Done()
+		fn(s.workers.ctx)
+	}()
+	return true
+}
+
+// Workers reports the state of the background workers. A worker is unhealthy if it stopped before the service
+// began shutting down, or is wedged
+func (s *UserService) Workers() []WorkerStatus {
+	s.workers.mutex.Lock()
+	defer s.workers.mutex.Unlock()
+
+	statuses := make([]WorkerStatus, 0, len(s.workers.states))
+	for _, state := range s.workers.states {
+		status := WorkerStatus{Name: state.name, Healthy: true, Heartbeat: state.heartbeat}
+		if state.stopped && !s.ShuttingDown() {
+			status.Healthy, status.Detail = false, "stopped unexpectedly"
+		} else if since := time.Since(state.heartbeat); state.interval > 0 && !state.stopped &&
+			since > WORKER_WEDGED_INTERVALS*state.interval {
+			status.Healthy, status.Detail = false, fmt.Sprintf("no heartbeat for %s", since.Round(time.Second))
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// ShuttingDown reports whether the service has begun shutting down
+func (s *UserService) ShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
+
+// stopWorkers cancels the workers and waits for them to return
+// returns ctx's error if it is done first
+func (s *UserService) stopWorkers(ctx context.Context) error {
+	s.workers.mutex.Lock()
+	if s.workers.ctx == nil {
+		s.workers.ctx, s.workers.cancel = context.WithCancel(context.Background())
+	}
+	s.workers.cancel()
+	s.workers.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NewServer builds the HTTP server for the handler with the configured timeouts
+func (s *UserService) NewServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  s.Config.Server.ReadTimeout,
+		WriteTimeout: s.Config.Server.WriteTimeout,
+		IdleTimeout:  s.Config.Server.IdleTimeout,
+		ErrorLog:     s.Logger.StdLogger(logging.LEVEL_ERROR),
+	}
+}
+
+// Run serves HTTP on the listener until ctx is done, such as on SIGTERM. It then reports not ready for
+// server.shutdown_delay and shuts down within server.shutdown_timeout: it stops accepting connections and waits for
+// in-flight requests to finish, then stops the background workers and waits for them, then closes the database
+// connection pool, and finally flushes any traces not yet exported
+// returns an error if the server fails or shutting down misses its deadline
+func (s *UserService) Run(ctx context.Context, server *http.Server, listener net.Listener) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	s.Logger.Info("User Service online and ready to serve", logging.Fields{"addr": listener.Addr().String()})
+
+	var err error
+	select {
+	case err = <-serveErr:
+		s.Logger.Error("Caught Error on HTTP Serve", logging.Fields{"error": err})
+	case <-ctx.Done():
+		s.Logger.Info("Shutting down, draining in-flight requests")
+	}
+
+	// Report not ready, and keep serving for the delay so load balancers stop routing here before connections close
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	if delay := s.Config.Server.ShutdownDelay; delay > 0 && err == nil {
+		time.Sleep(delay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Config.Server.ShutdownTimeout)
+	defer cancel()
+
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+		s.Logger.Error("In-flight requests did not finish in time", logging.Fields{"error": shutdownErr})
+		_ = server.Close()
+		if err == nil {
+			err = shutdownErr
+		}
+	}
+
+	if workerErr := s.stopWorkers(shutdownCtx); workerErr != nil {
+		s.Logger.Error("Background workers did not stop in time", logging.Fields{"error": workerErr})
+		if err == nil {
+			err = workerErr
+		}
+	}
+
+	if s.Dbh != nil {
+		s.Dbh.Disconnect()
+	}
+	if s.stopTracing != nil {
+		if tracingErr := s.stopTracing(shutdownCtx); tracingErr != nil {
+			s.Logger.Error("Unable to flush traces", logging.Fields{"error": tracingErr})
+		}
+	}
+	s.Logger.Info("User Service shut down")
+
+	return err
+}
@@ -0,0 +1,264 @@
+package service
+
+import (
+	"context"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startService runs a service with a handler on a local port
+// returns the address it serves on, a function to shut it down and the result of Run
+func startService(t *testing.T, s *UserService, handler http.Handler) (string, context.CancelFunc, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Caught error while listening: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Run(ctx, s.NewServer(handler), listener)
+	}()
+
+	return "http://" + listener.Addr().String(), cancel, result
+}
+
+func testService(shutdownTimeout time.Duration) *UserService {
+	s := &UserService{Config: config.Default()}
+	s.Config.Server.ShutdownTimeout = shutdownTimeout
+	return s
+}
+
+// TestRunDrainsRequests Checks shutting down waits for in-flight requests and then stops serving
+func TestRunDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+		_, _ = writer.Write([]byte("done"))
+	})
+
+	s := testService(5 * time.Second)
+	addr, shutdown, result := startService(t, s, handler)
+
+	response := make(chan string, 1)
+	go func() {
+		res, err := http.Get(addr)
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		response <- string(body)
+	}()
+
+	<-started
+	shutdown()
+
+	select {
+	case err := <-result:
+		t.Fatalf("Run expected to wait for the in-flight request, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if body := <-response; body != "done" {
+		t.Errorf("In-flight request expected to complete, got %s", body)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Run expected to shut down cleanly, got %s", err)
+	}
+
+	if _, err := http.Get(addr); err == nil {
+		t.Errorf("Requests expected to be refused after shutting down")
+	}
+}
+
+// TestRunStopsWorkers Checks background workers are cancelled and waited for
+func TestRunStopsWorkers(t *testing.T) {
+	s := testService(5 * time.Second)
+	stopped := make(chan struct{})
+	s.Go("test", 0, func(ctx context.Context, heartbeat func()) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		close(stopped)
+	})
+
+	_, shutdown, result := startService(t, s, http.NotFoundHandler())
+	shutdown()
+	if err := <-result; err != nil {
+		t.Errorf("Run expected to shut down cleanly, got %s", err)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("Run expected to wait for the worker to stop")
+	}
+
+	// Workers can't start once shutting down has begun
+	s.Go("late", 0, func(ctx context.Context, heartbeat func()) {
+		t.Errorf("Worker started after shutting down expected not to run")
+	})
+	time.Sleep(10 * time.Millisecond)
+}
+
+// TestRunStopsTasks Checks background tasks are cancelled and waited for, and aren't reported as workers
+func TestRunStopsTasks(t *testing.T) {
+	s := testService(5 * time.Second)
+	stopped := make(chan struct{})
+	if !s.Task("test", func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		close(stopped)
+	}) {
+		t.Fatalf("Task expected to start")
+	}
+	if workers := s.Workers(); len(workers) != 0 {
+		t.Errorf("Tasks expected not to be reported as workers, got %v", workers)
+	}
+
+	_, shutdown, result := startService(t, s, http.NotFoundHandler())
+	shutdown()
+	if err := <-result; err != nil {
+		t.Errorf("Run expected to shut down cleanly, got %s", err)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("Run expected to wait for the task to stop")
+	}
+
+	if s.Task("late", func(ctx context.Context) {
+		t.Errorf("Task started after shutting down expected not to run")
+	}) {
+		t.Errorf("Task started after shutting down expected to be refused")
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+// TestRunShutdownDeadline Checks shutting down gives up on requests and workers that overrun the deadline
+func TestRunShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+	})
+
+	s := testService(100 * time.Millisecond)
+	s.Go("stuck", 0, func(ctx context.Context, heartbeat func()) {
+		<-release
+	})
+	addr, shutdown, result := startService(t, s, handler)
+
+	go func() {
+		if res, err := http.Get(addr); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	begin := time.Now()
+	shutdown()
+	select {
+	case err := <-result:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Run expected to miss its deadline, got %v", err)
+		}
+		if elapsed := time.Since(begin); elapsed > 2*time.Second {
+			t.Errorf("Run expected to give up after the shutdown timeout, took %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run expected to return once the shutdown timeout passed")
+	}
+}
+
+// TestRunServeError Checks Run shuts down and reports a server that fails
+func TestRunServeError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Caught error while listening: %s", err)
+	}
+	listener.Close()
+
+	s := testService(time.Second)
+	if err = s.Run(context.Background(), s.NewServer(http.NotFoundHandler()), listener); err == nil {
+		t.Errorf("Run expected to fail on a closed listener")
+	}
+}
+
+// TestWorkers Checks workers that stop beating or stop early are reported, until the service shuts down
+func TestWorkers(t *testing.T) {
+	s := testService(5 * time.Second)
+	done := make(chan struct{})
+	s.Go("beating", 10*time.Millisecond, func(ctx context.Context, heartbeat func()) {
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				heartbeat()
+			}
+		}
+	})
+	s.Go("wedged", 10*time.Millisecond, func(ctx context.Context, heartbeat func()) {
+		<-ctx.Done()
+	})
+	s.Go("quitter", 0, func(ctx context.Context, heartbeat func()) {
+		close(done)
+	})
+	<-done
+	time.Sleep(100 * time.Millisecond)
+
+	expected := map[string]bool{"beating": true, "wedged": false, "quitter": false}
+	for _, worker := range s.Workers() {
+		if worker.Healthy != expected[worker.Name] {
+			t.Errorf("Worker %s expected healthy %v, got %+v", worker.Name, expected[worker.Name], worker)
+		}
+	}
+
+	_, shutdown, result := startService(t, s, http.NotFoundHandler())
+	shutdown()
+	<-result
+	if !s.ShuttingDown() {
+		t.Errorf("Service expected to report shutting down")
+	}
+	for _, worker := range s.Workers() {
+		if !worker.Healthy {
+			t.Errorf("Worker %s expected to be healthy once stopped by shutting down, got %+v", worker.Name, worker)
+		}
+	}
+}
+
+// TestRunShutdownDelay Checks the service keeps serving while reporting it is shutting down for the delay
+func TestRunShutdownDelay(t *testing.T) {
+	s := testService(5 * time.Second)
+	s.Config.Server.ShutdownDelay = 200 * time.Millisecond
+	addr, shutdown, result := startService(t, s, http.NotFoundHandler())
+
+	shutdown()
+	time.Sleep(50 * time.Millisecond)
+	if !s.ShuttingDown() {
+		t.Errorf("Service expected to report shutting down during the delay")
+	}
+	if res, err := http.Get(addr); err != nil {
+		t.Errorf("Service expected to keep serving during the delay, got %s", err)
+	} else {
+		res.Body.Close()
+	}
+
+	if err := <-result; err != nil {
+		t.Errorf("Run expected to shut down cleanly, got %s", err)
+	}
+}
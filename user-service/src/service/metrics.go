@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/metrics"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"time"
+)
+
+// countUsers is a worker that refreshes the users gauge of every organization each metrics.user_count_interval.
+// Counting on a schedule rather than when scraped keeps scrapes cheap however many organizations there are
+func (s *UserService) countUsers(ctx context.Context, heartbeat func()) {
+	ticker := time.NewTicker(s.Config.Metrics.UserCountInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.refreshUserCounts(ctx); err != nil {
+			s.Logger.Error("Unable to count users", logging.Fields{"error": err})
+		}
+		heartbeat()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshUserCounts sets the users gauge of every organization
+func (s *UserService) refreshUserCounts(ctx context.Context) error {
+	const pageSize = 100
+	counts := make(map[string]int)
+	for offset := 0; ; offset += pageSize {
+		orgs, err := models.GetOrganizations(ctx, s.Dbh, pageSize, offset)
+		if err != nil {
+			return err
+		}
+
+		for _, org := range orgs {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if counts[org.Slug], err = models.CountUsers(ctx, s.Dbh, org.ID); err != nil {
+				return err
+			}
+		}
+		if len(orgs) < pageSize {
+			break
+		}
+	}
+
+	// Reset so organizations that no longer exist stop being reported
+	metrics.Users.Reset()
+	for slug, count := range counts {
+		metrics.Users.WithLabelValues(slug).Set(float64(count))
+	}
+
+	return nil
+}
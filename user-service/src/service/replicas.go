@@ -0,0 +1,24 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// checkReplicas is a worker that checks the health and lag of the read replicas each
+// database.replica_check_interval, excluding those that can't be reached or lag too far behind from reads
+func (s *UserService) checkReplicas(ctx context.Context, heartbeat func()) {
+	ticker := time.NewTicker(s.Config.Database.ReplicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.Dbh.CheckReplicas(ctx)
+		heartbeat()
+	}
+}
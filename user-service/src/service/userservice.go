@@ -2,51 +2,137 @@
 package service
 
 import (
-	"fmt"
+	"context"
+	"crypto/rand"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/blob"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
 	"github.com/cclose/go-user-microservice-ex/user-service/src/database"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/logging"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/mail"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/metrics"
 	"github.com/cclose/go-user-microservice-ex/user-service/src/models"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/tracing"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/validation"
 	"github.com/gorilla/mux"
-	"log"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"os"
+	"strings"
 )
 
 // USerService manages the dependencies and subservices for the User Service
 type UserService struct {
-	Dbh         *database.PostGresDB
-	Router      *mux.Router
-	Logger      log.Logger
-	ServicePort string
+	Dbh    *database.PostGresDB
+	Router *mux.Router
+	// Logger writes the logs of the service. Handlers log through the logger of their request, see
+	// logging.FromContext
+	Logger *logging.Logger
+	// Config is the effective configuration of the service
+	Config config.Config
+	// Mailer delivers invitations
+	Mailer mail.Sender
+	// Blobs keeps uploaded files, such as avatars
+	Blobs blob.Store
+	// TokenKey signs the tokens the service issues
+	TokenKey []byte
+
+	workers workers
+	// shuttingDown is set to 1 once shutting down begins
+	shuttingDown int32
+	// stopTracing flushes and stops the trace exporter
+	stopTracing func(context.Context) error
 }
 
-func (s *UserService) Initialize() {
-	//Get our listening port
-	s.ServicePort = os.Getenv("PORT")
-	if s.ServicePort == "" {
-		s.ServicePort = "8080"
+// Initialize connects the service to its dependencies. Logs through Logger, or a logger writing to stdout at
+// logging.level if Logger isn't set
+func (s *UserService) Initialize(cfg config.Config) {
+	s.Config = cfg
+	if s.Logger == nil {
+		level, _ := logging.ParseLevel(cfg.Logging.Level)
+		s.Logger = logging.New(os.Stdout, level)
+	}
+
+	// Without an SMTP relay, invitations are printed instead of sent
+	if cfg.SMTP.Host != "" {
+		s.Mailer = &mail.SMTPSender{Host: cfg.SMTP.Host, Port: cfg.SMTP.Port, Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password, From: cfg.SMTP.From}
+	} else {
+		s.Mailer = mail.LogSender{Logger: s.Logger}
+	}
+
+	if cfg.Blob.Store == "s3" {
+		s.Blobs = blob.S3Store{Endpoint: cfg.Blob.S3Endpoint, Region: cfg.Blob.S3Region, Bucket: cfg.Blob.S3Bucket,
+			AccessKey: cfg.Blob.S3AccessKey, SecretKey: cfg.Blob.S3SecretKey}
+	} else {
+		s.Blobs = blob.LocalStore{Dir: cfg.Blob.Dir}
+	}
+
+	s.TokenKey = []byte(cfg.Auth.TokenSigningKey)
+	if len(s.TokenKey) == 0 {
+		s.TokenKey = make([]byte, 32)
+		if _, err := rand.Read(s.TokenKey); err != nil {
+			s.Logger.Fatal("Unable to generate a token signing key", logging.Fields{"error": err})
+		}
+		s.Logger.Warn("auth.token_signing_key is not set. Tokens will not survive a restart or be accepted by " +
+			"other instances")
+	}
+
+	models.BCRYPT_COST = cfg.Auth.BcryptCost
+	models.ADMIN_GROUP = cfg.Auth.AdminGroup
+	models.DEFAULT_REGION = strings.ToUpper(cfg.Phone.DefaultRegion)
+	models.PHONE_FORMAT = cfg.Phone.Format
+	// The domain lists were checked when the configuration was validated
+	models.EMAIL_ALLOWED_DOMAINS, _ = cfg.Email.AllowedDomainList()
+	models.EMAIL_DENIED_DOMAINS, _ = cfg.Email.DeniedDomainList()
+	models.EMAIL_CANONICALIZE = cfg.Email.Canonicalize
+	models.USERNAME_RESERVED = cfg.Username.ReservedList()
+	// Applied before the rules file, which can replace the username rule
+	if err := models.AllowUsernamePunctuation(cfg.Username.AllowedPunctuation); err != nil {
+		s.Logger.Fatal("Invalid username.allowed_punctuation", logging.Fields{"error": err})
+	}
+
+	validation.DEFAULT_LOCALE = strings.ToLower(cfg.Validation.DefaultLocale)
+	if cfg.Validation.RulesFile != "" {
+		rules, err := validation.LoadFile(cfg.Validation.RulesFile)
+		if err == nil {
+			err = rules.Apply(map[string]*validation.Validator{"user": models.UserValidator})
+		}
+		if err != nil {
+			s.Logger.Fatal("Unable to load the validation rules", logging.Fields{"error": err})
+		}
+	}
+	if !validation.HasLocale(validation.DEFAULT_LOCALE) {
+		s.Logger.Fatal("validation.default_locale has no messages", logging.Fields{"locale": validation.DEFAULT_LOCALE})
 	}
 
-	// Get our DB Connection settings
-	host := os.Getenv("PG_HOST")
-	user := os.Getenv("PG_USER")
-	pass := os.Getenv("PG_PASSWORD")
-	db := os.Getenv("PG_DB")
-	port := os.Getenv("PG_PORT")
-	//TODO validate values for these
+	var err error
+	if s.stopTracing, err = tracing.Setup(cfg.Tracing); err != nil {
+		s.Logger.Fatal("Unable to set up tracing", logging.Fields{"error": err})
+	}
 
 	// Boot the DB connection
-	Dbh, err := database.Connect(host, user, pass, db, port)
+	s.Dbh, err = database.Connect(context.Background(), cfg.Database, s.Logger)
 	if err != nil {
-		fmt.Println("[status] [fatal] Unable to connect to DB: ", err)
-		os.Exit(1)
+		s.Logger.Fatal("Unable to connect to DB", logging.Fields{"error": err})
+	}
+	metrics.Register(collectors.NewDBStatsCollector(s.Dbh.PgDbSession, s.Dbh.Name))
+	for address, dbh := range s.Dbh.ReplicaHandles() {
+		metrics.Register(collectors.NewDBStatsCollector(dbh, s.Dbh.Name+"@"+address))
 	}
-	s.Dbh = Dbh
 
-	//Verify the User Table
-	_, err = s.Dbh.PgDbSession.Exec(models.UserSchema)
+	//Bring the schema up to date
+	err = s.Dbh.Migrate(models.Migrations)
 	if err != nil {
-		fmt.Println("[status] [fatal] Unable to create UserModel Table: ", err)
-		os.Exit(1)
+		s.Logger.Fatal("Unable to migrate the database", logging.Fields{"error": err})
 	}
 
 	s.Router = mux.NewRouter()
+	// Lets reads after a write in the same request see it, rather than a replica that hasn't caught up yet
+	s.Router.Use(database.TrackWrites)
+
+	s.Go("user-count", s.Config.Metrics.UserCountInterval, s.countUsers)
+	s.Go("export-cleanup", cfg.Export.CleanupInterval, s.cleanExports)
+	s.Go("idempotency-cleanup", cfg.Idempotency.CleanupInterval, s.cleanIdempotencyKeys)
+	if len(cfg.Database.ReplicaList()) > 0 {
+		s.Go("replica-health", cfg.Database.ReplicaCheckInterval, s.checkReplicas)
+	}
 }
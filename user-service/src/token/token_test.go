@@ -0,0 +1,52 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImpersonationToken(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	claims := Claims{OrgID: 1, Subject: 2, Actor: 3, SessionID: "abc", IssuedAt: time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Minute).Unix()}
+
+	value, err := IssueImpersonation(key, claims)
+	if err != nil {
+		t.Fatalf("Caught error while issuing token: %s", err)
+	}
+	if !IsImpersonation(value) {
+		t.Errorf("Token %s expected to be marked as an impersonation token", value)
+	}
+
+	verified, err := VerifyImpersonation(key, value)
+	if err != nil {
+		t.Fatalf("Token %s expected to verify, failed: %s", value, err)
+	}
+	if verified.Actor != 3 || verified.Subject != 2 || verified.OrgID != 1 || verified.SessionID != "abc" {
+		t.Errorf("Token %s did not round trip its claims: %+v", value, verified)
+	}
+
+	//Test a token signed with another key
+	if _, err = VerifyImpersonation([]byte("another key entirely"), value); err != ErrInvalidToken {
+		t.Errorf("Token verified with the wrong key")
+	}
+
+	//Test a tampered payload
+	tampered := strings.Replace(value, value[len(IMPERSONATION_PREFIX):len(IMPERSONATION_PREFIX)+4], "AAAA", 1)
+	if _, err = VerifyImpersonation(key, tampered); err != ErrInvalidToken {
+		t.Errorf("Tampered token %s verified", tampered)
+	}
+
+	//Test an expired token
+	claims.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	expired, _ := IssueImpersonation(key, claims)
+	if _, err = VerifyImpersonation(key, expired); err != ErrInvalidToken {
+		t.Errorf("Expired token %s verified", expired)
+	}
+
+	//Test garbage
+	if _, err = VerifyImpersonation(key, "imp_garbage"); err != ErrInvalidToken {
+		t.Errorf("Garbage token verified")
+	}
+}
@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/config"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// recordSpans installs a tracer provider that records every span, for the rest of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+// TestInstrumentRouter Checks server spans continue the caller's trace and are named after the route template
+func TestInstrumentRouter(t *testing.T) {
+	if _, err := Setup(config.TracingConfig{Exporter: EXPORTER_NONE}); err != nil {
+		t.Fatalf("Caught error while setting up tracing: %s", err)
+	}
+	recorder := recordSpans(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/widget/{id:[0-9]+}", func(writer http.ResponseWriter, request *http.Request) {
+		_, span := Start(request.Context(), "handler")
+		span.End()
+		writer.WriteHeader(http.StatusInternalServerError)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/widget/7", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	InstrumentRouter(router, router).ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected a handler span and a server span, got %d spans", len(spans))
+	}
+	handler, server := spans[0], spans[1]
+
+	if server.Name() != "GET /api/v1/widget/{id:[0-9]+}" {
+		t.Errorf("Server span expected to be named after the route template, got %s", server.Name())
+	}
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Server span expected to continue the caller's trace, got %s", server.SpanContext().TraceID())
+	}
+	if handler.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Handler span expected to be a child of the server span")
+	}
+	if server.Status().Code != codes.Error {
+		t.Errorf("Server span of a 500 expected to have an error status, got %v", server.Status())
+	}
+}
+
+func TestEnd(t *testing.T) {
+	recorder := recordSpans(t)
+
+	for _, err := range []error{nil, sql.ErrNoRows, errors.New("boom")} {
+		_, span := Start(context.Background(), "operation")
+		End(span, err)
+	}
+
+	spans := recorder.Ended()
+	for i, expected := range []codes.Code{codes.Unset, codes.Unset, codes.Error} {
+		if spans[i].Status().Code != expected {
+			t.Errorf("Span %d expected status %v, got %v", i, expected, spans[i].Status())
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	for _, exporter := range []string{EXPORTER_NONE, EXPORTER_STDOUT} {
+		shutdown, err := Setup(config.TracingConfig{Exporter: exporter, SampleRatio: 1, ServiceName: "test"})
+		if err != nil {
+			t.Errorf("Exporter %s expected to set up, got %s", exporter, err)
+		} else if err = shutdown(context.Background()); err != nil {
+			t.Errorf("Exporter %s expected to shut down, got %s", exporter, err)
+		}
+	}
+
+	if _, err := Setup(config.TracingConfig{Exporter: "carrier-pigeon"}); err == nil {
+		t.Errorf("Unknown exporter expected to be rejected")
+	}
+}
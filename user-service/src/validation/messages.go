@@ -0,0 +1,123 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_LOCALE is the locale of messages when the caller accepts none the catalog has. It is set from the
+// configuration at boot
+var DEFAULT_LOCALE = "en"
+
+// catalog holds the message templates, keyed by locale, then by code or <field>.<code>. In a template {field} is
+// replaced by the field and {name} by the param name
+var catalog = map[string]map[string]string{
+	"en": {
+		CODE_REQUIRED:  "{field} is not specified!",
+		CODE_TOO_SHORT: "{field} must be at least {min} characters",
+		CODE_TOO_LONG:  "{field} must be at most {max} characters",
+		CODE_PATTERN:   "{field} contains characters that are not allowed",
+		CODE_FORMAT:    "Invalid {field} specified!",
+	},
+}
+
+// AddMessages adds the templates to the catalog of the locale, replacing any already there. Each is keyed by the
+// code it describes, or by <field>.<code> to describe the code for only that field. Messages are added at boot,
+// before any are built
+func AddMessages(locale string, messages map[string]string) {
+	locale = strings.ToLower(locale)
+	if catalog[locale] == nil {
+		catalog[locale] = make(map[string]string)
+	}
+	for key, template := range messages {
+		catalog[locale][key] = template
+	}
+}
+
+// HasLocale reports whether the catalog has messages in the locale
+func HasLocale(locale string) bool {
+	_, ok := catalog[strings.ToLower(locale)]
+	return ok
+}
+
+// Message builds the message for the code of the field in the locale, falling back to DEFAULT_LOCALE and then to
+// the code itself when the catalog has no template for it
+func Message(locale, field, code string, params map[string]interface{}) string {
+	template := code
+	for _, l := range []string{strings.ToLower(locale), DEFAULT_LOCALE} {
+		if t, ok := catalog[l][field+"."+code]; ok {
+			template = t
+			break
+		} else if t, ok = catalog[l][code]; ok {
+			template = t
+			break
+		}
+	}
+
+	replacements := []string{"{field}", field}
+	for name, value := range params {
+		replacements = append(replacements, "{"+name+"}", fmt.Sprint(value))
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// Localize returns the failures with the messages of those that have a code rebuilt in the locale. errs is left
+// untouched
+func Localize(locale string, errs []apperror.FieldError) []apperror.FieldError {
+	if len(errs) == 0 {
+		return errs
+	}
+
+	localized := make([]apperror.FieldError, len(errs))
+	for i, err := range errs {
+		if err.Code != "" {
+			err.Message = Message(locale, err.Field, err.Code, err.Params)
+		}
+		localized[i] = err
+	}
+	return localized
+}
+
+// Negotiate picks the locale for an Accept-Language header: the most preferred language the catalog has, by its
+// full tag, e.g. fr-ca, or else its base language, e.g. fr
+// returns DEFAULT_LOCALE if the catalog has none of them
+func Negotiate(acceptLanguage string) string {
+	type preference struct {
+		tag     string
+		quality float64
+	}
+
+	var preferences []preference
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		quality := 1.0
+		for _, param := range fields[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				if q, err := strconv.ParseFloat(value[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if tag != "" && tag != "*" && quality > 0 {
+			preferences = append(preferences, preference{tag, quality})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].quality > preferences[j].quality })
+
+	for _, p := range preferences {
+		if _, ok := catalog[p.tag]; ok {
+			return p.tag
+		}
+		if i := strings.IndexByte(p.tag, '-'); i > 0 {
+			if _, ok := catalog[p.tag[:i]]; ok {
+				return p.tag[:i]
+			}
+		}
+	}
+
+	return DEFAULT_LOCALE
+}
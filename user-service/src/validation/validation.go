@@ -0,0 +1,227 @@
+// Package validation checks the fields of a model against declarative rules, reporting each failure with a code
+// and params a caller can act on, and a message from a catalog that can be localised. The rules and messages
+// built into the models can be overridden from a rules file
+package validation
+
+import (
+	"fmt"
+	"github.com/cclose/go-user-microservice-ex/user-service/src/apperror"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The codes of the failures a rule reports, in the order they are checked. Only the first failure of a field is
+// reported
+const (
+	// CODE_REQUIRED is a required field that is empty
+	CODE_REQUIRED string = "required"
+	// CODE_TOO_SHORT is a value with fewer characters than min
+	CODE_TOO_SHORT string = "too_short"
+	// CODE_TOO_LONG is a value with more characters than max
+	CODE_TOO_LONG string = "too_long"
+	// CODE_PATTERN is a value that doesn't match pattern
+	CODE_PATTERN string = "pattern"
+	// CODE_FORMAT is a value that fails the check of its format, e.g. email
+	CODE_FORMAT string = "format"
+)
+
+// Rule is the validation of a single field. Empty values are only checked for being required
+type Rule struct {
+	Required bool `yaml:"required"`
+	// MinLength and MaxLength bound the number of characters of the value, 0 for no bound
+	MinLength int `yaml:"min_length"`
+	MaxLength int `yaml:"max_length"`
+	// Pattern is a regular expression the whole value must match
+	Pattern string `yaml:"pattern"`
+	// Format names a check registered with RegisterFormat
+	Format string `yaml:"format"`
+}
+
+// formats are the checks a rule can name as its format
+var formats = map[string]func(value string) bool{}
+
+// RegisterFormat makes check available to rules as the format name. Formats are registered as the models are
+// initialised, before any rules are built
+func RegisterFormat(name string, check func(value string) bool) {
+	formats[name] = check
+}
+
+// Validator checks the fields of one model
+type Validator struct {
+	// fields are the fields that have rules, in the order failures are reported
+	fields   []string
+	rules    map[string]Rule
+	patterns map[string]*regexp.Regexp
+}
+
+// New returns a validator checking fields, in that order, by their rules. Fields without a rule are never
+// reported, but can be given one by Override
+// returns an error if a pattern doesn't compile or a format isn't registered
+func New(fields []string, rules map[string]Rule) (*Validator, error) {
+	v := &Validator{fields: fields, rules: make(map[string]Rule), patterns: make(map[string]*regexp.Regexp)}
+	return v, v.Override(rules)
+}
+
+// MustNew is New for rules built into the service, which panics if they are invalid
+func MustNew(fields []string, rules map[string]Rule) *Validator {
+	v, err := New(fields, rules)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Override replaces the rule of each field in rules. Nothing is replaced if any of them is invalid. Override is
+// meant for boot, before the validator is in use
+// returns an error naming the first invalid rule or unknown field
+func (v *Validator) Override(rules map[string]Rule) error {
+	known := make(map[string]bool)
+	for _, field := range v.fields {
+		known[field] = true
+	}
+
+	names := make([]string, 0, len(rules))
+	for field := range rules {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	patterns := make(map[string]*regexp.Regexp)
+	for _, field := range names {
+		rule := rules[field]
+		if !known[field] {
+			return fmt.Errorf("rule for unknown field %s", field)
+		}
+		if rule.MinLength < 0 || rule.MaxLength < 0 || (rule.MaxLength > 0 && rule.MinLength > rule.MaxLength) {
+			return fmt.Errorf("rule for %s: min_length and max_length must not be negative, and min_length must "+
+				"not exceed max_length", field)
+		}
+		if _, ok := formats[rule.Format]; rule.Format != "" && !ok {
+			return fmt.Errorf("rule for %s: unknown format %s", field, rule.Format)
+		}
+		if rule.Pattern != "" {
+			// The pattern must match the whole value, not just part of it
+			pattern, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("rule for %s: invalid pattern: %s", field, err)
+			}
+			patterns[field] = pattern
+		}
+	}
+
+	for field, rule := range rules {
+		v.rules[field] = rule
+		delete(v.patterns, field)
+		if pattern, ok := patterns[field]; ok {
+			v.patterns[field] = pattern
+		}
+	}
+
+	return nil
+}
+
+// Rule returns the rule of the field, and whether it has one
+func (v *Validator) Rule(field string) (Rule, bool) {
+	rule, ok := v.rules[field]
+	return rule, ok
+}
+
+// Check checks the values, keyed by field, against the rules of only the named fields, or of every field if none
+// are named. A field missing from values is checked as empty. The messages are in DEFAULT_LOCALE
+// returns the failures, at most one per field, in the order of the validator's fields
+func (v *Validator) Check(values map[string]string, fields ...string) (errs []apperror.FieldError) {
+	checked := make(map[string]bool)
+	for _, field := range fields {
+		checked[field] = true
+	}
+
+	for _, field := range v.fields {
+		rule, ok := v.rules[field]
+		if !ok || (len(fields) > 0 && !checked[field]) {
+			continue
+		}
+		if code, params := v.check(field, rule, values[field]); code != "" {
+			errs = append(errs, apperror.FieldError{Field: field, Code: code, Params: params,
+				Message: Message(DEFAULT_LOCALE, field, code, params)})
+		}
+	}
+
+	return
+}
+
+// check returns the code and params of the first failure of the value, "" if it passes
+func (v *Validator) check(field string, rule Rule, value string) (string, map[string]interface{}) {
+	if value == "" {
+		if rule.Required {
+			return CODE_REQUIRED, nil
+		}
+		return "", nil
+	}
+
+	length := utf8.RuneCountInString(value)
+	switch {
+	case rule.MinLength > 0 && length < rule.MinLength:
+		return CODE_TOO_SHORT, map[string]interface{}{"min": rule.MinLength, "max": rule.MaxLength}
+	case rule.MaxLength > 0 && length > rule.MaxLength:
+		return CODE_TOO_LONG, map[string]interface{}{"min": rule.MinLength, "max": rule.MaxLength}
+	case v.patterns[field] != nil && !v.patterns[field].MatchString(value):
+		return CODE_PATTERN, map[string]interface{}{"pattern": rule.Pattern}
+	case rule.Format != "" && !formats[rule.Format](value):
+		return CODE_FORMAT, map[string]interface{}{"format": rule.Format}
+	}
+
+	return "", nil
+}
+
+// File is a rules file, which overrides the rules built into the models and adds to the message catalog
+type File struct {
+	// Rules are keyed by model, e.g. user, then by field
+	Rules map[string]map[string]Rule `yaml:"rules"`
+	// Messages are keyed by locale, then by code or <field>.<code>, see AddMessages
+	Messages map[string]map[string]string `yaml:"messages"`
+}
+
+// LoadFile reads a YAML (.yaml, .yml) or JSON (.json) rules file
+func LoadFile(path string) (file File, err error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+	default:
+		return file, fmt.Errorf("rules file %s must be .yaml, .yml or .json", path)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return file, err
+	}
+	// JSON is read as YAML, of which it is a subset
+	if err = yaml.UnmarshalStrict(contents, &file); err != nil {
+		return file, fmt.Errorf("rules file %s: %s", path, err)
+	}
+
+	return file, nil
+}
+
+// Apply overrides the rules of the validators, keyed by model, and adds the messages to the catalog
+// returns an error for rules of an unknown model or invalid rules
+func (f File) Apply(validators map[string]*Validator) error {
+	for model, rules := range f.Rules {
+		v, ok := validators[model]
+		if !ok {
+			return fmt.Errorf("rules for unknown model %s", model)
+		}
+		if err := v.Override(rules); err != nil {
+			return fmt.Errorf("rules for %s: %s", model, err)
+		}
+	}
+
+	for locale, messages := range f.Messages {
+		AddMessages(locale, messages)
+	}
+
+	return nil
+}
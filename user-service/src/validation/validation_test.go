@@ -0,0 +1,163 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testValidator(t *testing.T) *Validator {
+	RegisterFormat("lowercase", func(value string) bool { return strings.ToLower(value) == value })
+	v, err := New([]string{"name", "code", "nickname"}, map[string]Rule{
+		"name": {Required: true, MinLength: 2, MaxLength: 5},
+		"code": {Pattern: "[0-9]+", Format: "lowercase"},
+	})
+	if err != nil {
+		t.Fatalf("Caught error while building the validator: %s", err)
+	}
+	return v
+}
+
+// TestCheck Checks each rule reports its code, only once per field and in the order of the fields
+func TestCheck(t *testing.T) {
+	v := testValidator(t)
+
+	for _, test := range []struct {
+		values map[string]string
+		field  string
+		code   string
+	}{
+		{map[string]string{"code": "1"}, "name", CODE_REQUIRED},
+		{map[string]string{"name": "a"}, "name", CODE_TOO_SHORT},
+		{map[string]string{"name": "abcdef"}, "name", CODE_TOO_LONG},
+		{map[string]string{"name": "ab", "code": "1a"}, "code", CODE_PATTERN},
+	} {
+		errs := v.Check(test.values)
+		if len(errs) != 1 || errs[0].Field != test.field || errs[0].Code != test.code {
+			t.Errorf("Values %v expected to fail %s on %s, got %+v", test.values, test.code, test.field, errs)
+		}
+	}
+
+	// Multi-byte characters count once
+	if errs := v.Check(map[string]string{"name": "ééééé"}); len(errs) != 0 {
+		t.Errorf("Name of 5 characters expected to pass, failed: %+v", errs)
+	}
+
+	errs := v.Check(map[string]string{"code": "x"})
+	if len(errs) != 2 || errs[0].Field != "name" || errs[1].Field != "code" {
+		t.Errorf("Failures expected in the order of the fields, got %+v", errs)
+	}
+	if errs = v.Check(map[string]string{"code": "x"}, "code"); len(errs) != 1 || errs[0].Field != "code" {
+		t.Errorf("Only the named field expected to be checked, got %+v", errs)
+	}
+}
+
+// TestOverride Checks rules can be replaced or added for known fields, and invalid overrides change nothing
+func TestOverride(t *testing.T) {
+	v := testValidator(t)
+
+	if err := v.Override(map[string]Rule{"name": {MaxLength: 10}, "nickname": {Required: true}}); err != nil {
+		t.Fatalf("Override expected to pass, failed: %s", err)
+	}
+	errs := v.Check(map[string]string{"name": "abcdefgh"})
+	if len(errs) != 1 || errs[0].Field != "nickname" || errs[0].Code != CODE_REQUIRED {
+		t.Errorf("Overridden rules expected to apply, got %+v", errs)
+	}
+
+	for _, rules := range []map[string]Rule{
+		{"surname": {Required: true}},
+		{"name": {Pattern: "("}},
+		{"name": {Format: "unknown"}},
+		{"name": {MinLength: 5, MaxLength: 2}},
+		{"nickname": {}, "name": {Pattern: "("}},
+	} {
+		if err := v.Override(rules); err == nil {
+			t.Errorf("Override %+v expected to fail, passed", rules)
+		}
+	}
+	if rule, _ := v.Rule("nickname"); !rule.Required {
+		t.Errorf("Failed override expected to leave the rules untouched, got %+v", rule)
+	}
+}
+
+// TestMessages Checks messages are built in the locale from the most specific template, falling back to
+// DEFAULT_LOCALE
+func TestMessages(t *testing.T) {
+	AddMessages("xx", map[string]string{CODE_TOO_SHORT: "{field} < {min}", "name.required": "Name!"})
+
+	if message := Message("xx", "name", CODE_TOO_SHORT, map[string]interface{}{"min": 2}); message != "name < 2" {
+		t.Errorf("Message expected to come from the locale, got |%s|", message)
+	}
+	if message := Message("XX", "name", CODE_REQUIRED, nil); message != "Name!" {
+		t.Errorf("Message expected to come from the field's template, got |%s|", message)
+	}
+	if message := Message("xx", "code", CODE_REQUIRED, nil); message != "code is not specified!" {
+		t.Errorf("Message expected to fall back to the default locale, got |%s|", message)
+	}
+	if message := Message("xx", "code", "unknown", nil); message != "unknown" {
+		t.Errorf("Message without a template expected to be its code, got |%s|", message)
+	}
+
+	errs := testValidator(t).Check(map[string]string{})
+	localized := Localize("xx", errs)
+	if localized[0].Message != "Name!" || errs[0].Message != "name is not specified!" {
+		t.Errorf("Localize expected to rebuild a copy of the messages, got %+v and %+v", localized, errs)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	AddMessages("xx", map[string]string{})
+	for header, expected := range map[string]string{
+		"":                       DEFAULT_LOCALE,
+		"xx":                     "xx",
+		"XX-YY":                  "xx",
+		"de, xx;q=0.5":           "xx",
+		"en;q=0.4, xx;q=0.8":     "xx",
+		"xx;q=0, de":             DEFAULT_LOCALE,
+		"*":                      DEFAULT_LOCALE,
+		"fr-CA, fr;q=0.9, en-GB": "en",
+	} {
+		if locale := Negotiate(header); locale != expected {
+			t.Errorf("Accept-Language |%s| expected to pick %s, got %s", header, expected, locale)
+		}
+	}
+}
+
+// TestLoadFile Checks a rules file overrides the rules of its models and adds its messages
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.yaml")
+	contents := "rules:\n  test:\n    name:\n      required: true\n      max_length: 3\n" +
+		"messages:\n  yy:\n    too_long: \"{field} > {max}\"\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Caught error while writing the rules file: %s", err)
+	}
+
+	file, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile expected to pass, failed: %s", err)
+	}
+	v := testValidator(t)
+	if err = file.Apply(map[string]*Validator{"test": v}); err != nil {
+		t.Fatalf("Apply expected to pass, failed: %s", err)
+	}
+	errs := Localize("yy", v.Check(map[string]string{"name": "abcd"}, "name"))
+	if len(errs) != 1 || errs[0].Message != "name > 3" {
+		t.Errorf("Rules and messages of the file expected to apply, got %+v", errs)
+	}
+
+	if err = file.Apply(map[string]*Validator{}); err == nil {
+		t.Errorf("Rules for an unknown model expected to fail, passed")
+	}
+	if err = ioutil.WriteFile(path, []byte("rules:\n  test:\n    name:\n      minimum: 3\n"), 0600); err != nil {
+		t.Fatalf("Caught error while writing the rules file: %s", err)
+	}
+	if _, err = LoadFile(path); err == nil {
+		t.Errorf("Rules file with an unknown setting expected to fail, passed")
+	}
+	if _, err = LoadFile(filepath.Join(dir, "rules.ini")); err == nil || os.IsNotExist(err) {
+		t.Errorf("Rules file of an unsupported type expected to fail, got %v", err)
+	}
+}